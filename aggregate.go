@@ -0,0 +1,200 @@
+package eventmaster
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	eventmaster "github.com/ContextLogic/eventmaster/proto"
+)
+
+// Dimensions that event counts can be grouped by.
+const (
+	GroupByTopic = "topic"
+	GroupByDC    = "dc"
+	GroupByHost  = "host"
+	GroupByUser  = "user"
+	GroupByTag   = "tag"
+	// GroupByDataPrefix followed by a dotted path groups by a value in the
+	// event data, e.g. "data.deploy.service".
+	GroupByDataPrefix = "data."
+)
+
+// maxAggregateBuckets caps the time buckets an event time window may be
+// split into.
+const maxAggregateBuckets = 10000
+
+// Aggregation is how the events that match a query are counted: in buckets
+// of event time Interval seconds wide, split by the values of the GroupBy
+// dimensions.
+type Aggregation struct {
+	Interval int64
+	GroupBy  []string
+}
+
+// AggregateCount is the number of events in one time bucket with one set of
+// group values.
+type AggregateCount struct {
+	// Time is the start of the bucket, in seconds.
+	Time int64 `json:"time"`
+	// Group is the value of each of the GroupBy dimensions, in order.
+	Group []string `json:"group,omitempty"`
+	Count int64    `json:"count"`
+}
+
+// AggregateResult is the response to an aggregate query. Buckets without
+// events are left out.
+type AggregateResult struct {
+	Interval int64            `json:"interval"`
+	GroupBy  []string         `json:"group_by,omitempty"`
+	Buckets  []AggregateCount `json:"buckets"`
+}
+
+// validateAggregation checks that agg can be computed for q.
+func validateAggregation(q *eventmaster.Query, agg Aggregation) error {
+	if agg.Interval <= 0 {
+		return errors.New("interval must be a positive number of seconds")
+	}
+	if hasEventTimeWindow(q) && (q.EndEventTime-q.StartEventTime)/agg.Interval >= maxAggregateBuckets {
+		return errors.Errorf("interval is too small for the event time window, at most %d buckets are allowed", maxAggregateBuckets)
+	}
+	seen := map[string]bool{}
+	for _, dim := range agg.GroupBy {
+		switch {
+		case dim == GroupByTopic, dim == GroupByDC, dim == GroupByHost, dim == GroupByUser, dim == GroupByTag:
+		case strings.HasPrefix(dim, GroupByDataPrefix) && len(dim) > len(GroupByDataPrefix):
+		default:
+			return errors.Errorf("cannot group by %q", dim)
+		}
+		if seen[dim] {
+			return errors.Errorf("%q is grouped by more than once", dim)
+		}
+		seen[dim] = true
+	}
+	return nil
+}
+
+// needsData reports whether agg groups by a value in the event data.
+func (agg Aggregation) needsData() bool {
+	for _, dim := range agg.GroupBy {
+		if strings.HasPrefix(dim, GroupByDataPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// bucket returns the start of the bucket that t (in seconds) falls in.
+func (agg Aggregation) bucket(t int64) int64 {
+	b := t - t%agg.Interval
+	if t < 0 && b != t {
+		b -= agg.Interval
+	}
+	return b
+}
+
+// groupValues returns the values of evt for dim. An event is counted once
+// for each of its tags, and an event without tags has the tag "".
+func groupValues(evt *Event, dim string) []string {
+	switch dim {
+	case GroupByTopic:
+		return []string{evt.TopicID}
+	case GroupByDC:
+		return []string{evt.DCID}
+	case GroupByHost:
+		return []string{strings.ToLower(evt.Host)}
+	case GroupByUser:
+		return []string{strings.ToLower(evt.User)}
+	case GroupByTag:
+		if len(evt.Tags) == 0 {
+			return []string{""}
+		}
+		return evt.Tags
+	}
+	v, ok := lookupDataPath(evt.Data, strings.TrimPrefix(dim, GroupByDataPrefix))
+	return []string{formatDataValue(v, ok)}
+}
+
+// formatDataValue formats a value found in event data for grouping:
+// strings as they are, anything else as json, and missing or null values
+// as "".
+func formatDataValue(v interface{}, ok bool) string {
+	if !ok || v == nil {
+		return ""
+	}
+	if s, isString := v.(string); isString {
+		return s
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+// aggregateKey identifies a bucket; group is the group values joined by
+// aggregateGroupSep.
+type aggregateKey struct {
+	time  int64
+	group string
+}
+
+const aggregateGroupSep = "\x00"
+
+// aggregateCounter counts events into the buckets of an Aggregation.
+type aggregateCounter struct {
+	agg    Aggregation
+	counts map[aggregateKey]int64
+}
+
+func newAggregateCounter(agg Aggregation) *aggregateCounter {
+	return &aggregateCounter{agg: agg, counts: map[aggregateKey]int64{}}
+}
+
+// add counts evt, whose event time is in seconds.
+func (c *aggregateCounter) add(evt *Event) {
+	groups := [][]string{nil}
+	for _, dim := range c.agg.GroupBy {
+		var next [][]string
+		for _, g := range groups {
+			for _, v := range groupValues(evt, dim) {
+				next = append(next, append(append([]string{}, g...), v))
+			}
+		}
+		groups = next
+	}
+	t := c.agg.bucket(evt.EventTime)
+	for _, g := range groups {
+		c.addCount(t, g, 1)
+	}
+}
+
+// addCount adds n events to the bucket starting at t with group.
+func (c *aggregateCounter) addCount(t int64, group []string, n int64) {
+	c.counts[aggregateKey{time: t, group: strings.Join(group, aggregateGroupSep)}] += n
+}
+
+// result returns the counts ordered by time and then by group.
+func (c *aggregateCounter) result() []AggregateCount {
+	keys := make([]aggregateKey, 0, len(c.counts))
+	for k := range c.counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].time != keys[j].time {
+			return keys[i].time < keys[j].time
+		}
+		return keys[i].group < keys[j].group
+	})
+	r := make([]AggregateCount, 0, len(keys))
+	for _, k := range keys {
+		ac := AggregateCount{Time: k.time, Count: c.counts[k]}
+		if len(c.agg.GroupBy) > 0 {
+			ac.Group = strings.Split(k.group, aggregateGroupSep)
+		}
+		r = append(r, ac)
+	}
+	return r
+}
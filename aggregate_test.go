@@ -0,0 +1,177 @@
+package eventmaster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	eventmaster "github.com/ContextLogic/eventmaster/proto"
+)
+
+func TestAggregateCounter(t *testing.T) {
+	evts := []*Event{
+		{EventTime: 100, Host: "Web1", Tags: []string{"deploy", "api"}, Data: map[string]interface{}{"version": float64(2)}},
+		{EventTime: 159, Host: "web1", Data: map[string]interface{}{"version": "2"}},
+		{EventTime: 160, Host: "web2", Tags: []string{"api"}},
+	}
+	tests := []struct {
+		label string
+		agg   Aggregation
+		want  []AggregateCount
+	}{
+		{
+			label: "time only",
+			agg:   Aggregation{Interval: 60},
+			want:  []AggregateCount{{Time: 60, Count: 1}, {Time: 120, Count: 2}},
+		},
+		{
+			label: "host",
+			agg:   Aggregation{Interval: 3600, GroupBy: []string{GroupByHost}},
+			want: []AggregateCount{
+				{Time: 0, Group: []string{"web1"}, Count: 2},
+				{Time: 0, Group: []string{"web2"}, Count: 1},
+			},
+		},
+		{
+			label: "tag",
+			agg:   Aggregation{Interval: 3600, GroupBy: []string{GroupByTag}},
+			want: []AggregateCount{
+				{Time: 0, Group: []string{""}, Count: 1},
+				{Time: 0, Group: []string{"api"}, Count: 2},
+				{Time: 0, Group: []string{"deploy"}, Count: 1},
+			},
+		},
+		{
+			label: "data and host",
+			agg:   Aggregation{Interval: 3600, GroupBy: []string{"data.version", GroupByHost}},
+			want: []AggregateCount{
+				{Time: 0, Group: []string{"", "web2"}, Count: 1},
+				{Time: 0, Group: []string{"2", "web1"}, Count: 2},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.label, func(t *testing.T) {
+			c := newAggregateCounter(test.agg)
+			for _, evt := range evts {
+				c.add(evt)
+			}
+			assert.Equal(t, test.want, c.result())
+		})
+	}
+}
+
+func TestValidateAggregation(t *testing.T) {
+	q := &eventmaster.Query{StartEventTime: 0, EndEventTime: 86400}
+	tests := []struct {
+		label string
+		agg   Aggregation
+		valid bool
+	}{
+		{"hourly", Aggregation{Interval: 3600, GroupBy: []string{GroupByTopic, "data.deploy.service"}}, true},
+		{"no interval", Aggregation{}, false},
+		{"too many buckets", Aggregation{Interval: 1}, false},
+		{"unknown dimension", Aggregation{Interval: 3600, GroupBy: []string{"color"}}, false},
+		{"empty data path", Aggregation{Interval: 3600, GroupBy: []string{"data."}}, false},
+		{"repeated dimension", Aggregation{Interval: 3600, GroupBy: []string{GroupByDC, GroupByDC}}, false},
+	}
+	for _, test := range tests {
+		if got := validateAggregation(q, test.agg) == nil; got != test.valid {
+			t.Fatalf("%v: got %v, want %v", test.label, got, test.valid)
+		}
+	}
+}
+
+func TestBoltAggregate(t *testing.T) {
+	bs, cleanup := newTestBoltStore(t)
+	defer cleanup()
+
+	store := newTestEventStore(t, bs)
+
+	now := time.Now().Unix()
+	now -= now % 3600
+	for _, evt := range []*UnaddedEvent{
+		{EventTime: now + 10, DC: "dc1", TopicName: "test1", Host: "h"},
+		{EventTime: now + 20, DC: "dc1", TopicName: "test1", Host: "h"},
+		{EventTime: now + 30, DC: "dc2", TopicName: "test2", Host: "h"},
+		{EventTime: now - 3500, DC: "dc1", TopicName: "test1", Host: "h"},
+	} {
+		if _, err := store.AddEvent(context.Background(), evt); err != nil {
+			t.Fatalf("add event: %v", err)
+		}
+	}
+
+	res, err := store.Aggregate(context.Background(),
+		&eventmaster.Query{StartEventTime: now - 3600, EndEventTime: now + 3600, DC: []string{"dc1"}},
+		Aggregation{Interval: 3600, GroupBy: []string{GroupByTopic}})
+	if err != nil {
+		t.Fatalf("aggregate: %v", err)
+	}
+	want := &AggregateResult{
+		Interval: 3600,
+		GroupBy:  []string{GroupByTopic},
+		Buckets: []AggregateCount{
+			{Time: now - 3600, Group: []string{"test1"}, Count: 1},
+			{Time: now, Group: []string{"test1"}, Count: 2},
+		},
+	}
+	assert.Equal(t, want, res)
+}
+
+func TestAggregateHTTP(t *testing.T) {
+	store := newTestEventStore(t, &mockDataStore{})
+	ts := httptest.NewServer(NewServer(store, "", ""))
+	defer ts.Close()
+
+	now := time.Now().Unix()
+	for _, host := range []string{"a", "b", "a"} {
+		if _, err := store.AddEvent(context.Background(), &UnaddedEvent{DC: "dc1", TopicName: "test1", Host: host, EventTime: now}); err != nil {
+			t.Fatalf("add event: %v", err)
+		}
+	}
+
+	window := fmt.Sprintf(`"query": {"start_event_time": %d, "end_event_time": %d}`, now-3600, now+60)
+	tests := []struct {
+		label  string
+		path   string
+		body   string
+		status int
+	}{
+		{"counts", "/v1/event/aggregate", `{` + window + `, "interval": 86400, "group_by": ["host"]}`, http.StatusOK},
+		{"no interval", "/v1/event/aggregate", `{` + window + `}`, http.StatusBadRequest},
+		{"no window", "/v1/event/aggregate", `{"interval": 60}`, http.StatusBadRequest},
+		{"other id", "/v1/event/other", `{}`, http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.label, func(t *testing.T) {
+			resp, err := http.Post(ts.URL+test.path, "application/json", strings.NewReader(test.body))
+			if err != nil {
+				t.Fatalf("post: %v", err)
+			}
+			defer resp.Body.Close()
+			if got, want := resp.StatusCode, test.status; got != want {
+				t.Fatalf("status: got %v, want %v", got, want)
+			}
+			if test.status != http.StatusOK {
+				return
+			}
+			var res AggregateResult
+			if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+				t.Fatalf("json decode: %v", err)
+			}
+			day := now - now%86400
+			want := []AggregateCount{
+				{Time: day, Group: []string{"a"}, Count: 2},
+				{Time: day, Group: []string{"b"}, Count: 1},
+			}
+			assert.Equal(t, want, res.Buckets)
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package eventmaster
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+	"github.com/segmentio/ksuid"
+
+	"github.com/ContextLogic/eventmaster/jh"
+	"github.com/ContextLogic/eventmaster/metrics"
+)
+
+// Audit actions.
+const (
+	AuditDelete = "delete"
+	AuditRedact = "redact"
+)
+
+// AuditEntry records a change made to an event after it was added.
+type AuditEntry struct {
+	ID      string `json:"audit_id"`
+	EventID string `json:"event_id"`
+	Action  string `json:"action"`
+	// Paths are the data paths that were redacted.
+	Paths  []string `json:"paths,omitempty"`
+	User   string   `json:"user"`
+	Reason string   `json:"reason"`
+	// Time is when the change was made, in ms.
+	Time int64 `json:"time"`
+}
+
+// AuditInfo is who is changing an event, and why.
+type AuditInfo struct {
+	User   string `json:"user"`
+	Reason string `json:"reason"`
+}
+
+func (a AuditInfo) validate() error {
+	if a.User == "" || a.Reason == "" {
+		return jh.NewError("user and reason are required to change an event", http.StatusBadRequest)
+	}
+	return nil
+}
+
+// findForChange fetches the event with id, returning a 404 if there is none.
+func (es *EventStore) findForChange(ctx context.Context, id string, includeData bool) (*Event, error) {
+	evt, err := es.ds.FindByID(ctx, id, includeData)
+	if err != nil {
+		metrics.DBError("read")
+		return nil, errors.Wrap(err, "find event")
+	}
+	if evt == nil {
+		return nil, jh.NewError(errors.Errorf("no event with id %v", id).Error(), http.StatusNotFound)
+	}
+	return evt, nil
+}
+
+func (es *EventStore) audit(ctx context.Context, id, action string, paths []string, info AuditInfo) error {
+	if err := es.ds.AddAuditEntry(ctx, AuditEntry{
+		ID:      ksuid.New().String(),
+		EventID: id,
+		Action:  action,
+		Paths:   paths,
+		User:    info.User,
+		Reason:  info.Reason,
+		Time:    time.Now().UnixNano() / int64(time.Millisecond),
+	}); err != nil {
+		metrics.DBError("write")
+		return errors.Wrap(err, "add audit entry")
+	}
+	return nil
+}
+
+// DeleteEvent removes the event with id from the DataStore and records the
+// deletion in the event's audit trail.
+func (es *EventStore) DeleteEvent(ctx context.Context, id string, info AuditInfo) error {
+	start := time.Now()
+	defer func() {
+		metrics.EventStoreLatency("DeleteEvent", start)
+	}()
+
+	if err := info.validate(); err != nil {
+		return err
+	}
+	evt, err := es.findForChange(ctx, id, false)
+	if err != nil {
+		return err
+	}
+	// record the intent first so that a deletion is never unaccounted for
+	if err := es.audit(ctx, id, AuditDelete, nil, info); err != nil {
+		return err
+	}
+	if err := es.ds.DeleteEvent(ctx, id); err != nil {
+		metrics.DBError("write")
+		return errors.Wrap(err, "delete event")
+	}
+	es.unindexText(id)
+	es.publishChange(eventChange{Kind: changeDelete, Evt: evt})
+	return nil
+}
+
+// RedactEvent replaces the values at the given dotted data paths of the event
+// with id with null, keeping the rest of the event, and records the
+// redaction in the event's audit trail. Every path must exist.
+func (es *EventStore) RedactEvent(ctx context.Context, id string, paths []string, info AuditInfo) error {
+	start := time.Now()
+	defer func() {
+		metrics.EventStoreLatency("RedactEvent", start)
+	}()
+
+	if err := info.validate(); err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return jh.NewError("no paths to redact", http.StatusBadRequest)
+	}
+	evt, err := es.findForChange(ctx, id, true)
+	if err != nil {
+		return err
+	}
+	if evt.Data == nil {
+		evt.Data = map[string]interface{}{}
+	}
+	for _, p := range paths {
+		if !redactDataPath(evt.Data, p) {
+			return jh.NewError(errors.Errorf("path %v not in event data", p).Error(), http.StatusBadRequest)
+		}
+	}
+	if err := es.audit(ctx, id, AuditRedact, paths, info); err != nil {
+		return err
+	}
+	if err := es.ds.UpdateEventData(ctx, id, evt.Data); err != nil {
+		metrics.DBError("write")
+		return errors.Wrap(err, "update event data")
+	}
+	// redacted values must not stay searchable
+	es.indexText(evt)
+	es.publishChange(eventChange{Kind: changeRedact, Evt: evt})
+	return nil
+}
+
+// AuditTrail returns the changes made to the event with id, oldest first. The
+// trail is kept after the event is deleted.
+func (es *EventStore) AuditTrail(ctx context.Context, id string) ([]AuditEntry, error) {
+	start := time.Now()
+	defer func() {
+		metrics.EventStoreLatency("AuditTrail", start)
+	}()
+
+	entries, err := es.ds.GetAuditEntries(ctx, id)
+	if err != nil {
+		metrics.DBError("read")
+		return nil, errors.Wrap(err, "get audit entries")
+	}
+	return entries, nil
+}
+
+// RedactRequest is the body of a request to redact an event.
+type RedactRequest struct {
+	Paths []string `json:"paths"`
+	AuditInfo
+}
+
+func (s *Server) deleteEvent(w http.ResponseWriter, r *http.Request, ps httprouter.Params) (interface{}, error) {
+	id := ps.ByName("id")
+	info := AuditInfo{
+		User:   r.URL.Query().Get("user"),
+		Reason: r.URL.Query().Get("reason"),
+	}
+	if err := s.store.DeleteEvent(r.Context(), id, info); err != nil {
+		return nil, jh.Wrap(err, "delete event")
+	}
+	return map[string]string{"event_id": id}, nil
+}
+
+func (s *Server) redactEvent(w http.ResponseWriter, r *http.Request, ps httprouter.Params) (interface{}, error) {
+	var req RedactRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, jh.NewError(errors.Wrap(err, "json decode").Error(), http.StatusBadRequest)
+	}
+	id := ps.ByName("id")
+	if err := s.store.RedactEvent(r.Context(), id, req.Paths, req.AuditInfo); err != nil {
+		return nil, jh.Wrap(err, "redact event")
+	}
+	return map[string]string{"event_id": id}, nil
+}
+
+func (s *Server) getAuditTrail(w http.ResponseWriter, r *http.Request, ps httprouter.Params) (interface{}, error) {
+	entries, err := s.store.AuditTrail(r.Context(), ps.ByName("id"))
+	if err != nil {
+		return nil, jh.Wrap(err, "get audit trail")
+	}
+	if entries == nil {
+		entries = []AuditEntry{}
+	}
+	return map[string][]AuditEntry{"results": entries}, nil
+}
@@ -0,0 +1,214 @@
+package eventmaster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ContextLogic/eventmaster/jh"
+	eventmaster "github.com/ContextLogic/eventmaster/proto"
+)
+
+func TestDeleteAndRedactEvent(t *testing.T) {
+	bs, cleanup := newTestBoltStore(t)
+	defer cleanup()
+
+	store := newTestEventStore(t, bs)
+
+	now := time.Now().Unix()
+	var ids []string
+	for i := 0; i < 2; i++ {
+		id, err := store.AddEvent(context.Background(), &UnaddedEvent{
+			EventTime: now,
+			DC:        "dc1",
+			TopicName: "test1",
+			Host:      "h",
+			User:      "u",
+			Tags:      []string{"t"},
+			Data: map[string]interface{}{
+				"token": "secret",
+				"req":   map[string]interface{}{"ip": "10.0.0.1", "path": "/"},
+			},
+		})
+		if err != nil {
+			t.Fatalf("add event: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	info := AuditInfo{User: "admin", Reason: "gdpr"}
+
+	if err := store.RedactEvent(context.Background(), ids[0], []string{"token", "req.ip"}, info); err != nil {
+		t.Fatalf("redact: %v", err)
+	}
+	evt, err := store.FindByID(context.Background(), ids[0])
+	if err != nil {
+		t.Fatalf("find by id: %v", err)
+	}
+	want := map[string]interface{}{
+		"token": nil,
+		"req":   map[string]interface{}{"ip": nil, "path": "/"},
+	}
+	if !dataValuesEqual(evt.Data, want) {
+		t.Fatalf("redacted data: got %v, want %v", evt.Data, want)
+	}
+
+	if err := store.DeleteEvent(context.Background(), ids[1], info); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if evt, err := bs.FindByID(context.Background(), ids[1], true); err != nil || evt != nil {
+		t.Fatalf("deleted event: got %v, %v, want nil", evt, err)
+	}
+	evts, _, err := store.Find(context.Background(), &eventmaster.Query{
+		TopicName:      []string{"test1"},
+		User:           []string{"u"},
+		TagSet:         []string{"t"},
+		StartEventTime: now - 60,
+		EndEventTime:   now + 60,
+	})
+	if err != nil {
+		t.Fatalf("find: %v", err)
+	}
+	if len(evts) != 1 || evts[0].EventID != ids[0] {
+		t.Fatalf("find after delete: got %v, want only %v", evts, ids[0])
+	}
+
+	for i, action := range []string{AuditRedact, AuditDelete} {
+		trail, err := store.AuditTrail(context.Background(), ids[i])
+		if err != nil {
+			t.Fatalf("audit trail: %v", err)
+		}
+		if len(trail) != 1 || trail[0].Action != action || trail[0].User != "admin" || trail[0].Reason != "gdpr" {
+			t.Fatalf("audit trail of %v: got %+v, want one %v entry", ids[i], trail, action)
+		}
+	}
+
+	errTests := []struct {
+		name   string
+		err    error
+		status int
+	}{
+		{"no reason", store.DeleteEvent(context.Background(), ids[0], AuditInfo{User: "admin"}), http.StatusBadRequest},
+		{"missing event", store.DeleteEvent(context.Background(), ids[1], info), http.StatusNotFound},
+		{"missing path", store.RedactEvent(context.Background(), ids[0], []string{"req.port"}, info), http.StatusBadRequest},
+		{"no paths", store.RedactEvent(context.Background(), ids[0], nil, info), http.StatusBadRequest},
+	}
+	for _, test := range errTests {
+		herr, ok := test.err.(jh.Error)
+		if !ok {
+			t.Fatalf("%v: got %v, want a jh.Error", test.name, test.err)
+		}
+		if got := herr.Status(); got != test.status {
+			t.Fatalf("%v: got status %v, want %v", test.name, got, test.status)
+		}
+	}
+}
+
+func TestDeleteEventHTTP(t *testing.T) {
+	store := newTestEventStore(t, &mockDataStore{})
+	ts := httptest.NewServer(NewServer(store, "", ""))
+	defer ts.Close()
+
+	id, err := store.AddEvent(context.Background(), &UnaddedEvent{DC: "dc1", TopicName: "test1", Host: "h"})
+	if err != nil {
+		t.Fatalf("add event: %v", err)
+	}
+
+	req, err := http.NewRequest("DELETE", ts.URL+"/v1/event/"+id+"?user=admin&reason=cleanup", nil)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		t.Fatalf("delete status: got %v, want %v", got, want)
+	}
+	if got := len(store.ds.(*mockDataStore).events); got != 0 {
+		t.Fatalf("events after delete: got %v, want 0", got)
+	}
+
+	resp, err = http.Post(ts.URL+"/v1/event/"+id+"/redact", "application/json",
+		strings.NewReader(`{"paths": ["a"], "user": "admin", "reason": "cleanup"}`))
+	if err != nil {
+		t.Fatalf("redact: %v", err)
+	}
+	resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusNotFound; got != want {
+		t.Fatalf("redact deleted event status: got %v, want %v", got, want)
+	}
+
+	resp, err = http.Get(ts.URL + "/v1/event/" + id + "/audit")
+	if err != nil {
+		t.Fatalf("audit: %v", err)
+	}
+	defer resp.Body.Close()
+	var r struct {
+		Results []AuditEntry `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		t.Fatalf("json decode: %v", err)
+	}
+	if len(r.Results) != 1 || r.Results[0].Action != AuditDelete {
+		t.Fatalf("audit trail: got %+v, want one delete", r.Results)
+	}
+}
+
+func TestReceivedTimeHTTP(t *testing.T) {
+	store := newTestEventStore(t, &mockDataStore{})
+	ts := httptest.NewServer(NewServer(store, "", ""))
+	defer ts.Close()
+
+	// an event from long ago that only just arrived
+	id, err := store.AddEvent(context.Background(), &UnaddedEvent{DC: "dc1", TopicName: "test1", Host: "h", EventTime: 1497309509})
+	if err != nil {
+		t.Fatalf("add event: %v", err)
+	}
+
+	// received times are in ms, both in the query and in the results
+	find := func(start, end int64) []*EventResult {
+		resp, err := http.Get(fmt.Sprintf("%s/v1/event?start_received_time=%d&end_received_time=%d", ts.URL, start, end))
+		if err != nil {
+			t.Fatalf("get events: %v", err)
+		}
+		defer resp.Body.Close()
+		if got, want := resp.StatusCode, http.StatusOK; got != want {
+			t.Fatalf("status: got %v, want %v", got, want)
+		}
+		var r SearchResult
+		if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+			t.Fatalf("json decode: %v", err)
+		}
+		return r.Results
+	}
+	now := time.Now().Unix() * 1000
+	results := find(now-300000, now+60000)
+	if len(results) != 1 || results[0].EventID != id {
+		t.Fatalf("results: got %+v, want %v", results, id)
+	}
+	received := results[0].ReceivedTime
+	if received < now-1000 || received > now+1000 {
+		t.Fatalf("received time: got %v, want about %v", received, now)
+	}
+	if results := find(received, received); len(results) != 1 || results[0].EventID != id {
+		t.Fatalf("results at the received time: got %+v, want %v", results, id)
+	}
+	if results := find(received+1, received+1000); len(results) != 0 {
+		t.Fatalf("results after the received time: got %+v, want none", results)
+	}
+
+	resp, err := http.Get(ts.URL + "/v1/event?start_received_time=" + fmt.Sprint(now))
+	if err != nil {
+		t.Fatalf("get events: %v", err)
+	}
+	resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusBadRequest; got != want {
+		t.Fatalf("incomplete window status: got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,161 @@
+package eventmaster
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	eventmaster "github.com/ContextLogic/eventmaster/proto"
+)
+
+func TestAddEventsHTTP(t *testing.T) {
+	store := newTestEventStore(t, &mockDataStore{})
+	ts := httptest.NewServer(NewServer(store, "", ""))
+	defer ts.Close()
+
+	tests := []struct {
+		name string
+		body string
+		errs []bool
+	}{
+		{
+			name: "array",
+			body: `[
+				{"dc": "dc1", "topic_name": "test1", "host": "h"},
+				{"dc": "nope", "topic_name": "test1", "host": "h"},
+				"not an event",
+				{"dc": "dc2", "topic_name": "test2", "host": "h"}
+			]`,
+			errs: []bool{false, true, true, false},
+		},
+		{
+			name: "ndjson",
+			body: `{"dc": "dc1", "topic_name": "test1", "host": "h"}
+
+{"dc": "dc1", "topic_name": "test1"
+{"dc": "dc1", "topic_name": "test2", "host": "h"}
+`,
+			errs: []bool{false, true, false},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			before := len(store.ds.(*mockDataStore).events)
+			resp, err := http.Post(ts.URL+"/v1/events", "application/json", strings.NewReader(test.body))
+			if err != nil {
+				t.Fatalf("post: %v", err)
+			}
+			defer resp.Body.Close()
+			if got, want := resp.StatusCode, http.StatusOK; got != want {
+				t.Fatalf("status: got %v, want %v", got, want)
+			}
+			var r struct {
+				Results []AddEventResult `json:"results"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+				t.Fatalf("json decode: %v", err)
+			}
+			if got, want := len(r.Results), len(test.errs); got != want {
+				t.Fatalf("results: got %v, want %v", got, want)
+			}
+			stored := 0
+			for i, res := range r.Results {
+				if got, want := res.Error != "", test.errs[i]; got != want {
+					t.Fatalf("result %d error %q: got %v, want %v", i, res.Error, got, want)
+				}
+				if got, want := res.EventID != "", !test.errs[i]; got != want {
+					t.Fatalf("result %d event id %q: got %v, want %v", i, res.EventID, got, want)
+				}
+				if res.EventID != "" {
+					stored++
+				}
+			}
+			if got, want := len(store.ds.(*mockDataStore).events)-before, stored; got != want {
+				t.Fatalf("stored events: got %v, want %v", got, want)
+			}
+		})
+	}
+
+	resp, err := http.Post(ts.URL+"/v1/events", "application/json", strings.NewReader("[1, "))
+	if err != nil {
+		t.Fatalf("post: %v", err)
+	}
+	resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusBadRequest; got != want {
+		t.Fatalf("status: got %v, want %v", got, want)
+	}
+
+	for name, body := range map[string]string{
+		"events": strings.Repeat("{}\n", maxBatchEvents+1),
+		"bytes":  `[{"data": {"x": "` + strings.Repeat("x", maxBatchBytes) + `"}}]`,
+	} {
+		resp, err := http.Post(ts.URL+"/v1/events", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("post: %v", err)
+		}
+		resp.Body.Close()
+		if got, want := resp.StatusCode, http.StatusRequestEntityTooLarge; got != want {
+			t.Fatalf("too many %v: status: got %v, want %v", name, got, want)
+		}
+	}
+}
+
+// addEventsStream sends n copies of evt to an AddEvents handler.
+type addEventsStream struct {
+	grpc.ServerStream
+	evt  *eventmaster.Event
+	n    int
+	resp *eventmaster.AddEventsResponse
+}
+
+func (s *addEventsStream) Context() context.Context { return context.Background() }
+
+func (s *addEventsStream) Recv() (*eventmaster.Event, error) {
+	if s.n == 0 {
+		return nil, io.EOF
+	}
+	s.n--
+	return s.evt, nil
+}
+
+func (s *addEventsStream) SendAndClose(resp *eventmaster.AddEventsResponse) error {
+	s.resp = resp
+	return nil
+}
+
+func TestAddEventsGRPC(t *testing.T) {
+	store := newTestEventStore(t, &mockDataStore{})
+	s := NewGRPCServer(&Flags{}, store)
+
+	evt := &eventmaster.Event{DC: "dc1", TopicName: "test1", Host: "h"}
+	stream := &addEventsStream{evt: evt, n: 3}
+	if err := s.AddEvents(stream); err != nil {
+		t.Fatalf("add events: %v", err)
+	}
+	if got, want := len(stream.resp.Results), 3; got != want {
+		t.Fatalf("results: got %v, want %v", got, want)
+	}
+
+	big := &eventmaster.Event{DC: "dc1", TopicName: "test1", Host: "h", Data: []byte(`{"x": "` + strings.Repeat("x", maxBatchLine) + `"}`)}
+	for name, stream := range map[string]*addEventsStream{
+		"events": {evt: evt, n: maxBatchEvents + 1},
+		"bytes":  {evt: big, n: maxBatchBytes/maxBatchLine + 1},
+	} {
+		before := len(store.ds.(*mockDataStore).events)
+		err := s.AddEvents(stream)
+		if got, want := status.Code(err), codes.ResourceExhausted; got != want {
+			t.Fatalf("too many %v: code: got %v, want %v", name, got, want)
+		}
+		if got := len(store.ds.(*mockDataStore).events) - before; got != 0 {
+			t.Fatalf("too many %v: stored events: got %v, want 0", name, got)
+		}
+	}
+}
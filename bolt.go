@@ -0,0 +1,850 @@
+package eventmaster
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+
+	eventmaster "github.com/ContextLogic/eventmaster/proto"
+)
+
+// BoltConfig defines the embedded data store section of the eventmaster
+// configuration file.
+type BoltConfig struct {
+	Path    string `json:"path"`
+	Timeout string `json:"timeout"`
+}
+
+// Bucket names mirror the Cassandra tables created in cassandra_migrations.go.
+const (
+	boltEventBucket          = "event"
+	boltEventMetadataBucket  = "event_metadata"
+	boltByTopicBucket        = "event_by_topic"
+	boltByDCBucket           = "event_by_dc"
+	boltByHostBucket         = "event_by_host"
+	boltByUserBucket         = "event_by_user"
+	boltByParentEventBucket  = "event_by_parent_event_id"
+	boltByDateBucket         = "event_by_date"
+	boltByReceivedBucket     = "event_by_received_time"
+	boltTopicBucket          = "event_topic"
+	boltDCBucket             = "event_dc"
+	boltIdempotencyKeyBucket = "event_by_idempotency_key"
+	boltAuditBucket          = "event_audit"
+	boltRuleBucket           = "event_rule"
+	boltRuleStateBucket      = "event_rule_state"
+	boltIndexTimeKeyLen      = 8
+	boltIndexValueTerminator = 0
+)
+
+var boltBuckets = []string{
+	boltEventBucket,
+	boltEventMetadataBucket,
+	boltByTopicBucket,
+	boltByDCBucket,
+	boltByHostBucket,
+	boltByUserBucket,
+	boltByParentEventBucket,
+	boltByDateBucket,
+	boltByReceivedBucket,
+	boltTopicBucket,
+	boltDCBucket,
+	boltIdempotencyKeyBucket,
+	boltAuditBucket,
+	boltRuleBucket,
+	boltRuleStateBucket,
+}
+
+// boltIdempotencyEntry is the value stored for each key in
+// boltIdempotencyKeyBucket.
+type boltIdempotencyEntry struct {
+	EventID      string `json:"event_id"`
+	ReceivedTime int64  `json:"received_time"`
+}
+
+// BoltStore is an implementation of DataStore that is backed by an embedded
+// bolt database.
+//
+// It is intended for single node deployments (development, CI, small sites)
+// where running a Cassandra cluster is not worth the trouble.
+//
+// Each secondary index is a bucket whose keys are the indexed value, a zero
+// byte, the big-endian event time and the event id. This keeps entries for
+// one value sorted by time so range queries are a single cursor seek. The
+// received time index has the received time in place of the event time.
+//
+// Transactions are local and short, so only the scans of Find and FindIDs
+// stop early when their context is done.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStore opens (creating if necessary) the bolt database at c.Path.
+func NewBoltStore(c BoltConfig) (*BoltStore, error) {
+	if c.Path == "" {
+		return nil, errors.New("embedded data store path cannot be empty")
+	}
+	opts := &bolt.Options{}
+	if c.Timeout != "" {
+		timeout, err := time.ParseDuration(c.Timeout)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse timeout")
+		}
+		opts.Timeout = timeout
+	}
+
+	db, err := bolt.Open(c.Path, 0600, opts)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open bolt db %v", c.Path)
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		// databases created before the received time index need it built
+		indexReceived := tx.Bucket([]byte(boltByReceivedBucket)) == nil && tx.Bucket([]byte(boltEventBucket)) != nil
+		for _, b := range boltBuckets {
+			if _, err := tx.CreateBucketIfNotExists([]byte(b)); err != nil {
+				return errors.Wrapf(err, "create bucket %v", b)
+			}
+		}
+		if indexReceived {
+			return boltIndexReceivedTimes(tx)
+		}
+		return nil
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStore{
+		db: db,
+	}, nil
+}
+
+// boltIndexKey builds the key used in the index buckets.
+func boltIndexKey(value string, eventTime int64, eventID string) []byte {
+	k := make([]byte, 0, len(value)+1+boltIndexTimeKeyLen+len(eventID))
+	k = append(k, value...)
+	k = append(k, boltIndexValueTerminator)
+	var t [boltIndexTimeKeyLen]byte
+	binary.BigEndian.PutUint64(t[:], uint64(eventTime))
+	k = append(k, t[:]...)
+	return append(k, eventID...)
+}
+
+// boltIndexKeys returns the index bucket and key pairs that need to be
+// written for evt.
+func boltIndexKeys(evt *Event) map[string][]byte {
+	r := map[string][]byte{
+		boltByTopicBucket:    boltIndexKey(evt.TopicID, evt.EventTime, evt.EventID),
+		boltByDCBucket:       boltIndexKey(evt.DCID, evt.EventTime, evt.EventID),
+		boltByHostBucket:     boltIndexKey(strings.ToLower(evt.Host), evt.EventTime, evt.EventID),
+		boltByDateBucket:     boltIndexKey("", evt.EventTime, evt.EventID),
+		boltByReceivedBucket: boltIndexKey("", evt.ReceivedTime, evt.EventID),
+	}
+	if evt.User != "" {
+		r[boltByUserBucket] = boltIndexKey(strings.ToLower(evt.User), evt.EventTime, evt.EventID)
+	}
+	if evt.ParentEventID != "" {
+		r[boltByParentEventBucket] = boltIndexKey(evt.ParentEventID, evt.EventTime, evt.EventID)
+	}
+	return r
+}
+
+// boltIndexReceivedTimes adds every stored event to boltByReceivedBucket.
+func boltIndexReceivedTimes(tx *bolt.Tx) error {
+	index := tx.Bucket([]byte(boltByReceivedBucket))
+	return tx.Bucket([]byte(boltEventBucket)).ForEach(func(k, v []byte) error {
+		var evt Event
+		if err := json.Unmarshal(v, &evt); err != nil {
+			return errors.Wrapf(err, "Error unmarshalling event %s", k)
+		}
+		return errors.Wrap(index.Put(boltIndexKey("", evt.ReceivedTime, evt.EventID), nil), "put received time")
+	})
+}
+
+// AddEvent stores evt and all of its index entries in a single transaction.
+func (b *BoltStore) AddEvent(ctx context.Context, evt *Event) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return boltAddEvent(tx, evt)
+	})
+}
+
+// AddEvents stores all of evts in a single transaction.
+func (b *BoltStore) AddEvents(ctx context.Context, evts []*Event) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		for _, evt := range evts {
+			if err := boltAddEvent(tx, evt); err != nil {
+				return errors.Wrapf(err, "event %v", evt.EventID)
+			}
+		}
+		return nil
+	})
+}
+
+func boltAddEvent(tx *bolt.Tx, evt *Event) error {
+	data := []byte("{}")
+	if evt.Data != nil {
+		var err error
+		data, err = json.Marshal(evt.Data)
+		if err != nil {
+			return errors.Wrap(err, "Error marshalling event data into json")
+		}
+	}
+	core := *evt
+	core.Data = nil
+	core.Host = strings.ToLower(evt.Host)
+	core.User = strings.ToLower(evt.User)
+	coreBytes, err := json.Marshal(&core)
+	if err != nil {
+		return errors.Wrap(err, "Error marshalling event into json")
+	}
+
+	if err := tx.Bucket([]byte(boltEventBucket)).Put([]byte(evt.EventID), coreBytes); err != nil {
+		return errors.Wrap(err, "put event")
+	}
+	if err := tx.Bucket([]byte(boltEventMetadataBucket)).Put([]byte(evt.EventID), data); err != nil {
+		return errors.Wrap(err, "put event metadata")
+	}
+	for bucket, key := range boltIndexKeys(evt) {
+		if err := tx.Bucket([]byte(bucket)).Put(key, nil); err != nil {
+			return errors.Wrapf(err, "put %v", bucket)
+		}
+	}
+	return nil
+}
+
+// ClaimIdempotencyKey implements DataStore. The key is looked up and
+// claimed in a single transaction, and only the latest claim of each key is
+// kept.
+func (b *BoltStore) ClaimIdempotencyKey(ctx context.Context, key, id string, receivedTime, since int64) (string, error) {
+	var holder string
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		keys := tx.Bucket([]byte(boltIdempotencyKeyBucket))
+		if v := keys.Get([]byte(key)); v != nil {
+			var entry boltIdempotencyEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return errors.Wrap(err, "json unmarshal idempotency entry")
+			}
+			if entry.ReceivedTime >= since {
+				holder = entry.EventID
+				return nil
+			}
+		}
+		entry, err := json.Marshal(boltIdempotencyEntry{EventID: id, ReceivedTime: receivedTime})
+		if err != nil {
+			return errors.Wrap(err, "json marshal idempotency entry")
+		}
+		return errors.Wrap(keys.Put([]byte(key), entry), "put idempotency key")
+	})
+	return holder, err
+}
+
+// ReleaseIdempotencyKey implements DataStore.
+func (b *BoltStore) ReleaseIdempotencyKey(ctx context.Context, key, id string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return boltReleaseIdempotencyKey(tx, key, id)
+	})
+}
+
+// boltReleaseIdempotencyKey deletes key if the event with id holds it.
+func boltReleaseIdempotencyKey(tx *bolt.Tx, key, id string) error {
+	keys := tx.Bucket([]byte(boltIdempotencyKeyBucket))
+	var entry boltIdempotencyEntry
+	if v := keys.Get([]byte(key)); v != nil && json.Unmarshal(v, &entry) == nil && entry.EventID == id {
+		return errors.Wrap(keys.Delete([]byte(key)), "delete idempotency key")
+	}
+	return nil
+}
+
+// boltDeleteEvent removes the event with id, its data and all of its index
+// entries. Deleting an event that does not exist is not an error.
+func boltDeleteEvent(tx *bolt.Tx, id string) error {
+	v := tx.Bucket([]byte(boltEventBucket)).Get([]byte(id))
+	if v == nil {
+		return nil
+	}
+	evt := &Event{}
+	if err := json.Unmarshal(v, evt); err != nil {
+		return errors.Wrap(err, "Error unmarshalling event")
+	}
+	for bucket, key := range boltIndexKeys(evt) {
+		if err := tx.Bucket([]byte(bucket)).Delete(key); err != nil {
+			return errors.Wrapf(err, "delete from %v", bucket)
+		}
+	}
+	if evt.IdempotencyKey != "" {
+		if err := boltReleaseIdempotencyKey(tx, evt.IdempotencyKey, id); err != nil {
+			return err
+		}
+	}
+	if err := tx.Bucket([]byte(boltEventMetadataBucket)).Delete([]byte(id)); err != nil {
+		return errors.Wrap(err, "delete event metadata")
+	}
+	return errors.Wrap(tx.Bucket([]byte(boltEventBucket)).Delete([]byte(id)), "delete event")
+}
+
+// DeleteEvent implements DataStore.
+func (b *BoltStore) DeleteEvent(ctx context.Context, id string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return boltDeleteEvent(tx, id)
+	})
+}
+
+// UpdateEventData implements DataStore.
+func (b *BoltStore) UpdateEventData(ctx context.Context, id string, data map[string]interface{}) error {
+	v, err := json.Marshal(data)
+	if err != nil {
+		return errors.Wrap(err, "Error marshalling event data into json")
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(boltEventBucket)).Get([]byte(id)) == nil {
+			return errors.Errorf("event %v does not exist", id)
+		}
+		return errors.Wrap(tx.Bucket([]byte(boltEventMetadataBucket)).Put([]byte(id), v), "put event metadata")
+	})
+}
+
+// boltAuditKey sorts entries by event and then by their ksuid, which is the
+// order they were added in.
+func boltAuditKey(eventID, auditID string) []byte {
+	return append(append([]byte(eventID), boltIndexValueTerminator), auditID...)
+}
+
+// AddAuditEntry implements DataStore.
+func (b *BoltStore) AddAuditEntry(ctx context.Context, e AuditEntry) error {
+	v, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "json marshal audit entry")
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(boltAuditBucket)).Put(boltAuditKey(e.EventID, e.ID), v)
+	})
+}
+
+// GetAuditEntries implements DataStore.
+func (b *BoltStore) GetAuditEntries(ctx context.Context, eventID string) ([]AuditEntry, error) {
+	var entries []AuditEntry
+	err := b.db.View(func(tx *bolt.Tx) error {
+		prefix := boltAuditKey(eventID, "")
+		c := tx.Bucket([]byte(boltAuditBucket)).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var e AuditEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return errors.Wrap(err, "json unmarshal audit entry")
+			}
+			entries = append(entries, e)
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// topicEventsBefore returns the ids of the events in the topic with an
+// event time (in seconds) before before.
+func topicEventsBefore(tx *bolt.Tx, topicID string, before int64) ([]string, error) {
+	var ids []string
+	err := scanIndex(tx, boltByTopicBucket, []string{topicID}, 0, before*1000-1, func(id string) error {
+		ids = append(ids, id)
+		return nil
+	})
+	return ids, err
+}
+
+// CountEvents implements DataStore.
+func (b *BoltStore) CountEvents(ctx context.Context, topicID string, before int64) (int, error) {
+	var n int
+	err := b.db.View(func(tx *bolt.Tx) error {
+		ids, err := topicEventsBefore(tx, topicID, before)
+		n = len(ids)
+		return err
+	})
+	return n, err
+}
+
+// PurgeEvents implements DataStore.
+func (b *BoltStore) PurgeEvents(ctx context.Context, topicID string, before int64) (int, error) {
+	var n int
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		ids, err := topicEventsBefore(tx, topicID, before)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if err := boltDeleteEvent(tx, id); err != nil {
+				return errors.Wrapf(err, "event %v", id)
+			}
+		}
+		n = len(ids)
+		return nil
+	})
+	return n, err
+}
+
+// scanIndex calls fn with the id of every event in bucket that is indexed
+// under one of values and whose event time (in ms) is within [start, end].
+func scanIndex(tx *bolt.Tx, bucket string, values []string, start, end int64, fn func(eventID string) error) error {
+	c := tx.Bucket([]byte(bucket)).Cursor()
+	for _, v := range values {
+		prefix := append([]byte(v), boltIndexValueTerminator)
+		for k, _ := c.Seek(boltIndexKey(v, start, "")); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			rest := k[len(prefix):]
+			if len(rest) < boltIndexTimeKeyLen {
+				continue
+			}
+			if int64(binary.BigEndian.Uint64(rest[:boltIndexTimeKeyLen])) > end {
+				break
+			}
+			if err := fn(string(rest[boltIndexTimeKeyLen:])); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (b *BoltStore) getFromIndex(tx *bolt.Tx, bucket string, values []string, start, end int64) (map[string]struct{}, error) {
+	events := make(map[string]struct{})
+	err := scanIndex(tx, bucket, values, start, end, func(eventID string) error {
+		events[eventID] = struct{}{}
+		return nil
+	})
+	return events, err
+}
+
+func (b *BoltStore) findByID(tx *bolt.Tx, id string, includeData bool) (*Event, error) {
+	v := tx.Bucket([]byte(boltEventBucket)).Get([]byte(id))
+	if v == nil {
+		return nil, nil
+	}
+	evt := &Event{}
+	if err := json.Unmarshal(v, evt); err != nil {
+		return nil, errors.Wrap(err, "Error unmarshalling event")
+	}
+	// match CassandraStore, which hands back event time in seconds
+	evt.EventTime /= 1000
+
+	if includeData {
+		if data := tx.Bucket([]byte(boltEventMetadataBucket)).Get([]byte(id)); len(data) > 0 {
+			var d map[string]interface{}
+			if err := json.Unmarshal(data, &d); err != nil {
+				return nil, errors.Wrap(err, "Error unmarshalling JSON in event data")
+			}
+			evt.Data = d
+		}
+	}
+	return evt, nil
+}
+
+// FindByID returns the event with the given id, or nil if there is no such
+// event.
+func (b *BoltStore) FindByID(ctx context.Context, id string, includeData bool) (*Event, error) {
+	var evt *Event
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		evt, err = b.findByID(tx, id, includeData)
+		return err
+	})
+	return evt, err
+}
+
+// FindByIDs returns the events with ids, and their data if includeData is
+// true, from a single transaction. Ids that are not found are left out.
+func (b *BoltStore) FindByIDs(ctx context.Context, ids []string, includeData bool) (Events, error) {
+	var evts Events
+	err := b.db.View(func(tx *bolt.Tx) error {
+		for _, id := range ids {
+			evt, err := b.findByID(tx, id, includeData)
+			if err != nil {
+				return err
+			}
+			if evt != nil {
+				evts = append(evts, evt)
+			}
+		}
+		return nil
+	})
+	return evts, err
+}
+
+// Find searches using the Query, and filters topicIDs and dcIDs.
+//
+// Like CassandraStore it intersects the ids found in each relevant index
+// before fetching the events themselves. Without an event time window the
+// event time indexes are read in full.
+func (b *BoltStore) Find(ctx context.Context, q *eventmaster.Query, topicIDs []string, dcIDs []string) (Events, error) {
+	return b.find(ctx, q, topicIDs, dcIDs, q.Data != "")
+}
+
+// Aggregate implements DataStore. Event data is only read if q filters on it
+// or agg groups by it.
+func (b *BoltStore) Aggregate(ctx context.Context, q *eventmaster.Query, topicIDs []string, dcIDs []string, agg Aggregation) ([]AggregateCount, error) {
+	evts, err := b.find(ctx, q, topicIDs, dcIDs, q.Data != "" || agg.needsData())
+	if err != nil {
+		return nil, err
+	}
+	counter := newAggregateCounter(agg)
+	for _, evt := range evts {
+		counter.add(evt)
+	}
+	return counter.result(), nil
+}
+
+// find returns the events that match q, with their data if includeData is
+// true.
+func (b *BoltStore) find(ctx context.Context, q *eventmaster.Query, topicIDs []string, dcIDs []string, includeData bool) (Events, error) {
+	start, end := int64(0), int64(math.MaxInt64)
+	if hasEventTimeWindow(q) {
+		start, end = q.StartEventTime*1000, q.EndEventTime*1000
+	}
+
+	type index struct {
+		bucket     string
+		values     []string
+		start, end int64
+	}
+	indexes := []index{
+		{boltByUserBucket, lowerAll(q.User), start, end},
+		{boltByParentEventBucket, q.ParentEventID, start, end},
+		{boltByHostBucket, lowerAll(q.Host), start, end},
+		{boltByTopicBucket, topicIDs, start, end},
+		{boltByDCBucket, dcIDs, start, end},
+	}
+	if hasReceivedTimeWindow(q) {
+		indexes = append(indexes, index{boltByReceivedBucket, []string{""}, q.StartReceivedTime, q.EndReceivedTime})
+	}
+
+	var events Events
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var evts map[string]struct{}
+		for _, idx := range indexes {
+			if len(idx.values) == 0 {
+				continue
+			}
+			found, err := b.getFromIndex(tx, idx.bucket, idx.values, idx.start, idx.end)
+			if err != nil {
+				return errors.Wrapf(err, "scan %v", idx.bucket)
+			}
+			if evts == nil {
+				evts = found
+			} else {
+				for id := range evts {
+					if _, ok := found[id]; !ok {
+						delete(evts, id)
+					}
+				}
+			}
+			if len(evts) == 0 {
+				return nil
+			}
+		}
+		if evts == nil {
+			var err error
+			evts, err = b.getFromIndex(tx, boltByDateBucket, []string{""}, start, end)
+			if err != nil {
+				return errors.Wrapf(err, "scan %v", boltByDateBucket)
+			}
+		}
+
+		for id := range evts {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			evt, err := b.findByID(tx, id, includeData)
+			if err != nil {
+				return errors.Wrapf(err, "find %v", id)
+			}
+			if evt != nil && matchesTimeWindows(q, evt) {
+				events = append(events, evt)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return filterEvents(q, events)
+}
+
+// FindPage returns at most limit events that match q and sort after the
+// cursor after (if non-nil), in Events order.
+//
+// It walks a single index backwards from the cursor, the most selective one
+// q names a single value of or else the date index, and stops once it has
+// found limit events, so a page costs O(limit) reads for unselective queries.
+func (b *BoltStore) FindPage(ctx context.Context, q *eventmaster.Query, topicIDs []string, dcIDs []string, after *pageCursor, limit int) (Events, error) {
+	m, err := newEventMatcher(q, topicIDs, dcIDs)
+	if err != nil {
+		return nil, err
+	}
+	bucket, value := boltByDateBucket, ""
+	for _, idx := range []struct {
+		bucket string
+		values []string
+	}{
+		{boltByUserBucket, lowerAll(q.User)},
+		{boltByParentEventBucket, q.ParentEventID},
+		{boltByHostBucket, lowerAll(q.Host)},
+		{boltByTopicBucket, topicIDs},
+		{boltByDCBucket, dcIDs},
+	} {
+		if len(idx.values) == 1 {
+			bucket, value = idx.bucket, idx.values[0]
+			break
+		}
+	}
+
+	// an event time of -1 encodes as the largest possible time
+	start, hi := int64(0), boltIndexKey(value, -1, "")
+	if hasEventTimeWindow(q) {
+		start, hi = q.StartEventTime*1000, boltIndexKey(value, q.EndEventTime*1000+1, "")
+	}
+	if after != nil {
+		if k := boltIndexKey(value, after.EventTime*1000, after.EventID); bytes.Compare(k, hi) < 0 {
+			hi = k
+		}
+	}
+
+	var evts Events
+	err = b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(bucket)).Cursor()
+		prefix := append([]byte(value), boltIndexValueTerminator)
+		k, _ := c.Seek(hi)
+		if k == nil {
+			k, _ = c.Last()
+		} else {
+			k, _ = c.Prev()
+		}
+		for ; k != nil && bytes.HasPrefix(k, prefix) && len(evts) < limit; k, _ = c.Prev() {
+			rest := k[len(prefix):]
+			if len(rest) < boltIndexTimeKeyLen {
+				continue
+			}
+			if int64(binary.BigEndian.Uint64(rest[:boltIndexTimeKeyLen])) < start {
+				break
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			id := string(rest[boltIndexTimeKeyLen:])
+			evt, err := b.findByID(tx, id, q.Data != "")
+			if err != nil {
+				return errors.Wrapf(err, "find %v", id)
+			}
+			if evt != nil && matchesTimeWindows(q, evt) && m.matches(evt) {
+				evts = append(evts, evt)
+			}
+		}
+		return nil
+	})
+	return evts, err
+}
+
+// FindIDs walks the date index in the order requested by q and calls stream
+// with each event ID found.
+func (b *BoltStore) FindIDs(ctx context.Context, q *eventmaster.TimeQuery, stream HandleEvent) error {
+	start, end := q.StartEventTime*1000, q.EndEventTime*1000
+	return b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(boltByDateBucket)).Cursor()
+		prefix := []byte{boltIndexValueTerminator}
+		inRange := func(k []byte) (string, bool) {
+			if k == nil || !bytes.HasPrefix(k, prefix) || len(k) < len(prefix)+boltIndexTimeKeyLen {
+				return "", false
+			}
+			t := int64(binary.BigEndian.Uint64(k[len(prefix) : len(prefix)+boltIndexTimeKeyLen]))
+			if t < start || t > end {
+				return "", false
+			}
+			return string(k[len(prefix)+boltIndexTimeKeyLen:]), true
+		}
+
+		var k []byte
+		var next func() ([]byte, []byte)
+		if q.Ascending {
+			k, _ = c.Seek(boltIndexKey("", start, ""))
+			next = c.Next
+		} else {
+			if k, _ = c.Seek(boltIndexKey("", end+1, "")); k == nil {
+				k, _ = c.Last()
+			} else {
+				k, _ = c.Prev()
+			}
+			next = c.Prev
+		}
+
+		var n int32
+		for ; ; k, _ = next() {
+			id, ok := inRange(k)
+			if !ok || (q.Limit > 0 && n >= q.Limit) {
+				return nil
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := stream(id); err != nil {
+				return errors.Wrap(err, "Error streaming event ID")
+			}
+			n++
+		}
+	})
+}
+
+// GetTopics returns all topics.
+func (b *BoltStore) GetTopics(ctx context.Context) ([]Topic, error) {
+	var topics []Topic
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(boltTopicBucket)).ForEach(func(k, v []byte) error {
+			var rt RawTopic
+			if err := json.Unmarshal(v, &rt); err != nil {
+				return errors.Wrap(err, "Error unmarshalling topic")
+			}
+			var s map[string]interface{}
+			if err := json.Unmarshal([]byte(rt.Schema), &s); err != nil {
+				return errors.Wrap(err, "Error unmarshalling schema")
+			}
+			topics = append(topics, Topic{
+				ID:               rt.ID,
+				Name:             rt.Name,
+				Schema:           s,
+				RetentionSeconds: rt.RetentionSeconds,
+			})
+			return nil
+		})
+	})
+	return topics, err
+}
+
+func (b *BoltStore) putTopic(t RawTopic, mustExist bool) error {
+	v, err := json.Marshal(&t)
+	if err != nil {
+		return errors.Wrap(err, "Error marshalling topic")
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(boltTopicBucket))
+		if mustExist && bucket.Get([]byte(t.ID)) == nil {
+			return errors.Errorf("topic %v does not exist", t.ID)
+		}
+		return bucket.Put([]byte(t.ID), v)
+	})
+}
+
+// AddTopic stores t.
+func (b *BoltStore) AddTopic(ctx context.Context, t RawTopic) error {
+	return b.putTopic(t, false)
+}
+
+// UpdateTopic replaces the name, schema and retention of the topic with t.ID.
+func (b *BoltStore) UpdateTopic(ctx context.Context, t RawTopic) error {
+	return b.putTopic(t, true)
+}
+
+// DeleteTopic removes the topic with the given id.
+func (b *BoltStore) DeleteTopic(ctx context.Context, id string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(boltTopicBucket)).Delete([]byte(id))
+	})
+}
+
+// GetDCs returns all stored datacenters.
+func (b *BoltStore) GetDCs(ctx context.Context) ([]DC, error) {
+	var dcs []DC
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(boltDCBucket)).ForEach(func(k, v []byte) error {
+			dcs = append(dcs, DC{
+				ID:   string(k),
+				Name: string(v),
+			})
+			return nil
+		})
+	})
+	return dcs, err
+}
+
+// AddDC stores dc.
+func (b *BoltStore) AddDC(ctx context.Context, dc DC) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(boltDCBucket)).Put([]byte(dc.ID), []byte(dc.Name))
+	})
+}
+
+// UpdateDC replaces the name for a given DC by id.
+func (b *BoltStore) UpdateDC(ctx context.Context, id string, newName string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(boltDCBucket))
+		if bucket.Get([]byte(id)) == nil {
+			return errors.Errorf("dc %v does not exist", id)
+		}
+		return bucket.Put([]byte(id), []byte(newName))
+	})
+}
+
+// GetRules returns all stored rules.
+func (b *BoltStore) GetRules(ctx context.Context) ([]Rule, error) {
+	var rules []Rule
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(boltRuleBucket)).ForEach(func(k, v []byte) error {
+			var r Rule
+			if err := json.Unmarshal(v, &r); err != nil {
+				return errors.Wrap(err, "json unmarshal rule")
+			}
+			rules = append(rules, r)
+			return nil
+		})
+	})
+	return rules, err
+}
+
+// PutRule implements DataStore.
+func (b *BoltStore) PutRule(ctx context.Context, r Rule) error {
+	v, err := json.Marshal(r)
+	if err != nil {
+		return errors.Wrap(err, "json marshal rule")
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(boltRuleBucket)).Put([]byte(r.ID), v)
+	})
+}
+
+// DeleteRule implements DataStore.
+func (b *BoltStore) DeleteRule(ctx context.Context, id string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket([]byte(boltRuleBucket)).Delete([]byte(id)); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(boltRuleStateBucket)).Delete([]byte(id))
+	})
+}
+
+// GetRuleState implements DataStore.
+func (b *BoltStore) GetRuleState(ctx context.Context, id string) (RuleState, error) {
+	var state RuleState
+	err := b.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(boltRuleStateBucket)).Get([]byte(id))
+		if v == nil {
+			return nil
+		}
+		return errors.Wrap(json.Unmarshal(v, &state), "json unmarshal rule state")
+	})
+	return state, err
+}
+
+// SaveRuleState implements DataStore.
+func (b *BoltStore) SaveRuleState(ctx context.Context, id string, state RuleState) error {
+	v, err := json.Marshal(state)
+	if err != nil {
+		return errors.Wrap(err, "json marshal rule state")
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(boltRuleStateBucket)).Put([]byte(id), v)
+	})
+}
+
+// CloseSession closes the underlying bolt database.
+func (b *BoltStore) CloseSession() {
+	b.db.Close()
+}
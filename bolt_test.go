@@ -0,0 +1,227 @@
+package eventmaster
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	eventmaster "github.com/ContextLogic/eventmaster/proto"
+)
+
+func newTestBoltStore(t *testing.T) (*BoltStore, func()) {
+	dir, err := ioutil.TempDir("", "eventmaster")
+	if err != nil {
+		t.Fatalf("temp dir: %v", err)
+	}
+	bs, err := NewBoltStore(BoltConfig{Path: filepath.Join(dir, "eventmaster.db")})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("new bolt store: %v", err)
+	}
+	return bs, func() {
+		bs.CloseSession()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestBoltTopicsAndDCs(t *testing.T) {
+	bs, cleanup := newTestBoltStore(t)
+	defer cleanup()
+
+	store, err := GetTestEventStore(bs)
+	if err != nil {
+		t.Fatalf("creating event store: %v", err)
+	}
+	if err := PopulateTestData(store); err != nil {
+		t.Fatalf("populating test data: %v", err)
+	}
+
+	if _, err := store.UpdateTopic(context.Background(), "t0000", TopicUpdate{Name: "renamed"}); err != nil {
+		t.Fatalf("update topic: %v", err)
+	}
+	if err := store.DeleteTopic(context.Background(), &eventmaster.DeleteTopicRequest{TopicName: "t0001"}); err != nil {
+		t.Fatalf("delete topic: %v", err)
+	}
+	if _, err := store.UpdateDC(context.Background(), &eventmaster.UpdateDCRequest{OldName: "dc0000", NewName: "renamed"}); err != nil {
+		t.Fatalf("update dc: %v", err)
+	}
+
+	// reload the caches from disk to make sure everything was persisted
+	if err := store.Update(context.Background()); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+
+	topics, err := store.GetTopics(context.Background())
+	if err != nil {
+		t.Fatalf("get topics: %v", err)
+	}
+	if got, want := len(topics), 4; got != want {
+		t.Fatalf("number of topics: got %v, want %v", got, want)
+	}
+	if store.getTopicID("renamed") == "" {
+		t.Fatalf("renamed topic not found")
+	}
+
+	dcs, err := store.GetDCs(context.Background())
+	if err != nil {
+		t.Fatalf("get dcs: %v", err)
+	}
+	if got, want := len(dcs), 5; got != want {
+		t.Fatalf("number of dcs: got %v, want %v", got, want)
+	}
+	if store.getDCID("renamed") == "" {
+		t.Fatalf("renamed dc not found")
+	}
+}
+
+func TestBoltEvents(t *testing.T) {
+	bs, cleanup := newTestBoltStore(t)
+	defer cleanup()
+
+	store := newTestEventStore(t, bs)
+
+	now := time.Now().Unix()
+	evts := []*UnaddedEvent{
+		{EventTime: now - 3, DC: "dc1", TopicName: "test1", Host: "Host1", User: "alice", Tags: []string{"a", "b"}},
+		{EventTime: now - 2, DC: "dc2", TopicName: "test1", Host: "host2", User: "bob", Tags: []string{"a"}},
+		{EventTime: now - 1, DC: "dc1", TopicName: "test2", Host: "host1", TargetHosts: []string{"th1"}, Data: map[string]interface{}{
+			"k":      "v",
+			"deploy": map[string]interface{}{"service": "api", "version": 2},
+		}},
+		{EventTime: now - 86400*3, DC: "dc1", TopicName: "test1", Host: "host1"},
+	}
+	var ids []string
+	for _, evt := range evts {
+		id, err := store.AddEvent(context.Background(), evt)
+		if err != nil {
+			t.Fatalf("add event: %v", err)
+		}
+		ids = append(ids, id)
+	}
+
+	tests := []struct {
+		label string
+		q     *eventmaster.Query
+		want  []string
+	}{
+		{"all", &eventmaster.Query{}, []string{ids[2], ids[1], ids[0]}},
+		{"older window", &eventmaster.Query{StartEventTime: now - 86400*4, EndEventTime: now}, []string{ids[2], ids[1], ids[0], ids[3]}},
+		{"host", &eventmaster.Query{Host: []string{"HOST1"}}, []string{ids[2], ids[0]}},
+		{"user", &eventmaster.Query{User: []string{"bob"}}, []string{ids[1]}},
+		{"topic", &eventmaster.Query{TopicName: []string{"test1"}}, []string{ids[1], ids[0]}},
+		{"dc and topic", &eventmaster.Query{DC: []string{"dc1"}, TopicName: []string{"test1"}}, []string{ids[0]}},
+		{"tags and", &eventmaster.Query{TagSet: []string{"a", "b"}, TagAndOperator: true}, []string{ids[0]}},
+		{"tags or", &eventmaster.Query{TagSet: []string{"a", "b"}}, []string{ids[1], ids[0]}},
+		{"exclude tags", &eventmaster.Query{TagSet: []string{"a"}, ExcludeTagSet: []string{"b"}}, []string{ids[1]}},
+		{"target host", &eventmaster.Query{TargetHostSet: []string{"th1"}}, []string{ids[2]}},
+		{"data", &eventmaster.Query{Data: `{"k": "v"}`}, []string{ids[2]}},
+		{"nested data", &eventmaster.Query{Data: `{"deploy": {"service": "api"}, "deploy.version": 2}`}, []string{ids[2]}},
+		{"data mismatch", &eventmaster.Query{Data: `{"deploy.version": "2"}`}, nil},
+		{"data missing path", &eventmaster.Query{Data: `{"deploy.service.name": "api"}`}, nil},
+		{"no match", &eventmaster.Query{Host: []string{"host2"}, DC: []string{"dc1"}}, nil},
+		{"received", &eventmaster.Query{StartReceivedTime: (now - 60) * 1000, EndReceivedTime: (now + 60) * 1000}, []string{ids[2], ids[1], ids[0], ids[3]}},
+		{"received and host", &eventmaster.Query{Host: []string{"host1"}, StartReceivedTime: (now - 60) * 1000, EndReceivedTime: (now + 60) * 1000}, []string{ids[2], ids[0], ids[3]}},
+		{"received earlier", &eventmaster.Query{StartReceivedTime: (now - 600) * 1000, EndReceivedTime: (now - 300) * 1000}, nil},
+		{"received and event", &eventmaster.Query{StartReceivedTime: (now - 60) * 1000, EndReceivedTime: (now + 60) * 1000, StartEventTime: now - 86400*4, EndEventTime: now - 86400}, []string{ids[3]}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.label, func(t *testing.T) {
+			if test.q.StartEventTime == 0 && test.q.StartReceivedTime == 0 {
+				test.q.StartEventTime = now - 60
+				test.q.EndEventTime = now
+			}
+			found, _, err := store.Find(context.Background(), test.q)
+			if err != nil {
+				t.Fatalf("find: %v", err)
+			}
+			var got []string
+			for _, evt := range found {
+				got = append(got, evt.EventID)
+			}
+			if len(got) != len(test.want) {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Fatalf("got %v, want %v", got, test.want)
+				}
+			}
+		})
+	}
+
+	evt, err := store.FindByID(context.Background(), ids[2])
+	if err != nil {
+		t.Fatalf("find by id: %v", err)
+	}
+	if got, want := evt.Data["k"], "v"; got != want {
+		t.Fatalf("data: got %v, want %v", got, want)
+	}
+	if got, want := evt.EventTime, now-1; got != want {
+		t.Fatalf("event time: got %v, want %v", got, want)
+	}
+
+	var streamed []string
+	err = store.FindIDs(context.Background(), &eventmaster.TimeQuery{
+		StartEventTime: now - 86400*4,
+		EndEventTime:   now,
+		Ascending:      true,
+	}, func(id string) error {
+		streamed = append(streamed, id)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("find ids: %v", err)
+	}
+	if got, want := len(streamed), 4; got != want {
+		t.Fatalf("streamed ids: got %v, want %v", got, want)
+	}
+	if got, want := streamed[0], ids[3]; got != want {
+		t.Fatalf("first streamed id: got %v, want %v", got, want)
+	}
+}
+
+func TestBoltIdempotencyKey(t *testing.T) {
+	bs, cleanup := newTestBoltStore(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	claim := func(key, id string, receivedTime, since int64, want string) {
+		t.Helper()
+		got, err := bs.ClaimIdempotencyKey(ctx, key, id, receivedTime, since)
+		if err != nil {
+			t.Fatalf("claim idempotency key: %v", err)
+		}
+		if got != want {
+			t.Fatalf("ClaimIdempotencyKey(%q, %q, %v, %v): got %q, want %q", key, id, receivedTime, since, got, want)
+		}
+	}
+	claim("k", "a", 1000, 0, "")
+	claim("k", "b", 2000, 1000, "a")
+	claim("other", "b", 2000, 1000, "")
+	// a claim from before the window is taken over
+	claim("k", "c", 3000, 1001, "")
+	claim("k", "d", 3000, 0, "c")
+
+	// only the holder of a key releases it
+	if err := bs.ReleaseIdempotencyKey(ctx, "k", "a"); err != nil {
+		t.Fatalf("release idempotency key: %v", err)
+	}
+	claim("k", "d", 3000, 0, "c")
+	if err := bs.ReleaseIdempotencyKey(ctx, "k", "c"); err != nil {
+		t.Fatalf("release idempotency key: %v", err)
+	}
+	claim("k", "e", 4000, 0, "")
+
+	// and so does deleting it
+	if err := bs.AddEvent(ctx, &Event{EventID: "e", IdempotencyKey: "k", ReceivedTime: 4000}); err != nil {
+		t.Fatalf("add event: %v", err)
+	}
+	if err := bs.DeleteEvent(ctx, "e"); err != nil {
+		t.Fatalf("delete event: %v", err)
+	}
+	claim("k", "f", 5000, 0, "")
+}
@@ -1,9 +1,11 @@
 package eventmaster
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
+	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gocql/gocql"
@@ -11,6 +13,7 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	cass "github.com/ContextLogic/eventmaster/cassandra"
+	"github.com/ContextLogic/eventmaster/jh"
 	servicelookup "github.com/ContextLogic/goServiceLookup/servicelookup"
 
 	eventmaster "github.com/ContextLogic/eventmaster/proto"
@@ -24,16 +27,36 @@ type CassandraConfig struct {
 	Consistency string   `json:"consistency"`
 	Timeout     string   `json:"timeout"`
 	ServiceName string   `json:"service_name"`
+	// MaxPreparedStatements sizes the cache of prepared statements; 0 uses
+	// the driver's default.
+	MaxPreparedStatements int `json:"max_prepared_statements"`
+	// Replication is used when `eventmaster migrate` creates the keyspace.
+	Replication CassandraReplication `json:"replication"`
+	// HydrateConcurrency is the most reads Find runs at once to fetch the
+	// events that match a query; 0 uses defaultHydrateConcurrency.
+	HydrateConcurrency int `json:"hydrate_concurrency"`
+	// HydrateBatchSize is the number of events fetched by each of those
+	// reads; 0 uses defaultHydrateBatchSize.
+	HydrateBatchSize int `json:"hydrate_batch_size"`
 }
 
+// Defaults for the hydration of query results by Find.
+const (
+	defaultHydrateConcurrency = 8
+	defaultHydrateBatchSize   = 50
+)
+
 // CassandraStore is an implementation of DataStore that is backed by
 // Cassandra.
 type CassandraStore struct {
-	session cass.Session
+	session            cass.Session
+	hydrateConcurrency int
+	hydrateBatchSize   int
 }
 
-// NewCassandraStore returns a working CassandraStore, or an error.
-func NewCassandraStore(c CassandraConfig) (*CassandraStore, error) {
+// cassandraIPs returns the addresses of the cassandra cluster, looking them up
+// by service name if one is configured.
+func cassandraIPs(c CassandraConfig) []string {
 	var cassandraIps []string
 
 	if c.ServiceName != "" {
@@ -44,122 +67,247 @@ func NewCassandraStore(c CassandraConfig) (*CassandraStore, error) {
 	}
 
 	log.Infof("Connecting to cassandra: %v", cassandraIps)
-	session, err := cass.NewCQLSession(cassandraIps, c.Keyspace, c.Consistency, c.Timeout)
+	return cassandraIps
+}
+
+// NewCassandraStore returns a working CassandraStore, or an error.
+//
+// The keyspace is not migrated; a warning is logged if it is behind.
+func NewCassandraStore(c CassandraConfig) (*CassandraStore, error) {
+	session, err := cass.NewCQLSession(cassandraIPs(c), c.Keyspace, c.Consistency, c.Timeout, c.MaxPreparedStatements)
 	if err != nil {
 		return nil, errors.Wrap(err, "Error creating cassandra session")
 	}
 
+	applied, err := appliedCassandraMigrations(context.Background(), session)
+	if err != nil {
+		log.Warnf("Unable to read cassandra schema version, run `eventmaster migrate`: %v", err)
+	} else if n := len(cassandraMigrations) - len(applied); n > 0 {
+		log.Warnf("Cassandra keyspace is %d migrations behind, run `eventmaster migrate`", n)
+	}
+
 	return &CassandraStore{
-		session: session,
+		session:            session,
+		hydrateConcurrency: c.HydrateConcurrency,
+		hydrateBatchSize:   c.HydrateBatchSize,
 	}, nil
 }
 
-func (event *Event) toCassandra() (string, error) {
+// Statements that write an event. TTL 0 means the event does not expire.
+const (
+	insertEventCQL = `INSERT INTO event (event_id, parent_event_id, dc_id, topic_id, host, target_host_set, user, event_time, tag_set, received_time, date, idempotency_key)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) USING TTL ?`
+	insertEventMetadataCQL = `INSERT INTO event_metadata (event_id, data_json) VALUES (?, ?) USING TTL ?`
+	insertEventByTopicCQL  = `INSERT INTO event_by_topic_v2 (event_id, topic_id, event_time, date) VALUES (?, ?, ?, ?) USING TTL ?`
+	insertEventByDCCQL     = `INSERT INTO event_by_dc_v2 (event_id, dc_id, event_time, date) VALUES (?, ?, ?, ?) USING TTL ?`
+	insertEventByHostCQL   = `INSERT INTO event_by_host_v2 (event_id, host, event_time, date) VALUES (?, ?, ?, ?) USING TTL ?`
+	insertEventByDateCQL   = `INSERT INTO event_by_date_v2 (event_id, event_time, date) VALUES (?, ?, ?) USING TTL ?`
+	insertEventByUserCQL   = `INSERT INTO event_by_user_v2 (event_id, user, event_time, date) VALUES (?, ?, ?, ?) USING TTL ?`
+	insertEventByParentCQL = `INSERT INTO event_by_parent_event_id_v2 (event_id, parent_event_id, event_time, date) VALUES (?, ?, ?, ?) USING TTL ?`
+	insertEventByTagCQL    = `INSERT INTO event_by_tag (event_id, tag, event_time, date) VALUES (?, ?, ?, ?) USING TTL ?`
+	insertEventByTargetCQL = `INSERT INTO event_by_target_host (event_id, target_host, event_time, date) VALUES (?, ?, ?, ?) USING TTL ?`
+	// event_by_received_time is partitioned by the date the event was
+	// received, not the date of its event time.
+	insertEventByReceivedCQL = `INSERT INTO event_by_received_time (event_id, received_time, date) VALUES (?, ?, ?) USING TTL ?`
+)
+
+// cassandraInserts returns the insert statements that store event in the
+// event table and all of the lookup tables.
+func (event *Event) cassandraInserts() ([]cass.Statement, error) {
 	date := getDate(event.EventTime / 1000)
+	var ttl int64
+	if event.RetentionSeconds > 0 {
+		// expire retention seconds after the event time, not after now
+		ttl = event.RetentionSeconds - (time.Now().Unix() - event.EventTime/1000)
+		if ttl < 1 {
+			ttl = 1
+		}
+	}
 	data := "{}"
 	if event.Data != nil {
 		dataBytes, err := json.Marshal(event.Data)
 		if err != nil {
-			return "", errors.Wrap(err, "Error marshalling event data into json")
+			return nil, errors.Wrap(err, "Error marshalling event data into json")
 		}
 		data = string(dataBytes)
 	}
-	coreFields := fmt.Sprintf(`
-    INSERT INTO event (event_id, parent_event_id, dc_id, topic_id, host, target_host_set, user, event_time, tag_set, received_time, date)
-    VALUES (%[1]s, %[2]s, %[3]s, %[4]s, %[5]s, %[6]s, %[7]s, %[8]d, %[9]s, %[11]d, %[12]s);
-    INSERT INTO event_metadata(event_id, data_json)
-    VALUES (%[1]s, $$%[10]s$$);
-    INSERT INTO event_by_topic(event_id, topic_id, event_time, date)
-    VALUES (%[1]s, %[4]s, %[8]d, %[12]s);
-    INSERT INTO event_by_dc(event_id, dc_id, event_time, date)
-    VALUES (%[1]s, %[3]s, %[8]d, %[12]s);
-    INSERT INTO event_by_host(event_id, host, event_time, date)
-    VALUES (%[1]s, %[5]s, %[8]d, %[12]s);
-    INSERT INTO event_by_date(event_id, event_time, date)
-    VALUES (%[1]s, %[8]d, %[12]s);`,
-		stringify(event.EventID), stringify(event.ParentEventID), stringifyUUID(event.DCID), stringifyUUID(event.TopicID),
-		stringify(strings.ToLower(event.Host)), stringifyArr(event.TargetHosts), stringify(strings.ToLower(event.User)), event.EventTime,
-		stringifyArr(event.Tags), data, event.ReceivedTime, stringify(date))
-	userField := ""
-	parentEventIDField := ""
+	stmts := []cass.Statement{
+		cass.NewStatement(insertEventCQL, event.EventID, event.ParentEventID, event.DCID, event.TopicID,
+			strings.ToLower(event.Host), event.TargetHosts, strings.ToLower(event.User), event.EventTime, event.Tags,
+			event.ReceivedTime, date, event.IdempotencyKey, ttl),
+		cass.NewStatement(insertEventMetadataCQL, event.EventID, data, ttl),
+	}
+	return append(stmts, event.indexInserts(date, ttl)...), nil
+}
+
+// indexInserts returns the statements that index event in every event_by_*
+// table other than event_by_idempotency_key.
+func (event *Event) indexInserts(date string, ttl int64) []cass.Statement {
+	host := strings.ToLower(event.Host)
+	user := strings.ToLower(event.User)
+	stmts := []cass.Statement{
+		cass.NewStatement(insertEventByTopicCQL, event.EventID, event.TopicID, event.EventTime, date, ttl),
+		cass.NewStatement(insertEventByDCCQL, event.EventID, event.DCID, event.EventTime, date, ttl),
+		cass.NewStatement(insertEventByHostCQL, event.EventID, host, event.EventTime, date, ttl),
+		cass.NewStatement(insertEventByDateCQL, event.EventID, event.EventTime, date, ttl),
+	}
 	if event.User != "" {
-		userField = fmt.Sprintf(`INSERT INTO event_by_user(event_id, user, event_time, date)
-		VALUES (%s, %s, %d, %s);`, stringify(event.EventID), stringify(event.User), event.EventTime, stringify(date))
+		stmts = append(stmts, cass.NewStatement(insertEventByUserCQL, event.EventID, user, event.EventTime, date, ttl))
 	}
 	if event.ParentEventID != "" {
-		parentEventIDField = fmt.Sprintf(`INSERT INTO event_by_parent_event_id(event_id, parent_event_id, event_time, date)
-		VALUES (%s, %s, %d, %s);`, stringify(event.EventID), stringify(event.ParentEventID), event.EventTime, stringify(date))
+		stmts = append(stmts, cass.NewStatement(insertEventByParentCQL, event.EventID, event.ParentEventID, event.EventTime, date, ttl))
 	}
-
-	return fmt.Sprintf(`
-		BEGIN BATCH
-		%s
-		%s
-		%s
-		APPLY BATCH;`, coreFields, userField, parentEventIDField), nil
+	stmts = append(stmts, cass.NewStatement(insertEventByReceivedCQL,
+		event.EventID, event.ReceivedTime, getDate(event.ReceivedTime/1000), ttl))
+	for _, tag := range event.Tags {
+		stmts = append(stmts, cass.NewStatement(insertEventByTagCQL, event.EventID, tag, event.EventTime, date, ttl))
+	}
+	for _, th := range event.TargetHosts {
+		stmts = append(stmts, cass.NewStatement(insertEventByTargetCQL, event.EventID, th, event.EventTime, date, ttl))
+	}
+	return stmts
 }
 
 // AddEvent takes an *Event and stores it in Cassandra.
-func (c *CassandraStore) AddEvent(evt *Event) error {
+func (c *CassandraStore) AddEvent(ctx context.Context, evt *Event) error {
 	// TODO: move eventStoreDbErrCounter.WithLabelValues("cassandra", "write").Inc() here
-	query, err := evt.toCassandra()
+	stmts, err := evt.cassandraInserts()
 	if err != nil {
 		return errors.Wrap(err, "Error converting event to cassandra event")
 	}
-	return c.session.ExecQuery(query)
+	return c.session.ExecBatch(ctx, cass.LoggedBatch, stmts)
 }
 
-func (c *CassandraStore) getFromTable(tableName string, columnName string, dates []string, timeFilter string, fields []string) (map[string]struct{}, error) {
-	events := make(map[string]struct{})
-	var eventID string
-	for _, date := range dates {
-		dateFilter := fmt.Sprintf("date = %s", stringify(date))
-		// TODO: put a reasonable limit on this
-		query := fmt.Sprintf(`SELECT event_id FROM %s WHERE %s in (%s) AND %s AND %s LIMIT 200;`,
-			tableName, columnName, strings.Join(fields, ","), dateFilter, timeFilter)
-		scanIter, closeIter := c.session.ExecIterQuery(query)
-		for true {
-			if scanIter(&eventID) {
-				events[eventID] = struct{}{}
-			} else {
-				break
+// cassandraBatchSize is the number of events written per unlogged batch by
+// AddEvents.
+const cassandraBatchSize = 20
+
+// AddEvents stores evts using unlogged batches of up to cassandraBatchSize
+// events. Unlogged batches skip the batch log, so a failed batch may have
+// been partially applied.
+//
+// A failed batch does not stop the ones after it; the events of the batches
+// that failed are reported in a *BatchError.
+func (c *CassandraStore) AddEvents(ctx context.Context, evts []*Event) error {
+	errs := make([]error, len(evts))
+	failed := false
+	for start := 0; start < len(evts); start += cassandraBatchSize {
+		end := start + cassandraBatchSize
+		if end > len(evts) {
+			end = len(evts)
+		}
+		var stmts []cass.Statement
+		var batch []int
+		for i := start; i < end; i++ {
+			s, err := evts[i].cassandraInserts()
+			if err != nil {
+				errs[i] = errors.Wrapf(err, "Error converting event %v to cassandra event", evts[i].EventID)
+				failed = true
+				continue
 			}
+			stmts = append(stmts, s...)
+			batch = append(batch, i)
 		}
-		if err := closeIter(); err != nil {
-			return nil, errors.Wrap(err, "Error closing cassandra iter")
+		if len(stmts) == 0 {
+			continue
+		}
+		if err := c.session.ExecBatch(ctx, cass.UnloggedBatch, stmts); err != nil {
+			for _, i := range batch {
+				errs[i] = err
+			}
+			failed = true
 		}
 	}
-
-	return events, nil
+	if failed {
+		return &BatchError{Errs: errs}
+	}
+	return nil
 }
 
-func (c *CassandraStore) joinEvents(evts map[string]struct{}, newEvts map[string]struct{}, needsIntersection bool) map[string]struct{} {
-	if needsIntersection {
-		intersection := make(map[string]struct{})
-		for eID := range newEvts {
-			if _, ok := evts[eID]; ok {
-				intersection[eID] = struct{}{}
-			}
+// cassandraClaimAttempts is how many times a claim of an idempotency key is
+// tried while other writes keep changing the key.
+const cassandraClaimAttempts = 3
+
+// ClaimIdempotencyKey implements DataStore with lightweight transactions on
+// event_by_idempotency_key, which keeps the latest claim of each key until
+// the idempotency window has passed.
+func (c *CassandraStore) ClaimIdempotencyKey(ctx context.Context, key, id string, receivedTime, since int64) (string, error) {
+	ttl := (receivedTime - since) / 1000
+	if ttl < 1 {
+		ttl = 1
+	}
+	for i := 0; i < cassandraClaimAttempts; i++ {
+		row := map[string]interface{}{}
+		applied, err := c.session.ExecCAS(ctx, cass.NewStatement(
+			`INSERT INTO event_by_idempotency_key (idempotency_key, event_id, received_time) VALUES (?, ?, ?) IF NOT EXISTS USING TTL ?`,
+			key, id, receivedTime, ttl), row)
+		if err != nil {
+			return "", errors.Wrap(err, "insert into event_by_idempotency_key")
+		}
+		if applied {
+			return "", nil
+		}
+		holder, _ := row["event_id"].(string)
+		held, _ := row["received_time"].(int64)
+		if held >= since {
+			return holder, nil
+		}
+
+		// the key was claimed before the window, so it is taken over
+		// unless another write takes it over first
+		row = map[string]interface{}{}
+		applied, err = c.session.ExecCAS(ctx, cass.NewStatement(
+			`UPDATE event_by_idempotency_key USING TTL ? SET event_id = ?, received_time = ? WHERE idempotency_key = ? IF received_time = ?`,
+			ttl, id, receivedTime, key, held), row)
+		if err != nil {
+			return "", errors.Wrap(err, "update event_by_idempotency_key")
+		}
+		if applied {
+			return "", nil
 		}
-		return intersection
 	}
-	return newEvts
+	return "", errors.Errorf("idempotency key %q kept changing", key)
+}
+
+// ReleaseIdempotencyKey implements DataStore.
+func (c *CassandraStore) ReleaseIdempotencyKey(ctx context.Context, key, id string) error {
+	_, err := c.session.ExecCAS(ctx, cass.NewStatement(
+		`DELETE FROM event_by_idempotency_key WHERE idempotency_key = ? IF event_id = ?`, key, id), map[string]interface{}{})
+	return errors.Wrap(err, "delete from event_by_idempotency_key")
 }
 
 // FindByID searches cassandra for an event by its id.
 //
-// If includeData is true
-func (c *CassandraStore) FindByID(id string, includeData bool) (*Event, error) {
+// If includeData is true the event's data is read from event_metadata too.
+func (c *CassandraStore) FindByID(ctx context.Context, id string, includeData bool) (*Event, error) {
+	evts, err := c.findByIDs(ctx, []string{id}, includeData)
+	if err != nil || len(evts) == 0 {
+		return nil, err
+	}
+	return evts[0], nil
+}
+
+// FindByIDs returns the events with ids, and their data if includeData is
+// true, reading them like the results of Find. Ids that are not found are
+// left out.
+func (c *CassandraStore) FindByIDs(ctx context.Context, ids []string, includeData bool) (Events, error) {
+	return c.hydrate(ctx, ids, includeData)
+}
+
+// findByIDs reads the events with ids, and their data if includeData is
+// true, with one IN query on each table. Ids that are not found are left
+// out.
+func (c *CassandraStore) findByIDs(ctx context.Context, ids []string, includeData bool) (Events, error) {
+	var evts Events
 	var topicID, dcID gocql.UUID
 	var eventTime, receivedTime int64
 	var eventID, parentEventID, host, user string
 	var targetHostSet, tagSet []string
-	var evt *Event
-	scanIter, closeIter := c.session.ExecIterQuery(
-		fmt.Sprintf(`SELECT event_id, dc_id, event_time, host, parent_event_id, received_time, tag_set, target_host_set, topic_id, user
-			FROM event WHERE event_id=%s LIMIT 1;`, stringify(id)))
-	if scanIter(&eventID, &dcID, &eventTime, &host, &parentEventID, &receivedTime, &tagSet, &targetHostSet, &topicID, &user) {
-		evt = &Event{
+	scanIter, closeIter := c.session.Query(ctx, cass.NewStatement(
+		`SELECT event_id, dc_id, event_time, host, parent_event_id, received_time, tag_set, target_host_set, topic_id, user
+			FROM event WHERE event_id IN ?`, ids))
+	for scanIter(&eventID, &dcID, &eventTime, &host, &parentEventID, &receivedTime, &tagSet, &targetHostSet, &topicID, &user) {
+		evts = append(evts, &Event{
 			EventID:       eventID,
 			ParentEventID: parentEventID,
 			EventTime:     eventTime / 1000,
@@ -170,32 +318,245 @@ func (c *CassandraStore) FindByID(id string, includeData bool) (*Event, error) {
 			TargetHosts:   targetHostSet,
 			User:          user,
 			ReceivedTime:  receivedTime,
+		})
+		// each row starts with empty sets
+		targetHostSet, tagSet = nil, nil
+	}
+	if err := closeIter(); err != nil {
+		return nil, err
+	}
+	if !includeData || len(evts) == 0 {
+		return evts, nil
+	}
+
+	byID := make(map[string]*Event, len(evts))
+	for _, evt := range evts {
+		byID[evt.EventID] = evt
+	}
+	var data string
+	scanIter, closeIter = c.session.Query(ctx, cass.NewStatement(
+		`SELECT event_id, data_json FROM event_metadata WHERE event_id IN ?`, ids))
+	for scanIter(&eventID, &data) {
+		evt, ok := byID[eventID]
+		if !ok || data == "" {
+			continue
+		}
+		if err := json.Unmarshal([]byte(data), &evt.Data); err != nil {
+			closeIter()
+			return nil, errors.Wrap(err, "Error unmarshalling JSON in event data")
 		}
 	}
 	if err := closeIter(); err != nil {
 		return nil, err
 	}
-	if includeData {
-		var data string
-		scanIter, closeIter := c.session.ExecIterQuery(
-			fmt.Sprintf(`SELECT data_json
-			FROM event_metadata WHERE event_id=%s LIMIT 1;`, stringify(id)))
-		if scanIter(&data) {
-			var d map[string]interface{}
-			if data != "" {
-				if err := json.Unmarshal([]byte(data), &d); err != nil {
-					return nil, errors.Wrap(err, "Error unmarshalling JSON in event data")
+	return evts, nil
+}
+
+// hydrate fetches the events with ids in batches of hydrateBatchSize, on up
+// to hydrateConcurrency workers. It gives up at the first failed read, or
+// once ctx is done.
+func (c *CassandraStore) hydrate(ctx context.Context, ids []string, includeData bool) (Events, error) {
+	size := c.hydrateBatchSize
+	if size <= 0 {
+		size = defaultHydrateBatchSize
+	}
+	workers := c.hydrateConcurrency
+	if workers <= 0 {
+		workers = defaultHydrateConcurrency
+	}
+	if n := (len(ids) + size - 1) / size; n < workers {
+		workers = n
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	batches := make(chan []string)
+	go func() {
+		defer close(batches)
+		for start := 0; start < len(ids); start += size {
+			end := start + size
+			if end > len(ids) {
+				end = len(ids)
+			}
+			select {
+			case batches <- ids[start:end]:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var mu sync.Mutex
+	var evts Events
+	var firstErr error
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				found, err := c.findByIDs(ctx, batch, includeData)
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+					cancel()
 				}
+				evts = append(evts, found...)
+				mu.Unlock()
 			}
-			evt.Data = d
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, errors.Wrap(firstErr, "Error reading events")
+	}
+	// a batch may not have been sent because ctx was done
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return evts, nil
+}
+
+// DeleteEvent removes the event from event, event_metadata, every event_by_*
+// table and, if it still points at the event, event_by_idempotency_key.
+//
+// The idempotency key delete is conditional and cannot share a batch, so it
+// is made first; a delete that fails after it can be retried.
+func (c *CassandraStore) DeleteEvent(ctx context.Context, id string) error {
+	evt, err := c.FindByID(ctx, id, false)
+	if err != nil {
+		return errors.Wrap(err, "find event")
+	}
+	if evt == nil {
+		return nil
+	}
+	var key string
+	scanIter, closeIter := c.session.Query(ctx, cass.NewStatement(`SELECT idempotency_key FROM event WHERE event_id = ?`, id))
+	scanIter(&key)
+	if err := closeIter(); err != nil {
+		return errors.Wrap(err, "find idempotency key")
+	}
+	if key != "" {
+		if err := c.session.Exec(ctx, cass.NewStatement(
+			`DELETE FROM event_by_idempotency_key WHERE idempotency_key = ? IF event_id = ?`, key, id)); err != nil {
+			return errors.Wrap(err, "delete from event_by_idempotency_key")
 		}
-		if err := closeIter(); err != nil {
-			return nil, err
+	}
+
+	eventTime := evt.EventTime * 1000
+	date := getDate(evt.EventTime)
+	stmts := []cass.Statement{
+		cass.NewStatement(`DELETE FROM event WHERE event_id = ?`, id),
+		cass.NewStatement(`DELETE FROM event_metadata WHERE event_id = ?`, id),
+		cass.NewStatement(`DELETE FROM event_by_topic_v2 WHERE topic_id = ? AND date = ? AND event_time = ? AND event_id = ?`, evt.TopicID, date, eventTime, id),
+		cass.NewStatement(`DELETE FROM event_by_dc_v2 WHERE dc_id = ? AND date = ? AND event_time = ? AND event_id = ?`, evt.DCID, date, eventTime, id),
+		cass.NewStatement(`DELETE FROM event_by_host_v2 WHERE host = ? AND date = ? AND event_time = ? AND event_id = ?`, strings.ToLower(evt.Host), date, eventTime, id),
+		cass.NewStatement(`DELETE FROM event_by_date_v2 WHERE date = ? AND event_time = ? AND event_id = ?`, date, eventTime, id),
+		cass.NewStatement(`DELETE FROM event_by_received_time WHERE date = ? AND received_time = ? AND event_id = ?`,
+			getDate(evt.ReceivedTime/1000), evt.ReceivedTime, id),
+	}
+	if evt.User != "" {
+		stmts = append(stmts, cass.NewStatement(`DELETE FROM event_by_user_v2 WHERE user = ? AND date = ? AND event_time = ? AND event_id = ?`,
+			strings.ToLower(evt.User), date, eventTime, id))
+	}
+	if evt.ParentEventID != "" {
+		stmts = append(stmts, cass.NewStatement(`DELETE FROM event_by_parent_event_id_v2 WHERE parent_event_id = ? AND date = ? AND event_time = ? AND event_id = ?`,
+			evt.ParentEventID, date, eventTime, id))
+	}
+	for _, tag := range evt.Tags {
+		stmts = append(stmts, cass.NewStatement(`DELETE FROM event_by_tag WHERE tag = ? AND date = ? AND event_time = ? AND event_id = ?`,
+			tag, date, eventTime, id))
+	}
+	for _, th := range evt.TargetHosts {
+		stmts = append(stmts, cass.NewStatement(`DELETE FROM event_by_target_host WHERE target_host = ? AND date = ? AND event_time = ? AND event_id = ?`,
+			th, date, eventTime, id))
+	}
+	return c.session.ExecBatch(ctx, cass.LoggedBatch, stmts)
+}
+
+// UpdateEventData replaces the data of the event with id, keeping whatever
+// TTL the event was written with.
+func (c *CassandraStore) UpdateEventData(ctx context.Context, id string, data map[string]interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return errors.Wrap(err, "Error marshalling event data into json")
+	}
+	var remaining int64
+	scanIter, closeIter := c.session.Query(ctx, cass.NewStatement(
+		`SELECT TTL(data_json) FROM event_metadata WHERE event_id = ?`, id))
+	scanIter(&remaining)
+	if err := closeIter(); err != nil {
+		return errors.Wrap(err, "Error closing iter")
+	}
+	return c.session.Exec(ctx, cass.NewStatement(insertEventMetadataCQL, id, string(b), remaining))
+}
+
+// AddAuditEntry inserts e into event_audit.
+func (c *CassandraStore) AddAuditEntry(ctx context.Context, e AuditEntry) error {
+	return c.session.Exec(ctx, cass.NewStatement(`INSERT INTO event_audit
+		(event_id, audit_id, action, paths, user, reason, audit_time)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		e.EventID, e.ID, e.Action, e.Paths, e.User, e.Reason, e.Time))
+}
+
+// GetAuditEntries returns the entries in event_audit for an event. Audit ids
+// are ksuids, so the clustering order is the order they were added in.
+func (c *CassandraStore) GetAuditEntries(ctx context.Context, eventID string) ([]AuditEntry, error) {
+	scanIter, closeIter := c.session.Query(ctx, cass.NewStatement(
+		`SELECT audit_id, action, paths, user, reason, audit_time FROM event_audit WHERE event_id = ?`, eventID))
+	var entries []AuditEntry
+	for {
+		e := AuditEntry{EventID: eventID}
+		if !scanIter(&e.ID, &e.Action, &e.Paths, &e.User, &e.Reason, &e.Time) {
+			break
+		}
+		entries = append(entries, e)
+	}
+	if err := closeIter(); err != nil {
+		return nil, errors.Wrap(err, "Error closing iter")
+	}
+	return entries, nil
+}
+
+// BackfillIndexes writes the event_by_* rows of every event in the keyspace,
+// keeping each event's remaining TTL, and returns the number of events
+// indexed.
+// progress, if not nil, is called with the running count every
+// backfillProgressEvery events.
+//
+// It reads the whole event table, and is safe to run more than once.
+func (c *CassandraStore) BackfillIndexes(ctx context.Context, progress func(n int)) (int, error) {
+	scanIter, closeIter := c.session.Query(ctx, cass.NewStatement(
+		`SELECT event_id, parent_event_id, dc_id, topic_id, host, user, event_time, received_time, tag_set, target_host_set, TTL(date) FROM event`))
+	n := 0
+	for {
+		evt := &Event{}
+		var topicID, dcID gocql.UUID
+		var ttl int64
+		if !scanIter(&evt.EventID, &evt.ParentEventID, &dcID, &topicID, &evt.Host, &evt.User,
+			&evt.EventTime, &evt.ReceivedTime, &evt.Tags, &evt.TargetHosts, &ttl) {
+			break
 		}
+		evt.TopicID, evt.DCID = topicID.String(), dcID.String()
+		stmts := evt.indexInserts(getDate(evt.EventTime/1000), ttl)
+		if err := c.session.ExecBatch(ctx, cass.UnloggedBatch, stmts); err != nil {
+			closeIter()
+			return n, errors.Wrapf(err, "index event %v", evt.EventID)
+		}
+		n++
+		if progress != nil && n%backfillProgressEvery == 0 {
+			progress(n)
+		}
+	}
+	if err := closeIter(); err != nil {
+		return n, errors.Wrap(err, "Error closing cassandra iter")
 	}
-	return evt, nil
+	return n, nil
 }
 
+// backfillProgressEvery is how often BackfillIndexes reports progress.
+const backfillProgressEvery = 10000
+
 // getDates returns a slice of strings of YYYY-MM-DD for all days between
 // startEventTime and endEventTime.
 func getDates(startEventTime int64, endEventTime int64) ([]string, error) {
@@ -220,218 +581,77 @@ func getDates(startEventTime int64, endEventTime int64) ([]string, error) {
 }
 
 // Find searches using the Query, and filters topicIDs and dcIDs.
-func (c *CassandraStore) Find(q *eventmaster.Query, topicIDs []string, dcIDs []string) (Events, error) {
-	dates, err := getDates(q.StartEventTime, q.EndEventTime)
-	if err != nil {
-		return nil, errors.Wrap(err, "Error getting dates from timestamps")
-	}
-	timeFilter := fmt.Sprintf("event_time >= %d AND event_time <= %d", q.StartEventTime*1000, q.EndEventTime*1000)
+//
+// The candidate events are found by the index reads chosen by plan, then
+// fetched by hydrate and checked against every predicate of q.
+func (c *CassandraStore) Find(ctx context.Context, q *eventmaster.Query, topicIDs []string, dcIDs []string) (Events, error) {
+	return c.find(ctx, q, topicIDs, dcIDs, q.Data != "")
+}
 
-	needsIntersection := false
-	evts := make(map[string]struct{})
-	if len(q.User) > 0 {
-		var users []string
-		for _, user := range q.User {
-			users = append(users, stringify(strings.ToLower(user)))
-		}
-		userEvts, err := c.getFromTable("event_by_user", "user", dates, timeFilter, users)
-		if err != nil {
-			return nil, errors.Wrap(err, "Error getting event ids from cassandra table")
-		}
-		evts = c.joinEvents(evts, userEvts, needsIntersection)
-		if len(evts) == 0 {
-			return nil, nil
-		}
-		needsIntersection = true
-	}
-	if len(q.ParentEventID) > 0 {
-		var parentEventIDs []string
-		for _, peID := range q.ParentEventID {
-			parentEventIDs = append(parentEventIDs, stringify(peID))
-		}
-		peIDEvts, err := c.getFromTable("event_by_parent_event_id", "parent_event_id", dates, timeFilter, parentEventIDs)
-		if err != nil {
-			return nil, errors.Wrap(err, "Error getting event ids from cassandra table")
-		}
-		evts = c.joinEvents(evts, peIDEvts, needsIntersection)
-		if len(evts) == 0 {
-			return nil, nil
-		}
-		needsIntersection = true
+// Aggregate implements DataStore. The candidates are fetched from the event
+// table alone unless agg groups by event data.
+func (c *CassandraStore) Aggregate(ctx context.Context, q *eventmaster.Query, topicIDs []string, dcIDs []string, agg Aggregation) ([]AggregateCount, error) {
+	evts, err := c.find(ctx, q, topicIDs, dcIDs, q.Data != "" || agg.needsData())
+	if err != nil {
+		return nil, err
 	}
-	if len(q.Host) > 0 {
-		var hosts []string
-		for _, host := range q.Host {
-			hosts = append(hosts, stringify(strings.ToLower(host)))
-		}
-		hostEvts, err := c.getFromTable("event_by_host", "host", dates, timeFilter, hosts)
-		if err != nil {
-			return nil, errors.Wrap(err, "Error getting event ids from cassandra table")
-		}
-		evts = c.joinEvents(evts, hostEvts, needsIntersection)
-		if len(evts) == 0 {
-			return nil, nil
-		}
-		needsIntersection = true
+	counter := newAggregateCounter(agg)
+	for _, evt := range evts {
+		counter.add(evt)
 	}
-	if len(topicIDs) > 0 {
-		topicEvts, err := c.getFromTable("event_by_topic", "topic_id", dates, timeFilter, topicIDs)
-		if err != nil {
-			return nil, errors.Wrap(err, "Error getting event ids from cassandra table")
-		}
-		evts = c.joinEvents(evts, topicEvts, needsIntersection)
-		if len(evts) == 0 {
-			return nil, nil
-		}
-		needsIntersection = true
+	return counter.result(), nil
+}
+
+// find returns the events that match q, with their data if includeData is
+// true.
+func (c *CassandraStore) find(ctx context.Context, q *eventmaster.Query, topicIDs []string, dcIDs []string, includeData bool) (Events, error) {
+	p, err := c.plan(ctx, q, topicIDs, dcIDs)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error planning query")
 	}
-	if len(dcIDs) > 0 {
-		dcEvts, err := c.getFromTable("event_by_dc", "dc_id", dates, timeFilter, dcIDs)
-		if err != nil {
-			return nil, errors.Wrap(err, "Error getting event ids from cassandra table")
-		}
-		evts = c.joinEvents(evts, dcEvts, needsIntersection)
-		if len(evts) == 0 {
-			return nil, nil
-		}
-		needsIntersection = true
-	}
-	if !needsIntersection {
-		for _, date := range dates {
-			var eventID string
-			dateFilter := fmt.Sprintf("date = %s", stringify(date))
-			query := fmt.Sprintf(`SELECT event_id FROM %s WHERE %s AND %s LIMIT 200;`,
-				"event_by_date", dateFilter, timeFilter)
-			scanIter, closeIter := c.session.ExecIterQuery(query)
-			for true {
-				if scanIter(&eventID) {
-					evts[eventID] = struct{}{}
-				} else {
-					break
-				}
-			}
-			if err := closeIter(); err != nil {
-				return nil, errors.Wrap(err, "Error closing cassandra iter")
-			}
-		}
+	candidates, err := c.candidates(ctx, p)
+	if err != nil {
+		return nil, err
 	}
-
-	ch := make(chan *Event, len(evts))
-	for eID := range evts {
-		go func(eID string) {
-			evt, err := c.FindByID(eID, false)
-			if err != nil {
-				log.Errorf("Error closing cassandra iter on read: %v", err)
-				ch <- nil
-			} else {
-				ch <- evt
-			}
-		}(eID)
+	matcher, err := newEventMatcher(q, topicIDs, dcIDs)
+	if err != nil {
+		return nil, err
 	}
 
-	eventMap := make(map[string]*Event)
-	for _ = range evts {
-		if evt := <-ch; evt != nil {
-			eventMap[evt.EventID] = evt
-		}
+	ids := make([]string, 0, len(candidates))
+	for id := range candidates {
+		ids = append(ids, id)
 	}
-
-	// filter based on target host and tags
-	if len(q.TargetHostSet) > 0 {
-		targetHosts := make(map[string]struct{})
-		for _, thost := range q.TargetHostSet {
-			targetHosts[thost] = struct{}{}
-		}
-		for eID, evtData := range eventMap {
-			exists := false
-			for _, th := range evtData.TargetHosts {
-				if _, ok := targetHosts[th]; ok {
-					exists = true
-				}
-			}
-			if !exists {
-				delete(eventMap, eID)
-			}
-		}
+	evts, err := c.hydrate(ctx, ids, includeData)
+	if err != nil {
+		return nil, err
 	}
 
-	if len(q.TagSet) > 0 || len(q.ExcludeTagSet) > 0 {
-		tags := make(map[string]struct{})
-		for _, tag := range q.TagSet {
-			tags[tag] = struct{}{}
-		}
-		excludeTags := make(map[string]struct{})
-		for _, tag := range q.ExcludeTagSet {
-			excludeTags[tag] = struct{}{}
-		}
-		andOp := q.TagAndOperator
-		for eID, evtData := range eventMap {
-			deleteEvt := false
-			if andOp {
-				for tag := range tags {
-					tagExists := false
-					for _, t := range evtData.Tags {
-						if tag == t {
-							tagExists = true
-							break
-						}
-					}
-					if !tagExists {
-						deleteEvt = true
-						break
-					}
-				}
-			} else {
-				missingTags := true
-				for _, t := range evtData.Tags {
-					if _, ok := tags[t]; ok {
-						missingTags = false
-						break
-					}
-				}
-				deleteEvt = missingTags
-			}
-
-			if !deleteEvt && len(q.ExcludeTagSet) > 0 {
-				for _, t := range evtData.Tags {
-					if _, ok := excludeTags[t]; ok {
-						deleteEvt = true
-						break
-					}
-				}
-			}
-
-			if deleteEvt {
-				delete(eventMap, eID)
-			}
+	events := Events{}
+	for _, event := range evts {
+		if matcher.matches(event) && matchesTimeWindows(q, event) {
+			events = append(events, event)
 		}
 	}
-
-	var events []*Event
-	for _, event := range eventMap {
-		events = append(events, event)
-	}
 	return events, nil
 }
 
 // FindIDs traverses the temporal space defined by q day by day and calls
 // stream function with each event ID found.
-func (c *CassandraStore) FindIDs(q *eventmaster.TimeQuery, stream HandleEvent) error {
+func (c *CassandraStore) FindIDs(ctx context.Context, q *eventmaster.TimeQuery, stream HandleEvent) error {
 	dates, err := getDates(q.StartEventTime, q.EndEventTime)
 	if err != nil {
 		return errors.Wrap(err, "Error getting dates from start and end time")
 	}
-	timeFilter := fmt.Sprintf("event_time >= %d AND event_time <= %d", q.StartEventTime*1000, q.EndEventTime*1000)
+	// the clustering order cannot be bound, so there is a statement for each
+	cql := `SELECT event_id FROM event_by_date_v2 WHERE date = ? AND event_time >= ? AND event_time <= ? ORDER BY event_time DESC LIMIT ?`
+	if q.Ascending {
+		cql = `SELECT event_id FROM event_by_date_v2 WHERE date = ? AND event_time >= ? AND event_time <= ? ORDER BY event_time ASC LIMIT ?`
+	}
 	for _, date := range dates {
 		var eventID string
-		dateFilter := fmt.Sprintf("date = %s", stringify(date))
-		order := "DESC"
-		if q.Ascending {
-			order = "ASC"
-		}
-		query := fmt.Sprintf(`SELECT event_id FROM %s WHERE %s AND %s ORDER BY event_time %s LIMIT %d;`,
-			"event_by_date", dateFilter, timeFilter, order, q.Limit)
-		scanIter, closeIter := c.session.ExecIterQuery(query)
+		scanIter, closeIter := c.session.Query(ctx, cass.NewStatement(cql,
+			date, q.StartEventTime*1000, q.EndEventTime*1000, q.Limit))
 		for scanIter(&eventID) {
 			if err := stream(eventID); err != nil {
 				closeIter()
@@ -445,23 +665,42 @@ func (c *CassandraStore) FindIDs(q *eventmaster.TimeQuery, stream HandleEvent) e
 	return nil
 }
 
+// CountEvents implements DataStore. It is not supported: counting the events
+// of a topic would scan every partition of event_by_topic_v2 across the
+// cluster, and events past their retention have mostly expired through their
+// TTL already, so the count would say little.
+func (c *CassandraStore) CountEvents(ctx context.Context, topicID string, before int64) (int, error) {
+	return 0, jh.NewError("counting events past retention is not supported on cassandra, where they expire through their TTL", http.StatusNotImplemented)
+}
+
+// PurgeEvents implements DataStore. Events are written with a TTL derived
+// from their topic's retention, so Cassandra expires them itself and there
+// is nothing to do here. Events written before a retention was set or
+// shortened keep their original TTL.
+func (c *CassandraStore) PurgeEvents(ctx context.Context, topicID string, before int64) (int, error) {
+	return 0, nil
+}
+
 // GetTopics returns all topics.
-func (c *CassandraStore) GetTopics() ([]Topic, error) {
-	scanIter, closeIter := c.session.ExecIterQuery("SELECT topic_id, topic_name, data_schema FROM event_topic;")
+func (c *CassandraStore) GetTopics(ctx context.Context) ([]Topic, error) {
+	scanIter, closeIter := c.session.Query(ctx, cass.NewStatement(
+		`SELECT topic_id, topic_name, data_schema, retention_seconds FROM event_topic`))
 	var topicID gocql.UUID
 	var name, schema string
+	var retention int64
 	var topics []Topic
 	for {
-		if scanIter(&topicID, &name, &schema) {
+		if scanIter(&topicID, &name, &schema, &retention) {
 			var s map[string]interface{}
 			err := json.Unmarshal([]byte(schema), &s)
 			if err != nil {
 				return nil, errors.Wrap(err, "Error unmarshalling schema")
 			}
 			topics = append(topics, Topic{
-				ID:     topicID.String(),
-				Name:   name,
-				Schema: s,
+				ID:               topicID.String(),
+				Name:             name,
+				Schema:           s,
+				RetentionSeconds: retention,
 			})
 		} else {
 			break
@@ -474,33 +713,30 @@ func (c *CassandraStore) GetTopics() ([]Topic, error) {
 }
 
 // AddTopic inserts t into event_topic.
-func (c *CassandraStore) AddTopic(t RawTopic) error {
-	queryStr := fmt.Sprintf(`INSERT INTO event_topic
-		(topic_id, topic_name, data_schema)
-		VALUES (%[1]s, %[2]s, %[3]s);`,
-		t.ID, stringify(t.Name), stringify(t.Schema))
-
-	return c.session.ExecQuery(queryStr)
+func (c *CassandraStore) AddTopic(ctx context.Context, t RawTopic) error {
+	return c.session.Exec(ctx, cass.NewStatement(`INSERT INTO event_topic
+		(topic_id, topic_name, data_schema, retention_seconds)
+		VALUES (?, ?, ?, ?)`,
+		t.ID, t.Name, t.Schema, t.RetentionSeconds))
 }
 
 // UpdateTopic performs a cql update with t aginst event_topic table.
-func (c *CassandraStore) UpdateTopic(t RawTopic) error {
-	queryStr := fmt.Sprintf(`UPDATE event_topic SET
-		topic_name=%s,
-		data_schema=%s
-		WHERE topic_id=%s;`, stringify(t.Name), stringify(t.Schema), t.ID)
-	return c.session.ExecQuery(queryStr)
+func (c *CassandraStore) UpdateTopic(ctx context.Context, t RawTopic) error {
+	return c.session.Exec(ctx, cass.NewStatement(`UPDATE event_topic SET
+		topic_name = ?,
+		data_schema = ?,
+		retention_seconds = ?
+		WHERE topic_id = ?`, t.Name, t.Schema, t.RetentionSeconds, t.ID))
 }
 
 // DeleteTopic removes the topic with the given id.
-func (c *CassandraStore) DeleteTopic(id string) error {
-	return c.session.ExecQuery(fmt.Sprintf(`DELETE FROM event_topic WHERE topic_id=%[1]s;`,
-		id))
+func (c *CassandraStore) DeleteTopic(ctx context.Context, id string) error {
+	return c.session.Exec(ctx, cass.NewStatement(`DELETE FROM event_topic WHERE topic_id = ?`, id))
 }
 
 // GetDCs returns all entries from the event_dc table.
-func (c *CassandraStore) GetDCs() ([]DC, error) {
-	scanIter, closeIter := c.session.ExecIterQuery("SELECT dc_id, dc FROM event_dc;")
+func (c *CassandraStore) GetDCs(ctx context.Context) ([]DC, error) {
+	scanIter, closeIter := c.session.Query(ctx, cass.NewStatement(`SELECT dc_id, dc FROM event_dc`))
 	var id gocql.UUID
 	var dc string
 	var dcs []DC
@@ -521,20 +757,80 @@ func (c *CassandraStore) GetDCs() ([]DC, error) {
 }
 
 // AddDC inserts dc into the event_dc table.
-func (c *CassandraStore) AddDC(dc DC) error {
-	queryStr := fmt.Sprintf(`INSERT INTO event_dc 
+func (c *CassandraStore) AddDC(ctx context.Context, dc DC) error {
+	return c.session.Exec(ctx, cass.NewStatement(`INSERT INTO event_dc
 		(dc_id, dc)
-		VALUES (%[1]s, %[2]s);`,
-		dc.ID, stringify(dc.Name))
-
-	return c.session.ExecQuery(queryStr)
+		VALUES (?, ?)`,
+		dc.ID, dc.Name))
 }
 
 // UpdateDC replaces the name for a given DC by id.
-func (c *CassandraStore) UpdateDC(id string, newName string) error {
-	queryStr := fmt.Sprintf(`UPDATE event_dc SET dc=%s WHERE dc_id=%s;`,
-		stringify(newName), id)
-	return c.session.ExecQuery(queryStr)
+func (c *CassandraStore) UpdateDC(ctx context.Context, id string, newName string) error {
+	return c.session.Exec(ctx, cass.NewStatement(`UPDATE event_dc SET dc = ? WHERE dc_id = ?`, newName, id))
+}
+
+// GetRules returns the rules in the event_rule table.
+func (c *CassandraStore) GetRules(ctx context.Context) ([]Rule, error) {
+	scanIter, closeIter := c.session.Query(ctx, cass.NewStatement(`SELECT rule_json FROM event_rule`))
+	var rules []Rule
+	var ruleJSON string
+	for scanIter(&ruleJSON) {
+		var r Rule
+		if err := json.Unmarshal([]byte(ruleJSON), &r); err != nil {
+			closeIter()
+			return nil, errors.Wrap(err, "json unmarshal rule")
+		}
+		rules = append(rules, r)
+	}
+	if err := closeIter(); err != nil {
+		return nil, errors.Wrap(err, "Error closing iter")
+	}
+	return rules, nil
+}
+
+// PutRule inserts r into the event_rule table.
+func (c *CassandraStore) PutRule(ctx context.Context, r Rule) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return errors.Wrap(err, "json marshal rule")
+	}
+	return c.session.Exec(ctx, cass.NewStatement(`INSERT INTO event_rule (rule_id, rule_json) VALUES (?, ?)`,
+		r.ID, string(b)))
+}
+
+// DeleteRule removes the rule with id from event_rule and its state from
+// event_rule_state.
+func (c *CassandraStore) DeleteRule(ctx context.Context, id string) error {
+	return c.session.ExecBatch(ctx, cass.LoggedBatch, []cass.Statement{
+		cass.NewStatement(`DELETE FROM event_rule WHERE rule_id = ?`, id),
+		cass.NewStatement(`DELETE FROM event_rule_state WHERE rule_id = ?`, id),
+	})
+}
+
+// GetRuleState returns the state of the rule with id from event_rule_state.
+func (c *CassandraStore) GetRuleState(ctx context.Context, id string) (RuleState, error) {
+	scanIter, closeIter := c.session.Query(ctx, cass.NewStatement(
+		`SELECT state_json FROM event_rule_state WHERE rule_id = ?`, id))
+	var state RuleState
+	var stateJSON string
+	found := scanIter(&stateJSON)
+	if err := closeIter(); err != nil {
+		return state, errors.Wrap(err, "Error closing iter")
+	}
+	if !found {
+		return state, nil
+	}
+	return state, errors.Wrap(json.Unmarshal([]byte(stateJSON), &state), "json unmarshal rule state")
+}
+
+// SaveRuleState inserts the state of the rule with id into event_rule_state.
+func (c *CassandraStore) SaveRuleState(ctx context.Context, id string, state RuleState) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return errors.Wrap(err, "json marshal rule state")
+	}
+	return c.session.Exec(ctx, cass.NewStatement(`INSERT INTO event_rule_state (rule_id, state_json) VALUES (?, ?)`,
+		id, string(b)))
 }
 
 // CloseSession closes the underlying session.
@@ -0,0 +1,146 @@
+package cassandra
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// Batch is a batch of statements recorded by FakeSession.
+type Batch struct {
+	Kind       BatchKind
+	Statements []Statement
+}
+
+// FakeSession is a Session used in testing. It records the statements it is
+// given and answers queries with the rows returned by Rows. Like CQLSession,
+// it fails statements whose context is done.
+type FakeSession struct {
+	// Rows, if set, returns the rows for a query. Each row is scanned into
+	// the destinations in order, so its values must have the same types.
+	Rows func(stmt Statement) [][]interface{}
+	// Err, if set, returns the error for executing a statement.
+	Err func(stmt Statement) error
+	// CAS, if set, returns whether a conditional statement is applied and,
+	// if not, the current values of the row. Unset, every one is applied.
+	CAS func(stmt Statement) (bool, map[string]interface{})
+
+	mu      sync.Mutex
+	stmts   []Statement
+	batches []Batch
+}
+
+// Exec implements Session.
+func (s *FakeSession) Exec(ctx context.Context, stmt Statement) error {
+	s.mu.Lock()
+	s.stmts = append(s.stmts, stmt)
+	s.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if s.Err != nil {
+		return s.Err(stmt)
+	}
+	return nil
+}
+
+// ExecCAS implements Session.
+func (s *FakeSession) ExecCAS(ctx context.Context, stmt Statement, dest map[string]interface{}) (bool, error) {
+	if err := s.Exec(ctx, stmt); err != nil {
+		return false, err
+	}
+	if s.CAS == nil {
+		return true, nil
+	}
+	applied, row := s.CAS(stmt)
+	for k, v := range row {
+		dest[k] = v
+	}
+	return applied, nil
+}
+
+// Query implements Session.
+func (s *FakeSession) Query(ctx context.Context, stmt Statement) (ScanIter, CloseIter) {
+	s.mu.Lock()
+	s.stmts = append(s.stmts, stmt)
+	s.mu.Unlock()
+
+	var rows [][]interface{}
+	err := ctx.Err()
+	if s.Rows != nil && err == nil {
+		rows = s.Rows(stmt)
+	}
+	return func(dest ...interface{}) bool {
+			if len(rows) == 0 || err != nil {
+				return false
+			}
+			row := rows[0]
+			rows = rows[1:]
+			if len(row) != len(dest) {
+				err = fmt.Errorf("row has %d values, scanning into %d", len(row), len(dest))
+				return false
+			}
+			for i, v := range row {
+				if v == nil {
+					continue
+				}
+				reflect.ValueOf(dest[i]).Elem().Set(reflect.ValueOf(v))
+			}
+			return true
+		}, func() error {
+			return err
+		}
+}
+
+// ExecBatch implements Session.
+func (s *FakeSession) ExecBatch(ctx context.Context, kind BatchKind, stmts []Statement) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stmts = append(s.stmts, stmts...)
+	s.batches = append(s.batches, Batch{Kind: kind, Statements: stmts})
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if s.Err != nil {
+		for _, stmt := range stmts {
+			if err := s.Err(stmt); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Close implements Session.
+func (s *FakeSession) Close() {}
+
+// Statements returns every statement executed or queried so far, including
+// those in batches.
+func (s *FakeSession) Statements() []Statement {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Statement(nil), s.stmts...)
+}
+
+// LastStatement returns the most recent statement, or the zero Statement if
+// there has been none.
+func (s *FakeSession) LastStatement() Statement {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.stmts) == 0 {
+		return Statement{}
+	}
+	return s.stmts[len(s.stmts)-1]
+}
+
+// LastBatch returns the most recent batch, or the zero Batch if there has
+// been none.
+func (s *FakeSession) LastBatch() Batch {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.batches) == 0 {
+		return Batch{}
+	}
+	return s.batches[len(s.batches)-1]
+}
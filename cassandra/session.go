@@ -1,16 +1,46 @@
 package cassandra
 
 import (
+	"context"
 	"time"
 
 	"github.com/gocql/gocql"
 )
 
+// Statement is a CQL statement with ? markers and the values bound to them.
+// Values are never interpolated into the CQL text.
+type Statement struct {
+	CQL    string
+	Values []interface{}
+}
+
+// NewStatement returns a Statement that binds values to the markers in cql.
+func NewStatement(cql string, values ...interface{}) Statement {
+	return Statement{CQL: cql, Values: values}
+}
+
+// BatchKind selects how a batch of statements is applied.
+type BatchKind int
+
+// Batch kinds, see the cassandra documentation on BATCH.
+const (
+	LoggedBatch BatchKind = iota
+	UnloggedBatch
+)
+
 // Session is an interface that describes the surface area of interacting with
 // a cassandra store.
+//
+// Statements are abandoned, and their iterators return ctx.Err() when
+// closed, once ctx is done.
 type Session interface {
-	ExecQuery(string) error
-	ExecIterQuery(query string) (ScanIter, CloseIter)
+	Exec(ctx context.Context, stmt Statement) error
+	// ExecCAS executes a conditional statement, reporting whether it was
+	// applied. If it was not, the current values of the row are stored in
+	// dest by column name.
+	ExecCAS(ctx context.Context, stmt Statement, dest map[string]interface{}) (bool, error)
+	Query(ctx context.Context, stmt Statement) (ScanIter, CloseIter)
+	ExecBatch(ctx context.Context, kind BatchKind, stmts []Statement) error
 	Close()
 }
 
@@ -19,19 +49,26 @@ type CQLSession struct {
 	session *gocql.Session
 }
 
-// ScanIter defines the function type returned from ExecIterQuery.
+// ScanIter defines the function type returned from Query.
 type ScanIter func(...interface{}) bool
 
-// CloseIter is a type returned from ExecIterQuery. When used it wraps the
-// close of the underlying iterator.
+// CloseIter is a type returned from Query. When used it wraps the close of
+// the underlying iterator.
 type CloseIter func() error
 
 // NewCQLSession returns a populated CQLSession struct, or an error using the
 // underlying cassandra driver.
-func NewCQLSession(ips []string, keyspace string, consistency string, timeout string) (*CQLSession, error) {
+//
+// Every statement is prepared the first time it is used on a connection and
+// then kept in the driver's statement cache, which holds up to maxPrepared
+// statements; 0 keeps the driver's default.
+func NewCQLSession(ips []string, keyspace string, consistency string, timeout string, maxPrepared int) (*CQLSession, error) {
 	cluster := gocql.NewCluster(ips...)
 	cluster.Keyspace = keyspace
 	cluster.Consistency = gocql.ParseConsistency(consistency)
+	if maxPrepared > 0 {
+		cluster.MaxPreparedStmts = maxPrepared
+	}
 	var err error
 	cluster.Timeout, err = time.ParseDuration(timeout)
 	if err != nil {
@@ -48,15 +85,20 @@ func NewCQLSession(ips []string, keyspace string, consistency string, timeout st
 	}, nil
 }
 
-// ExecQuery executes the provided query against the underlying cassandra
+// Exec executes the provided statement against the underlying cassandra
 // session.
-func (s *CQLSession) ExecQuery(query string) error {
-	return s.session.Query(query).Exec()
+func (s *CQLSession) Exec(ctx context.Context, stmt Statement) error {
+	return s.session.Query(stmt.CQL, stmt.Values...).WithContext(ctx).Exec()
+}
+
+// ExecCAS implements Session.
+func (s *CQLSession) ExecCAS(ctx context.Context, stmt Statement, dest map[string]interface{}) (bool, error) {
+	return s.session.Query(stmt.CQL, stmt.Values...).WithContext(ctx).MapScanCAS(dest)
 }
 
-// ExecIterQuery performs an iterated query against the underlying session.
-func (s *CQLSession) ExecIterQuery(query string) (ScanIter, CloseIter) {
-	iter := s.session.Query(query).Iter()
+// Query performs an iterated query against the underlying session.
+func (s *CQLSession) Query(ctx context.Context, stmt Statement) (ScanIter, CloseIter) {
+	iter := s.session.Query(stmt.CQL, stmt.Values...).WithContext(ctx).Iter()
 
 	return func(dest ...interface{}) bool {
 			return iter.Scan(dest...)
@@ -65,37 +107,20 @@ func (s *CQLSession) ExecIterQuery(query string) (ScanIter, CloseIter) {
 		}
 }
 
+// ExecBatch applies stmts in a single batch of the given kind.
+func (s *CQLSession) ExecBatch(ctx context.Context, kind BatchKind, stmts []Statement) error {
+	typ := gocql.LoggedBatch
+	if kind == UnloggedBatch {
+		typ = gocql.UnloggedBatch
+	}
+	b := s.session.NewBatch(typ).WithContext(ctx)
+	for _, stmt := range stmts {
+		b.Query(stmt.CQL, stmt.Values...)
+	}
+	return s.session.ExecuteBatch(b)
+}
+
 // Close closes the underlying cassandra session.
 func (s *CQLSession) Close() {
 	s.session.Close()
 }
-
-// MockCassSession is used in testing.
-type MockCassSession struct {
-	query string
-}
-
-// ExecQuery implements the interface for testing.
-func (s *MockCassSession) ExecQuery(query string) error {
-	s.query = query
-	return nil
-}
-
-// ExecIterQuery implements the interface for testing.
-func (s *MockCassSession) ExecIterQuery(query string) (ScanIter, CloseIter) {
-	s.query = query
-	return func(dest ...interface{}) bool {
-			return false
-		},
-		func() error {
-			return nil
-		}
-}
-
-// Close implements the interface for testing.
-func (s *MockCassSession) Close() {}
-
-// LastQuery is used during tests to validate the generated query.
-func (s *MockCassSession) LastQuery() string {
-	return s.query
-}
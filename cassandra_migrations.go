@@ -0,0 +1,413 @@
+package eventmaster
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	cass "github.com/ContextLogic/eventmaster/cassandra"
+)
+
+// cassMigration is a single, numbered change to the Cassandra keyspace.
+//
+// Migrations are applied in order by migrateCassandra and recorded in the
+// schema_migrations table. Once released a migration must never be edited;
+// add a new one instead. Statements must be safe to run against a keyspace
+// that already has the change, since keyspaces that were set up by hand have
+// no record of what they contain.
+type cassMigration struct {
+	Version     int
+	Description string
+	Statements  []string
+}
+
+var cassandraMigrations = []cassMigration{
+	{
+		Version:     1,
+		Description: "create event, topic and dc tables",
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS event (
+				event_id text,
+				parent_event_id text,
+				dc_id uuid,
+				topic_id uuid,
+				host text,
+				target_host_set set<text>,
+				user text,
+				event_time timestamp,
+				tag_set set<text>,
+				received_time timestamp,
+				date text,
+				PRIMARY KEY (event_id)
+			)`,
+			`CREATE TABLE IF NOT EXISTS event_metadata (
+				event_id text,
+				data_json text,
+				PRIMARY KEY (event_id)
+			)`,
+			`CREATE TABLE IF NOT EXISTS event_by_topic (
+				event_id text,
+				topic_id uuid,
+				event_time timestamp,
+				date text,
+				PRIMARY KEY ((topic_id, date), event_time)
+			) WITH CLUSTERING ORDER BY (event_time DESC)`,
+			`CREATE TABLE IF NOT EXISTS event_by_dc (
+				event_id text,
+				dc_id uuid,
+				event_time timestamp,
+				date text,
+				PRIMARY KEY ((dc_id, date), event_time)
+			) WITH CLUSTERING ORDER BY (event_time DESC)`,
+			`CREATE TABLE IF NOT EXISTS event_by_host (
+				event_id text,
+				host text,
+				event_time timestamp,
+				date text,
+				PRIMARY KEY ((host, date), event_time)
+			) WITH CLUSTERING ORDER BY (event_time DESC)`,
+			`CREATE TABLE IF NOT EXISTS event_by_user (
+				event_id text,
+				user text,
+				event_time timestamp,
+				date text,
+				PRIMARY KEY ((user, date), event_time)
+			) WITH CLUSTERING ORDER BY (event_time DESC)`,
+			`CREATE TABLE IF NOT EXISTS event_by_parent_event_id (
+				event_id text,
+				parent_event_id text,
+				event_time timestamp,
+				date text,
+				PRIMARY KEY ((parent_event_id, date), event_time)
+			) WITH CLUSTERING ORDER BY (event_time DESC)`,
+			`CREATE TABLE IF NOT EXISTS event_by_date (
+				event_id text,
+				event_time timestamp,
+				date text,
+				PRIMARY KEY (date, event_time)
+			) WITH CLUSTERING ORDER BY (event_time DESC)`,
+			`CREATE TABLE IF NOT EXISTS event_topic (
+				topic_id uuid,
+				topic_name text,
+				data_schema text,
+				PRIMARY KEY (topic_id)
+			)`,
+			`CREATE TABLE IF NOT EXISTS event_dc (
+				dc_id uuid,
+				dc text,
+				PRIMARY KEY (dc_id)
+			)`,
+		},
+	},
+	{
+		Version:     2,
+		Description: "add event idempotency keys",
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS event_by_idempotency_key (
+				idempotency_key text,
+				event_id text,
+				received_time timestamp,
+				PRIMARY KEY (idempotency_key)
+			)`,
+		},
+	},
+	{
+		Version:     3,
+		Description: "add topic retention",
+		Statements: []string{
+			`ALTER TABLE event_topic ADD retention_seconds bigint`,
+		},
+	},
+	{
+		Version:     4,
+		Description: "create event audit table",
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS event_audit (
+				event_id text,
+				audit_id text,
+				action text,
+				paths set<text>,
+				user text,
+				reason text,
+				audit_time timestamp,
+				PRIMARY KEY (event_id, audit_id)
+			)`,
+		},
+	},
+	{
+		// run `eventmaster backfill` to index events added before this
+		Version:     5,
+		Description: "create tag and target host index tables",
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS event_by_tag (
+				event_id text,
+				tag text,
+				event_time timestamp,
+				date text,
+				PRIMARY KEY ((tag, date), event_time, event_id)
+			) WITH CLUSTERING ORDER BY (event_time DESC, event_id ASC)`,
+			`CREATE TABLE IF NOT EXISTS event_by_target_host (
+				event_id text,
+				target_host text,
+				event_time timestamp,
+				date text,
+				PRIMARY KEY ((target_host, date), event_time, event_id)
+			) WITH CLUSTERING ORDER BY (event_time DESC, event_id ASC)`,
+		},
+	},
+	{
+		// run `eventmaster backfill` to index events added before this
+		Version:     6,
+		Description: "create received time index table",
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS event_by_received_time (
+				event_id text,
+				received_time timestamp,
+				date text,
+				PRIMARY KEY (date, received_time, event_id)
+			) WITH CLUSTERING ORDER BY (received_time DESC, event_id ASC)`,
+		},
+	},
+	{
+		Version:     7,
+		Description: "create rule tables",
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS event_rule (
+				rule_id text,
+				rule_json text,
+				PRIMARY KEY (rule_id)
+			)`,
+			`CREATE TABLE IF NOT EXISTS event_rule_state (
+				rule_id text,
+				state_json text,
+				PRIMARY KEY (rule_id)
+			)`,
+		},
+	},
+	{
+		// deleting an event added before this leaves its idempotency key
+		// to expire
+		Version:     8,
+		Description: "record the idempotency key of events",
+		Statements: []string{
+			`ALTER TABLE event ADD idempotency_key text`,
+		},
+	},
+	{
+		// run `eventmaster backfill` to index events added before this. The
+		// index tables of migration 1 keep one event per second and are
+		// dropped in migration 10.
+		Version:     9,
+		Description: "add event id to the clustering key of the index tables",
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS event_by_topic_v2 (
+				event_id text,
+				topic_id uuid,
+				event_time timestamp,
+				date text,
+				PRIMARY KEY ((topic_id, date), event_time, event_id)
+			) WITH CLUSTERING ORDER BY (event_time DESC, event_id ASC)`,
+			`CREATE TABLE IF NOT EXISTS event_by_dc_v2 (
+				event_id text,
+				dc_id uuid,
+				event_time timestamp,
+				date text,
+				PRIMARY KEY ((dc_id, date), event_time, event_id)
+			) WITH CLUSTERING ORDER BY (event_time DESC, event_id ASC)`,
+			`CREATE TABLE IF NOT EXISTS event_by_host_v2 (
+				event_id text,
+				host text,
+				event_time timestamp,
+				date text,
+				PRIMARY KEY ((host, date), event_time, event_id)
+			) WITH CLUSTERING ORDER BY (event_time DESC, event_id ASC)`,
+			`CREATE TABLE IF NOT EXISTS event_by_user_v2 (
+				event_id text,
+				user text,
+				event_time timestamp,
+				date text,
+				PRIMARY KEY ((user, date), event_time, event_id)
+			) WITH CLUSTERING ORDER BY (event_time DESC, event_id ASC)`,
+			`CREATE TABLE IF NOT EXISTS event_by_parent_event_id_v2 (
+				event_id text,
+				parent_event_id text,
+				event_time timestamp,
+				date text,
+				PRIMARY KEY ((parent_event_id, date), event_time, event_id)
+			) WITH CLUSTERING ORDER BY (event_time DESC, event_id ASC)`,
+			`CREATE TABLE IF NOT EXISTS event_by_date_v2 (
+				event_id text,
+				event_time timestamp,
+				date text,
+				PRIMARY KEY (date, event_time, event_id)
+			) WITH CLUSTERING ORDER BY (event_time DESC, event_id ASC)`,
+		},
+	},
+	{
+		// the backfill reads the event table, so it still works after this;
+		// stop any eventmaster from before migration 9 first, since it reads
+		// these tables
+		Version:     10,
+		Description: "drop the index tables replaced in migration 9",
+		Statements: []string{
+			`DROP TABLE IF EXISTS event_by_topic`,
+			`DROP TABLE IF EXISTS event_by_dc`,
+			`DROP TABLE IF EXISTS event_by_host`,
+			`DROP TABLE IF EXISTS event_by_user`,
+			`DROP TABLE IF EXISTS event_by_parent_event_id`,
+			`DROP TABLE IF EXISTS event_by_date`,
+		},
+	},
+}
+
+// CassandraReplication is the replication of the eventmaster keyspace, used
+// when it is created by MigrateCassandra.
+type CassandraReplication struct {
+	// Class is SimpleStrategy or NetworkTopologyStrategy.
+	Class string `json:"class"`
+	// Factor is the replication factor for SimpleStrategy.
+	Factor int `json:"replication_factor"`
+	// DCs is the replication factor of each data center for
+	// NetworkTopologyStrategy.
+	DCs map[string]int `json:"dcs"`
+}
+
+var cqlIdentifier = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_]*$`)
+
+// createKeyspaceCQL returns the statement that creates keyspace with
+// replication r. Neither can be bound, so both are validated instead.
+func createKeyspaceCQL(keyspace string, r CassandraReplication) (string, error) {
+	if !cqlIdentifier.MatchString(keyspace) {
+		return "", errors.Errorf("invalid keyspace name %q", keyspace)
+	}
+	var opts []string
+	switch r.Class {
+	case "", "SimpleStrategy":
+		factor := r.Factor
+		if factor == 0 {
+			factor = 1
+		}
+		if factor < 0 {
+			return "", errors.Errorf("invalid replication factor %d", factor)
+		}
+		opts = []string{"'class': 'SimpleStrategy'", fmt.Sprintf("'replication_factor': %d", factor)}
+	case "NetworkTopologyStrategy":
+		if len(r.DCs) == 0 {
+			return "", errors.New("NetworkTopologyStrategy needs the replication factor of at least one dc")
+		}
+		opts = []string{"'class': 'NetworkTopologyStrategy'"}
+		var dcs []string
+		for dc := range r.DCs {
+			dcs = append(dcs, dc)
+		}
+		sort.Strings(dcs)
+		for _, dc := range dcs {
+			if dc == "" || strings.ContainsAny(dc, `'"\`) {
+				return "", errors.Errorf("invalid dc name %q", dc)
+			}
+			if r.DCs[dc] < 0 {
+				return "", errors.Errorf("invalid replication factor %d for dc %v", r.DCs[dc], dc)
+			}
+			opts = append(opts, fmt.Sprintf("'%s': %d", dc, r.DCs[dc]))
+		}
+	default:
+		return "", errors.Errorf("unknown replication class %q", r.Class)
+	}
+	return fmt.Sprintf("CREATE KEYSPACE IF NOT EXISTS %s WITH REPLICATION = {%s}",
+		keyspace, strings.Join(opts, ", ")), nil
+}
+
+// alreadyApplied reports whether err is Cassandra refusing a schema change
+// because the keyspace already has it.
+func alreadyApplied(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "already exist") || strings.Contains(msg, "conflicts with an existing column")
+}
+
+// appliedCassandraMigrations returns the versions recorded in
+// schema_migrations.
+func appliedCassandraMigrations(ctx context.Context, s cass.Session) (map[int]bool, error) {
+	applied := map[int]bool{}
+	scanIter, closeIter := s.Query(ctx, cass.NewStatement(`SELECT version FROM schema_migrations`))
+	var v int
+	for scanIter(&v) {
+		applied[v] = true
+	}
+	if err := closeIter(); err != nil {
+		return nil, errors.Wrap(err, "select schema_migrations")
+	}
+	return applied, nil
+}
+
+// migrateCassandra applies every migration in migrations that has not yet
+// been recorded in the schema_migrations table, returning the versions it
+// applied.
+func migrateCassandra(ctx context.Context, s cass.Session, migrations []cassMigration) ([]int, error) {
+	if err := s.Exec(ctx, cass.NewStatement(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version int PRIMARY KEY,
+		description text,
+		applied_at timestamp
+	)`)); err != nil {
+		return nil, errors.Wrap(err, "create schema_migrations")
+	}
+	applied, err := appliedCassandraMigrations(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []int
+	for _, m := range migrations {
+		if applied[m.Version] {
+			continue
+		}
+		log.Infof("applying cassandra migration %d: %v", m.Version, m.Description)
+		for _, stmt := range m.Statements {
+			if err := s.Exec(ctx, cass.NewStatement(stmt)); err != nil {
+				if !alreadyApplied(err) {
+					return versions, errors.Wrapf(err, "migration %d", m.Version)
+				}
+				log.Infof("skipping statement of migration %d: %v", m.Version, err)
+			}
+		}
+		if err := s.Exec(ctx, cass.NewStatement(
+			`INSERT INTO schema_migrations (version, description, applied_at) VALUES (?, ?, ?)`,
+			m.Version, m.Description, time.Now())); err != nil {
+			return versions, errors.Wrapf(err, "record migration %d", m.Version)
+		}
+		versions = append(versions, m.Version)
+	}
+	return versions, nil
+}
+
+// MigrateCassandra creates the keyspace described by c if it does not exist
+// and brings its tables up to date, returning the versions of the migrations
+// it applied. The replication of an existing keyspace is left alone.
+func MigrateCassandra(ctx context.Context, c CassandraConfig) ([]int, error) {
+	ksCQL, err := createKeyspaceCQL(c.Keyspace, c.Replication)
+	if err != nil {
+		return nil, err
+	}
+	ips := cassandraIPs(c)
+	s, err := cass.NewCQLSession(ips, "", c.Consistency, c.Timeout, c.MaxPreparedStatements)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error creating cassandra session")
+	}
+	err = s.Exec(ctx, cass.NewStatement(ksCQL))
+	s.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "create keyspace")
+	}
+
+	s, err = cass.NewCQLSession(ips, c.Keyspace, c.Consistency, c.Timeout, c.MaxPreparedStatements)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error creating cassandra session")
+	}
+	defer s.Close()
+	return migrateCassandra(ctx, s, cassandraMigrations)
+}
@@ -0,0 +1,325 @@
+package eventmaster
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/pkg/errors"
+
+	cass "github.com/ContextLogic/eventmaster/cassandra"
+	eventmaster "github.com/ContextLogic/eventmaster/proto"
+)
+
+const (
+	// plannerSampleDays is the most days of a query's window that are read
+	// to estimate how many events match a predicate.
+	plannerSampleDays = 3
+	// plannerSampleLimit caps the rows read from an index for one sampled
+	// day, so estimates are lower bounds for very common values.
+	plannerSampleLimit = 1000
+	// plannerFetchCost is the cost of fetching a candidate event by id,
+	// relative to reading one index row. Another index is only scanned if
+	// reading it is expected to be cheaper than fetching the candidates it
+	// would rule out.
+	plannerFetchCost = 10
+)
+
+// Plan step operations.
+const (
+	// PlanScan reads the ids of an index into the candidate set.
+	PlanScan = "scan"
+	// PlanIntersect keeps only the candidates that are also in an index.
+	PlanIntersect = "intersect"
+	// PlanExclude removes the candidates that are in an index.
+	PlanExclude = "exclude"
+)
+
+// PlanStep is one index read of a QueryPlan.
+type PlanStep struct {
+	Op     string   `json:"op"`
+	Index  string   `json:"index"`
+	Values []string `json:"values,omitempty"`
+	// Estimate is the estimated number of events in the query window that
+	// are in the index with one of Values.
+	Estimate int `json:"estimate"`
+
+	column string
+	window *planWindow
+}
+
+// planWindow is the time range a step reads: the date partitions and the
+// bounds, in ms, on the index's time column.
+type planWindow struct {
+	column     string
+	dates      []string
+	start, end int64
+}
+
+// newPlanWindow returns the window on column between start and end, which
+// are in ms.
+func newPlanWindow(column string, start, end int64) (*planWindow, error) {
+	dates, err := getDates(start/1000, end/1000)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error getting dates from timestamps")
+	}
+	return &planWindow{column: column, dates: dates, start: start, end: end}, nil
+}
+
+// QueryPlan describes how CassandraStore.Find answers a query: the index
+// reads that produce the candidate events, in order, and the predicates
+// that are checked on each candidate after it has been fetched.
+type QueryPlan struct {
+	Steps []PlanStep `json:"steps"`
+	// Filters are the predicates left to check on fetched events.
+	Filters []string `json:"filters,omitempty"`
+	// Candidates is the estimated number of events that will be fetched.
+	Candidates int `json:"candidates"`
+	// Days is the most date partitions any step reads.
+	Days int `json:"days"`
+}
+
+// predicates returns the index lookups that can answer q within the event
+// time window w. A set matched with an AND operator becomes one predicate per
+// value.
+func predicates(q *eventmaster.Query, topicIDs []string, dcIDs []string, w *planWindow) (include []PlanStep, exclude []PlanStep) {
+	add := func(index, column string, values []string, and bool) {
+		if len(values) == 0 {
+			return
+		}
+		if !and {
+			include = append(include, PlanStep{Index: index, column: column, Values: values, window: w})
+			return
+		}
+		for _, v := range values {
+			include = append(include, PlanStep{Index: index, column: column, Values: []string{v}, window: w})
+		}
+	}
+	add("event_by_user_v2", "user", lowerAll(q.User), false)
+	add("event_by_parent_event_id_v2", "parent_event_id", q.ParentEventID, false)
+	add("event_by_host_v2", "host", lowerAll(q.Host), false)
+	add("event_by_tag", "tag", q.TagSet, q.TagAndOperator)
+	add("event_by_target_host", "target_host", q.TargetHostSet, q.TargetHostAndOperator)
+	add("event_by_topic_v2", "topic_id", topicIDs, false)
+	add("event_by_dc_v2", "dc_id", dcIDs, false)
+	if len(q.ExcludeTagSet) > 0 {
+		exclude = append(exclude, PlanStep{Op: PlanExclude, Index: "event_by_tag", column: "tag", Values: q.ExcludeTagSet, window: w})
+	}
+	return include, exclude
+}
+
+// sampleDates returns up to plannerSampleDays of dates, spread over them.
+func sampleDates(dates []string) []string {
+	if len(dates) <= plannerSampleDays {
+		return dates
+	}
+	var r []string
+	for i := 0; i < plannerSampleDays; i++ {
+		r = append(r, dates[i*(len(dates)-1)/(plannerSampleDays-1)])
+	}
+	return r
+}
+
+// indexStatement returns the statement that reads the ids in the index of
+// step on date, within the window of step. Steps without values read every
+// id in the window.
+func indexStatement(step PlanStep, date string) cass.Statement {
+	w := step.window
+	if len(step.Values) == 0 {
+		return cass.NewStatement(
+			fmt.Sprintf(`SELECT event_id FROM %s WHERE date = ? AND %s >= ? AND %s <= ?`, step.Index, w.column, w.column),
+			date, w.start, w.end)
+	}
+	return cass.NewStatement(
+		fmt.Sprintf(`SELECT event_id FROM %s WHERE %s IN ? AND date = ? AND %s >= ? AND %s <= ?`,
+			step.Index, step.column, w.column, w.column),
+		step.Values, date, w.start, w.end)
+}
+
+// estimate returns the estimated number of events in the window of step
+// that it matches, by counting a capped number of index rows on a sample of
+// the days and extrapolating to the rest.
+func (c *CassandraStore) estimate(ctx context.Context, step PlanStep) (int, error) {
+	dates := step.window.dates
+	sample := sampleDates(dates)
+	n := 0
+	for _, date := range sample {
+		stmt := indexStatement(step, date)
+		stmt.CQL += " LIMIT ?"
+		stmt.Values = append(stmt.Values, plannerSampleLimit)
+		scanIter, closeIter := c.session.Query(ctx, stmt)
+		var id string
+		for scanIter(&id) {
+			n++
+		}
+		if err := closeIter(); err != nil {
+			return 0, errors.Wrap(err, "Error closing cassandra iter")
+		}
+	}
+	if len(sample) == 0 {
+		return 0, nil
+	}
+	return n * len(dates) / len(sample), nil
+}
+
+// filterName is how step is listed in QueryPlan.Filters when it is left to
+// be checked on fetched events.
+func filterName(step PlanStep) string {
+	name := step.column
+	if step.Op == PlanExclude {
+		name = "not " + name
+	}
+	return name
+}
+
+// plan estimates the selectivity of each predicate in q and orders the index
+// reads from the most selective. Predicates whose index is too large to be
+// worth reading are left as filters.
+//
+// The event_by_* indexes are partitioned by the date of the event time, so
+// they are only read when q has an event time window. A received time window
+// is read from event_by_received_time.
+func (c *CassandraStore) plan(ctx context.Context, q *eventmaster.Query, topicIDs []string, dcIDs []string) (*QueryPlan, error) {
+	p := &QueryPlan{}
+	var include, exclude []PlanStep
+	var windows []*planWindow
+	if hasEventTimeWindow(q) {
+		w, err := newPlanWindow("event_time", q.StartEventTime*1000, q.EndEventTime*1000)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, w)
+		if include, exclude = predicates(q, topicIDs, dcIDs, w); len(include) == 0 {
+			// no index narrows the window, so every event in it is a candidate
+			include = []PlanStep{{Index: "event_by_date_v2", column: "event_time", window: w}}
+		}
+	} else {
+		// without an event time window the predicates can only be filters
+		in, ex := predicates(q, topicIDs, dcIDs, nil)
+		for _, step := range append(in, ex...) {
+			p.Filters = append(p.Filters, filterName(step))
+		}
+	}
+	if hasReceivedTimeWindow(q) {
+		w, err := newPlanWindow("received_time", q.StartReceivedTime, q.EndReceivedTime)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, w)
+		include = append(include, PlanStep{Index: "event_by_received_time", column: "received_time", window: w})
+	}
+	if len(include) == 0 {
+		return nil, errors.New("query has no event time or received time window")
+	}
+	for _, w := range windows {
+		if len(w.dates) > p.Days {
+			p.Days = len(w.dates)
+		}
+	}
+
+	for _, steps := range [][]PlanStep{include, exclude} {
+		for i := range steps {
+			var err error
+			if steps[i].Estimate, err = c.estimate(ctx, steps[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	sort.SliceStable(include, func(i, j int) bool {
+		return include[i].Estimate < include[j].Estimate
+	})
+
+	include[0].Op = PlanScan
+	p.Steps = []PlanStep{include[0]}
+	p.Candidates = include[0].Estimate
+	rest := append(append([]PlanStep{}, include[1:]...), exclude...)
+	for _, step := range rest {
+		if step.Estimate >= plannerFetchCost*p.Candidates {
+			// a step that only reads a window is listed with the windows
+			if len(step.Values) > 0 {
+				p.Filters = append(p.Filters, filterName(step))
+			}
+			continue
+		}
+		if step.Op == "" {
+			step.Op = PlanIntersect
+			if step.Estimate < p.Candidates {
+				p.Candidates = step.Estimate
+			}
+		}
+		p.Steps = append(p.Steps, step)
+	}
+	// a window none of the steps read is checked on the fetched events
+	for _, w := range windows {
+		read := false
+		for _, step := range p.Steps {
+			read = read || step.window == w
+		}
+		if !read {
+			p.Filters = append(p.Filters, w.column)
+		}
+	}
+	if q.Data != "" {
+		p.Filters = append(p.Filters, "data")
+	}
+	return p, nil
+}
+
+// scanIndex calls fn with the id of every event in the window of step that
+// it matches.
+func (c *CassandraStore) scanIndex(ctx context.Context, step PlanStep, fn func(id string)) error {
+	for _, date := range step.window.dates {
+		// no LIMIT: the driver pages through the partition, truncating here
+		// would silently drop matching events.
+		scanIter, closeIter := c.session.Query(ctx, indexStatement(step, date))
+		var id string
+		for scanIter(&id) {
+			fn(id)
+		}
+		if err := closeIter(); err != nil {
+			return errors.Wrap(err, "Error closing cassandra iter")
+		}
+	}
+	return nil
+}
+
+// candidates runs the steps of p and returns the ids of the events that
+// satisfy all of them. Only the first scan is held in full; each later step
+// streams its index and keeps or drops candidates as it goes.
+func (c *CassandraStore) candidates(ctx context.Context, p *QueryPlan) (map[string]struct{}, error) {
+	var ids map[string]struct{}
+	for _, step := range p.Steps {
+		var err error
+		switch step.Op {
+		case PlanScan:
+			ids = make(map[string]struct{})
+			err = c.scanIndex(ctx, step, func(id string) {
+				ids[id] = struct{}{}
+			})
+		case PlanIntersect:
+			kept := make(map[string]struct{})
+			err = c.scanIndex(ctx, step, func(id string) {
+				if _, ok := ids[id]; ok {
+					kept[id] = struct{}{}
+				}
+			})
+			ids = kept
+		case PlanExclude:
+			err = c.scanIndex(ctx, step, func(id string) {
+				delete(ids, id)
+			})
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error reading %v", step.Index)
+		}
+		if len(ids) == 0 {
+			return nil, nil
+		}
+	}
+	return ids, nil
+}
+
+// Explain returns the plan Find would use for q, without running it.
+func (c *CassandraStore) Explain(ctx context.Context, q *eventmaster.Query, topicIDs []string, dcIDs []string) (*QueryPlan, error) {
+	return c.plan(ctx, q, topicIDs, dcIDs)
+}
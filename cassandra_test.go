@@ -0,0 +1,621 @@
+package eventmaster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/ContextLogic/eventmaster/cassandra"
+	"github.com/ContextLogic/eventmaster/jh"
+	eventmaster "github.com/ContextLogic/eventmaster/proto"
+)
+
+func TestCassandraFindBindsValues(t *testing.T) {
+	fs := &cassandra.FakeSession{}
+	c := &CassandraStore{session: fs}
+
+	// 2017-06-12 23:00 to 2017-06-13 01:00 UTC spans two days
+	q := &eventmaster.Query{
+		User:           []string{"Robert'); DROP TABLE event;--"},
+		Host:           []string{"Host1", "host2"},
+		StartEventTime: 1497308400,
+		EndEventTime:   1497315600,
+	}
+	if _, err := c.Find(context.Background(), q, []string{"9a0b4d3c-6c3e-4b1a-8f5e-2d0c4f1e7a61"}, nil); err != nil {
+		t.Fatalf("find: %v", err)
+	}
+
+	// after estimating each index, the first of the equally selective
+	// indexes is scanned and, finding nothing, ends the query
+	stmts := fs.Statements()
+	if got, want := len(stmts), 8; got != want {
+		t.Fatalf("statements: got %v, want %v", got, want)
+	}
+	for i, date := range []string{"2017-06-13", "2017-06-12"} {
+		want := cassandra.NewStatement(
+			`SELECT event_id FROM event_by_user_v2 WHERE user IN ? AND date = ? AND event_time >= ? AND event_time <= ?`,
+			[]string{"robert'); drop table event;--"}, date, int64(1497308400000), int64(1497315600000))
+		assert.Equal(t, want, stmts[6+i])
+	}
+}
+
+func TestCassandraClaimIdempotencyKey(t *testing.T) {
+	tests := []struct {
+		name  string
+		held  int64 // received time of the current holder, 0 for none
+		want  string
+		stmts []cassandra.Statement
+	}{
+		{
+			name: "free",
+			stmts: []cassandra.Statement{
+				cassandra.NewStatement(`INSERT INTO event_by_idempotency_key (idempotency_key, event_id, received_time) VALUES (?, ?, ?) IF NOT EXISTS USING TTL ?`,
+					"build-1", "b", int64(5000), int64(4)),
+			},
+		},
+		{
+			name: "held",
+			held: 2000,
+			want: "a",
+			stmts: []cassandra.Statement{
+				cassandra.NewStatement(`INSERT INTO event_by_idempotency_key (idempotency_key, event_id, received_time) VALUES (?, ?, ?) IF NOT EXISTS USING TTL ?`,
+					"build-1", "b", int64(5000), int64(4)),
+			},
+		},
+		{
+			name: "held before the window",
+			held: 500,
+			stmts: []cassandra.Statement{
+				cassandra.NewStatement(`INSERT INTO event_by_idempotency_key (idempotency_key, event_id, received_time) VALUES (?, ?, ?) IF NOT EXISTS USING TTL ?`,
+					"build-1", "b", int64(5000), int64(4)),
+				cassandra.NewStatement(`UPDATE event_by_idempotency_key USING TTL ? SET event_id = ?, received_time = ? WHERE idempotency_key = ? IF received_time = ?`,
+					int64(4), "b", int64(5000), "build-1", int64(500)),
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fs := &cassandra.FakeSession{
+				CAS: func(stmt cassandra.Statement) (bool, map[string]interface{}) {
+					if test.held == 0 || strings.HasPrefix(stmt.CQL, "UPDATE") {
+						return true, nil
+					}
+					return false, map[string]interface{}{"idempotency_key": "build-1", "event_id": "a", "received_time": test.held}
+				},
+			}
+			c := &CassandraStore{session: fs}
+			got, err := c.ClaimIdempotencyKey(context.Background(), "build-1", "b", 5000, 1000)
+			if err != nil {
+				t.Fatalf("claim idempotency key: %v", err)
+			}
+			if got != test.want {
+				t.Fatalf("holder: got %q, want %q", got, test.want)
+			}
+			assert.Equal(t, test.stmts, fs.Statements())
+		})
+	}
+}
+
+func TestCassandraDeleteEvent(t *testing.T) {
+	topicID, dcID := gocql.TimeUUID(), gocql.TimeUUID()
+	fs := &cassandra.FakeSession{
+		Rows: func(stmt cassandra.Statement) [][]interface{} {
+			switch {
+			case strings.HasPrefix(stmt.CQL, "SELECT event_id, dc_id"):
+				return [][]interface{}{{
+					"abc", dcID, int64(1497309509000), "Host1", "", int64(1497309510000),
+					[]string{"deploy"}, nil, topicID, "Jane",
+				}}
+			case strings.HasPrefix(stmt.CQL, "SELECT idempotency_key"):
+				return [][]interface{}{{"build-1"}}
+			}
+			return nil
+		},
+	}
+	c := &CassandraStore{session: fs}
+	if err := c.DeleteEvent(context.Background(), "abc"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	date, ms := "2017-06-12", int64(1497309509000)
+	var conditional []cassandra.Statement
+	for _, stmt := range fs.Statements() {
+		if strings.HasPrefix(stmt.CQL, "DELETE") && strings.Contains(stmt.CQL, " IF ") {
+			conditional = append(conditional, stmt)
+		}
+	}
+	// the idempotency key is only deleted if it still points at the event
+	assert.Equal(t, []cassandra.Statement{cassandra.NewStatement(
+		`DELETE FROM event_by_idempotency_key WHERE idempotency_key = ? IF event_id = ?`, "build-1", "abc")}, conditional)
+
+	b := fs.LastBatch()
+	if got, want := b.Kind, cassandra.LoggedBatch; got != want {
+		t.Fatalf("batch kind: got %v, want %v", got, want)
+	}
+	got := map[string][]interface{}{}
+	for _, stmt := range b.Statements {
+		got[strings.Fields(stmt.CQL)[2]] = stmt.Values
+	}
+	want := map[string][]interface{}{
+		"event":                  {"abc"},
+		"event_metadata":         {"abc"},
+		"event_by_topic_v2":      {topicID.String(), date, ms, "abc"},
+		"event_by_dc_v2":         {dcID.String(), date, ms, "abc"},
+		"event_by_host_v2":       {"host1", date, ms, "abc"},
+		"event_by_date_v2":       {date, ms, "abc"},
+		"event_by_user_v2":       {"jane", date, ms, "abc"},
+		"event_by_tag":           {"deploy", date, ms, "abc"},
+		"event_by_received_time": {date, int64(1497309510000), "abc"},
+	}
+	assert.Equal(t, want, got)
+}
+
+func TestCassandraFindTags(t *testing.T) {
+	index := map[string][][]interface{}{
+		"a": {{"1"}, {"2"}},
+		"b": {{"2"}, {"3"}},
+		"x": {{"4"}},
+	}
+	fs := &cassandra.FakeSession{
+		Rows: func(stmt cassandra.Statement) [][]interface{} {
+			if !strings.Contains(stmt.CQL, "FROM event_by_tag") && !strings.Contains(stmt.CQL, "FROM event_by_target_host") {
+				return nil
+			}
+			var rows [][]interface{}
+			for _, v := range stmt.Values[0].([]string) {
+				rows = append(rows, index[v]...)
+			}
+			return rows
+		},
+	}
+	c := &CassandraStore{session: fs}
+
+	tests := []struct {
+		name string
+		q    *eventmaster.Query
+		want []string
+	}{
+		{"any tag", &eventmaster.Query{TagSet: []string{"a", "b"}}, []string{"1", "2", "3"}},
+		{"all tags", &eventmaster.Query{TagSet: []string{"a", "b"}, TagAndOperator: true}, []string{"2"}},
+		{"all target hosts", &eventmaster.Query{TargetHostSet: []string{"a", "b"}, TargetHostAndOperator: true}, []string{"2"}},
+		{"tags and target hosts", &eventmaster.Query{TagSet: []string{"a"}, TargetHostSet: []string{"b"}}, []string{"2"}},
+		{"exclude", &eventmaster.Query{TagSet: []string{"a", "x"}, ExcludeTagSet: []string{"b"}}, []string{"1", "4"}},
+		{"none", &eventmaster.Query{TagSet: []string{"x"}, TargetHostSet: []string{"a"}}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.q.StartEventTime, test.q.EndEventTime = 1497309509, 1497309509
+			evts := map[string]struct{}{}
+			before := len(fs.Statements())
+			if _, err := c.Find(context.Background(), test.q, nil, nil); err != nil {
+				t.Fatalf("find: %v", err)
+			}
+			// the candidates are fetched by id after the index lookups
+			for _, stmt := range fs.Statements()[before:] {
+				if strings.HasPrefix(stmt.CQL, "SELECT event_id, dc_id") {
+					for _, id := range stmt.Values[0].([]string) {
+						evts[id] = struct{}{}
+					}
+				}
+			}
+			var got []string
+			for _, id := range []string{"1", "2", "3", "4"} {
+				if _, ok := evts[id]; ok {
+					got = append(got, id)
+				}
+			}
+			assert.Equal(t, test.want, got)
+		})
+	}
+}
+
+func TestCassandraBackfillIndexes(t *testing.T) {
+	topicID, dcID := gocql.TimeUUID(), gocql.TimeUUID()
+	fs := &cassandra.FakeSession{
+		Rows: func(stmt cassandra.Statement) [][]interface{} {
+			return [][]interface{}{
+				{"b", "", dcID, topicID, "h", "", int64(1497309509000), int64(1497309600000), nil, nil, nil},
+				{"a", "b", dcID, topicID, "h", "jane", int64(1497309509000), int64(1497398400000),
+					[]string{"deploy"}, []string{"web1"}, int64(60)},
+			}
+		},
+	}
+	c := &CassandraStore{session: fs}
+	n, err := c.BackfillIndexes(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("backfill: %v", err)
+	}
+	if got, want := n, 2; got != want {
+		t.Fatalf("indexed: got %v, want %v", got, want)
+	}
+	date, ms := "2017-06-12", int64(1497309509000)
+	want := []cassandra.Statement{
+		cassandra.NewStatement(insertEventByTopicCQL, "a", topicID.String(), ms, date, int64(60)),
+		cassandra.NewStatement(insertEventByDCCQL, "a", dcID.String(), ms, date, int64(60)),
+		cassandra.NewStatement(insertEventByHostCQL, "a", "h", ms, date, int64(60)),
+		cassandra.NewStatement(insertEventByDateCQL, "a", ms, date, int64(60)),
+		cassandra.NewStatement(insertEventByUserCQL, "a", "jane", ms, date, int64(60)),
+		cassandra.NewStatement(insertEventByParentCQL, "a", "b", ms, date, int64(60)),
+		cassandra.NewStatement(insertEventByReceivedCQL, "a", int64(1497398400000), "2017-06-14", int64(60)),
+		cassandra.NewStatement(insertEventByTagCQL, "a", "deploy", ms, date, int64(60)),
+		cassandra.NewStatement(insertEventByTargetCQL, "a", "web1", ms, date, int64(60)),
+	}
+	assert.Equal(t, want, fs.LastBatch().Statements)
+}
+
+func TestCassandraMigrationsOrdered(t *testing.T) {
+	for i, m := range cassandraMigrations {
+		if got, want := m.Version, i+1; got != want {
+			t.Fatalf("migration %d has version %d, want %d", i, got, want)
+		}
+		if len(m.Statements) == 0 {
+			t.Fatalf("migration %d has no statements", m.Version)
+		}
+	}
+}
+
+func TestMigrateCassandra(t *testing.T) {
+	fs := &cassandra.FakeSession{
+		Rows: func(stmt cassandra.Statement) [][]interface{} {
+			if stmt.CQL == "SELECT version FROM schema_migrations" {
+				return [][]interface{}{{1}}
+			}
+			return nil
+		},
+		Err: func(stmt cassandra.Statement) error {
+			if strings.HasPrefix(stmt.CQL, "ALTER TABLE t ADD") {
+				return errors.New("Invalid column name c because it conflicts with an existing column")
+			}
+			if stmt.CQL == "broken" {
+				return errors.New("syntax error")
+			}
+			return nil
+		},
+	}
+	migrations := []cassMigration{
+		{Version: 1, Statements: []string{"CREATE TABLE a"}},
+		{Version: 2, Description: "add c", Statements: []string{"ALTER TABLE t ADD c int", "CREATE TABLE b"}},
+		{Version: 3, Statements: []string{"broken"}},
+	}
+	applied, err := migrateCassandra(context.Background(), fs, migrations)
+	if err == nil {
+		t.Fatalf("expected error from migration 3")
+	}
+	assert.Equal(t, []int{2}, applied)
+
+	stmts := fs.Statements()
+	wantPrefixes := []string{
+		"CREATE TABLE IF NOT EXISTS schema_migrations",
+		"SELECT version FROM schema_migrations",
+		"ALTER TABLE t ADD c int",
+		"CREATE TABLE b",
+		"INSERT INTO schema_migrations",
+		"broken",
+	}
+	if len(stmts) != len(wantPrefixes) {
+		t.Fatalf("got %d statements, want %d: %v", len(stmts), len(wantPrefixes), stmts)
+	}
+	for i, prefix := range wantPrefixes {
+		if !strings.HasPrefix(stmts[i].CQL, prefix) {
+			t.Fatalf("statement %d: got %q, want %q", i, stmts[i].CQL, prefix)
+		}
+	}
+	assert.Equal(t, []interface{}{2, "add c"}, stmts[4].Values[:2])
+}
+
+func TestCreateKeyspaceCQL(t *testing.T) {
+	tests := []struct {
+		keyspace string
+		r        CassandraReplication
+		want     string
+	}{
+		{"event_master", CassandraReplication{},
+			"CREATE KEYSPACE IF NOT EXISTS event_master WITH REPLICATION = {'class': 'SimpleStrategy', 'replication_factor': 1}"},
+		{"em", CassandraReplication{Class: "SimpleStrategy", Factor: 3},
+			"CREATE KEYSPACE IF NOT EXISTS em WITH REPLICATION = {'class': 'SimpleStrategy', 'replication_factor': 3}"},
+		{"em", CassandraReplication{Class: "NetworkTopologyStrategy", DCs: map[string]int{"us-west": 2, "us-east": 3}},
+			"CREATE KEYSPACE IF NOT EXISTS em WITH REPLICATION = {'class': 'NetworkTopologyStrategy', 'us-east': 3, 'us-west': 2}"},
+		{"em; DROP", CassandraReplication{}, ""},
+		{"em", CassandraReplication{Class: "NetworkTopologyStrategy"}, ""},
+		{"em", CassandraReplication{Class: "NetworkTopologyStrategy", DCs: map[string]int{"a'": 1}}, ""},
+		{"em", CassandraReplication{Class: "LocalStrategy"}, ""},
+	}
+	for _, test := range tests {
+		got, err := createKeyspaceCQL(test.keyspace, test.r)
+		if test.want == "" {
+			if err == nil {
+				t.Fatalf("%v %+v: expected error, got %v", test.keyspace, test.r, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v %+v: %v", test.keyspace, test.r, err)
+		}
+		if got != test.want {
+			t.Fatalf("got %v, want %v", got, test.want)
+		}
+	}
+}
+
+func TestCassandraPlan(t *testing.T) {
+	// rows per day in each index
+	sizes := map[string]int{
+		"event_by_host_v2":  5,
+		"event_by_topic_v2": 40,
+		"event_by_dc_v2":    2000,
+		"event_by_tag":      30,
+	}
+	fs := &cassandra.FakeSession{
+		Rows: func(stmt cassandra.Statement) [][]interface{} {
+			n := sizes[strings.Fields(stmt.CQL)[3]]
+			if limit, ok := stmt.Values[len(stmt.Values)-1].(int); ok && n > limit {
+				n = limit
+			}
+			rows := make([][]interface{}, n)
+			for i := range rows {
+				rows[i] = []interface{}{"id"}
+			}
+			return rows
+		},
+	}
+	c := &CassandraStore{session: fs}
+
+	// ten days, of which three are sampled
+	q := &eventmaster.Query{
+		Host:           []string{"h"},
+		ExcludeTagSet:  []string{"t"},
+		Data:           `{"a": 1}`,
+		StartEventTime: 1497309509,
+		EndEventTime:   1497309509 + 9*24*3600,
+	}
+	p, err := c.Explain(context.Background(), q, []string{"topic"}, []string{"dc"})
+	if err != nil {
+		t.Fatalf("explain: %v", err)
+	}
+	want := &QueryPlan{
+		Steps: []PlanStep{
+			{Op: PlanScan, Index: "event_by_host_v2", Values: []string{"h"}, Estimate: 50, column: "host"},
+			{Op: PlanIntersect, Index: "event_by_topic_v2", Values: []string{"topic"}, Estimate: 400, column: "topic_id"},
+			{Op: PlanExclude, Index: "event_by_tag", Values: []string{"t"}, Estimate: 300, column: "tag"},
+		},
+		Filters:    []string{"dc_id", "data"},
+		Candidates: 50,
+		Days:       10,
+	}
+	for i := range p.Steps {
+		p.Steps[i].window = nil
+	}
+	assert.Equal(t, want, p)
+	for _, stmt := range fs.Statements() {
+		if !strings.HasSuffix(stmt.CQL, "LIMIT ?") {
+			t.Fatalf("explain ran more than the estimates: %v", stmt.CQL)
+		}
+	}
+}
+
+func TestCassandraPlanReceivedTime(t *testing.T) {
+	// rows per day in each index
+	sizes := map[string]int{
+		"event_by_received_time": 20,
+		"event_by_host_v2":       5,
+		"event_by_date_v2":       1000,
+	}
+	fs := &cassandra.FakeSession{
+		Rows: func(stmt cassandra.Statement) [][]interface{} {
+			n := sizes[strings.Fields(stmt.CQL)[3]]
+			if limit, ok := stmt.Values[len(stmt.Values)-1].(int); ok && n > limit {
+				n = limit
+			}
+			rows := make([][]interface{}, n)
+			for i := range rows {
+				rows[i] = []interface{}{"id"}
+			}
+			return rows
+		},
+	}
+	c := &CassandraStore{session: fs}
+
+	tests := []struct {
+		label string
+		q     *eventmaster.Query
+		steps []string
+		want  []string
+	}{
+		{
+			label: "received only",
+			q:     &eventmaster.Query{Host: []string{"h"}, StartReceivedTime: 1497309509000, EndReceivedTime: 1497309809000},
+			steps: []string{"event_by_received_time"},
+			want:  []string{"host"},
+		},
+		{
+			label: "received and event",
+			q: &eventmaster.Query{StartReceivedTime: 1497309509000, EndReceivedTime: 1497309809000,
+				StartEventTime: 1497309509, EndEventTime: 1497309809},
+			steps: []string{"event_by_received_time"},
+			want:  []string{"event_time"},
+		},
+		{
+			label: "received and selective event index",
+			q: &eventmaster.Query{Host: []string{"h"}, StartReceivedTime: 1497309509000, EndReceivedTime: 1497309809000,
+				StartEventTime: 1497309509, EndEventTime: 1497309809},
+			steps: []string{"event_by_host_v2", "event_by_received_time"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.label, func(t *testing.T) {
+			p, err := c.Explain(context.Background(), test.q, nil, nil)
+			if err != nil {
+				t.Fatalf("explain: %v", err)
+			}
+			var steps []string
+			for _, step := range p.Steps {
+				steps = append(steps, step.Index)
+			}
+			assert.Equal(t, test.steps, steps)
+			assert.Equal(t, test.want, p.Filters)
+		})
+	}
+
+	stmt := indexStatement(PlanStep{Index: "event_by_received_time", window: &planWindow{column: "received_time", start: 1, end: 2}}, "2017-06-12")
+	if got, want := stmt.CQL, "SELECT event_id FROM event_by_received_time WHERE date = ? AND received_time >= ? AND received_time <= ?"; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestExplainHTTP(t *testing.T) {
+	tests := []struct {
+		label  string
+		ds     DataStore
+		query  string
+		status int
+	}{
+		{"cassandra", NewNoOpDataStore(), "start_event_time=1497309509&end_event_time=1497309609", http.StatusOK},
+		{"no times", NewNoOpDataStore(), "", http.StatusBadRequest},
+		{"unsupported", &mockDataStore{}, "start_event_time=1497309509&end_event_time=1497309609", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.label, func(t *testing.T) {
+			store, err := GetTestEventStore(test.ds)
+			if err != nil {
+				t.Fatalf("creating event store: %v", err)
+			}
+			ts := httptest.NewServer(NewServer(store, "", ""))
+			defer ts.Close()
+
+			resp, err := http.Get(fmt.Sprintf("%s/v1/event?explain=true&%s", ts.URL, test.query))
+			if err != nil {
+				t.Fatalf("get: %v", err)
+			}
+			defer resp.Body.Close()
+			if got, want := resp.StatusCode, test.status; got != want {
+				t.Fatalf("bad status: got %v, want %v", got, want)
+			}
+			if resp.StatusCode != http.StatusOK {
+				return
+			}
+			var r struct {
+				Plan QueryPlan `json:"plan"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if got, want := len(r.Plan.Steps), 1; got != want {
+				t.Fatalf("bad number of steps: got %v, want %v", got, want)
+			}
+			if got, want := r.Plan.Steps[0].Index, "event_by_date_v2"; got != want {
+				t.Fatalf("bad index: got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestCassandraHydrate(t *testing.T) {
+	var mu sync.Mutex
+	var inFlight, maxInFlight int
+	fs := &cassandra.FakeSession{
+		Rows: func(stmt cassandra.Statement) [][]interface{} {
+			mu.Lock()
+			inFlight++
+			if inFlight > maxInFlight {
+				maxInFlight = inFlight
+			}
+			mu.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+
+			var rows [][]interface{}
+			for _, id := range stmt.Values[0].([]string) {
+				if strings.Contains(stmt.CQL, "FROM event_metadata") {
+					rows = append(rows, []interface{}{id, `{"n": 1}`})
+					continue
+				}
+				rows = append(rows, []interface{}{
+					id, gocql.TimeUUID(), int64(1497309509000), "host1", "", int64(1497309510000),
+					nil, nil, gocql.TimeUUID(), "",
+				})
+			}
+			return rows
+		},
+	}
+	c := &CassandraStore{session: fs, hydrateConcurrency: 2, hydrateBatchSize: 50}
+
+	var ids []string
+	for i := 0; i < 120; i++ {
+		ids = append(ids, fmt.Sprintf("%03d", i))
+	}
+	evts, err := c.hydrate(context.Background(), ids, true)
+	if err != nil {
+		t.Fatalf("hydrate: %v", err)
+	}
+	if got, want := len(evts), len(ids); got != want {
+		t.Fatalf("events: got %v, want %v", got, want)
+	}
+	for _, evt := range evts {
+		if got, want := evt.Data["n"], 1.0; got != want {
+			t.Fatalf("data of %v: got %v, want %v", evt.EventID, got, want)
+		}
+	}
+	// a query on event and on event_metadata for each batch of 50
+	if got, want := len(fs.Statements()), 6; got != want {
+		t.Fatalf("statements: got %v, want %v", got, want)
+	}
+	if maxInFlight > 2 {
+		t.Fatalf("concurrent reads: got %v, want at most 2", maxInFlight)
+	}
+}
+
+func TestCassandraFindCanceled(t *testing.T) {
+	fs := &cassandra.FakeSession{}
+	c := &CassandraStore{session: fs}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	q := &eventmaster.Query{StartEventTime: 1497309509, EndEventTime: 1497309509}
+	if _, err := c.Find(ctx, q, nil, nil); errors.Cause(err) != context.Canceled {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+	if got, want := len(fs.Statements()), 1; got != want {
+		t.Fatalf("statements: got %v, want %v", got, want)
+	}
+}
+
+func TestQueryTimeout(t *testing.T) {
+	fs := &cassandra.FakeSession{
+		Rows: func(stmt cassandra.Statement) [][]interface{} {
+			time.Sleep(20 * time.Millisecond)
+			return nil
+		},
+	}
+	store, err := GetTestEventStore(&CassandraStore{session: fs})
+	if err != nil {
+		t.Fatalf("creating event store: %v", err)
+	}
+	store.SetQueryTimeout(time.Millisecond)
+
+	q := &eventmaster.Query{StartEventTime: 1497309509, EndEventTime: 1497309509}
+	_, _, err = store.Find(context.Background(), q)
+	herr, ok := err.(jh.Error)
+	if !ok {
+		t.Fatalf("got %v, want a jh.Error", err)
+	}
+	if got, want := herr.Status(), http.StatusGatewayTimeout; got != want {
+		t.Fatalf("bad status: got %v, want %v", got, want)
+	}
+	if got, want := status.Code(contextStatus(err)), codes.DeadlineExceeded; got != want {
+		t.Fatalf("grpc code: got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/pkg/errors"
+
+	"github.com/ContextLogic/eventmaster"
+	pb "github.com/ContextLogic/eventmaster/proto"
+)
+
+const applyUsage = `emctl apply -f <dir|file> [--dry-run] [--prune]`
+
+// manifest is the contents of one manifest file. It may declare dcs, topics
+// or both:
+//
+//	dcs:
+//	  - us-east-1
+//	topics:
+//	  - name: deploy
+//	    retention: 2160h
+//	    schema:
+//	      type: object
+//	      properties:
+//	        service: {type: string}
+type manifest struct {
+	DCs    []string        `json:"dcs"`
+	Topics []manifestTopic `json:"topics"`
+}
+
+type manifestTopic struct {
+	Name   string                 `json:"name"`
+	Schema map[string]interface{} `json:"schema"`
+	// Retention is a duration such as "720h"; empty or "0" keeps events
+	// forever.
+	Retention string `json:"retention"`
+
+	retentionSecs int64
+}
+
+// loadManifests reads and merges every .yaml, .yml and .json file under path,
+// which may also be a single file. Names are lower cased, as they are by
+// eventmaster, and declaring the same dc or topic twice is an error.
+func loadManifests(path string) (*manifest, error) {
+	var files []string
+	err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		switch strings.ToLower(filepath.Ext(p)) {
+		case ".yaml", ".yml", ".json":
+			if !info.IsDir() {
+				files = append(files, p)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "finding manifests")
+	}
+	if len(files) == 0 {
+		return nil, errors.Errorf("no manifests found in %v", path)
+	}
+
+	r := &manifest{}
+	dcs := map[string]string{}
+	topics := map[string]string{}
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading manifest")
+		}
+		var m manifest
+		if err := yaml.Unmarshal(b, &m); err != nil {
+			return nil, errors.Wrapf(err, "parsing %v", f)
+		}
+		for _, dc := range m.DCs {
+			dc = strings.ToLower(dc)
+			if prev, ok := dcs[dc]; ok {
+				return nil, errors.Errorf("dc %q declared in both %v and %v", dc, prev, f)
+			}
+			dcs[dc] = f
+			r.DCs = append(r.DCs, dc)
+		}
+		for _, t := range m.Topics {
+			if t.Name == "" {
+				return nil, errors.Errorf("topic without a name in %v", f)
+			}
+			t.Name = strings.ToLower(t.Name)
+			if t.Retention != "" {
+				if t.retentionSecs, err = parseRetention(t.Retention); err != nil {
+					return nil, errors.Wrapf(err, "topic %q in %v", t.Name, f)
+				}
+			}
+			if prev, ok := topics[t.Name]; ok {
+				return nil, errors.Errorf("topic %q declared in both %v and %v", t.Name, prev, f)
+			}
+			topics[t.Name] = f
+			r.Topics = append(r.Topics, t)
+		}
+	}
+	return r, nil
+}
+
+type action string
+
+const (
+	actionCreate action = "+"
+	actionUpdate action = "~"
+	actionDelete action = "-"
+	actionExtra  action = "?"
+)
+
+// change is one step needed to bring eventmaster in line with the manifests.
+type change struct {
+	Action action
+	Kind   string // "dc" or "topic"
+	Name   string
+
+	// for topics
+	OldSchema    map[string]interface{}
+	NewSchema    map[string]interface{}
+	OldRetention int64
+	NewRetention int64
+	// Incompatible is set on updates that eventmaster would reject.
+	Incompatible bool
+}
+
+// plan computes the changes needed to make the current topics and dcs match
+// m. Topics and dcs that are not in m are reported as extra, or deleted if
+// prune is set; dcs cannot be deleted so they are always only reported.
+func plan(m *manifest, topics []*pb.Topic, dcs []*pb.DC, prune bool) ([]change, error) {
+	var r []change
+
+	haveDCs := map[string]bool{}
+	for _, dc := range dcs {
+		haveDCs[strings.ToLower(dc.DCName)] = true
+	}
+	wantDCs := map[string]bool{}
+	for _, dc := range m.DCs {
+		wantDCs[dc] = true
+		if !haveDCs[dc] {
+			r = append(r, change{Action: actionCreate, Kind: "dc", Name: dc})
+		}
+	}
+	var extraDCs []string
+	for dc := range haveDCs {
+		if !wantDCs[dc] {
+			extraDCs = append(extraDCs, dc)
+		}
+	}
+	sort.Strings(extraDCs)
+	for _, dc := range extraDCs {
+		r = append(r, change{Action: actionExtra, Kind: "dc", Name: dc})
+	}
+
+	haveTopics := map[string]map[string]interface{}{}
+	haveRetention := map[string]int64{}
+	for _, t := range topics {
+		var schema map[string]interface{}
+		if len(t.DataSchema) > 0 {
+			if err := json.Unmarshal(t.DataSchema, &schema); err != nil {
+				return nil, errors.Wrapf(err, "decoding schema of topic %v", t.TopicName)
+			}
+		}
+		if schema == nil {
+			schema = map[string]interface{}{}
+		}
+		haveTopics[strings.ToLower(t.TopicName)] = schema
+		haveRetention[strings.ToLower(t.TopicName)] = t.RetentionSeconds
+	}
+	wantTopics := map[string]bool{}
+	for _, t := range m.Topics {
+		wantTopics[t.Name] = true
+		schema := t.Schema
+		if schema == nil {
+			schema = map[string]interface{}{}
+		}
+		old, ok := haveTopics[t.Name]
+		switch {
+		case !ok:
+			r = append(r, change{Action: actionCreate, Kind: "topic", Name: t.Name, NewSchema: schema, NewRetention: t.retentionSecs})
+		case !reflect.DeepEqual(old, schema) || haveRetention[t.Name] != t.retentionSecs:
+			r = append(r, change{
+				Action:       actionUpdate,
+				Kind:         "topic",
+				Name:         t.Name,
+				OldSchema:    old,
+				NewSchema:    schema,
+				OldRetention: haveRetention[t.Name],
+				NewRetention: t.retentionSecs,
+				Incompatible: !eventmaster.CheckBackwardsCompatible(old, schema),
+			})
+		}
+	}
+	var extraTopics []string
+	for t := range haveTopics {
+		if !wantTopics[t] {
+			extraTopics = append(extraTopics, t)
+		}
+	}
+	sort.Strings(extraTopics)
+	for _, t := range extraTopics {
+		a := actionExtra
+		if prune {
+			a = actionDelete
+		}
+		r = append(r, change{Action: a, Kind: "topic", Name: t, OldSchema: haveTopics[t], OldRetention: haveRetention[t]})
+	}
+	return r, nil
+}
+
+func schemaJSON(schema map[string]interface{}) []byte {
+	if schema == nil {
+		return nil
+	}
+	b, _ := json.Marshal(schema)
+	return b
+}
+
+func printPlan(w io.Writer, changes []change) {
+	if len(changes) == 0 {
+		fmt.Fprintln(w, "no changes")
+		return
+	}
+	for _, c := range changes {
+		switch {
+		case c.Action == actionExtra:
+			fmt.Fprintf(w, "%v %v %v (not in manifests)\n", c.Action, c.Kind, c.Name)
+		case c.Incompatible:
+			fmt.Fprintf(w, "! %v %v: new schema is not backwards compatible\n", c.Kind, c.Name)
+		default:
+			fmt.Fprintf(w, "%v %v %v\n", c.Action, c.Kind, c.Name)
+		}
+		if c.Kind == "topic" && c.Action != actionExtra && c.OldRetention != c.NewRetention {
+			switch c.Action {
+			case actionCreate:
+				fmt.Fprintf(w, "    + retention: %v\n", formatRetention(c.NewRetention))
+			case actionUpdate:
+				fmt.Fprintf(w, "    - retention: %v\n    + retention: %v\n", formatRetention(c.OldRetention), formatRetention(c.NewRetention))
+			}
+		}
+		if c.Kind == "topic" && c.Action != actionExtra {
+			var oldLines, newLines []string
+			if c.OldSchema != nil {
+				oldLines = schemaLines(schemaJSON(c.OldSchema))
+			}
+			if c.NewSchema != nil {
+				newLines = schemaLines(schemaJSON(c.NewSchema))
+			}
+			for _, l := range diffLines(oldLines, newLines) {
+				fmt.Fprintf(w, "    %v\n", l)
+			}
+		}
+	}
+}
+
+func applyChange(ctx context.Context, c pb.EventMasterClient, ch change) error {
+	switch {
+	case ch.Kind == "dc" && ch.Action == actionCreate:
+		_, err := c.AddDC(ctx, &pb.DC{DCName: ch.Name})
+		return errors.Wrapf(err, "add dc %v", ch.Name)
+	case ch.Kind == "topic" && ch.Action == actionCreate:
+		_, err := c.AddTopic(ctx, &pb.Topic{TopicName: ch.Name, DataSchema: schemaJSON(ch.NewSchema), RetentionSeconds: ch.NewRetention})
+		return errors.Wrapf(err, "add topic %v", ch.Name)
+	case ch.Kind == "topic" && ch.Action == actionUpdate:
+		_, err := c.UpdateTopic(ctx, &pb.UpdateTopicRequest{OldName: ch.Name, DataSchema: schemaJSON(ch.NewSchema), RetentionSeconds: &wrappers.Int64Value{Value: ch.NewRetention}})
+		return errors.Wrapf(err, "update topic %v", ch.Name)
+	case ch.Kind == "topic" && ch.Action == actionDelete:
+		_, err := c.DeleteTopic(ctx, &pb.DeleteTopicRequest{TopicName: ch.Name})
+		return errors.Wrapf(err, "delete topic %v", ch.Name)
+	}
+	return nil
+}
+
+func apply(ctx context.Context, c pb.EventMasterClient, args []string) error {
+	var path string
+	var dryRun, prune bool
+	fs := flag.NewFlagSet("apply", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprintf(os.Stderr, "usage: %v\n", applyUsage); fs.PrintDefaults() }
+	fs.StringVar(&path, "f", "", "directory (or single file) of yaml/json manifests")
+	fs.BoolVar(&dryRun, "dry-run", false, "only show the changes that would be made")
+	fs.BoolVar(&prune, "prune", false, "delete topics that are not in the manifests")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if path == "" {
+		return errors.Errorf("usage: %v", applyUsage)
+	}
+
+	m, err := loadManifests(path)
+	if err != nil {
+		return err
+	}
+	topics, err := c.GetTopics(ctx, &pb.EmptyRequest{})
+	if err != nil {
+		return errors.Wrap(err, "getting topics")
+	}
+	dcs, err := c.GetDCs(ctx, &pb.EmptyRequest{})
+	if err != nil {
+		return errors.Wrap(err, "getting dcs")
+	}
+	changes, err := plan(m, topics.Results, dcs.Results, prune)
+	if err != nil {
+		return err
+	}
+
+	printPlan(os.Stdout, changes)
+	for _, ch := range changes {
+		if ch.Incompatible {
+			return errors.New("refusing to apply incompatible schema changes")
+		}
+	}
+	if dryRun {
+		return nil
+	}
+	for _, ch := range changes {
+		if err := applyChange(ctx, c, ch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/ContextLogic/eventmaster/proto"
+)
+
+func writeManifests(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "emctl")
+	if err != nil {
+		t.Fatalf("temp dir: %v", err)
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("write %v: %v", name, err)
+		}
+	}
+	return dir
+}
+
+func TestLoadManifests(t *testing.T) {
+	dir := writeManifests(t, map[string]string{
+		"dcs.yaml": "dcs:\n  - US-East\n  - eu-west\n",
+		"deploy.json": `{"topics": [{"name": "deploy", "retention": "720h", "schema": {"type": "object",
+			"properties": {"service": {"type": "string"}}}}]}`,
+		"README.md": "not a manifest",
+	})
+	defer os.RemoveAll(dir)
+
+	m, err := loadManifests(dir)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if got, want := len(m.DCs), 2; got != want {
+		t.Fatalf("dcs: got %v, want %v", got, want)
+	}
+	if got, want := m.DCs[0], "us-east"; got != want {
+		t.Fatalf("dc name: got %v, want %v", got, want)
+	}
+	if got, want := len(m.Topics), 1; got != want {
+		t.Fatalf("topics: got %v, want %v", got, want)
+	}
+	if _, ok := m.Topics[0].Schema["properties"]; !ok {
+		t.Fatalf("schema properties missing: %v", m.Topics[0].Schema)
+	}
+	if got, want := m.Topics[0].retentionSecs, int64(720*60*60); got != want {
+		t.Fatalf("retention: got %v, want %v", got, want)
+	}
+
+	dup := writeManifests(t, map[string]string{
+		"a.yaml": "dcs: [dc1]\n",
+		"b.yaml": "dcs: [DC1]\n",
+	})
+	defer os.RemoveAll(dup)
+	if _, err := loadManifests(dup); err == nil {
+		t.Fatalf("expected error for duplicate dc")
+	}
+}
+
+func TestPlan(t *testing.T) {
+	m := &manifest{
+		DCs: []string{"dc1", "dc2"},
+		Topics: []manifestTopic{
+			{Name: "new"},
+			{Name: "same", Schema: map[string]interface{}{"type": "object"}},
+			{Name: "retained", retentionSecs: 3600},
+			{Name: "compatible", Schema: map[string]interface{}{
+				"required":   []interface{}{"a"},
+				"properties": map[string]interface{}{"a": map[string]interface{}{"default": "x"}},
+			}},
+			{Name: "incompatible", Schema: map[string]interface{}{
+				"required":   []interface{}{"a"},
+				"properties": map[string]interface{}{"a": map[string]interface{}{"type": "string"}},
+			}},
+		},
+	}
+	topics := []*pb.Topic{
+		{TopicName: "same", DataSchema: []byte(`{"type": "object"}`)},
+		{TopicName: "retained", DataSchema: []byte(`{}`), RetentionSeconds: 60},
+		{TopicName: "compatible", DataSchema: []byte(`{}`)},
+		{TopicName: "incompatible", DataSchema: []byte(`null`)},
+		{TopicName: "old", DataSchema: []byte(`{}`)},
+	}
+	dcs := []*pb.DC{{DCName: "dc1"}, {DCName: "dc3"}}
+
+	type step struct {
+		a            action
+		kind, name   string
+		incompatible bool
+	}
+	tests := []struct {
+		prune bool
+		want  []step
+	}{
+		{false, []step{
+			{actionCreate, "dc", "dc2", false},
+			{actionExtra, "dc", "dc3", false},
+			{actionCreate, "topic", "new", false},
+			{actionUpdate, "topic", "retained", false},
+			{actionUpdate, "topic", "compatible", false},
+			{actionUpdate, "topic", "incompatible", true},
+			{actionExtra, "topic", "old", false},
+		}},
+		{true, []step{
+			{actionCreate, "dc", "dc2", false},
+			{actionExtra, "dc", "dc3", false},
+			{actionCreate, "topic", "new", false},
+			{actionUpdate, "topic", "retained", false},
+			{actionUpdate, "topic", "compatible", false},
+			{actionUpdate, "topic", "incompatible", true},
+			{actionDelete, "topic", "old", false},
+		}},
+	}
+	for _, test := range tests {
+		changes, err := plan(m, topics, dcs, test.prune)
+		if err != nil {
+			t.Fatalf("plan: %v", err)
+		}
+		var got []step
+		for _, c := range changes {
+			got = append(got, step{c.Action, c.Kind, c.Name, c.Incompatible})
+		}
+		if len(got) != len(test.want) {
+			t.Fatalf("prune=%v: got %v, want %v", test.prune, got, test.want)
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Fatalf("prune=%v: got %v, want %v", test.prune, got, test.want)
+			}
+		}
+	}
+}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"sort"
+	"strings"
 
 	pb "github.com/ContextLogic/eventmaster/proto"
 	"github.com/pkg/errors"
@@ -24,3 +26,73 @@ func listDC(ctx context.Context, c pb.EventMasterClient) error {
 	}
 	return nil
 }
+
+// dcExists reports whether a dc called name exists.
+func dcExists(ctx context.Context, c pb.EventMasterClient, name string) (bool, error) {
+	dcs, err := c.GetDCs(ctx, &pb.EmptyRequest{})
+	if err != nil {
+		return false, errors.Wrap(err, "getting dcs")
+	}
+	for _, dc := range dcs.Results {
+		if strings.EqualFold(dc.DCName, name) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func createDC(ctx context.Context, c pb.EventMasterClient, args []string) error {
+	var dryRun bool
+	fs := flag.NewFlagSet("dc create", flag.ContinueOnError)
+	fs.BoolVar(&dryRun, "dry-run", false, "only show what would be created")
+	pos, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(pos) != 1 {
+		return errors.New("usage: emctl dc create <name> [--dry-run]")
+	}
+	name := pos[0]
+
+	fmt.Printf("+ dc %v\n", name)
+	if dryRun {
+		return nil
+	}
+	resp, err := c.AddDC(ctx, &pb.DC{DCName: name})
+	if err != nil {
+		return errors.Wrap(err, "add dc")
+	}
+	fmt.Printf("created dc %v (%v)\n", name, resp.ID)
+	return nil
+}
+
+func renameDC(ctx context.Context, c pb.EventMasterClient, args []string) error {
+	var dryRun bool
+	fs := flag.NewFlagSet("dc rename", flag.ContinueOnError)
+	fs.BoolVar(&dryRun, "dry-run", false, "only show what would be renamed")
+	pos, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(pos) != 2 {
+		return errors.New("usage: emctl dc rename <old-name> <new-name> [--dry-run]")
+	}
+	oldName, newName := pos[0], pos[1]
+
+	ok, err := dcExists(ctx, c, oldName)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.Errorf("no dc named %q", oldName)
+	}
+	fmt.Printf("- dc %v\n+ dc %v\n", oldName, newName)
+	if dryRun {
+		return nil
+	}
+	if _, err := c.UpdateDC(ctx, &pb.UpdateDCRequest{OldName: oldName, NewName: newName}); err != nil {
+		return errors.Wrap(err, "update dc")
+	}
+	fmt.Printf("renamed dc %v to %v\n", oldName, newName)
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// printDiff writes a line based diff between a and b, prefixing removed lines
+// with "-", added lines with "+" and unchanged lines with a space.
+func printDiff(w io.Writer, a, b []string) {
+	for _, l := range diffLines(a, b) {
+		fmt.Fprintln(w, l)
+	}
+}
+
+// diffLines returns the diff of a and b as computed from their longest common
+// subsequence. Schemas are small, so the quadratic table is fine.
+func diffLines(a, b []string) []string {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var r []string
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			r = append(r, "  "+a[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			r = append(r, "- "+a[i])
+			i++
+		default:
+			r = append(r, "+ "+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		r = append(r, "- "+a[i])
+	}
+	for ; j < len(b); j++ {
+		r = append(r, "+ "+b[j])
+	}
+	return r
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffLines(t *testing.T) {
+	a := []string{"{", `  "a": 1,`, `  "b": 2`, "}"}
+	b := []string{"{", `  "a": 1,`, `  "c": 3`, "}"}
+	want := []string{"  {", `    "a": 1,`, `-   "b": 2`, `+   "c": 3`, "  }"}
+	if got := diffLines(a, b); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if got, want := diffLines(nil, []string{"x"}), []string{"+ x"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
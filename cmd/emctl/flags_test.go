@@ -0,0 +1,26 @@
+package main
+
+import (
+	"flag"
+	"reflect"
+	"testing"
+)
+
+func TestParseInterspersed(t *testing.T) {
+	var schema string
+	var dryRun bool
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.StringVar(&schema, "schema", "", "")
+	fs.BoolVar(&dryRun, "dry-run", false, "")
+
+	pos, err := parseInterspersed(fs, []string{"old", "--schema", "s.json", "new", "--dry-run"})
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if got, want := pos, []string{"old", "new"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("positional: got %v, want %v", got, want)
+	}
+	if schema != "s.json" || !dryRun {
+		t.Fatalf("flags: got schema=%q dry-run=%v", schema, dryRun)
+	}
+}
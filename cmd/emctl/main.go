@@ -20,9 +20,9 @@ func init() {
 	log.SetFlags(log.Lshortfile)
 }
 
-const usage = `emctl [(in)ject|(l)oad|(t)opic|dc]`
-const topicUsage = `emctl topic [list]`
-const dcUsage = `emctl dc [list]`
+const usage = `emctl [(in)ject|(l)oad|(t)opic|dc|(q)uery|tail|apply]`
+const topicUsage = `emctl topic [list|show|create|update|delete]`
+const dcUsage = `emctl dc [list|create|rename]`
 
 func main() {
 	cfg, err := parseConfig()
@@ -71,6 +71,21 @@ func main() {
 			fmt.Fprintf(os.Stderr, "load: %v\n", err)
 			os.Exit(1)
 		}
+	case "q", "query":
+		if err := query(ctx, c, os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "query: %v\n", err)
+			os.Exit(1)
+		}
+	case "tail":
+		if err := tail(ctx, c, os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "tail: %v\n", err)
+			os.Exit(1)
+		}
+	case "apply":
+		if err := apply(ctx, c, os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "apply: %v\n", err)
+			os.Exit(1)
+		}
 	case "t", "topic":
 		rest := os.Args[1:]
 		sub := ""
@@ -83,6 +98,26 @@ func main() {
 				fmt.Fprintf(os.Stderr, "topic list: %v\n", err)
 				os.Exit(1)
 			}
+		case "show":
+			if err := showTopic(ctx, c, os.Args[3:]); err != nil {
+				fmt.Fprintf(os.Stderr, "topic show: %v\n", err)
+				os.Exit(1)
+			}
+		case "create":
+			if err := createTopic(ctx, c, os.Args[3:]); err != nil {
+				fmt.Fprintf(os.Stderr, "topic create: %v\n", err)
+				os.Exit(1)
+			}
+		case "update":
+			if err := updateTopic(ctx, c, os.Args[3:]); err != nil {
+				fmt.Fprintf(os.Stderr, "topic update: %v\n", err)
+				os.Exit(1)
+			}
+		case "rm", "delete":
+			if err := deleteTopic(ctx, c, os.Args[3:]); err != nil {
+				fmt.Fprintf(os.Stderr, "topic delete: %v\n", err)
+				os.Exit(1)
+			}
 		default:
 			fmt.Fprintf(os.Stderr, "usage: %v\n", topicUsage)
 			os.Exit(1)
@@ -99,6 +134,16 @@ func main() {
 				fmt.Fprintf(os.Stderr, "topic list: %v\n", err)
 				os.Exit(1)
 			}
+		case "create":
+			if err := createDC(ctx, c, os.Args[3:]); err != nil {
+				fmt.Fprintf(os.Stderr, "dc create: %v\n", err)
+				os.Exit(1)
+			}
+		case "rename":
+			if err := renameDC(ctx, c, os.Args[3:]); err != nil {
+				fmt.Fprintf(os.Stderr, "dc rename: %v\n", err)
+				os.Exit(1)
+			}
 		default:
 			fmt.Fprintf(os.Stderr, "usage: %v\n", dcUsage)
 			os.Exit(1)
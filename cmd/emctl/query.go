@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/ContextLogic/eventmaster"
+	pb "github.com/ContextLogic/eventmaster/proto"
+)
+
+const queryUsage = `emctl query [--topic t] [--dc dc] [--host h] [--user u] [--tag t] [--target-host h]
+            [--data k=v] [--since 1h] [--until 0s] [--limit n] [--output table|json|csv]`
+const tailUsage = `emctl tail [--topic t] [--dc dc] [--host h] [--user u] [--tag t] [--target-host h]
+            [--data k=v] [--output table|json|csv]`
+
+// pageSize is the number of events requested from GetEvents at a time.
+const pageSize = 500
+
+// filterFlags are the flags common to query and tail.
+type filterFlags struct {
+	topics      stringsFlag
+	dcs         stringsFlag
+	hosts       stringsFlag
+	users       stringsFlag
+	tags        stringsFlag
+	targetHosts stringsFlag
+	data        stringsFlag
+	allTags     bool
+	output      string
+}
+
+func (f *filterFlags) register(fs *flag.FlagSet) {
+	fs.Var(&f.topics, "topic", "only events in this topic (repeatable)")
+	fs.Var(&f.dcs, "dc", "only events in this dc (repeatable)")
+	fs.Var(&f.hosts, "host", "only events from this host (repeatable)")
+	fs.Var(&f.users, "user", "only events by this user (repeatable)")
+	fs.Var(&f.tags, "tag", "only events with this tag (repeatable)")
+	fs.Var(&f.targetHosts, "target-host", "only events targeting this host (repeatable)")
+	fs.Var(&f.data, "data", "only events whose data has key (a dotted path) equal to value, as key=value (repeatable)")
+	fs.BoolVar(&f.allTags, "all-tags", false, "require all of the given tags rather than any of them")
+	fs.StringVar(&f.output, "output", "table", "output format: table, json (one event per line) or csv")
+}
+
+// query builds the pb.Query for the filter flags, without any time window.
+func (f *filterFlags) query() (*pb.Query, error) {
+	data, err := dataFilter(f.data)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.Query{
+		TopicName:      f.topics,
+		DC:             f.dcs,
+		Host:           f.hosts,
+		User:           f.users,
+		TagSet:         f.tags,
+		TagAndOperator: f.allTags,
+		TargetHostSet:  f.targetHosts,
+		Data:           data,
+	}, nil
+}
+
+// dataFilter converts key=value pairs into the json object expected in
+// pb.Query.Data. Values that parse as json (numbers, booleans, quoted
+// strings) are used as such, anything else is taken as a string.
+func dataFilter(pairs []string) (string, error) {
+	if len(pairs) == 0 {
+		return "", nil
+	}
+	m := map[string]interface{}{}
+	for _, p := range pairs {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return "", errors.Errorf("data filter %q is not of the form key=value", p)
+		}
+		var v interface{}
+		if err := json.Unmarshal([]byte(kv[1]), &v); err != nil {
+			v = kv[1]
+		}
+		m[kv[0]] = v
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return "", errors.Wrap(err, "json marshal of data filter")
+	}
+	return string(b), nil
+}
+
+// parseTime interprets s as a duration before now (e.g. "2h"), an RFC3339
+// timestamp or unix seconds.
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	return time.Time{}, errors.Errorf("%q is not a duration, RFC3339 time or unix timestamp", s)
+}
+
+func query(ctx context.Context, c pb.EventMasterClient, args []string) error {
+	var f filterFlags
+	var since, until string
+	var limit int
+	fs := flag.NewFlagSet("query", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprintf(os.Stderr, "usage: %v\n", queryUsage); fs.PrintDefaults() }
+	f.register(fs)
+	fs.StringVar(&since, "since", "1h", "start of the window: a duration ago, RFC3339 time or unix timestamp")
+	fs.StringVar(&until, "until", "0s", "end of the window: a duration ago, RFC3339 time or unix timestamp")
+	fs.IntVar(&limit, "limit", 0, "maximum number of events to print (0 for all)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	p, err := newPrinter(f.output, os.Stdout)
+	if err != nil {
+		return err
+	}
+	q, err := f.query()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	start, err := parseTime(since, now)
+	if err != nil {
+		return errors.Wrap(err, "parsing --since")
+	}
+	end, err := parseTime(until, now)
+	if err != nil {
+		return errors.Wrap(err, "parsing --until")
+	}
+	q.StartEventTime, q.EndEventTime = start.Unix(), end.Unix()
+
+	n := 0
+	for {
+		q.Limit = pageSize
+		if limit > 0 && limit-n < pageSize {
+			q.Limit = int32(limit - n)
+		}
+		var md metadata.MD
+		stream, err := c.GetEvents(ctx, q, grpc.Trailer(&md))
+		if err != nil {
+			return errors.Wrap(err, "get events")
+		}
+		for {
+			e, err := stream.Recv()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return errors.Wrap(err, "receiving events")
+			}
+			if err := p.Print(e); err != nil {
+				return err
+			}
+			n++
+		}
+		cursor := md.Get(eventmaster.CursorTrailer)
+		if len(cursor) == 0 || (limit > 0 && n >= limit) {
+			break
+		}
+		q.Cursor = cursor[0]
+	}
+	return p.Flush()
+}
+
+func tail(ctx context.Context, c pb.EventMasterClient, args []string) error {
+	var f filterFlags
+	fs := flag.NewFlagSet("tail", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprintf(os.Stderr, "usage: %v\n", tailUsage); fs.PrintDefaults() }
+	f.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	p, err := newPrinter(f.output, os.Stdout)
+	if err != nil {
+		return err
+	}
+	q, err := f.query()
+	if err != nil {
+		return err
+	}
+	stream, err := c.Subscribe(ctx, q)
+	if err != nil {
+		return errors.Wrap(err, "subscribe")
+	}
+	for {
+		e, err := stream.Recv()
+		if err == io.EOF || status.Code(err) == codes.Canceled {
+			return p.Flush()
+		}
+		if err != nil {
+			return errors.Wrap(err, "receiving events")
+		}
+		if err := p.Print(e); err != nil {
+			return err
+		}
+		// events trickle in, so show each one as soon as it arrives
+		if err := p.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+// printer writes events out in one of the supported output formats.
+type printer interface {
+	Print(*pb.Event) error
+	Flush() error
+}
+
+func newPrinter(format string, w io.Writer) (printer, error) {
+	switch format {
+	case "table":
+		return &tablePrinter{w: tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)}, nil
+	case "json", "jsonl":
+		return &jsonPrinter{enc: json.NewEncoder(w)}, nil
+	case "csv":
+		return &csvPrinter{w: csv.NewWriter(w)}, nil
+	default:
+		return nil, errors.Errorf("unknown output format %q", format)
+	}
+}
+
+var columns = []string{"TIME", "TOPIC", "DC", "HOST", "USER", "TAGS", "TARGET HOSTS", "EVENT ID"}
+
+func row(e *pb.Event) []string {
+	return []string{
+		time.Unix(e.EventTime, 0).Format(time.RFC3339),
+		e.TopicName,
+		e.DC,
+		e.Host,
+		e.User,
+		strings.Join(e.TagSet, ","),
+		strings.Join(e.TargetHostSet, ","),
+		e.EventID,
+	}
+}
+
+type tablePrinter struct {
+	w      *tabwriter.Writer
+	header bool
+}
+
+func (p *tablePrinter) Print(e *pb.Event) error {
+	if !p.header {
+		fmt.Fprintln(p.w, strings.Join(columns, "\t"))
+		p.header = true
+	}
+	_, err := fmt.Fprintln(p.w, strings.Join(row(e), "\t"))
+	return err
+}
+
+func (p *tablePrinter) Flush() error {
+	return p.w.Flush()
+}
+
+type jsonPrinter struct {
+	enc *json.Encoder
+}
+
+// jsonEvent is pb.Event with its data decoded, so that it is emitted as
+// a json object rather than base64.
+type jsonEvent struct {
+	EventID       string          `json:"event_id"`
+	ParentEventID string          `json:"parent_event_id,omitempty"`
+	EventTime     int64           `json:"event_time"`
+	DC            string          `json:"dc"`
+	TopicName     string          `json:"topic_name"`
+	TagSet        []string        `json:"tag_set"`
+	Host          string          `json:"host"`
+	TargetHostSet []string        `json:"target_host_set"`
+	User          string          `json:"user"`
+	Data          json.RawMessage `json:"data,omitempty"`
+}
+
+func (p *jsonPrinter) Print(e *pb.Event) error {
+	je := jsonEvent{
+		EventID:       e.EventID,
+		ParentEventID: e.ParentEventID,
+		EventTime:     e.EventTime,
+		DC:            e.DC,
+		TopicName:     e.TopicName,
+		TagSet:        e.TagSet,
+		Host:          e.Host,
+		TargetHostSet: e.TargetHostSet,
+		User:          e.User,
+	}
+	if json.Valid(e.Data) {
+		je.Data = e.Data
+	}
+	return errors.Wrap(p.enc.Encode(je), "json encode")
+}
+
+func (p *jsonPrinter) Flush() error {
+	return nil
+}
+
+type csvPrinter struct {
+	w      *csv.Writer
+	header bool
+}
+
+func (p *csvPrinter) Print(e *pb.Event) error {
+	if !p.header {
+		if err := p.w.Write(append(columns, "DATA")); err != nil {
+			return errors.Wrap(err, "csv write")
+		}
+		p.header = true
+	}
+	return errors.Wrap(p.w.Write(append(row(e), string(e.Data))), "csv write")
+}
+
+func (p *csvPrinter) Flush() error {
+	p.w.Flush()
+	return errors.Wrap(p.w.Error(), "csv flush")
+}
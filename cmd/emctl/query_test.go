@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseTime(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	tests := []struct {
+		in   string
+		want int64
+	}{
+		{"2h", 1500000000 - 7200},
+		{"0s", 1500000000},
+		{"2017-07-14T02:40:00Z", 1500000000},
+		{"1400000000", 1400000000},
+	}
+	for _, test := range tests {
+		got, err := parseTime(test.in, now)
+		if err != nil {
+			t.Fatalf("parse %q: %v", test.in, err)
+		}
+		if got.Unix() != test.want {
+			t.Fatalf("parse %q: got %v, want %v", test.in, got.Unix(), test.want)
+		}
+	}
+	if _, err := parseTime("yesterday", now); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestDataFilter(t *testing.T) {
+	got, err := dataFilter([]string{"deploy.service=api", "version=2", "canary=true", "tag=a=b"})
+	if err != nil {
+		t.Fatalf("data filter: %v", err)
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(got), &m); err != nil {
+		t.Fatalf("json decode %q: %v", got, err)
+	}
+	want := map[string]interface{}{
+		"deploy.service": "api",
+		"version":        float64(2),
+		"canary":         true,
+		"tag":            "a=b",
+	}
+	if !reflect.DeepEqual(m, want) {
+		t.Fatalf("got %v, want %v", m, want)
+	}
+
+	if _, err := dataFilter([]string{"novalue"}); err == nil {
+		t.Fatalf("expected error")
+	}
+}
@@ -1,11 +1,20 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"sort"
+	"strings"
+	"time"
 
+	"github.com/ContextLogic/eventmaster"
 	pb "github.com/ContextLogic/eventmaster/proto"
+	"github.com/golang/protobuf/ptypes/wrappers"
 	"github.com/pkg/errors"
 )
 
@@ -24,3 +33,237 @@ func listTopic(ctx context.Context, c pb.EventMasterClient) error {
 	}
 	return nil
 }
+
+// getTopic returns the topic called name, or nil if there is none.
+func getTopic(ctx context.Context, c pb.EventMasterClient, name string) (*pb.Topic, error) {
+	topics, err := c.GetTopics(ctx, &pb.EmptyRequest{})
+	if err != nil {
+		return nil, errors.Wrap(err, "getting topics")
+	}
+	for _, t := range topics.Results {
+		if strings.EqualFold(t.TopicName, name) {
+			return t, nil
+		}
+	}
+	return nil, nil
+}
+
+// readSchema reads and validates the json schema in path.
+func readSchema(path string) ([]byte, map[string]interface{}, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "reading schema")
+	}
+	var schema map[string]interface{}
+	if err := json.Unmarshal(b, &schema); err != nil {
+		return nil, nil, errors.Wrapf(err, "%v is not a json object", path)
+	}
+	return b, schema, nil
+}
+
+// parseRetention parses a retention given as a duration, e.g. "720h", into
+// seconds. "0" and "0s" mean events are kept forever.
+func parseRetention(s string) (int64, error) {
+	if s == "0" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, errors.Wrap(err, "parsing retention")
+	}
+	if d < 0 {
+		return 0, errors.New("retention cannot be negative")
+	}
+	return int64(d / time.Second), nil
+}
+
+// formatRetention is the inverse of parseRetention.
+func formatRetention(secs int64) string {
+	if secs == 0 {
+		return "forever"
+	}
+	return (time.Duration(secs) * time.Second).String()
+}
+
+// schemaLines returns schema indented for display, one line per element.
+func schemaLines(schema []byte) []string {
+	if len(schema) == 0 {
+		schema = []byte("{}")
+	}
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, schema, "", "  "); err != nil {
+		return strings.Split(string(schema), "\n")
+	}
+	return strings.Split(buf.String(), "\n")
+}
+
+func showTopic(ctx context.Context, c pb.EventMasterClient, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: emctl topic show <name>")
+	}
+	t, err := getTopic(ctx, c, args[0])
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		return errors.Errorf("no topic named %q", args[0])
+	}
+	fmt.Printf("name:   %v\n", t.TopicName)
+	fmt.Printf("id:     %v\n", t.ID)
+	fmt.Printf("retain: %v\n", formatRetention(t.RetentionSeconds))
+	fmt.Printf("schema:\n%v\n", strings.Join(schemaLines(t.DataSchema), "\n"))
+	return nil
+}
+
+func createTopic(ctx context.Context, c pb.EventMasterClient, args []string) error {
+	var schemaFile, retention string
+	var dryRun bool
+	fs := flag.NewFlagSet("topic create", flag.ContinueOnError)
+	fs.StringVar(&schemaFile, "schema", "", "path to a json file with the topic's data schema")
+	fs.StringVar(&retention, "retention", "0", "how long to keep events, e.g. 720h (0 keeps them forever)")
+	fs.BoolVar(&dryRun, "dry-run", false, "only show what would be created")
+	pos, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(pos) != 1 {
+		return errors.New("usage: emctl topic create <name> [--schema file.json] [--retention 720h] [--dry-run]")
+	}
+	name := pos[0]
+	retentionSecs, err := parseRetention(retention)
+	if err != nil {
+		return err
+	}
+
+	schema := []byte("{}")
+	if schemaFile != "" {
+		if schema, _, err = readSchema(schemaFile); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("+ topic %v\n", name)
+	fmt.Printf("+ retention: %v\n", formatRetention(retentionSecs))
+	printDiff(os.Stdout, nil, schemaLines(schema))
+	if dryRun {
+		return nil
+	}
+	resp, err := c.AddTopic(ctx, &pb.Topic{TopicName: name, DataSchema: schema, RetentionSeconds: retentionSecs})
+	if err != nil {
+		return errors.Wrap(err, "add topic")
+	}
+	fmt.Printf("created topic %v (%v)\n", name, resp.ID)
+	return nil
+}
+
+func updateTopic(ctx context.Context, c pb.EventMasterClient, args []string) error {
+	var schemaFile, rename, retention string
+	var dryRun bool
+	fs := flag.NewFlagSet("topic update", flag.ContinueOnError)
+	fs.StringVar(&schemaFile, "schema", "", "path to a json file with the new data schema")
+	fs.StringVar(&rename, "rename", "", "new name for the topic")
+	fs.StringVar(&retention, "retention", "", "how long to keep events, e.g. 720h (0 keeps them forever)")
+	fs.BoolVar(&dryRun, "dry-run", false, "only show the changes and whether the new schema is compatible")
+	pos, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(pos) != 1 || (schemaFile == "" && rename == "" && retention == "") {
+		return errors.New("usage: emctl topic update <name> [--schema file.json] [--rename new-name] [--retention 720h] [--dry-run]")
+	}
+	name := pos[0]
+
+	t, err := getTopic(ctx, c, name)
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		return errors.Errorf("no topic named %q", name)
+	}
+
+	// UpdateTopic replaces the schema, so carry the old one over when it is
+	// not being changed.
+	newSchema := t.DataSchema
+	newRetention := t.RetentionSeconds
+	if retention != "" {
+		if newRetention, err = parseRetention(retention); err != nil {
+			return err
+		}
+	}
+	if schemaFile != "" {
+		var schema map[string]interface{}
+		if newSchema, schema, err = readSchema(schemaFile); err != nil {
+			return err
+		}
+		var old map[string]interface{}
+		if len(t.DataSchema) > 0 {
+			if err := json.Unmarshal(t.DataSchema, &old); err != nil {
+				return errors.Wrap(err, "decoding current schema")
+			}
+		}
+		if !eventmaster.CheckBackwardsCompatible(old, schema) {
+			printDiff(os.Stdout, schemaLines(t.DataSchema), schemaLines(newSchema))
+			return errors.New("new schema is not backwards compatible: newly required properties need defaults")
+		}
+	}
+
+	fmt.Printf("~ topic %v\n", t.TopicName)
+	if rename != "" {
+		fmt.Printf("- name: %v\n+ name: %v\n", t.TopicName, rename)
+	}
+	if newRetention != t.RetentionSeconds {
+		fmt.Printf("- retention: %v\n+ retention: %v\n", formatRetention(t.RetentionSeconds), formatRetention(newRetention))
+	}
+	printDiff(os.Stdout, schemaLines(t.DataSchema), schemaLines(newSchema))
+	if schemaFile != "" {
+		fmt.Println("new schema is backwards compatible")
+	}
+	if dryRun {
+		return nil
+	}
+
+	req := &pb.UpdateTopicRequest{
+		OldName:    t.TopicName,
+		NewName:    rename,
+		DataSchema: newSchema,
+	}
+	if retention != "" {
+		req.RetentionSeconds = &wrappers.Int64Value{Value: newRetention}
+	}
+	if _, err := c.UpdateTopic(ctx, req); err != nil {
+		return errors.Wrap(err, "update topic")
+	}
+	fmt.Printf("updated topic %v\n", t.TopicName)
+	return nil
+}
+
+func deleteTopic(ctx context.Context, c pb.EventMasterClient, args []string) error {
+	var dryRun bool
+	fs := flag.NewFlagSet("topic delete", flag.ContinueOnError)
+	fs.BoolVar(&dryRun, "dry-run", false, "only show what would be deleted")
+	pos, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(pos) != 1 {
+		return errors.New("usage: emctl topic delete <name> [--dry-run]")
+	}
+
+	t, err := getTopic(ctx, c, pos[0])
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		return errors.Errorf("no topic named %q", pos[0])
+	}
+	fmt.Printf("- topic %v\n", t.TopicName)
+	printDiff(os.Stdout, schemaLines(t.DataSchema), nil)
+	if dryRun {
+		return nil
+	}
+	if _, err := c.DeleteTopic(ctx, &pb.DeleteTopicRequest{TopicName: t.TopicName}); err != nil {
+		return errors.Wrap(err, "delete topic")
+	}
+	fmt.Printf("deleted topic %v\n", t.TopicName)
+	return nil
+}
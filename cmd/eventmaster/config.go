@@ -12,7 +12,30 @@ import (
 type EMConfig struct {
 	DataStore      string             `json:"data_store"`
 	CassConfig     em.CassandraConfig `json:"cassandra_config"`
+	BoltConfig     em.BoltConfig      `json:"embedded_config"`
+	PostgresConfig em.PostgresConfig  `json:"postgres_config"`
 	UpdateInterval int                `json:"update_interval"`
+	// IdempotencyWindow is how long idempotency keys are remembered, as a
+	// duration string. "0s" disables deduplication.
+	IdempotencyWindow string `json:"idempotency_window"`
+	// PurgeInterval is how often, in seconds, events past their topic's
+	// retention are deleted.
+	PurgeInterval int `json:"purge_interval"`
+	// QueryTimeout is the longest a query may run for, as a duration
+	// string. "0s" removes the limit.
+	QueryTimeout string `json:"query_timeout"`
+	// TextIndexConfig configures the full-text search index, which is
+	// disabled unless it has a path.
+	TextIndexConfig em.TextIndexConfig `json:"text_index_config"`
+	// ElasticsearchConfig configures shipping events to Elasticsearch,
+	// which is disabled unless it has addresses.
+	ElasticsearchConfig em.ElasticsearchConfig `json:"elasticsearch_config"`
+	// Sinks are the webhooks, Kafka topics and files that stored events
+	// are sent to.
+	Sinks []em.SinkConfig `json:"sinks"`
+	// KafkaConsumers are the Kafka topics whose messages are added as
+	// events.
+	KafkaConsumers []em.KafkaConsumerConfig `json:"kafka_consumers"`
 }
 
 // DefaultEMConfig returns sane defaults for an EMConfig
@@ -20,13 +43,33 @@ func DefaultEMConfig() EMConfig {
 	return EMConfig{
 		DataStore: "cassandra",
 		CassConfig: em.CassandraConfig{
-			Addrs:       []string{"127.0.0.1:9042"},
-			Keyspace:    "event_master",
-			Consistency: "one",
-			Timeout:     "5s",
-			ServiceName: "cassandra-client",
+			Addrs:              []string{"127.0.0.1:9042"},
+			Keyspace:           "event_master",
+			Consistency:        "one",
+			Timeout:            "5s",
+			ServiceName:        "cassandra-client",
+			HydrateConcurrency: 8,
+			HydrateBatchSize:   50,
+			Replication: em.CassandraReplication{
+				Class:  "SimpleStrategy",
+				Factor: 1,
+			},
+		},
+		BoltConfig: em.BoltConfig{
+			Path:    "eventmaster.db",
+			Timeout: "5s",
+		},
+		PostgresConfig: em.PostgresConfig{
+			DSN:          "postgres://eventmaster@127.0.0.1/eventmaster?sslmode=disable",
+			MaxOpenConns: 20,
+		},
+		UpdateInterval:    10,
+		IdempotencyWindow: "24h",
+		PurgeInterval:     3600,
+		QueryTimeout:      "30s",
+		TextIndexConfig: em.TextIndexConfig{
+			Timeout: "5s",
 		},
-		UpdateInterval: 10,
 	}
 }
 
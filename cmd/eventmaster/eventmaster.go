@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
@@ -9,6 +10,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
@@ -36,6 +38,22 @@ func main() {
 		case "v", "version":
 			em.PrintVersions()
 			os.Exit(0)
+		case "migrate", "backfill", "reindex":
+			emConf, err := ParseEMConfig(config.ConfigFile)
+			if err != nil {
+				log.Fatalf("problem parsing config file: %v", err)
+			}
+			run := migrate
+			switch a[0] {
+			case "backfill":
+				run = backfill
+			case "reindex":
+				run = func(conf EMConfig) error { return reindex(conf, a[1:]) }
+			}
+			if err := run(emConf); err != nil {
+				log.Fatalf("%v failed: %v", a[0], err)
+			}
+			os.Exit(0)
 		}
 	}
 
@@ -49,22 +67,37 @@ func main() {
 		log.Fatalf("problem parsing config file: %v", err)
 	}
 
-	var ds em.DataStore
-	if emConf.DataStore == "cassandra" {
-		ds, err = em.NewCassandraStore(emConf.CassConfig)
-		if err != nil {
-			log.Fatalf("failed to create cassandra data store: %v", err)
-		}
-	} else {
-		log.Fatalf("Unrecognized data store option")
+	if err := checkTextIndex(emConf); err != nil {
+		log.Fatal(err)
+	}
+	ds, err := newDataStore(emConf)
+	if err != nil {
+		log.Fatal(err)
 	}
 	store, err := em.NewEventStore(ds)
 	if err != nil {
 		log.Fatalf("Unable to create event store: %v", err)
 	}
-	if err := store.Update(); err != nil {
-		log.Errorf("Error loading dcs and topics from cassandra: %v", err)
+	if emConf.TextIndexConfig.Path != "" {
+		ti, err := em.NewTextIndex(emConf.TextIndexConfig)
+		if err != nil {
+			log.Fatalf("Unable to open text index: %v", err)
+		}
+		store.SetTextIndex(ti)
+	}
+	if err := store.Update(context.Background()); err != nil {
+		log.Errorf("Error loading dcs, topics and rules: %v", err)
+	}
+	idempotencyWindow, err := time.ParseDuration(emConf.IdempotencyWindow)
+	if err != nil {
+		log.Fatalf("Unable to parse idempotency window: %v", err)
+	}
+	store.SetIdempotencyWindow(idempotencyWindow)
+	queryTimeout, err := time.ParseDuration(emConf.QueryTimeout)
+	if err != nil {
+		log.Fatalf("Unable to parse query timeout: %v", err)
 	}
+	store.SetQueryTimeout(queryTimeout)
 
 	// Create listening socket for grpc server
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", config.Port))
@@ -105,7 +138,7 @@ func main() {
 
 	grpcServer := em.NewGRPCServer(&config, store)
 
-	maxMsgSizeOpt := grpc.MaxMsgSize(1024 * 1024 * 100)
+	maxMsgSizeOpt := grpc.MaxRecvMsgSize(em.MaxGRPCMessageSize)
 	// Create the gRPC server and register our service
 	grpcS := grpc.NewServer(maxMsgSizeOpt)
 	emproto.RegisterEventMasterServer(grpcS, grpcServer)
@@ -124,11 +157,55 @@ func main() {
 	updateTicker := time.NewTicker(time.Second * time.Duration(emConf.UpdateInterval))
 	go func() {
 		for range updateTicker.C {
-			if err := store.Update(); err != nil {
-				log.Errorf("Error loading dcs and topics from cassandra: %v", err)
+			if err := store.Update(context.Background()); err != nil {
+				log.Errorf("Error loading dcs, topics and rules: %v", err)
 			}
 		}
 	}()
+	purgeTicker := time.NewTicker(time.Second * time.Duration(emConf.PurgeInterval))
+	go func() {
+		for range purgeTicker.C {
+			if _, err := store.PurgeExpired(context.Background()); err != nil {
+				log.Errorf("Error purging expired events: %v", err)
+			}
+		}
+	}()
+	for _, c := range emConf.Sinks {
+		sink, err := em.NewSink(c)
+		if err != nil {
+			log.Fatalf("Unable to create sink %v: %v", c.Name, err)
+		}
+		store.AddSink(sink, c)
+	}
+	sinkCtx, stopSinks := context.WithCancel(context.Background())
+	sinksDone := make(chan struct{})
+	if len(emConf.ElasticsearchConfig.Addrs) > 0 {
+		sink, err := em.NewElasticsearchSink(store, emConf.ElasticsearchConfig)
+		if err != nil {
+			log.Fatalf("Unable to create elasticsearch sink: %v", err)
+		}
+		go func() {
+			sink.Run(sinkCtx)
+			close(sinksDone)
+		}()
+	} else {
+		close(sinksDone)
+	}
+	var consumers sync.WaitGroup
+	for _, c := range emConf.KafkaConsumers {
+		consumer, err := em.NewKafkaConsumer(store, c)
+		if err != nil {
+			log.Fatalf("Unable to create kafka consumer %v: %v", c.Name, err)
+		}
+		consumers.Add(1)
+		go func() {
+			defer consumers.Done()
+			consumer.Run(sinkCtx)
+			if err := consumer.Close(); err != nil {
+				log.Errorf("Error closing kafka consumer: %v", err)
+			}
+		}()
+	}
 	rsyslogServer := &em.RsyslogServer{}
 
 	if config.RsyslogServer {
@@ -145,6 +222,14 @@ func main() {
 	<-stopChan
 	log.Info("Got shutdown signal, gracefully shutting down")
 	updateTicker.Stop()
+	purgeTicker.Stop()
+	stopSinks()
+	<-sinksDone
+	consumers.Wait()
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), 10*time.Second)
+	store.CloseSinks(drainCtx)
+	store.CloseRules(drainCtx)
+	cancelDrain()
 	store.CloseSession()
 	grpcS.GracefulStop()
 	lis.Close()
@@ -152,3 +237,39 @@ func main() {
 		rsyslogServer.Stop()
 	}
 }
+
+// checkTextIndex refuses a text index on a data store that other
+// eventmasters may write to, unless the config says there are none.
+func checkTextIndex(conf EMConfig) error {
+	if conf.TextIndexConfig.Path == "" || conf.TextIndexConfig.SingleWriter || conf.DataStore == "embedded" {
+		return nil
+	}
+	return fmt.Errorf("the text index needs this to be the only eventmaster writing to the %v data store; "+
+		"set text_index_config.single_writer if it is, or use elasticsearch_config instead", conf.DataStore)
+}
+
+// newDataStore opens the data store selected by conf.
+func newDataStore(conf EMConfig) (em.DataStore, error) {
+	switch conf.DataStore {
+	case "cassandra":
+		ds, err := em.NewCassandraStore(conf.CassConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create cassandra data store: %v", err)
+		}
+		return ds, nil
+	case "embedded":
+		ds, err := em.NewBoltStore(conf.BoltConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create embedded data store: %v", err)
+		}
+		return ds, nil
+	case "postgres":
+		ds, err := em.NewPostgresStore(conf.PostgresConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create postgres data store: %v", err)
+		}
+		return ds, nil
+	default:
+		return nil, fmt.Errorf("Unrecognized data store option: %q", conf.DataStore)
+	}
+}
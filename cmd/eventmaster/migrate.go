@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	em "github.com/ContextLogic/eventmaster"
+)
+
+// migrate brings the schema of the configured data store up to date.
+//
+// Only Cassandra needs this; the embedded store has no schema and the
+// PostgreSQL store migrates itself when it is opened.
+func migrate(conf EMConfig) error {
+	switch conf.DataStore {
+	case "cassandra":
+		applied, err := em.MigrateCassandra(context.Background(), conf.CassConfig)
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			log.Infof("keyspace %v is up to date", conf.CassConfig.Keyspace)
+			return nil
+		}
+		log.Infof("applied migrations %v to keyspace %v", applied, conf.CassConfig.Keyspace)
+		return nil
+	case "embedded":
+		log.Info("the embedded data store needs no migrations")
+		return nil
+	case "postgres":
+		ps, err := em.NewPostgresStore(conf.PostgresConfig)
+		if err != nil {
+			return err
+		}
+		ps.CloseSession()
+		log.Info("postgres schema is up to date")
+		return nil
+	default:
+		return fmt.Errorf("unrecognized data store option: %q", conf.DataStore)
+	}
+}
+
+// backfill indexes events that were added before the current index tables
+// existed. Only the Cassandra store keeps separate index tables.
+func backfill(conf EMConfig) error {
+	if conf.DataStore != "cassandra" {
+		log.Infof("the %v data store needs no backfill", conf.DataStore)
+		return nil
+	}
+	cs, err := em.NewCassandraStore(conf.CassConfig)
+	if err != nil {
+		return err
+	}
+	defer cs.CloseSession()
+	n, err := cs.BackfillIndexes(context.Background(), func(n int) {
+		log.Infof("indexed %d events", n)
+	})
+	if err != nil {
+		return err
+	}
+	log.Infof("wrote the index entries of %d events", n)
+	return nil
+}
+
+// reindex rebuilds the full-text search index from the data store. With no
+// arguments the index is emptied and every event is indexed again; an
+// argument such as "720h" only indexes the events from that long ago until
+// now. The text index cannot be open in a running server at the same time.
+func reindex(conf EMConfig, args []string) error {
+	if conf.TextIndexConfig.Path == "" {
+		return errors.New("full-text search is not enabled: text_index_config has no path")
+	}
+	end := time.Now().Unix()
+	var start int64
+	if len(args) > 0 {
+		d, err := time.ParseDuration(args[0])
+		if err != nil {
+			return fmt.Errorf("parse reindex window: %v", err)
+		}
+		start = end - int64(d/time.Second)
+	}
+
+	ds, err := newDataStore(conf)
+	if err != nil {
+		return err
+	}
+	store, err := em.NewEventStore(ds)
+	if err != nil {
+		ds.CloseSession()
+		return err
+	}
+	ti, err := em.NewTextIndex(conf.TextIndexConfig)
+	if err != nil {
+		ds.CloseSession()
+		return err
+	}
+	store.SetTextIndex(ti)
+	defer store.CloseSession()
+
+	if start == 0 {
+		if err := ti.Reset(); err != nil {
+			return err
+		}
+	}
+	n, err := store.RebuildTextIndex(context.Background(), start, end, func(n int) {
+		log.Infof("indexed %d events", n)
+	})
+	if err != nil {
+		return err
+	}
+	log.Infof("indexed the text of %d events", n)
+	return nil
+}
@@ -0,0 +1,77 @@
+package eventmaster
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// pageCursor identifies the last event returned in a page of search results.
+//
+// Results are ordered by descending event time and then descending event id
+// (see Events.Less), so the next page consists of all events that sort after
+// this position.
+type pageCursor struct {
+	EventTime int64
+	EventID   string
+}
+
+// encode returns the opaque string handed to clients.
+func (c pageCursor) encode() string {
+	s := fmt.Sprintf("%d:%s", c.EventTime, c.EventID)
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+// after reports whether evt sorts strictly after the cursor position.
+func (c pageCursor) after(evt *Event) bool {
+	if evt.EventTime != c.EventTime {
+		return evt.EventTime < c.EventTime
+	}
+	return evt.EventID < c.EventID
+}
+
+func decodeCursor(s string) (pageCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return pageCursor{}, errors.Wrap(err, "base64 decode")
+	}
+	parts := strings.SplitN(string(b), ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return pageCursor{}, errors.New("malformed cursor")
+	}
+	t, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return pageCursor{}, errors.Wrap(err, "parse cursor event time")
+	}
+	return pageCursor{EventTime: t, EventID: parts[1]}, nil
+}
+
+// paginate drops evts up to and including cursor (if non-nil), skips start
+// events and truncates to limit events. evts must already be sorted.
+//
+// If more events remain after the returned page the cursor to fetch them is
+// returned, otherwise the returned cursor is empty.
+func paginate(evts Events, cursor *pageCursor, start, limit int) (Events, string) {
+	if cursor != nil {
+		i := 0
+		for i < len(evts) && !cursor.after(evts[i]) {
+			i++
+		}
+		evts = evts[i:]
+	}
+	if start > 0 {
+		if start >= len(evts) {
+			return nil, ""
+		}
+		evts = evts[start:]
+	}
+	if limit <= 0 || len(evts) <= limit {
+		return evts, ""
+	}
+	evts = evts[:limit]
+	last := evts[limit-1]
+	return evts, pageCursor{EventTime: last.EventTime, EventID: last.EventID}.encode()
+}
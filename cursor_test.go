@@ -0,0 +1,158 @@
+package eventmaster
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	eventmaster "github.com/ContextLogic/eventmaster/proto"
+)
+
+func TestCursorRoundtrip(t *testing.T) {
+	c := pageCursor{EventTime: 1497309509, EventID: "0ujsszwN8NRY24YaXiTIE2VWDTS"}
+	got, err := decodeCursor(c.encode())
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got != c {
+		t.Fatalf("got %v, want %v", got, c)
+	}
+
+	for _, bad := range []string{"!!", "MTIz", "YWJjOmRlZg"} {
+		if _, err := decodeCursor(bad); err == nil {
+			t.Fatalf("decode %q: expected error", bad)
+		}
+	}
+}
+
+func TestPaginate(t *testing.T) {
+	evts := Events{
+		{EventID: "d", EventTime: 3},
+		{EventID: "c", EventTime: 2},
+		{EventID: "b", EventTime: 2},
+		{EventID: "a", EventTime: 1},
+	}
+
+	page, next := paginate(evts, nil, 0, 2)
+	if len(page) != 2 || page[1].EventID != "c" {
+		t.Fatalf("first page: got %v", page)
+	}
+	c, err := decodeCursor(next)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	page, next = paginate(evts, &c, 0, 2)
+	if len(page) != 2 || page[0].EventID != "b" || page[1].EventID != "a" {
+		t.Fatalf("second page: got %v", page)
+	}
+	if next != "" {
+		t.Fatalf("last page cursor: got %q, want empty", next)
+	}
+
+	page, next = paginate(evts, nil, 1, 0)
+	if len(page) != 3 || next != "" {
+		t.Fatalf("start without limit: got %v, %q", page, next)
+	}
+}
+
+func TestBoltPagination(t *testing.T) {
+	bs, cleanup := newTestBoltStore(t)
+	defer cleanup()
+
+	store := newTestEventStore(t, bs)
+
+	// several events share an event time to exercise the id tie-breaker
+	now := time.Now().Unix()
+	want := map[string]bool{}
+	for i := 0; i < 7; i++ {
+		id, err := store.AddEvent(context.Background(), &UnaddedEvent{EventTime: now - int64(i/3), DC: "dc1", TopicName: "test1", Host: "h"})
+		if err != nil {
+			t.Fatalf("add event: %v", err)
+		}
+		want[id] = true
+	}
+
+	seen := map[string]bool{}
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatalf("too many pages")
+		}
+		evts, next, err := store.Find(context.Background(), &eventmaster.Query{
+			StartEventTime: now - 60,
+			EndEventTime:   now,
+			Limit:          3,
+			Cursor:         cursor,
+		})
+		if err != nil {
+			t.Fatalf("find: %v", err)
+		}
+		for _, evt := range evts {
+			if seen[evt.EventID] {
+				t.Fatalf("event %v returned twice", evt.EventID)
+			}
+			seen[evt.EventID] = true
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if len(seen) != len(want) {
+		t.Fatalf("got %d events, want %d", len(seen), len(want))
+	}
+
+	if _, _, err := store.Find(context.Background(), &eventmaster.Query{StartEventTime: now - 60, EndEventTime: now, Cursor: "!!"}); err == nil {
+		t.Fatalf("expected error for bad cursor")
+	}
+
+	// pages read from the store one at a time add up to the full result
+	for i := 0; i < 5; i++ {
+		if _, err := store.AddEvent(context.Background(), &UnaddedEvent{EventTime: now - int64(i), DC: "dc2", TopicName: "test2", Host: "g", Tags: []string{"x"}}); err != nil {
+			t.Fatalf("add event: %v", err)
+		}
+	}
+	for _, query := range []func() *eventmaster.Query{
+		func() *eventmaster.Query { return &eventmaster.Query{StartEventTime: now - 60, EndEventTime: now} },
+		func() *eventmaster.Query { return &eventmaster.Query{StartEventTime: now - 1, EndEventTime: now} },
+		func() *eventmaster.Query {
+			return &eventmaster.Query{StartEventTime: now - 60, EndEventTime: now, TopicName: []string{"test2"}}
+		},
+		func() *eventmaster.Query {
+			return &eventmaster.Query{StartEventTime: now - 60, EndEventTime: now, Host: []string{"H"}, DC: []string{"dc1", "dc2"}}
+		},
+		func() *eventmaster.Query {
+			return &eventmaster.Query{StartEventTime: now - 60, EndEventTime: now, DC: []string{"dc2"}, TagSet: []string{"x"}, Start: 1}
+		},
+		func() *eventmaster.Query {
+			return &eventmaster.Query{StartEventTime: now - 60, EndEventTime: now, TopicName: []string{"nope"}}
+		},
+	} {
+		q := query()
+		want, _, err := store.Find(context.Background(), query())
+		if err != nil {
+			t.Fatalf("find %v: %v", q, err)
+		}
+		var got Events
+		for q.Cursor = ""; ; {
+			q.Limit = 2
+			evts, next, err := store.Find(context.Background(), q)
+			if err != nil {
+				t.Fatalf("find %v: %v", q, err)
+			}
+			got = append(got, evts...)
+			if next == "" {
+				break
+			}
+			q.Cursor, q.Start = next, 0
+		}
+		if len(got) != len(want) {
+			t.Fatalf("paged find %v: got %d events, want %d", q, len(got), len(want))
+		}
+		for i := range want {
+			if got[i].EventID != want[i].EventID {
+				t.Fatalf("paged find %v: event %d is %v, want %v", q, i, got[i].EventID, want[i].EventID)
+			}
+		}
+	}
+}
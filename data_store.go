@@ -1,28 +1,98 @@
 package eventmaster
 
 import (
+	"context"
+	"fmt"
+
 	eventmaster "github.com/ContextLogic/eventmaster/proto"
 )
 
 // DataStore defines the interface needed to be used as a backing store for
 // eventmaster.
 //
-// A few examples include CassandraStore and MockDataStore.
+// A few examples include CassandraStore, PostgresStore, BoltStore and
+// MockDataStore.
+//
+// Every method but CloseSession takes the context of the request it serves,
+// and should give up and return its error once the context is done.
 type DataStore interface {
-	AddEvent(*Event) error
-	Find(q *eventmaster.Query, topicIDs []string, dcIDs []string) (Events, error)
-	FindByID(string, bool) (*Event, error)
-	FindIDs(*eventmaster.TimeQuery, HandleEvent) error
-	GetTopics() ([]Topic, error)
-	AddTopic(RawTopic) error
-	UpdateTopic(RawTopic) error
-	DeleteTopic(string) error
-	GetDCs() ([]DC, error)
-	AddDC(DC) error
-	UpdateDC(string, string) error
+	AddEvent(context.Context, *Event) error
+	// AddEvents stores a batch of events. If an error is returned some of
+	// the events may have been stored; a *BatchError tells which were not.
+	AddEvents(context.Context, []*Event) error
+	// Find returns the events that match q, where topicIDs and dcIDs are
+	// the ids of the topics and dcs named in q. q has an event time
+	// window, a received time window or both; see validateTimeWindows.
+	Find(ctx context.Context, q *eventmaster.Query, topicIDs []string, dcIDs []string) (Events, error)
+	// Aggregate counts the events that Find would return for the same
+	// arguments, as described by agg. Topics and dcs are grouped by id.
+	Aggregate(ctx context.Context, q *eventmaster.Query, topicIDs []string, dcIDs []string, agg Aggregation) ([]AggregateCount, error)
+	FindByID(context.Context, string, bool) (*Event, error)
+	FindIDs(context.Context, *eventmaster.TimeQuery, HandleEvent) error
+	// ClaimIdempotencyKey atomically records that the event with id,
+	// received at receivedTime, holds key, unless an event received at or
+	// after since already holds it, in which case that event's id is
+	// returned and nothing changes. Times are in milliseconds.
+	ClaimIdempotencyKey(ctx context.Context, key, id string, receivedTime, since int64) (string, error)
+	// ReleaseIdempotencyKey removes the claim of key by the event with id,
+	// if it still holds it.
+	ReleaseIdempotencyKey(ctx context.Context, key, id string) error
+	// CountEvents returns the number of events in the topic with an event
+	// time (in seconds) before before.
+	CountEvents(ctx context.Context, topicID string, before int64) (int, error)
+	// PurgeEvents deletes the events in the topic with an event time (in
+	// seconds) before before, returning how many were deleted. Stores that
+	// expire events on their own may do nothing.
+	PurgeEvents(ctx context.Context, topicID string, before int64) (int, error)
+	// DeleteEvent removes the event with id, its data and all of its index
+	// entries.
+	DeleteEvent(ctx context.Context, id string) error
+	// UpdateEventData replaces the data of the event with id.
+	UpdateEventData(ctx context.Context, id string, data map[string]interface{}) error
+	AddAuditEntry(context.Context, AuditEntry) error
+	// GetAuditEntries returns the audit entries for an event, oldest first.
+	GetAuditEntries(ctx context.Context, eventID string) ([]AuditEntry, error)
+	GetTopics(context.Context) ([]Topic, error)
+	AddTopic(context.Context, RawTopic) error
+	UpdateTopic(context.Context, RawTopic) error
+	DeleteTopic(context.Context, string) error
+	GetDCs(context.Context) ([]DC, error)
+	AddDC(context.Context, DC) error
+	UpdateDC(context.Context, string, string) error
+	GetRules(context.Context) ([]Rule, error)
+	// PutRule stores r, replacing any rule with the same id.
+	PutRule(ctx context.Context, r Rule) error
+	// DeleteRule removes the rule with id and its state.
+	DeleteRule(ctx context.Context, id string) error
+	// GetRuleState returns the saved state of the rule with id, which is
+	// empty if none was saved.
+	GetRuleState(ctx context.Context, id string) (RuleState, error)
+	SaveRuleState(ctx context.Context, id string, state RuleState) error
 	CloseSession()
 }
 
 // HandleEvent defines a function for interacting with a stream of events one
 // at a time.
 type HandleEvent func(eventID string) error
+
+// BatchError is returned by DataStore.AddEvents when the events of a batch
+// were stored in parts, not all of which succeeded. Errs has an entry for
+// each event of the batch: the error that kept it from being stored, or nil
+// if it was.
+type BatchError struct {
+	Errs []error
+}
+
+func (e *BatchError) Error() string {
+	var first error
+	n := 0
+	for _, err := range e.Errs {
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			n++
+		}
+	}
+	return fmt.Sprintf("%d of %d events not stored: %v", n, len(e.Errs), first)
+}
@@ -17,7 +17,7 @@ func (s *Server) addDC(w http.ResponseWriter, r *http.Request, _ httprouter.Para
 		return dd, jh.NewError(errors.Wrap(err, "json decode").Error(), http.StatusBadRequest)
 	}
 
-	id, err := s.store.AddDC(&eventmaster.DC{
+	id, err := s.store.AddDC(r.Context(), &eventmaster.DC{
 		DCName: dd.Name,
 	})
 	if err != nil {
@@ -27,7 +27,7 @@ func (s *Server) addDC(w http.ResponseWriter, r *http.Request, _ httprouter.Para
 }
 
 func (s *Server) getDC(w http.ResponseWriter, r *http.Request, _ httprouter.Params) (interface{}, error) {
-	dcs, err := s.store.GetDCs()
+	dcs, err := s.store.GetDCs(r.Context())
 	if err != nil {
 		return dcs, jh.Wrap(err, "get dcs")
 	}
@@ -46,7 +46,7 @@ func (s *Server) updateDC(w http.ResponseWriter, r *http.Request, ps httprouter.
 		return nil, jh.NewError(errors.New("Must include dc name in request").Error(), http.StatusBadRequest)
 	}
 
-	id, err := s.store.UpdateDC(&eventmaster.UpdateDCRequest{
+	id, err := s.store.UpdateDC(r.Context(), &eventmaster.UpdateDCRequest{
 		OldName: dcName,
 		NewName: dd.Name,
 	})
@@ -2,6 +2,7 @@ package eventmaster
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -25,7 +26,7 @@ func TestDCRoundtrip(t *testing.T) {
 	name := "test"
 
 	{
-		dcs, err := store.GetDCs()
+		dcs, err := store.GetDCs(context.Background())
 		if err != nil {
 			t.Fatalf("get dcs: %v", err)
 		}
@@ -42,7 +43,7 @@ func TestDCRoundtrip(t *testing.T) {
 	t.Logf("created dc: %v", id)
 
 	{
-		dcs, err := store.GetDCs()
+		dcs, err := store.GetDCs(context.Background())
 		if err != nil {
 			t.Fatalf("get dcs: %v", err)
 		}
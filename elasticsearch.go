@@ -0,0 +1,519 @@
+package eventmaster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ContextLogic/eventmaster/metrics"
+	eventmaster "github.com/ContextLogic/eventmaster/proto"
+)
+
+// ElasticsearchConfig configures the sink that bulk indexes events into
+// Elasticsearch. The sink is off unless it has at least one address.
+type ElasticsearchConfig struct {
+	// Addrs are the base urls of the cluster's nodes, e.g.
+	// "http://127.0.0.1:9200". Requests go to the first one that answers.
+	Addrs []string `json:"addrs"`
+	// IndexPattern names the index an event is written to. "{topic}" is
+	// replaced with the topic name and "{date}" with the event time
+	// formatted with DateFormat.
+	IndexPattern string `json:"index_pattern"`
+	// TopicIndexPatterns overrides IndexPattern for the topics it names.
+	TopicIndexPatterns map[string]string `json:"topic_index_patterns"`
+	// DateFormat is the Go time layout of "{date}", in UTC.
+	DateFormat string `json:"date_format"`
+	// BatchSize is the most events sent in one bulk request.
+	BatchSize int `json:"batch_size"`
+	// FlushInterval is the longest a new event waits before it is sent, as
+	// a duration string.
+	FlushInterval string `json:"flush_interval"`
+	// CheckpointPath is the file the received time of the newest shipped
+	// event is saved in. Without it the sink starts from ResumeOverlap ago.
+	CheckpointPath string `json:"checkpoint_path"`
+	// ResumeOverlap is how far before the checkpoint the sink starts again
+	// after a restart, to pick up events that other replicas stored with a
+	// slightly earlier received time.
+	ResumeOverlap string `json:"resume_overlap"`
+	// Timeout limits each bulk request, as a duration string.
+	Timeout string `json:"timeout"`
+}
+
+// Defaults for the ElasticsearchConfig fields that are left empty.
+const (
+	DefaultElasticsearchIndexPattern = "eventmaster-{date}"
+	DefaultElasticsearchDateFormat   = "2006-01-02"
+	DefaultElasticsearchBatchSize    = 500
+	defaultElasticsearchFlush        = 5 * time.Second
+	defaultElasticsearchOverlap      = 10 * time.Minute
+	defaultElasticsearchTimeout      = 30 * time.Second
+)
+
+// elasticsearchRetryInterval is how long the sink waits after a failure
+// before it starts again.
+var elasticsearchRetryInterval = 10 * time.Second
+
+// elasticsearchCatchUpWindow is the span of received times read with each
+// Find during a catch up.
+var elasticsearchCatchUpWindow = 10 * time.Minute
+
+// elasticsearchMaxPending is the most new events held back while the sink
+// catches up. Past it they are dropped and the catch up runs again to cover
+// them.
+var elasticsearchMaxPending = 100000
+
+// ElasticsearchSink indexes the events added to an EventStore into
+// Elasticsearch.
+//
+// It ships new events as they are added and records the received time of
+// the newest one it has shipped as its checkpoint. When it starts, and
+// whenever it falls behind or fails, it reads the events received since the
+// checkpoint before going back to new events, so nothing added while it was
+// down is lost, whatever its event time. Events are indexed by id, so
+// shipping one twice is harmless.
+//
+// Events deleted or redacted through the EventStore are deleted from or
+// indexed again in Elasticsearch. Those changes are not replayed by a catch
+// up, so one made while the sink is down or too far behind is not shipped.
+type ElasticsearchSink struct {
+	store         *EventStore
+	conf          ElasticsearchConfig
+	client        *http.Client
+	flushInterval time.Duration
+	overlap       time.Duration
+
+	// checkpoint is the received time, in ms, of the newest event shipped
+	checkpoint int64
+	// addr is the index in conf.Addrs of the node that last answered
+	addr int
+}
+
+// NewElasticsearchSink returns a sink for the events of store. The
+// checkpoint is loaded from c.CheckpointPath if it exists.
+func NewElasticsearchSink(store *EventStore, c ElasticsearchConfig) (*ElasticsearchSink, error) {
+	if len(c.Addrs) == 0 {
+		return nil, errors.New("elasticsearch sink needs at least one address")
+	}
+	if c.IndexPattern == "" {
+		c.IndexPattern = DefaultElasticsearchIndexPattern
+	}
+	if c.DateFormat == "" {
+		c.DateFormat = DefaultElasticsearchDateFormat
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = DefaultElasticsearchBatchSize
+	}
+	flushInterval, err := durationOrDefault(c.FlushInterval, defaultElasticsearchFlush)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse flush interval")
+	}
+	overlap, err := durationOrDefault(c.ResumeOverlap, defaultElasticsearchOverlap)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse resume overlap")
+	}
+	timeout, err := durationOrDefault(c.Timeout, defaultElasticsearchTimeout)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse timeout")
+	}
+	s := &ElasticsearchSink{
+		store:         store,
+		conf:          c,
+		client:        &http.Client{Timeout: timeout},
+		flushInterval: flushInterval,
+		overlap:       overlap,
+	}
+	if err := s.loadCheckpoint(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// durationOrDefault parses v, or returns def if v is empty.
+func durationOrDefault(v string, def time.Duration) (time.Duration, error) {
+	if v == "" {
+		return def, nil
+	}
+	return time.ParseDuration(v)
+}
+
+// esCheckpoint is the content of the checkpoint file.
+type esCheckpoint struct {
+	ReceivedTime int64 `json:"received_time"`
+	// EventTime is the checkpoint, in seconds, of older versions
+	EventTime int64 `json:"event_time,omitempty"`
+}
+
+func (s *ElasticsearchSink) loadCheckpoint() error {
+	if s.conf.CheckpointPath == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(s.conf.CheckpointPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "read checkpoint")
+	}
+	var c esCheckpoint
+	if err := json.Unmarshal(b, &c); err != nil {
+		return errors.Wrapf(err, "json decode checkpoint %v", s.conf.CheckpointPath)
+	}
+	s.checkpoint = c.ReceivedTime
+	if s.checkpoint == 0 {
+		s.checkpoint = c.EventTime * 1000
+	}
+	return nil
+}
+
+// saveCheckpoint writes the checkpoint to a temporary file that then
+// replaces the old one, so a crash never leaves half a checkpoint.
+func (s *ElasticsearchSink) saveCheckpoint() error {
+	if s.conf.CheckpointPath == "" {
+		return nil
+	}
+	b, err := json.Marshal(esCheckpoint{ReceivedTime: s.checkpoint})
+	if err != nil {
+		return errors.Wrap(err, "json encode checkpoint")
+	}
+	f, err := ioutil.TempFile(filepath.Dir(s.conf.CheckpointPath), filepath.Base(s.conf.CheckpointPath))
+	if err != nil {
+		return errors.Wrap(err, "create checkpoint")
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return errors.Wrap(err, "write checkpoint")
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return errors.Wrap(err, "close checkpoint")
+	}
+	return errors.Wrap(os.Rename(f.Name(), s.conf.CheckpointPath), "replace checkpoint")
+}
+
+// Checkpoint returns the received time, in ms, of the newest event shipped.
+func (s *ElasticsearchSink) Checkpoint() int64 {
+	return s.checkpoint
+}
+
+// Run ships events until ctx is done, starting again after every failure.
+func (s *ElasticsearchSink) Run(ctx context.Context) {
+	for {
+		err := s.run(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		metrics.SinkError("elasticsearch")
+		log.Errorf("elasticsearch sink: %v", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(elasticsearchRetryInterval):
+		}
+	}
+}
+
+// run catches up from the checkpoint and then ships new events, until it
+// fails or ctx is done.
+func (s *ElasticsearchSink) run(ctx context.Context) error {
+	// watch first so that nothing changed during the catch up is missed
+	feed := s.store.watchChanges()
+	defer feed.Close()
+	batch, err := s.catchUp(ctx, feed)
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+	for {
+		for len(batch) >= s.conf.BatchSize {
+			if err := s.send(ctx, batch[:s.conf.BatchSize]); err != nil {
+				return err
+			}
+			batch = batch[s.conf.BatchSize:]
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case c, ok := <-feed.changes:
+			if !ok {
+				return errors.Errorf("change feed ended: %v", feed.err)
+			}
+			batch = append(batch, c)
+			continue
+		case <-ticker.C:
+		}
+		if err := s.send(ctx, batch); err != nil {
+			return err
+		}
+		batch = nil
+	}
+}
+
+// catchUp runs CatchUp while draining feed, so that it is not closed for
+// falling behind, and returns the changes made meanwhile. If more than
+// elasticsearchMaxPending events are added in that time they are dropped
+// and CatchUp runs again; deletions and redactions are always kept.
+func (s *ElasticsearchSink) catchUp(ctx context.Context, feed *changeFeed) ([]eventChange, error) {
+	var pending []eventChange
+	for {
+		done := make(chan error, 1)
+		go func() {
+			done <- s.CatchUp(ctx)
+		}()
+		added, dropped := 0, false
+	drain:
+		for {
+			select {
+			case err := <-done:
+				if err != nil {
+					return nil, err
+				}
+				break drain
+			case c, ok := <-feed.changes:
+				if !ok {
+					<-done
+					return nil, errors.Errorf("change feed ended: %v", feed.err)
+				}
+				if c.Kind == changeAdd {
+					if dropped {
+						continue
+					}
+					if added++; added > elasticsearchMaxPending {
+						pending, dropped = withoutAdditions(pending), true
+						continue
+					}
+				}
+				pending = append(pending, c)
+			}
+		}
+		if !dropped {
+			return pending, nil
+		}
+	}
+}
+
+// withoutAdditions returns the changes in cs that are not additions.
+func withoutAdditions(cs []eventChange) []eventChange {
+	var r []eventChange
+	for _, c := range cs {
+		if c.Kind != changeAdd {
+			r = append(r, c)
+		}
+	}
+	return r
+}
+
+// CatchUp ships the events received from shortly before the checkpoint
+// until now, oldest first. They are found elasticsearchCatchUpWindow at a
+// time with the received time index, and read BatchSize at a time.
+func (s *ElasticsearchSink) CatchUp(ctx context.Context) error {
+	end := time.Now().UnixNano() / int64(time.Millisecond)
+	start := s.checkpoint
+	if start == 0 {
+		start = end
+	}
+	start -= int64(s.overlap / time.Millisecond)
+
+	window := int64(elasticsearchCatchUpWindow / time.Millisecond)
+	for from := start; from <= end; from += window {
+		to := from + window - 1
+		if to > end {
+			to = end
+		}
+		found, err := s.store.ds.Find(ctx, &eventmaster.Query{StartReceivedTime: from, EndReceivedTime: to}, nil, nil)
+		if err != nil {
+			metrics.DBError("read")
+			return errors.Wrap(err, "catch up")
+		}
+		sort.Slice(found, func(i, j int) bool {
+			if found[i].ReceivedTime != found[j].ReceivedTime {
+				return found[i].ReceivedTime < found[j].ReceivedTime
+			}
+			return found[i].EventID < found[j].EventID
+		})
+		for i := 0; i < len(found); i += s.conf.BatchSize {
+			j := i + s.conf.BatchSize
+			if j > len(found) {
+				j = len(found)
+			}
+			ids := make([]string, 0, j-i)
+			for _, evt := range found[i:j] {
+				ids = append(ids, evt.EventID)
+			}
+			evts, err := s.store.findByIDs(ctx, ids)
+			if err != nil {
+				return errors.Wrap(err, "catch up")
+			}
+			if err := s.Ship(ctx, evts); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// indexName returns the index evt is written to.
+func (s *ElasticsearchSink) indexName(evt *EventResult) string {
+	pattern := s.conf.IndexPattern
+	if p, ok := s.conf.TopicIndexPatterns[evt.TopicName]; ok {
+		pattern = p
+	}
+	name := strings.NewReplacer(
+		"{topic}", evt.TopicName,
+		"{date}", time.Unix(evt.EventTime, 0).UTC().Format(s.conf.DateFormat),
+	).Replace(pattern)
+	// index names are lower case and cannot contain these
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`\/*?"<>| ,#:`, r) {
+			return '_'
+		}
+		return r
+	}, strings.ToLower(name))
+}
+
+// esBulkAction is the line before each document in a bulk request, or the
+// whole of a delete.
+type esBulkAction struct {
+	Index  *esBulkTarget `json:"index,omitempty"`
+	Delete *esBulkTarget `json:"delete,omitempty"`
+}
+
+// esBulkTarget is the document a bulk action applies to.
+type esBulkTarget struct {
+	Index string `json:"_index"`
+	ID    string `json:"_id"`
+}
+
+// esBulkResponse is the part of a bulk response the sink reads.
+type esBulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		ID     string          `json:"_id"`
+		Status int             `json:"status"`
+		Error  json.RawMessage `json:"error"`
+	} `json:"items"`
+}
+
+// Ship bulk indexes evts, which are in the form returned by the DataStores,
+// and moves the checkpoint up to the newest of them.
+//
+// Events that Elasticsearch rejects as invalid are logged and dropped;
+// anything else that fails fails the whole batch so that it can be retried.
+func (s *ElasticsearchSink) Ship(ctx context.Context, evts []*Event) error {
+	changes := make([]eventChange, len(evts))
+	for i, evt := range evts {
+		changes[i] = eventChange{Kind: changeAdd, Evt: evt}
+	}
+	return s.send(ctx, changes)
+}
+
+// send ships changes in one bulk request: additions and redactions are
+// indexed and deletions deleted. The checkpoint moves up to the newest event
+// indexed.
+func (s *ElasticsearchSink) send(ctx context.Context, changes []eventChange) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	newest := s.checkpoint
+	for _, c := range changes {
+		res := s.store.eventResult(c.Evt)
+		target := &esBulkTarget{Index: s.indexName(res), ID: res.EventID}
+		if c.Kind == changeDelete {
+			if err := enc.Encode(esBulkAction{Delete: target}); err != nil {
+				return errors.Wrap(err, "json encode bulk action")
+			}
+			continue
+		}
+		if err := enc.Encode(esBulkAction{Index: target}); err != nil {
+			return errors.Wrap(err, "json encode bulk action")
+		}
+		if err := enc.Encode(res); err != nil {
+			return errors.Wrapf(err, "json encode event %v", res.EventID)
+		}
+		if c.Evt.ReceivedTime > newest {
+			newest = c.Evt.ReceivedTime
+		}
+	}
+
+	resp, err := s.bulk(ctx, body.Bytes())
+	if err != nil {
+		return err
+	}
+	dropped := 0
+	for _, item := range resp.Items {
+		for action, r := range item {
+			switch {
+			case r.Status < 300:
+			case action == "delete" && r.Status == http.StatusNotFound:
+				// never shipped, or already deleted
+			case r.Status == http.StatusTooManyRequests || r.Status >= 500:
+				return errors.Errorf("%v event %v: status %d: %s", action, r.ID, r.Status, r.Error)
+			default:
+				dropped++
+				log.Errorf("elasticsearch rejected %v of event %v: status %d: %s", action, r.ID, r.Status, r.Error)
+			}
+		}
+	}
+	if dropped > 0 {
+		metrics.SinkDropped("elasticsearch", dropped)
+	}
+	metrics.SinkEvents("elasticsearch", len(changes)-dropped)
+
+	s.checkpoint = newest
+	return s.saveCheckpoint()
+}
+
+// bulk sends a bulk request, trying each node in turn until one answers.
+func (s *ElasticsearchSink) bulk(ctx context.Context, body []byte) (*esBulkResponse, error) {
+	var lastErr error
+	for i := 0; i < len(s.conf.Addrs); i++ {
+		addr := s.conf.Addrs[(s.addr+i)%len(s.conf.Addrs)]
+		resp, err := s.post(ctx, addr, body)
+		if err == nil {
+			s.addr = (s.addr + i) % len(s.conf.Addrs)
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func (s *ElasticsearchSink) post(ctx context.Context, addr string, body []byte) (*esBulkResponse, error) {
+	url := strings.TrimRight(addr, "/") + "/_bulk"
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "new bulk request")
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrapf(err, "post %v", url)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return nil, errors.Errorf("post %v: status %d: %s", url, resp.StatusCode, bytes.TrimSpace(b))
+	}
+	var r esBulkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, errors.Wrap(err, "json decode bulk response")
+	}
+	return &r, nil
+}
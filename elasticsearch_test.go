@@ -0,0 +1,350 @@
+package eventmaster
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeElasticsearch is a stand-in for the bulk API of an Elasticsearch node.
+type fakeElasticsearch struct {
+	mu sync.Mutex
+	// docs maps index name to the ids of the events indexed into it
+	docs map[string][]string
+	// data is the data of each indexed event, by id
+	data map[string]map[string]interface{}
+	// status, if set, is the item status returned for an event id
+	status map[string]int
+}
+
+func (f *fakeElasticsearch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/_bulk" || r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var resp esBulkResponse
+	sc := bufio.NewScanner(r.Body)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		var action esBulkAction
+		if err := json.Unmarshal(sc.Bytes(), &action); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		item := map[string]struct {
+			ID     string          `json:"_id"`
+			Status int             `json:"status"`
+			Error  json.RawMessage `json:"error"`
+		}{}
+		if t := action.Delete; t != nil {
+			r := item["delete"]
+			r.ID, r.Status = t.ID, http.StatusNotFound
+			var kept []string
+			for _, id := range f.docs[t.Index] {
+				if id == t.ID {
+					r.Status = http.StatusOK
+				} else {
+					kept = append(kept, id)
+				}
+			}
+			f.docs[t.Index] = kept
+			item["delete"] = r
+			resp.Items = append(resp.Items, item)
+			continue
+		}
+		if !sc.Scan() {
+			http.Error(w, "action without document", http.StatusBadRequest)
+			return
+		}
+		var doc EventResult
+		if err := json.Unmarshal(sc.Bytes(), &doc); err != nil || action.Index == nil || doc.EventID != action.Index.ID {
+			http.Error(w, "bad document", http.StatusBadRequest)
+			return
+		}
+		status := http.StatusCreated
+		if s, ok := f.status[doc.EventID]; ok {
+			status = s
+		}
+		r := item["index"]
+		r.ID, r.Status = doc.EventID, status
+		if status < 300 {
+			f.docs[action.Index.Index] = append(f.docs[action.Index.Index], doc.EventID)
+			f.data[doc.EventID] = doc.Data
+		} else {
+			resp.Errors = true
+			r.Error = json.RawMessage(`{"type":"mapper_parsing_exception"}`)
+		}
+		item["index"] = r
+		resp.Items = append(resp.Items, item)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// shipped reports whether id is indexed into index.
+func (f *fakeElasticsearch) shipped(index, id string) bool {
+	for _, v := range f.indexed()[index] {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeElasticsearch) indexed() map[string][]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r := map[string][]string{}
+	for k, v := range f.docs {
+		r[k] = append([]string{}, v...)
+	}
+	return r
+}
+
+func TestElasticsearchIndexName(t *testing.T) {
+	s := &ElasticsearchSink{conf: ElasticsearchConfig{
+		IndexPattern:       "events-{topic}-{date}",
+		TopicIndexPatterns: map[string]string{"audit": "audit"},
+		DateFormat:         "2006.01",
+	}}
+	evt := &EventResult{TopicName: "Deploy Events", EventTime: 1497309509}
+	if got, want := s.indexName(evt), "events-deploy_events-2017.06"; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	evt.TopicName = "audit"
+	if got, want := s.indexName(evt), "audit"; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestElasticsearchSink(t *testing.T) {
+	bs, cleanup := newTestBoltStore(t)
+	defer cleanup()
+	store := newTestEventStore(t, bs)
+	dir, err := ioutil.TempDir("", "eventmaster")
+	if err != nil {
+		t.Fatalf("temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fake := &fakeElasticsearch{docs: map[string][]string{}, data: map[string]map[string]interface{}{}, status: map[string]int{}}
+	es := httptest.NewServer(fake)
+	defer es.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	now := time.Now().Unix()
+	add := func(topic string, eventTime int64) string {
+		id, err := store.AddEvent(context.Background(), &UnaddedEvent{DC: "dc1", TopicName: topic, Host: "h", EventTime: eventTime,
+			Data: map[string]interface{}{"secret": "s"}})
+		if err != nil {
+			t.Fatalf("add event: %v", err)
+		}
+		return id
+	}
+	received := func(id string) int64 {
+		evt, err := store.FindByID(context.Background(), id)
+		if err != nil {
+			t.Fatalf("find: %v", err)
+		}
+		return evt.ReceivedTime
+	}
+	// waitFor polls until ok, while the sink runs
+	waitFor := func(what string, ok func() bool) {
+		for i := 0; !ok(); i++ {
+			if i > 200 {
+				t.Fatalf("%v: %v", what, fake.indexed())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	// stored while the sink was not running
+	old1 := add("test1", now-120)
+	old2 := add("test2", now-60)
+
+	conf := ElasticsearchConfig{
+		Addrs:          []string{down.URL, es.URL},
+		IndexPattern:   "em-{topic}",
+		CheckpointPath: filepath.Join(dir, "checkpoint"),
+		ResumeOverlap:  "1h",
+		FlushInterval:  "10ms",
+	}
+	sink, err := NewElasticsearchSink(store, conf)
+	if err != nil {
+		t.Fatalf("new sink: %v", err)
+	}
+	if err := sink.CatchUp(context.Background()); err != nil {
+		t.Fatalf("catch up: %v", err)
+	}
+	assert.Equal(t, map[string][]string{"em-test1": {old1}, "em-test2": {old2}}, fake.indexed())
+	if got, want := sink.Checkpoint(), received(old2); got != want {
+		t.Fatalf("checkpoint: got %v, want %v", got, want)
+	}
+
+	// a new sink resumes from the saved checkpoint, and ships events that
+	// arrived since however old they are
+	backdated := add("test2", now-30*86400)
+	sink, err = NewElasticsearchSink(store, conf)
+	if err != nil {
+		t.Fatalf("new sink: %v", err)
+	}
+	if got, want := sink.Checkpoint(), received(old2); got != want {
+		t.Fatalf("loaded checkpoint: got %v, want %v", got, want)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		sink.Run(ctx)
+		close(done)
+	}()
+	// the sink may not be watching yet, but catches up on anything it
+	// missed
+	live := add("test1", now)
+	waitFor("live event was not shipped", func() bool { return fake.shipped("em-test1", live) })
+	waitFor("backdated event was not shipped", func() bool { return fake.shipped("em-test2", backdated) })
+
+	info := AuditInfo{User: "jane", Reason: "test"}
+	if err := store.RedactEvent(context.Background(), old1, []string{"secret"}, info); err != nil {
+		t.Fatalf("redact: %v", err)
+	}
+	waitFor("redaction was not shipped", func() bool {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		return fake.data[old1]["secret"] == nil
+	})
+	if err := store.DeleteEvent(context.Background(), old2, info); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	waitFor("deletion was not shipped", func() bool { return !fake.shipped("em-test2", old2) })
+	cancel()
+	<-done
+
+	rejected := add("test1", now)
+	fake.status[rejected] = http.StatusBadRequest
+	evt, err := store.FindByID(context.Background(), rejected)
+	if err != nil {
+		t.Fatalf("find: %v", err)
+	}
+	if err := sink.Ship(context.Background(), []*Event{evt}); err != nil {
+		t.Fatalf("invalid events are dropped: got %v", err)
+	}
+	fake.status[rejected] = http.StatusTooManyRequests
+	if err := sink.Ship(context.Background(), []*Event{evt}); err == nil {
+		t.Fatalf("throttled batch: got nil error")
+	}
+
+	b, err := ioutil.ReadFile(conf.CheckpointPath)
+	if err != nil {
+		t.Fatalf("read checkpoint: %v", err)
+	}
+	if got, want := string(b), fmt.Sprintf(`{"received_time":%d}`, received(rejected)); got != want {
+		t.Fatalf("checkpoint file: got %v, want %v", got, want)
+	}
+
+	// checkpoints of event times, in seconds, are still read
+	if err := ioutil.WriteFile(conf.CheckpointPath, []byte(`{"event_time":1497309509}`), 0600); err != nil {
+		t.Fatalf("write checkpoint: %v", err)
+	}
+	sink, err = NewElasticsearchSink(store, conf)
+	if err != nil {
+		t.Fatalf("new sink: %v", err)
+	}
+	if got, want := sink.Checkpoint(), int64(1497309509000); got != want {
+		t.Fatalf("old checkpoint: got %v, want %v", got, want)
+	}
+}
+
+func TestElasticsearchCatchUpDrainsChanges(t *testing.T) {
+	defer func(pending, buffer int) {
+		elasticsearchMaxPending, changeFeedBuffer = pending, buffer
+	}(elasticsearchMaxPending, changeFeedBuffer)
+	elasticsearchMaxPending, changeFeedBuffer = 100, 500
+
+	store := newTestEventStore(t, &mockDataStore{})
+	add := func(n int) []string {
+		events := make([]*UnaddedEvent, n)
+		for i := range events {
+			events[i] = &UnaddedEvent{DC: "dc1", TopicName: "test1", Host: "h", EventTime: time.Now().Unix()}
+		}
+		var ids []string
+		for _, r := range store.AddEvents(context.Background(), events) {
+			if r.Error != "" {
+				t.Fatalf("add events: %v", r.Error)
+			}
+			ids = append(ids, r.EventID)
+		}
+		return ids
+	}
+	first := add(1)[0]
+
+	// the first bulk request is held until more changes were made than the
+	// feed can buffer
+	fake := &fakeElasticsearch{docs: map[string][]string{}, data: map[string]map[string]interface{}{}}
+	entered, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		once.Do(func() {
+			close(entered)
+			<-release
+		})
+		fake.ServeHTTP(w, r)
+	}))
+	defer es.Close()
+	sink, err := NewElasticsearchSink(store, ElasticsearchConfig{Addrs: []string{es.URL}, IndexPattern: "em"})
+	if err != nil {
+		t.Fatalf("new sink: %v", err)
+	}
+
+	feed := store.watchChanges()
+	defer feed.Close()
+	type result struct {
+		pending []eventChange
+		err     error
+	}
+	done := make(chan result)
+	go func() {
+		pending, err := sink.catchUp(context.Background(), feed)
+		done <- result{pending, err}
+	}()
+	<-entered
+	var added []string
+	for len(added) < changeFeedBuffer+10 {
+		added = append(added, add(100)...)
+		time.Sleep(time.Millisecond)
+	}
+	if err := store.DeleteEvent(context.Background(), first, AuditInfo{User: "jane", Reason: "test"}); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	close(release)
+
+	r := <-done
+	if r.err != nil {
+		t.Fatalf("catch up: %v", r.err)
+	}
+	if len(r.pending) != 1 || r.pending[0].Kind != changeDelete || r.pending[0].Evt.EventID != first {
+		t.Fatalf("pending: got %+v, want the deletion of %v", r.pending, first)
+	}
+	// the dropped additions were shipped by a second catch up
+	shipped := map[string]bool{}
+	for _, id := range fake.indexed()["em"] {
+		shipped[id] = true
+	}
+	for _, id := range added {
+		if !shipped[id] {
+			t.Fatalf("event %v was not shipped", id)
+		}
+	}
+}
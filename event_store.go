@@ -1,6 +1,7 @@
 package eventmaster
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -12,6 +13,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/satori/go.uuid"
 	"github.com/segmentio/ksuid"
+	log "github.com/sirupsen/logrus"
 	"github.com/xeipuuv/gojsonschema"
 
 	"github.com/ContextLogic/eventmaster/jh"
@@ -32,6 +34,12 @@ type Event struct {
 	User          string                 `json:"user"`
 	Data          map[string]interface{} `json:"data"`
 	ReceivedTime  int64                  `json:"received_time"`
+	// IdempotencyKey is only used to detect repeated writes and is not
+	// returned by Find or FindByID.
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	// RetentionSeconds is the retention of the event's topic when it was
+	// added, for DataStores that expire events as they are written.
+	RetentionSeconds int64 `json:"-"`
 }
 
 // Events is shorthand for a sortable slice of events.
@@ -41,8 +49,13 @@ func (evts Events) Len() int {
 	return len(evts)
 }
 
+// Less orders events newest first, breaking ties on event id so that the
+// order is stable across paginated queries.
 func (evts Events) Less(i, j int) bool {
-	return evts[i].EventTime > evts[j].EventTime
+	if evts[i].EventTime != evts[j].EventTime {
+		return evts[i].EventTime > evts[j].EventTime
+	}
+	return evts[i].EventID > evts[j].EventID
 }
 
 func (evts Events) Swap(i, j int) {
@@ -62,13 +75,18 @@ type UnaddedEvent struct {
 	TargetHosts   []string               `json:"target_host_set"`
 	User          string                 `json:"user"`
 	Data          map[string]interface{} `json:"data"`
+	// IdempotencyKey is an optional client supplied key. Adding an event
+	// with the same key as one added within the idempotency window returns
+	// the id of the earlier event instead of storing a new one.
+	IdempotencyKey string `json:"idempotency_key"`
 }
 
 // RawTopic is a Topic but with an unparsed Schema.
 type RawTopic struct {
-	ID     string
-	Name   string
-	Schema string
+	ID               string
+	Name             string
+	Schema           string
+	RetentionSeconds int64
 }
 
 // Topic represents a topic.
@@ -76,6 +94,20 @@ type Topic struct {
 	ID     string                 `json:"topic_id"`
 	Name   string                 `json:"topic_name"`
 	Schema map[string]interface{} `json:"data_schema"`
+	// RetentionSeconds is how long events in the topic are kept, counted
+	// from their event time. 0 keeps them forever.
+	RetentionSeconds int64 `json:"retention_seconds"`
+}
+
+// TopicUpdate is a change to a topic.
+type TopicUpdate struct {
+	// Name is the new name of the topic, or "" to keep its name.
+	Name string `json:"topic_name"`
+	// Schema replaces the schema of the topic.
+	Schema map[string]interface{} `json:"data_schema"`
+	// RetentionSeconds replaces the retention of the topic, or is nil to
+	// keep it.
+	RetentionSeconds *int64 `json:"retention_seconds"`
 }
 
 // DC represents a datacenter.
@@ -94,12 +126,29 @@ type EventStore struct {
 	topicSchemaPropertiesMap map[string](map[string]interface{}) // map of topic id to properties of topic data
 	dcNameToID               map[string]string                   // map of name to id
 	dcIDToName               map[string]string                   // map of id to name
+	topicRetentionMap        map[string]int64                    // map of topic id to retention in seconds
 	indexNames               []string                            // list of name of all indices in es cluster
 	topicMutex               *sync.RWMutex
 	dcMutex                  *sync.RWMutex
 	indexMutex               *sync.RWMutex
+	subscriptions            map[*Subscription]struct{} // live subscribers to new events
+	changeFeeds              map[*changeFeed]struct{}   // live watchers of every change, guarded by subMutex
+	subMutex                 *sync.RWMutex
+	idempotencyWindow        time.Duration // how long idempotency keys are remembered
+	queryTimeout             time.Duration // longest a query may run, 0 for no limit
+	textIndex                *TextIndex    // full-text search index, nil when disabled
+	sinks                    []*sinkQueue  // outbound sinks that stored events are sent to
+	sinkMutex                *sync.RWMutex
+	rules                    map[string]*compiledRule // alert rules by id
+	ruleMutex                *sync.RWMutex
+	ruleLoadMutex            *sync.Mutex     // serializes changes to which rules are evaluated
+	ruleSends                *sync.WaitGroup // rule notifications queued or being sent
 }
 
+// DefaultIdempotencyWindow is how long an idempotency key is remembered
+// unless changed with SetIdempotencyWindow.
+const DefaultIdempotencyWindow = 24 * time.Hour
+
 // NewEventStore initializes an EventStore.
 func NewEventStore(ds DataStore) (*EventStore, error) {
 	return &EventStore{
@@ -113,9 +162,82 @@ func NewEventStore(ds DataStore) (*EventStore, error) {
 		topicSchemaPropertiesMap: make(map[string](map[string]interface{})),
 		dcNameToID:               make(map[string]string),
 		dcIDToName:               make(map[string]string),
+		topicRetentionMap:        make(map[string]int64),
+		subscriptions:            make(map[*Subscription]struct{}),
+		changeFeeds:              make(map[*changeFeed]struct{}),
+		subMutex:                 &sync.RWMutex{},
+		sinkMutex:                &sync.RWMutex{},
+		ruleMutex:                &sync.RWMutex{},
+		ruleLoadMutex:            &sync.Mutex{},
+		ruleSends:                &sync.WaitGroup{},
+		idempotencyWindow:        DefaultIdempotencyWindow,
 	}, nil
 }
 
+// SetIdempotencyWindow sets how long after an event is received a write with
+// the same idempotency key is treated as a duplicate. A window of 0 disables
+// deduplication.
+func (es *EventStore) SetIdempotencyWindow(d time.Duration) {
+	es.idempotencyWindow = d
+}
+
+// SetQueryTimeout limits how long Find and Explain may run for. A query that
+// takes longer fails with a 504. A timeout of 0 leaves queries limited only
+// by the context they are given.
+func (es *EventStore) SetQueryTimeout(d time.Duration) {
+	es.queryTimeout = d
+}
+
+// queryContext returns ctx limited by the query timeout.
+func (es *EventStore) queryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if es.queryTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, es.queryTimeout)
+}
+
+// queryError wraps an error from running a query, giving it a 504 status if
+// the query ran out of time.
+func queryError(err error, msg string) error {
+	if errors.Cause(err) == context.DeadlineExceeded {
+		return jh.NewError(errors.Wrap(err, msg).Error(), http.StatusGatewayTimeout)
+	}
+	return errors.Wrap(err, msg)
+}
+
+// claimKey claims the idempotency key of evt for it before it is written,
+// returning the id of the event received within the idempotency window that
+// already holds the key, or "" if evt now does. The claim is atomic, so of
+// concurrent writes with the same key only one is stored; the others get its
+// id, even while it is still being written.
+func (es *EventStore) claimKey(ctx context.Context, evt *Event) (string, error) {
+	if evt.IdempotencyKey == "" || es.idempotencyWindow <= 0 {
+		return "", nil
+	}
+	since := evt.ReceivedTime - int64(es.idempotencyWindow/time.Millisecond)
+	id, err := es.ds.ClaimIdempotencyKey(ctx, evt.IdempotencyKey, evt.EventID, evt.ReceivedTime, since)
+	if err != nil {
+		metrics.DBError("write")
+		return "", errors.Wrap(err, "claim idempotency key")
+	}
+	if id != "" {
+		metrics.DuplicateEvent(es.getTopicName(evt.TopicID))
+	}
+	return id, nil
+}
+
+// releaseKey gives up the claim of evt on its idempotency key after it
+// failed to be written, so that a retry can store it.
+func (es *EventStore) releaseKey(ctx context.Context, evt *Event) {
+	if evt.IdempotencyKey == "" || es.idempotencyWindow <= 0 {
+		return
+	}
+	if err := es.ds.ReleaseIdempotencyKey(ctx, evt.IdempotencyKey, evt.EventID); err != nil {
+		metrics.DBError("write")
+		log.Errorf("release idempotency key %q: %v", evt.IdempotencyKey, err)
+	}
+}
+
 func (es *EventStore) getTopicIDs() map[string]string {
 	es.topicMutex.RLock()
 	ids := es.topicIDToName
@@ -137,6 +259,13 @@ func (es *EventStore) getTopicName(id string) string {
 	return name
 }
 
+func (es *EventStore) getTopicRetention(id string) int64 {
+	es.topicMutex.RLock()
+	r := es.topicRetentionMap[id]
+	es.topicMutex.RUnlock()
+	return r
+}
+
 func (es *EventStore) getTopicSchema(id string) *gojsonschema.Schema {
 	es.topicMutex.RLock()
 	schema := es.topicSchemaMap[id]
@@ -234,52 +363,224 @@ func (es *EventStore) augmentEvent(event *UnaddedEvent) (*Event, error) {
 	}
 
 	return &Event{
-		EventID:       eventID.String(),
-		ParentEventID: event.ParentEventID,
-		EventTime:     event.EventTime * 1000,
-		DCID:          dcID,
-		TopicID:       topicID,
-		Tags:          event.Tags,
-		Host:          event.Host,
-		TargetHosts:   event.TargetHosts,
-		User:          event.User,
-		Data:          event.Data,
-		ReceivedTime:  time.Now().Unix() * 1000,
+		EventID:          eventID.String(),
+		ParentEventID:    event.ParentEventID,
+		EventTime:        event.EventTime * 1000,
+		DCID:             dcID,
+		TopicID:          topicID,
+		Tags:             event.Tags,
+		Host:             event.Host,
+		TargetHosts:      event.TargetHosts,
+		User:             event.User,
+		Data:             event.Data,
+		ReceivedTime:     time.Now().Unix() * 1000,
+		IdempotencyKey:   event.IdempotencyKey,
+		RetentionSeconds: es.getTopicRetention(topicID),
 	}, nil
 }
 
-// Find performs validation and sorting around calling the underlying DataStore.
-func (es *EventStore) Find(q *eventmaster.Query) (Events, error) {
+// Find performs validation, sorting and pagination around calling the
+// underlying DataStore.
+//
+// At most q.Limit events are returned (all of them if q.Limit is 0). If more
+// events match q the returned cursor can be set as q.Cursor to fetch the next
+// page, otherwise it is empty. When the DataStore implements pageFinder and
+// the results are in time order, only that page is read from it.
+func (es *EventStore) Find(ctx context.Context, q *eventmaster.Query) (Events, string, error) {
+	evts, next, _, err := es.FindWithFacets(ctx, q, 0)
+	return evts, next, err
+}
+
+// FindWithFacets is Find, and if facetLimit is positive it also returns the
+// facetLimit most common values of each facet dimension across every event
+// that matches q, not just those on the returned page.
+func (es *EventStore) FindWithFacets(ctx context.Context, q *eventmaster.Query, facetLimit int) (Events, string, Facets, error) {
 	start := time.Now()
 	defer func() {
 		metrics.EventStoreLatency("Find", start)
 	}()
-	if q.StartEventTime == 0 || q.EndEventTime == 0 || q.EndEventTime < q.StartEventTime {
-		return nil, errors.New("Must specify valid start and end event time")
+	if err := validateTimeWindows(q); err != nil {
+		return nil, "", nil, jh.NewError(err.Error(), http.StatusBadRequest)
+	}
+	if _, err := parseDataFilter(q.Data); err != nil {
+		return nil, "", nil, jh.NewError(errors.Wrap(err, "invalid data filter").Error(), http.StatusBadRequest)
+	}
+	if err := validateTextQuery(q); err != nil {
+		return nil, "", nil, jh.NewError(err.Error(), http.StatusBadRequest)
+	}
+	scores, err := es.searchText(q)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	var cursor *pageCursor
+	if q.Cursor != "" {
+		c, err := decodeCursor(q.Cursor)
+		if err != nil {
+			return nil, "", nil, jh.NewError(errors.Wrap(err, "invalid cursor").Error(), http.StatusBadRequest)
+		}
+		cursor = &c
+		// nothing newer than the cursor can be on the next page, but facets
+		// count the whole match set
+		if hasEventTimeWindow(q) && c.EventTime < q.EndEventTime && facetLimit <= 0 {
+			q.EndEventTime = c.EventTime
+			if q.EndEventTime < q.StartEventTime {
+				return nil, "", nil, nil
+			}
+		}
+	}
+	topicIDs, dcIDs := es.queryIDs(q)
+	ctx, cancel := es.queryContext(ctx)
+	defer cancel()
+	if pf, ok := es.ds.(pageFinder); ok && scores == nil && q.Sort != SortRelevance && facetLimit <= 0 && q.Limit > 0 {
+		// one more than the page tells whether there is a next one
+		evts, err := pf.FindPage(ctx, q, topicIDs, dcIDs, cursor, int(q.Start+q.Limit)+1)
+		if err != nil {
+			metrics.DBError("read")
+			return nil, "", nil, queryError(err, "Error executing find in data source")
+		}
+		evts, next := paginate(evts, nil, int(q.Start), int(q.Limit))
+		return evts, next, nil, nil
+	}
+	evts, err := es.ds.Find(ctx, q, topicIDs, dcIDs)
+	if err != nil {
+		metrics.DBError("read")
+		return nil, "", nil, queryError(err, "Error executing find in data source")
+	}
+	if scores != nil {
+		evts = filterText(evts, scores)
+	}
+	if q.Sort == SortRelevance {
+		sortByRelevance(evts, scores)
+	} else {
+		sort.Sort(evts)
+	}
+	var facets Facets
+	if facetLimit > 0 {
+		facets = countFacets(evts, facetLimit, es.facetName)
+	}
+	evts, next := paginate(evts, cursor, int(q.Start), int(q.Limit))
+	if q.Sort == SortRelevance {
+		// cursors follow time order
+		next = ""
 	}
-	var topicIDs, dcIDs []string
+	return evts, next, facets, nil
+}
+
+// facetName returns the name of the topic or dc with id value, and any
+// other facet value as it is.
+func (es *EventStore) facetName(dim, value string) string {
+	switch dim {
+	case GroupByTopic:
+		return es.getTopicName(value)
+	case GroupByDC:
+		return es.getDCName(value)
+	}
+	return value
+}
+
+// queryIDs returns the ids of the topics and dcs named in q.
+func (es *EventStore) queryIDs(q *eventmaster.Query) (topicIDs []string, dcIDs []string) {
 	for _, topic := range q.TopicName {
 		topicIDs = append(topicIDs, es.getTopicID(topic))
 	}
 	for _, dc := range q.DC {
 		dcIDs = append(dcIDs, es.getDCID(dc))
 	}
-	evts, err := es.ds.Find(q, topicIDs, dcIDs)
+	return topicIDs, dcIDs
+}
+
+// pageFinder is implemented by DataStores that can return a page of
+// results without reading every event that matches a query. FindPage returns
+// at most limit events that match q and sort after the cursor after (if
+// non-nil), in Events order.
+type pageFinder interface {
+	FindPage(ctx context.Context, q *eventmaster.Query, topicIDs []string, dcIDs []string, after *pageCursor, limit int) (Events, error)
+}
+
+// queryExplainer is implemented by DataStores that plan their queries.
+type queryExplainer interface {
+	Explain(ctx context.Context, q *eventmaster.Query, topicIDs []string, dcIDs []string) (*QueryPlan, error)
+}
+
+// Explain returns the plan the DataStore would use to answer q.
+func (es *EventStore) Explain(ctx context.Context, q *eventmaster.Query) (*QueryPlan, error) {
+	start := time.Now()
+	defer func() {
+		metrics.EventStoreLatency("Explain", start)
+	}()
+	ex, ok := es.ds.(queryExplainer)
+	if !ok {
+		return nil, jh.NewError("this data store cannot explain queries", http.StatusBadRequest)
+	}
+	if err := validateTimeWindows(q); err != nil {
+		return nil, jh.NewError(err.Error(), http.StatusBadRequest)
+	}
+	topicIDs, dcIDs := es.queryIDs(q)
+	ctx, cancel := es.queryContext(ctx)
+	defer cancel()
+	p, err := ex.Explain(ctx, q, topicIDs, dcIDs)
 	if err != nil {
 		metrics.DBError("read")
-		return nil, errors.Wrap(err, "Error executing find in data source")
+		return nil, queryError(err, "explain query")
 	}
-	sort.Sort(evts)
-	return evts, nil
+	return p, nil
+}
+
+// Aggregate counts the events that match q as described by agg. Topics and
+// dcs are grouped by name.
+func (es *EventStore) Aggregate(ctx context.Context, q *eventmaster.Query, agg Aggregation) (*AggregateResult, error) {
+	start := time.Now()
+	defer func() {
+		metrics.EventStoreLatency("Aggregate", start)
+	}()
+	if err := validateTimeWindows(q); err != nil {
+		return nil, jh.NewError(err.Error(), http.StatusBadRequest)
+	}
+	if err := validateAggregation(q, agg); err != nil {
+		return nil, jh.NewError(err.Error(), http.StatusBadRequest)
+	}
+	if _, err := parseDataFilter(q.Data); err != nil {
+		return nil, jh.NewError(errors.Wrap(err, "invalid data filter").Error(), http.StatusBadRequest)
+	}
+	if err := validateTextQuery(q); err != nil {
+		return nil, jh.NewError(err.Error(), http.StatusBadRequest)
+	}
+	topicIDs, dcIDs := es.queryIDs(q)
+	ctx, cancel := es.queryContext(ctx)
+	defer cancel()
+	var counts []AggregateCount
+	var err error
+	if q.Text != "" {
+		// the DataStores cannot see the text index, so the matching events
+		// are counted here
+		counts, err = es.aggregateText(ctx, q, topicIDs, dcIDs, agg)
+	} else {
+		counts, err = es.ds.Aggregate(ctx, q, topicIDs, dcIDs, agg)
+	}
+	if err != nil {
+		metrics.DBError("read")
+		return nil, queryError(err, "Error executing aggregate in data source")
+	}
+	for _, c := range counts {
+		for i, dim := range agg.GroupBy {
+			switch dim {
+			case GroupByTopic:
+				c.Group[i] = es.getTopicName(c.Group[i])
+			case GroupByDC:
+				c.Group[i] = es.getDCName(c.Group[i])
+			}
+		}
+	}
+	return &AggregateResult{Interval: agg.Interval, GroupBy: agg.GroupBy, Buckets: counts}, nil
 }
 
 // FindByID gets an Event from the DataStore an updates defaults.
-func (es *EventStore) FindByID(id string) (*Event, error) {
+func (es *EventStore) FindByID(ctx context.Context, id string) (*Event, error) {
 	start := time.Now()
 	defer func() {
 		metrics.EventStoreLatency("Find", start)
 	}()
-	evt, err := es.ds.FindByID(id, true)
+	evt, err := es.ds.FindByID(ctx, id, true)
 	if err != nil {
 		metrics.DBError("read")
 		return nil, errors.Wrap(err, "Error executing find in data source")
@@ -295,9 +596,48 @@ func (es *EventStore) FindByID(id string) (*Event, error) {
 	return evt, nil
 }
 
+// idsFinder is implemented by DataStores that can read many events by id
+// at once. FindByIDs leaves out the ids it cannot find, and returns the rest
+// in no particular order.
+type idsFinder interface {
+	FindByIDs(ctx context.Context, ids []string, includeData bool) (Events, error)
+}
+
+// findByIDs gets the events with ids from the DataStore, with their data and
+// its defaults, in one read if the DataStore is an idsFinder. Ids that are
+// not found are left out.
+func (es *EventStore) findByIDs(ctx context.Context, ids []string) (Events, error) {
+	var evts Events
+	if f, ok := es.ds.(idsFinder); ok {
+		var err error
+		if evts, err = f.FindByIDs(ctx, ids, true); err != nil {
+			metrics.DBError("read")
+			return nil, errors.Wrap(err, "find events")
+		}
+	} else {
+		for _, id := range ids {
+			evt, err := es.ds.FindByID(ctx, id, true)
+			if err != nil {
+				metrics.DBError("read")
+				return nil, errors.Wrapf(err, "find event %v", id)
+			}
+			if evt != nil {
+				evts = append(evts, evt)
+			}
+		}
+	}
+	for _, evt := range evts {
+		if evt.Data == nil {
+			evt.Data = make(map[string]interface{})
+		}
+		es.insertDefaults(es.getTopicSchemaProperties(evt.TopicID), evt.Data)
+	}
+	return evts, nil
+}
+
 // FindIDs validates input and calls stream on all found Events using the
 // underlying DataStore.
-func (es *EventStore) FindIDs(q *eventmaster.TimeQuery, h HandleEvent) error {
+func (es *EventStore) FindIDs(ctx context.Context, q *eventmaster.TimeQuery, h HandleEvent) error {
 	start := time.Now()
 	defer func() {
 		metrics.EventStoreLatency("FindIDs", start)
@@ -309,11 +649,11 @@ func (es *EventStore) FindIDs(q *eventmaster.TimeQuery, h HandleEvent) error {
 		return errors.New("Start and end event time must be specified")
 	}
 
-	return es.ds.FindIDs(q, h)
+	return es.ds.FindIDs(ctx, q, h)
 }
 
 // AddEvent stores event in the DataStore.
-func (es *EventStore) AddEvent(event *UnaddedEvent) (string, error) {
+func (es *EventStore) AddEvent(ctx context.Context, event *UnaddedEvent) (string, error) {
 	start := time.Now()
 	defer func() {
 		metrics.EventStoreLatency("AddEvent", start)
@@ -323,22 +663,121 @@ func (es *EventStore) AddEvent(event *UnaddedEvent) (string, error) {
 	if err != nil {
 		return "", jh.NewError(errors.Wrap(err, "augmenting event").Error(), http.StatusBadRequest)
 	}
+	if id, err := es.claimKey(ctx, evt); err != nil || id != "" {
+		return id, err
+	}
 
-	if err = es.ds.AddEvent(evt); err != nil {
+	if err = es.ds.AddEvent(ctx, evt); err != nil {
 		metrics.DBError("write")
+		es.releaseKey(ctx, evt)
 		return "", errors.Wrap(err, "Error executing insert query in Cassandra")
 	}
+	pe := publishedEvent(evt)
+	es.indexText(pe)
+	es.publish(pe)
+	es.publishToSinks(pe)
+	es.evaluateRules(pe)
 
 	return evt.EventID, nil
 }
 
+// AddEventResult is the outcome of adding one event of a batch: either the id
+// of the stored event or the reason it was not stored.
+type AddEventResult struct {
+	EventID string `json:"event_id,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// AddEvents validates and stores a batch of events. Events that fail
+// validation are reported in their result and do not prevent the rest of
+// the batch from being stored; the results are in the same order as events.
+// If the DataStore stores only part of the batch, only the events it did not
+// store get an error, and the rest are published as usual.
+func (es *EventStore) AddEvents(ctx context.Context, events []*UnaddedEvent) []AddEventResult {
+	start := time.Now()
+	defer func() {
+		metrics.EventStoreLatency("AddEvents", start)
+	}()
+
+	results := make([]AddEventResult, len(events))
+	var evts []*Event
+	var idx []int
+	// keys seen earlier in this batch, mapped to the index of their event in
+	// evts, and the results that repeat one of them
+	keys := map[string]int{}
+	dups := map[int]int{}
+	for i, event := range events {
+		evt, err := es.augmentEvent(event)
+		if err != nil {
+			results[i].Error = errors.Wrap(err, "augmenting event").Error()
+			continue
+		}
+		if j, ok := keys[evt.IdempotencyKey]; ok && es.idempotencyWindow > 0 {
+			metrics.DuplicateEvent(es.getTopicName(evt.TopicID))
+			dups[i] = j
+			continue
+		}
+		id, err := es.claimKey(ctx, evt)
+		if err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		if id != "" {
+			results[i].EventID = id
+			continue
+		}
+		if evt.IdempotencyKey != "" {
+			keys[evt.IdempotencyKey] = len(evts)
+		}
+		evts = append(evts, evt)
+		idx = append(idx, i)
+	}
+	if len(evts) == 0 {
+		return results
+	}
+
+	// the error each event could not be stored with; a DataStore that
+	// stores a batch in parts may have stored some of them
+	failed := make([]error, len(evts))
+	if err := es.ds.AddEvents(ctx, evts); err != nil {
+		metrics.DBError("write")
+		if be, ok := errors.Cause(err).(*BatchError); ok && len(be.Errs) == len(evts) {
+			failed = be.Errs
+		} else {
+			for j := range failed {
+				failed[j] = err
+			}
+		}
+	}
+	var published []*Event
+	for j, evt := range evts {
+		if failed[j] != nil {
+			es.releaseKey(ctx, evt)
+			results[idx[j]].Error = errors.Wrap(failed[j], "Error executing batch insert").Error()
+			continue
+		}
+		results[idx[j]].EventID = evt.EventID
+		published = append(published, publishedEvent(evt))
+	}
+	for i, j := range dups {
+		results[i] = results[idx[j]]
+	}
+	es.indexText(published...)
+	for _, evt := range published {
+		es.publish(evt)
+		es.publishToSinks(evt)
+		es.evaluateRules(evt)
+	}
+	return results
+}
+
 // GetTopics retrieves all topics from the DataStore.
-func (es *EventStore) GetTopics() ([]Topic, error) {
+func (es *EventStore) GetTopics(ctx context.Context) ([]Topic, error) {
 	start := time.Now()
 	defer func() {
 		metrics.EventStoreLatency("GetTopics", start)
 	}()
-	topics, err := es.ds.GetTopics()
+	topics, err := es.ds.GetTopics(ctx)
 	if err != nil {
 		metrics.DBError("read")
 		return nil, errors.Wrap(err, "data source")
@@ -347,13 +786,13 @@ func (es *EventStore) GetTopics() ([]Topic, error) {
 }
 
 // GetDCs returns all stored datacenters.
-func (es *EventStore) GetDCs() ([]DC, error) {
+func (es *EventStore) GetDCs(ctx context.Context) ([]DC, error) {
 	start := time.Now()
 	defer func() {
 		metrics.EventStoreLatency("GetDCs", start)
 	}()
 
-	dcs, err := es.ds.GetDCs()
+	dcs, err := es.ds.GetDCs(ctx)
 	if err != nil {
 		metrics.DBError("read")
 		return nil, errors.Wrap(err, "get dcs from datastore")
@@ -362,7 +801,7 @@ func (es *EventStore) GetDCs() ([]DC, error) {
 }
 
 // AddTopic adds topic to the DataStore.
-func (es *EventStore) AddTopic(topic Topic) (string, error) {
+func (es *EventStore) AddTopic(ctx context.Context, topic Topic) (string, error) {
 	start := time.Now()
 	defer func() {
 		metrics.EventStoreLatency("AddTopic", start)
@@ -376,6 +815,9 @@ func (es *EventStore) AddTopic(topic Topic) (string, error) {
 	} else if es.getTopicID(name) != "" {
 		return "", jh.NewError(errors.New("Topic with name already exists").Error(), http.StatusConflict)
 	}
+	if topic.RetentionSeconds < 0 {
+		return "", jh.NewError(errors.New("retention_seconds cannot be negative").Error(), http.StatusBadRequest)
+	}
 
 	schemaStr := "{}"
 	if schema != nil {
@@ -392,10 +834,11 @@ func (es *EventStore) AddTopic(topic Topic) (string, error) {
 	}
 
 	id := uuid.NewV4().String()
-	if err := es.ds.AddTopic(RawTopic{
-		ID:     id,
-		Name:   name,
-		Schema: schemaStr,
+	if err := es.ds.AddTopic(ctx, RawTopic{
+		ID:               id,
+		Name:             name,
+		Schema:           schemaStr,
+		RetentionSeconds: topic.RetentionSeconds,
 	}); err != nil {
 		metrics.DBError("write")
 		return "", errors.Wrap(err, "Error adding topic to data source")
@@ -406,13 +849,14 @@ func (es *EventStore) AddTopic(topic Topic) (string, error) {
 	es.topicIDToName[id] = name
 	es.topicSchemaPropertiesMap[id] = schema
 	es.topicSchemaMap[id] = jsonSchema
+	es.topicRetentionMap[id] = topic.RetentionSeconds
 	es.topicMutex.Unlock()
 
 	return id, nil
 }
 
-// UpdateTopic stores
-func (es *EventStore) UpdateTopic(oldName string, td Topic) (string, error) {
+// UpdateTopic applies td to the topic named oldName.
+func (es *EventStore) UpdateTopic(ctx context.Context, oldName string, td TopicUpdate) (string, error) {
 	start := time.Now()
 	defer func() {
 		metrics.EventStoreLatency("UpdateTopic", start)
@@ -433,6 +877,13 @@ func (es *EventStore) UpdateTopic(oldName string, td Topic) (string, error) {
 	if id == "" {
 		return "", fmt.Errorf("Error updating topic - topic with name %s doesn't exist", oldName)
 	}
+	retention := es.getTopicRetention(id)
+	if td.RetentionSeconds != nil {
+		retention = *td.RetentionSeconds
+	}
+	if retention < 0 {
+		return "", jh.NewError(errors.New("retention_seconds cannot be negative").Error(), http.StatusBadRequest)
+	}
 
 	var jsonSchema *gojsonschema.Schema
 	var ok bool
@@ -456,10 +907,11 @@ func (es *EventStore) UpdateTopic(oldName string, td Topic) (string, error) {
 		}
 	}
 
-	if err := es.ds.UpdateTopic(RawTopic{
-		ID:     id,
-		Name:   newName,
-		Schema: schemaStr,
+	if err := es.ds.UpdateTopic(ctx, RawTopic{
+		ID:               id,
+		Name:             newName,
+		Schema:           schemaStr,
+		RetentionSeconds: retention,
 	}); err != nil {
 		metrics.DBError("write")
 		return "", errors.Wrap(err, "Error executing update query in Cassandra")
@@ -473,13 +925,14 @@ func (es *EventStore) UpdateTopic(oldName string, td Topic) (string, error) {
 	}
 	es.topicSchemaMap[id] = jsonSchema
 	es.topicSchemaPropertiesMap[id] = schema
+	es.topicRetentionMap[id] = retention
 	es.topicMutex.Unlock()
 
 	return id, nil
 }
 
 // DeleteTopic removes the Topic with the name in deletereq
-func (es *EventStore) DeleteTopic(deleteReq *eventmaster.DeleteTopicRequest) error {
+func (es *EventStore) DeleteTopic(ctx context.Context, deleteReq *eventmaster.DeleteTopicRequest) error {
 	start := time.Now()
 	defer func() {
 		metrics.EventStoreLatency("DeleteTopic", start)
@@ -491,7 +944,7 @@ func (es *EventStore) DeleteTopic(deleteReq *eventmaster.DeleteTopicRequest) err
 		return jh.NewError(errors.Errorf("could not find id for topic: %v", topicName).Error(), http.StatusNotFound)
 	}
 
-	if err := es.ds.DeleteTopic(id); err != nil {
+	if err := es.ds.DeleteTopic(ctx, id); err != nil {
 		metrics.DBError("write")
 		return errors.Wrap(err, "Error executing delete query in Cassandra")
 	}
@@ -501,13 +954,14 @@ func (es *EventStore) DeleteTopic(deleteReq *eventmaster.DeleteTopicRequest) err
 	delete(es.topicIDToName, id)
 	delete(es.topicSchemaMap, id)
 	delete(es.topicSchemaPropertiesMap, id)
+	delete(es.topicRetentionMap, id)
 	es.topicMutex.Unlock()
 
 	return nil
 }
 
 // AddDC stores dc, returning the ID and an error if there was one.
-func (es *EventStore) AddDC(dc *eventmaster.DC) (string, error) {
+func (es *EventStore) AddDC(ctx context.Context, dc *eventmaster.DC) (string, error) {
 	start := time.Now()
 	defer func() {
 		metrics.EventStoreLatency("AddDC", start)
@@ -523,7 +977,7 @@ func (es *EventStore) AddDC(dc *eventmaster.DC) (string, error) {
 	}
 
 	id = uuid.NewV4().String()
-	if err := es.ds.AddDC(DC{
+	if err := es.ds.AddDC(ctx, DC{
 		ID:   id,
 		Name: name,
 	}); err != nil {
@@ -541,7 +995,7 @@ func (es *EventStore) AddDC(dc *eventmaster.DC) (string, error) {
 
 // UpdateDC validates updateReq, stores in both the DataStore and in-memory
 // cache.
-func (es *EventStore) UpdateDC(updateReq *eventmaster.UpdateDCRequest) (string, error) {
+func (es *EventStore) UpdateDC(ctx context.Context, updateReq *eventmaster.UpdateDCRequest) (string, error) {
 	start := time.Now()
 	defer func() {
 		metrics.EventStoreLatency("UpdateDC", start)
@@ -565,7 +1019,7 @@ func (es *EventStore) UpdateDC(updateReq *eventmaster.UpdateDCRequest) (string,
 	if id == "" {
 		return "", jh.NewError(fmt.Errorf("Error updating dc - dc with name %s doesn't exist", oldName).Error(), http.StatusNotFound)
 	}
-	if err := es.ds.UpdateDC(id, newName); err != nil {
+	if err := es.ds.UpdateDC(ctx, id, newName); err != nil {
 		metrics.DBError("write")
 		return "", errors.Wrap(err, "Error executing update query in data source")
 	}
@@ -582,7 +1036,7 @@ func (es *EventStore) UpdateDC(updateReq *eventmaster.UpdateDCRequest) (string,
 }
 
 // Update reconstitutes internal memory caches with information in the DataStore.
-func (es *EventStore) Update() error {
+func (es *EventStore) Update(ctx context.Context) error {
 	start := time.Now()
 	defer func() {
 		metrics.EventStoreLatency("Update", start)
@@ -591,7 +1045,7 @@ func (es *EventStore) Update() error {
 	// Update DC maps
 	newDCNameToID := make(map[string]string)
 	newDCIDToName := make(map[string]string)
-	dcs, err := es.ds.GetDCs()
+	dcs, err := es.ds.GetDCs(ctx)
 	if err != nil {
 		metrics.DBError("read")
 		return errors.Wrap(err, "Error closing dc iter")
@@ -613,7 +1067,8 @@ func (es *EventStore) Update() error {
 	schemaMap := make(map[string]string)
 	newTopicSchemaMap := make(map[string]*gojsonschema.Schema)
 	newTopicSchemaPropertiesMap := make(map[string](map[string]interface{}))
-	topics, err := es.ds.GetTopics()
+	newTopicRetentionMap := make(map[string]int64)
+	topics, err := es.ds.GetTopics(ctx)
 	if err != nil {
 		metrics.DBError("read")
 		return errors.Wrap(err, "Error closing topic iter")
@@ -621,6 +1076,7 @@ func (es *EventStore) Update() error {
 	for _, t := range topics {
 		newTopicNameToID[t.Name] = t.ID
 		newTopicIDToName[t.ID] = t.Name
+		newTopicRetentionMap[t.ID] = t.RetentionSeconds
 		bytes, err := json.Marshal(t.Schema)
 		if err != nil {
 			bytes = []byte("")
@@ -648,11 +1104,17 @@ func (es *EventStore) Update() error {
 	es.topicIDToName = newTopicIDToName
 	es.topicSchemaMap = newTopicSchemaMap
 	es.topicSchemaPropertiesMap = newTopicSchemaPropertiesMap
+	es.topicRetentionMap = newTopicRetentionMap
 	es.topicMutex.Unlock()
-	return nil
+
+	// rules name topics and dcs, so they are loaded once those are known
+	return es.loadRules(ctx)
 }
 
-// CloseSession closes the underlying DataStore session.
+// CloseSession closes the underlying DataStore session and the text index.
 func (es *EventStore) CloseSession() {
 	es.ds.CloseSession()
+	if es.textIndex != nil {
+		es.textIndex.Close()
+	}
 }
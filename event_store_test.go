@@ -1,6 +1,7 @@
 package eventmaster
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -62,7 +63,7 @@ var testDCs = []*eventmaster.DC{
 
 func populateTopics(s *EventStore) error {
 	for _, topic := range testTopics {
-		_, err := s.AddTopic(topic)
+		_, err := s.AddTopic(context.Background(), topic)
 		if err != nil {
 			return err
 		}
@@ -72,7 +73,7 @@ func populateTopics(s *EventStore) error {
 
 func populateDCs(s *EventStore) error {
 	for _, dc := range testDCs {
-		_, err := s.AddDC(dc)
+		_, err := s.AddDC(context.Background(), dc)
 		if err != nil {
 			return err
 		}
@@ -94,10 +95,16 @@ func NewMockESServer() *httptest.Server {
 
 func NewNoOpDataStore() DataStore {
 	return &CassandraStore{
-		session: &cassandra.MockCassSession{},
+		session: &cassandra.FakeSession{},
 	}
 }
 
+// fakeSession returns the session of an EventStore created with
+// NewNoOpDataStore.
+func fakeSession(s *EventStore) *cassandra.FakeSession {
+	return s.ds.(*CassandraStore).session.(*cassandra.FakeSession)
+}
+
 func GetTestEventStore(ds DataStore) (*EventStore, error) {
 	ev := &EventStore{
 		ds:                       ds,
@@ -110,10 +117,35 @@ func GetTestEventStore(ds DataStore) (*EventStore, error) {
 		topicSchemaPropertiesMap: make(map[string](map[string]interface{})),
 		dcNameToID:               make(map[string]string),
 		dcIDToName:               make(map[string]string),
+		topicRetentionMap:        make(map[string]int64),
+		subscriptions:            make(map[*Subscription]struct{}),
+		changeFeeds:              make(map[*changeFeed]struct{}),
+		idempotencyWindow:        DefaultIdempotencyWindow,
+		subMutex:                 &sync.RWMutex{},
+		sinkMutex:                &sync.RWMutex{},
+		ruleMutex:                &sync.RWMutex{},
+		ruleLoadMutex:            &sync.Mutex{},
+		ruleSends:                &sync.WaitGroup{},
 	}
 	return ev, nil
 }
 
+// newTestEventStore returns an EventStore backed by ds with the test topics
+// and dcs added.
+func newTestEventStore(t *testing.T, ds DataStore) *EventStore {
+	store, err := GetTestEventStore(ds)
+	if err != nil {
+		t.Fatalf("creating event store: %v", err)
+	}
+	if err := populateTopics(store); err != nil {
+		t.Fatalf("populate topics: %v", err)
+	}
+	if err := populateDCs(store); err != nil {
+		t.Fatalf("populate dcs: %v", err)
+	}
+	return store
+}
+
 /******************************************
 	TOPIC TESTS BEGIN
 ******************************************/
@@ -129,24 +161,22 @@ var addTopicTests = []struct {
 		Schema: dataSchema,
 	}, false},
 	{Topic{Name: "test1"}, true},
+	{Topic{Name: "retained", RetentionSeconds: 3600}, false},
+	{Topic{Name: "negative", RetentionSeconds: -1}, true},
 }
 
-func checkAddTopicQuery(query string, topic Topic, id string) bool {
+func checkAddTopicQuery(t *testing.T, stmt cassandra.Statement, topic Topic, id string) {
 	schemaStr := "{}"
 	if topic.Schema != nil {
 		schemaBytes, err := json.Marshal(topic.Schema)
 		if err != nil {
-			return false
+			t.Fatalf("json marshal: %v", err)
 		}
 		schemaStr = string(schemaBytes)
 	}
 
-	schemaStr = strings.Replace(schemaStr, "[", "\\[", -1)
-	schemaStr = strings.Replace(schemaStr, "]", "\\]", -1)
-
-	exp := fmt.Sprintf(`^INSERT INTO event_topic[\s\S]*\(topic_id, topic_name, data_schema\)[\s\S]*VALUES \(%s, %s, %s\);$`,
-		id, stringify(topic.Name), stringify(schemaStr))
-	return regexp.MustCompile(exp).MatchString(query)
+	assert.True(t, regexp.MustCompile(`^INSERT INTO event_topic\s*\(topic_id, topic_name, data_schema, retention_seconds\)\s*VALUES \(\?, \?, \?, \?\)$`).MatchString(stmt.CQL))
+	assert.Equal(t, []interface{}{id, topic.Name, schemaStr, topic.RetentionSeconds}, stmt.Values)
 }
 
 func TestAddTopic(t *testing.T) {
@@ -157,11 +187,11 @@ func TestAddTopic(t *testing.T) {
 	assert.Nil(t, err)
 
 	for _, test := range addTopicTests {
-		id, err := s.AddTopic(test.Topic)
+		id, err := s.AddTopic(context.Background(), test.Topic)
 		assert.Equal(t, test.ErrExpected, err != nil)
 		if !test.ErrExpected {
 			assert.True(t, isUUID(id))
-			assert.True(t, checkAddTopicQuery(s.ds.(*CassandraStore).session.(*cassandra.MockCassSession).LastQuery(), test.Topic, id))
+			checkAddTopicQuery(t, fakeSession(s).LastStatement(), test.Topic, id)
 		}
 	}
 }
@@ -177,9 +207,8 @@ var deleteTopicTests = []struct {
 	{&eventmaster.DeleteTopicRequest{TopicName: "nonexistent"}, true, 1},
 }
 
-func checkDeleteTopicQuery(query string, id string) bool {
-	exp := fmt.Sprintf(`DELETE FROM event_topic WHERE topic_id=%s;`, id)
-	return query == exp
+func checkDeleteTopicQuery(t *testing.T, stmt cassandra.Statement, id string) {
+	assert.Equal(t, cassandra.NewStatement(`DELETE FROM event_topic WHERE topic_id = ?`, id), stmt)
 }
 
 func TestDeleteTopic(t *testing.T) {
@@ -195,27 +224,26 @@ func TestDeleteTopic(t *testing.T) {
 	for _, test := range deleteTopicTests {
 		id := s.topicNameToID[test.DeleteReq.TopicName]
 
-		err := s.DeleteTopic(test.DeleteReq)
+		err := s.DeleteTopic(context.Background(), test.DeleteReq)
 		assert.Equal(t, test.ErrExpected, err != nil)
 		assert.Equal(t, test.NumTopics, len(s.topicNameToID))
 
 		if !test.ErrExpected {
-			assert.True(t, checkDeleteTopicQuery(s.ds.(*CassandraStore).session.(*cassandra.MockCassSession).LastQuery(), id))
+			checkDeleteTopicQuery(t, fakeSession(s).LastStatement(), id)
 		}
 	}
 }
 
 var updateTopicTests = []struct {
-	Name          string
-	Topic         Topic
-	ErrExpected   bool
-	ExpectedQuery string
+	Name           string
+	Topic          TopicUpdate
+	ErrExpected    bool
+	ExpectedValues []interface{}
 }{
-	{"test1", Topic{Name: "test4"}, false,
-		`^UPDATE event_topic SET[\s\S]*topic_name='test4',[\s\S]*data_schema='{}'[\s\S]*WHERE topic_id=%s;$`},
-	{"test1", Topic{Name: "test2"}, true, ""},
-	{"test2", Topic{Name: "test4"}, true, ""},
-	{"test3", Topic{Schema: map[string]interface{}{
+	{"test1", TopicUpdate{Name: "test4"}, false, []interface{}{"test4", "{}", int64(0)}},
+	{"test1", TopicUpdate{Name: "test2"}, true, nil},
+	{"test2", TopicUpdate{Name: "test4"}, true, nil},
+	{"test3", TopicUpdate{Schema: map[string]interface{}{
 		"title":       "test",
 		"description": "test",
 		"type":        "object",
@@ -233,8 +261,8 @@ var updateTopicTests = []struct {
 				"minimum": 0,
 			},
 		},
-	}}, true, ""},
-	{"test3", Topic{Schema: map[string]interface{}{
+	}}, true, nil},
+	{"test3", TopicUpdate{Schema: map[string]interface{}{
 		"title":       "test",
 		"description": "test",
 		"type":        "object",
@@ -252,7 +280,7 @@ var updateTopicTests = []struct {
 				"minimum": 0,
 			},
 		},
-	}}, false, ""},
+	}}, false, nil},
 }
 
 func TestUpdateTopic(t *testing.T) {
@@ -266,16 +294,40 @@ func TestUpdateTopic(t *testing.T) {
 	assert.Nil(t, err)
 
 	for _, test := range updateTopicTests {
-		id, err := s.UpdateTopic(test.Name, test.Topic)
+		id, err := s.UpdateTopic(context.Background(), test.Name, test.Topic)
 		assert.Equal(t, test.ErrExpected, err != nil)
 
-		if test.ExpectedQuery != "" {
+		if test.ExpectedValues != nil {
 			assert.True(t, isUUID(id))
-			assert.True(t, regexp.MustCompile(fmt.Sprintf(test.ExpectedQuery, id)).MatchString(s.ds.(*CassandraStore).session.(*cassandra.MockCassSession).LastQuery()))
+			stmt := fakeSession(s).LastStatement()
+			assert.True(t, strings.HasPrefix(stmt.CQL, "UPDATE event_topic SET"))
+			assert.Equal(t, append(test.ExpectedValues, id), stmt.Values)
 		}
 	}
 }
 
+func TestUpdateTopicRetention(t *testing.T) {
+	s := newTestEventStore(t, NewNoOpDataStore())
+	if _, err := s.AddTopic(context.Background(), Topic{Name: "retained", RetentionSeconds: 3600}); err != nil {
+		t.Fatalf("add topic: %v", err)
+	}
+
+	// a rename that leaves the retention out keeps it
+	id, err := s.UpdateTopic(context.Background(), "retained", TopicUpdate{Name: "renamed"})
+	if err != nil {
+		t.Fatalf("update topic: %v", err)
+	}
+	assert.Equal(t, []interface{}{"renamed", "{}", int64(3600), id}, fakeSession(s).LastStatement().Values)
+	assert.Equal(t, int64(3600), s.getTopicRetention(id))
+
+	forever := int64(0)
+	if _, err := s.UpdateTopic(context.Background(), "renamed", TopicUpdate{RetentionSeconds: &forever}); err != nil {
+		t.Fatalf("update topic: %v", err)
+	}
+	assert.Equal(t, []interface{}{"renamed", "{}", int64(0), id}, fakeSession(s).LastStatement().Values)
+	assert.Equal(t, int64(0), s.getTopicRetention(id))
+}
+
 /******************************************
 	DC TESTS BEGIN
 ******************************************/
@@ -297,14 +349,14 @@ func TestAddDC(t *testing.T) {
 	assert.Nil(t, err)
 
 	for _, test := range addDCTests {
-		id, err := s.AddDC(test.DC)
+		id, err := s.AddDC(context.Background(), test.DC)
 		assert.Equal(t, test.ErrExpected, err != nil)
 
 		if !test.ErrExpected {
 			assert.True(t, isUUID(id))
-			exp := fmt.Sprintf(`^INSERT INTO event_dc[\s\S]*\(dc_id, dc\)[\s\S]*VALUES \(%s, %s\);$`,
-				id, stringify(test.DC.DCName))
-			assert.True(t, regexp.MustCompile(exp).MatchString(s.ds.(*CassandraStore).session.(*cassandra.MockCassSession).LastQuery()))
+			stmt := fakeSession(s).LastStatement()
+			assert.True(t, regexp.MustCompile(`^INSERT INTO event_dc\s*\(dc_id, dc\)\s*VALUES \(\?, \?\)$`).MatchString(stmt.CQL))
+			assert.Equal(t, []interface{}{id, test.DC.DCName}, stmt.Values)
 		}
 	}
 }
@@ -330,14 +382,13 @@ func TestUpdateDC(t *testing.T) {
 	assert.Nil(t, err)
 
 	for _, test := range updateDCTests {
-		id, err := s.UpdateDC(test.Req)
+		id, err := s.UpdateDC(context.Background(), test.Req)
 		assert.Equal(t, test.ErrExpected, err != nil)
 
 		if !test.ErrExpected {
 			assert.True(t, isUUID(id))
-			expectedQ := fmt.Sprintf("UPDATE event_dc SET dc=%s WHERE dc_id=%s;",
-				stringify(test.Req.NewName), id)
-			assert.Equal(t, expectedQ, s.ds.(*CassandraStore).session.(*cassandra.MockCassSession).LastQuery())
+			expected := cassandra.NewStatement("UPDATE event_dc SET dc = ? WHERE dc_id = ?", test.Req.NewName, id)
+			assert.Equal(t, expected, fakeSession(s).LastStatement())
 		}
 	}
 }
@@ -429,24 +480,74 @@ var addEventTests = []struct {
 	}, true},
 }
 
-func checkAddEventQuery(query string, id string, evt *UnaddedEvent) bool {
-	data, err := json.Marshal(evt.Data)
-	if err != nil {
-		return false
+// checkAddEventBatch checks the values bound to the statements that write
+// evt, which was added with id.
+func checkAddEventBatch(t *testing.T, b cassandra.Batch, id string, evt *UnaddedEvent, s *EventStore) {
+	if b.Kind != cassandra.LoggedBatch {
+		t.Fatalf("batch kind: got %v, want logged", b.Kind)
 	}
-
-	unixTimestamp := time.Now().Unix()
-	if evt.EventTime != 0 {
-		unixTimestamp = evt.EventTime
+	data := "{}"
+	if evt.Data != nil {
+		d, err := json.Marshal(evt.Data)
+		if err != nil {
+			t.Fatalf("json marshal: %v", err)
+		}
+		data = string(d)
 	}
-	date := getDate(unixTimestamp)
-
-	matchStr := fmt.Sprintf(`[\s\S]*BEGIN BATCH[\s\S]*INSERT INTO event \(event_id, parent_event_id, dc_id, topic_id, host, target_host_set, user, event_time, tag_set, received_time, date\)[\s\S]*VALUES \(%[1]s, %[2]s, %[3]s, %[4]s, %[5]s, %[6]s, %[7]s, %[8]s, %[9]s, %[11]s, %[12]s\);[\s\S]*INSERT INTO event_metadata\(event_id, data_json\)[\s\S]*VALUES \(%[1]s, \$\$%[10]s\$\$\);[\s\S]*INSERT INTO event_by_topic\(event_id, topic_id, event_time, date\)[\s\S]*VALUES \(%[1]s, %[4]s, %[8]s, %[12]s\);[\s\S]*INSERT INTO event_by_dc\(event_id, dc_id, event_time, date\)[\s\S]*VALUES \(%[1]s, %[3]s, %[8]s, %[12]s\);[\s\S]*INSERT INTO event_by_host\(event_id, host, event_time, date\)[\s\S]*VALUES \(%[1]s, %[5]s, %[8]s, %[12]s\);[\s\S]*INSERT INTO event_by_date\(event_id, event_time, date\)[\s\S]*VALUES \(%[1]s, %[8]s, %[12]s\);[\s\S]*APPLY BATCH;`,
-		stringify(id), stringify(evt.ParentEventID), uuidMatchStr, uuidMatchStr,
-		stringify(evt.Host), stringifyArr(evt.TargetHosts), stringify(evt.User), "\\d{10}000",
-		stringifyArr(evt.Tags), string(data), "\\d{10}000", stringify(date))
+	stmts := map[string][]interface{}{}
+	var tags, targetHosts []interface{}
+	for _, stmt := range b.Statements {
+		table := regexp.MustCompile(`^INSERT INTO (\w+)`).FindStringSubmatch(stmt.CQL)
+		if table == nil {
+			t.Fatalf("not an insert: %v", stmt.CQL)
+		}
+		switch table[1] {
+		case "event_by_tag":
+			tags = append(tags, stmt.Values[1])
+		case "event_by_target_host":
+			targetHosts = append(targetHosts, stmt.Values[1])
+		default:
+			stmts[table[1]] = stmt.Values
+		}
+	}
+	var wantTags, wantTargetHosts []interface{}
+	for _, tag := range evt.Tags {
+		wantTags = append(wantTags, tag)
+	}
+	for _, th := range evt.TargetHosts {
+		wantTargetHosts = append(wantTargetHosts, th)
+	}
+	assert.Equal(t, wantTags, tags)
+	assert.Equal(t, wantTargetHosts, targetHosts)
 
-	return regexp.MustCompile(matchStr).MatchString(query)
+	row := stmts["event"]
+	if len(row) != 13 {
+		t.Fatalf("event values: got %v", row)
+	}
+	eventTime := row[7].(int64)
+	if eventTime%1000 != 0 || !isUUID(row[2].(string)) {
+		t.Fatalf("event values: got %v", row)
+	}
+	date := getDate(eventTime / 1000)
+	topicID, dcID := s.getTopicID(evt.TopicName), s.getDCID(evt.DC)
+	want := map[string][]interface{}{
+		"event": {id, evt.ParentEventID, dcID, topicID, strings.ToLower(evt.Host), evt.TargetHosts,
+			strings.ToLower(evt.User), eventTime, evt.Tags, row[9], date, evt.IdempotencyKey, int64(0)},
+		"event_metadata":    {id, data, int64(0)},
+		"event_by_topic_v2": {id, topicID, eventTime, date, int64(0)},
+		"event_by_dc_v2":    {id, dcID, eventTime, date, int64(0)},
+		"event_by_host_v2":  {id, strings.ToLower(evt.Host), eventTime, date, int64(0)},
+		"event_by_date_v2":  {id, eventTime, date, int64(0)},
+
+		"event_by_received_time": {id, row[9], getDate(row[9].(int64) / 1000), int64(0)},
+	}
+	if evt.User != "" {
+		want["event_by_user_v2"] = []interface{}{id, strings.ToLower(evt.User), eventTime, date, int64(0)}
+	}
+	if evt.ParentEventID != "" {
+		want["event_by_parent_event_id_v2"] = []interface{}{id, evt.ParentEventID, eventTime, date, int64(0)}
+	}
+	assert.Equal(t, want, stmts)
 }
 
 func TestAddEvent(t *testing.T) {
@@ -463,30 +564,186 @@ func TestAddEvent(t *testing.T) {
 	assert.Nil(t, err)
 
 	for _, test := range addEventTests {
-		id, err := s.AddEvent(test.Event)
+		id, err := s.AddEvent(context.Background(), test.Event)
 		assert.Equal(t, test.ErrExpected, err != nil)
 		if !test.ErrExpected {
 			_, err := ksuid.Parse(id)
 			assert.Nil(t, err)
-			assert.True(t, checkAddEventQuery(s.ds.(*CassandraStore).session.(*cassandra.MockCassSession).LastQuery(), id, test.Event))
+			checkAddEventBatch(t, fakeSession(s).LastBatch(), id, test.Event, s)
 		}
 	}
 }
 
+func TestAddEvents(t *testing.T) {
+	s, err := GetTestEventStore(NewNoOpDataStore())
+	assert.Nil(t, err)
+
+	err = populateTopics(s)
+	assert.Nil(t, err)
+
+	err = populateDCs(s)
+	assert.Nil(t, err)
+
+	var evts []*UnaddedEvent
+	for _, test := range addEventTests {
+		evts = append(evts, test.Event)
+	}
+	results := s.AddEvents(context.Background(), evts)
+	assert.Equal(t, len(addEventTests), len(results))
+	for i, test := range addEventTests {
+		assert.Equal(t, test.ErrExpected, results[i].Error != "")
+		assert.Equal(t, test.ErrExpected, results[i].EventID == "")
+		if !test.ErrExpected {
+			_, err := ksuid.Parse(results[i].EventID)
+			assert.Nil(t, err)
+		}
+	}
+	assert.Equal(t, cassandra.UnloggedBatch, fakeSession(s).LastBatch().Kind)
+}
+
+func TestAddEventsPartialFailure(t *testing.T) {
+	s := newTestEventStore(t, NewNoOpDataStore())
+	// fail the batch holding the event on host "bad"
+	fakeSession(s).Err = func(stmt cassandra.Statement) error {
+		for _, v := range stmt.Values {
+			if v == "bad" {
+				return errors.New("timeout")
+			}
+		}
+		return nil
+	}
+	sub, err := s.Subscribe(&eventmaster.Query{})
+	assert.Nil(t, err)
+	defer sub.Close()
+
+	var evts []*UnaddedEvent
+	for i := 0; i < cassandraBatchSize+5; i++ {
+		evts = append(evts, &UnaddedEvent{DC: "dc1", TopicName: "test1", Host: "h"})
+	}
+	evts[cassandraBatchSize+1].Host = "bad"
+	results := s.AddEvents(context.Background(), evts)
+	for i, res := range results {
+		failed := i >= cassandraBatchSize
+		assert.Equal(t, failed, res.Error != "", "result %d: %+v", i, res)
+		assert.Equal(t, failed, res.EventID == "", "result %d: %+v", i, res)
+	}
+	assert.Equal(t, cassandraBatchSize, len(sub.Events()))
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	ds := &mockDataStore{}
+	s, err := GetTestEventStore(ds)
+	assert.Nil(t, err)
+	assert.Nil(t, populateTopics(s))
+	assert.Nil(t, populateDCs(s))
+
+	evt := func(key string) *UnaddedEvent {
+		return &UnaddedEvent{DC: "dc1", TopicName: "test1", Host: "h", IdempotencyKey: key}
+	}
+
+	id, err := s.AddEvent(context.Background(), evt("build-1"))
+	assert.Nil(t, err)
+	dup, err := s.AddEvent(context.Background(), evt("build-1"))
+	assert.Nil(t, err)
+	assert.Equal(t, id, dup)
+	assert.Equal(t, 1, len(ds.events))
+
+	other, err := s.AddEvent(context.Background(), evt("build-2"))
+	assert.Nil(t, err)
+	assert.NotEqual(t, id, other)
+
+	results := s.AddEvents(context.Background(), []*UnaddedEvent{evt("build-1"), evt("build-3"), evt("build-3"), evt(""), evt("")})
+	assert.Equal(t, id, results[0].EventID)
+	assert.Equal(t, results[1].EventID, results[2].EventID)
+	assert.NotEqual(t, results[3].EventID, results[4].EventID)
+	assert.Equal(t, 5, len(ds.events))
+
+	// once the earlier event is outside of the window the key is reused
+	old := ds.keys["build-1"]
+	old.ReceivedTime -= int64(2 * DefaultIdempotencyWindow / time.Millisecond)
+	ds.keys["build-1"] = old
+	again, err := s.AddEvent(context.Background(), evt("build-1"))
+	assert.Nil(t, err)
+	assert.NotEqual(t, id, again)
+
+	s.SetIdempotencyWindow(0)
+	disabled, err := s.AddEvent(context.Background(), evt("build-2"))
+	assert.Nil(t, err)
+	assert.NotEqual(t, other, disabled)
+}
+
+func TestIdempotencyKeyConcurrent(t *testing.T) {
+	bs, cleanup := newTestBoltStore(t)
+	defer cleanup()
+	s := newTestEventStore(t, bs)
+
+	// retries sent while the first write is still in flight all get the id
+	// of the one event that is stored
+	ids := make([]string, 20)
+	var wg sync.WaitGroup
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id, err := s.AddEvent(context.Background(), &UnaddedEvent{DC: "dc1", TopicName: "test1", Host: "h", IdempotencyKey: "build-1"})
+			if err != nil {
+				t.Errorf("add event: %v", err)
+			}
+			ids[i] = id
+		}(i)
+	}
+	wg.Wait()
+	for i, id := range ids {
+		if id != ids[0] {
+			t.Fatalf("id %d: got %v, want %v", i, id, ids[0])
+		}
+	}
+	n, err := bs.CountEvents(context.Background(), s.getTopicID("test1"), time.Now().Unix()+60)
+	if err != nil {
+		t.Fatalf("count events: %v", err)
+	}
+	if got, want := n, 1; got != want {
+		t.Fatalf("stored events: got %v, want %v", got, want)
+	}
+}
+
+func TestIdempotencyKeyReleasedOnFailure(t *testing.T) {
+	ds := &failingDataStore{mockDataStore: &mockDataStore{}, fails: 1}
+	s := newTestEventStore(t, ds)
+
+	evt := func() *UnaddedEvent {
+		return &UnaddedEvent{DC: "dc1", TopicName: "test1", Host: "h", IdempotencyKey: "build-1"}
+	}
+	if _, err := s.AddEvent(context.Background(), evt()); err == nil {
+		t.Fatalf("add event: got no error")
+	}
+	// the retry is stored rather than given the id of the failed write
+	id, err := s.AddEvent(context.Background(), evt())
+	if err != nil {
+		t.Fatalf("add event: %v", err)
+	}
+	if got, want := len(ds.events), 1; got != want {
+		t.Fatalf("stored events: got %v, want %v", got, want)
+	}
+	if got, want := ds.events[0].EventID, id; got != want {
+		t.Fatalf("stored event: got %v, want %v", got, want)
+	}
+}
+
 func PopulateTestData(es *EventStore) error {
 	for i := 0; i < 5; i++ {
 		dc := &eventmaster.DC{
 			ID:     uuid.NewV4().String(),
 			DCName: fmt.Sprintf("dc%04d", i),
 		}
-		if _, err := es.AddDC(dc); err != nil {
+		if _, err := es.AddDC(context.Background(), dc); err != nil {
 			return errors.Wrapf(err, "adding dc: %v", dc)
 		}
 		t := Topic{
 			ID:   uuid.NewV4().String(),
 			Name: fmt.Sprintf("t%04d", i),
 		}
-		if _, err := es.AddTopic(t); err != nil {
+		if _, err := es.AddTopic(context.Background(), t); err != nil {
 			return errors.Wrapf(err, "adding topic: %v", t)
 		}
 	}
@@ -1,12 +1,22 @@
 package eventmaster
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"time"
 
-	"github.com/ContextLogic/eventmaster/jh"
 	"github.com/julienschmidt/httprouter"
 	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ContextLogic/eventmaster/jh"
+	"github.com/ContextLogic/eventmaster/metrics"
+	eventmaster "github.com/ContextLogic/eventmaster/proto"
 )
 
 // EventResult is the json-serializable version of an Event.
@@ -27,6 +37,12 @@ type EventResult struct {
 // SearchResult groups a slice of EventResult for http responses.
 type SearchResult struct {
 	Results []*EventResult `json:"results"`
+	// Cursor fetches the next page of results when passed back as the
+	// cursor query parameter. It is empty on the last page.
+	Cursor string `json:"cursor,omitempty"`
+	// Facets are the most common values of each facet across every
+	// matching event, when asked for with the facets query parameter.
+	Facets Facets `json:"facets,omitempty"`
 }
 
 func (s *Server) addEvent(w http.ResponseWriter, r *http.Request, _ httprouter.Params) (interface{}, error) {
@@ -35,66 +51,289 @@ func (s *Server) addEvent(w http.ResponseWriter, r *http.Request, _ httprouter.P
 		return evt, jh.NewError(errors.Wrap(err, "json decode").Error(), http.StatusBadRequest)
 	}
 
-	id, err := s.store.AddEvent(&evt)
+	id, err := s.store.AddEvent(r.Context(), &evt)
 	if err != nil {
 		return nil, jh.Wrap(err, "add event")
 	}
 	return map[string]string{"event_id": id}, nil
 }
 
+// maxBatchLine is the longest line accepted in an NDJSON batch.
+const maxBatchLine = 1 << 20
+
+// maxBatchBytes and maxBatchEvents bound the size of a batch request.
+const (
+	maxBatchBytes  = 16 << 20
+	maxBatchEvents = 10000
+)
+
+// addEvents stores a batch of events, sent either as a json array or as
+// newline-delimited json with one event per line. Each event gets its own
+// result so that one bad event does not fail the batch.
+func (s *Server) addEvents(w http.ResponseWriter, r *http.Request, _ httprouter.Params) (interface{}, error) {
+	limited := &io.LimitedReader{R: r.Body, N: maxBatchBytes + 1}
+	tooLarge := func() error {
+		if limited.N > 0 {
+			return nil
+		}
+		return jh.NewError(fmt.Sprintf("batch is larger than %d bytes", maxBatchBytes), http.StatusRequestEntityTooLarge)
+	}
+	body := bufio.NewReader(limited)
+	var raw [][]byte
+	if first, err := peekNonSpace(body); err == nil && first == '[' {
+		var items []json.RawMessage
+		if err := json.NewDecoder(body).Decode(&items); err != nil {
+			if err := tooLarge(); err != nil {
+				return nil, err
+			}
+			return nil, jh.NewError(errors.Wrap(err, "json decode").Error(), http.StatusBadRequest)
+		}
+		for _, item := range items {
+			raw = append(raw, item)
+		}
+	} else {
+		sc := bufio.NewScanner(body)
+		sc.Buffer(make([]byte, 64*1024), maxBatchLine)
+		for sc.Scan() {
+			line := bytes.TrimSpace(sc.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			raw = append(raw, append([]byte(nil), line...))
+		}
+		if err := sc.Err(); err != nil {
+			return nil, jh.NewError(errors.Wrap(err, "reading body").Error(), http.StatusBadRequest)
+		}
+	}
+	if err := tooLarge(); err != nil {
+		return nil, err
+	}
+	if len(raw) == 0 {
+		return nil, jh.NewError("no events in request", http.StatusBadRequest)
+	}
+	if len(raw) > maxBatchEvents {
+		return nil, jh.NewError(fmt.Sprintf("batch has more than %d events", maxBatchEvents), http.StatusRequestEntityTooLarge)
+	}
+
+	results := make([]AddEventResult, len(raw))
+	var evts []*UnaddedEvent
+	var idx []int
+	for i, b := range raw {
+		var evt UnaddedEvent
+		if err := json.Unmarshal(b, &evt); err != nil {
+			results[i].Error = errors.Wrap(err, "json decode").Error()
+			continue
+		}
+		evts = append(evts, &evt)
+		idx = append(idx, i)
+	}
+	for j, res := range s.store.AddEvents(r.Context(), evts) {
+		results[idx[j]] = res
+	}
+	return map[string][]AddEventResult{"results": results}, nil
+}
+
+// peekNonSpace skips leading whitespace in r and returns the next byte
+// without consuming it.
+func peekNonSpace(r *bufio.Reader) (byte, error) {
+	for {
+		b, err := r.Peek(1)
+		if err != nil {
+			return 0, err
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			r.ReadByte()
+		default:
+			return b[0], nil
+		}
+	}
+}
+
 func (s *Server) getEvent(w http.ResponseWriter, r *http.Request, _ httprouter.Params) (interface{}, error) {
 	q, err := getQueryFromRequest(r)
 	if err != nil {
 		return q, jh.NewError(errors.Wrap(err, "get query from request").Error(), http.StatusBadRequest)
 	}
 
-	events, err := s.store.Find(q)
+	if r.URL.Query().Get("explain") == "true" {
+		p, err := s.store.Explain(r.Context(), q)
+		if err != nil {
+			return nil, jh.Wrap(err, "explain query")
+		}
+		return map[string]*QueryPlan{"plan": p}, nil
+	}
+
+	var facetLimit int
+	if f := r.URL.Query().Get("facets"); f != "" {
+		if facetLimit, err = strconv.Atoi(f); err != nil || facetLimit < 1 || facetLimit > maxFacetLimit {
+			return nil, jh.NewError(fmt.Sprintf("facets must be a number from 1 to %d", maxFacetLimit), http.StatusBadRequest)
+		}
+	}
+
+	events, cursor, facets, err := s.store.FindWithFacets(r.Context(), q, facetLimit)
 	if err != nil {
-		return events, errors.Wrap(err, "find events")
+		return events, jh.Wrap(err, "find events")
 	}
 
-	sr := SearchResult{}
+	sr := SearchResult{Cursor: cursor, Facets: facets}
 	for _, ev := range events {
-		sr.Results = append(sr.Results, &EventResult{
-			EventID:       ev.EventID,
-			ParentEventID: ev.ParentEventID,
-			EventTime:     ev.EventTime,
-			DC:            s.store.getDCName(ev.DCID),
-			TopicName:     s.store.getTopicName(ev.TopicID),
-			Tags:          ev.Tags,
-			Host:          ev.Host,
-			TargetHosts:   ev.TargetHosts,
-			User:          ev.User,
-			Data:          ev.Data,
-		})
+		sr.Results = append(sr.Results, s.store.eventResult(ev))
 	}
 	return sr, nil
 }
 
+// aggregateEvents counts the events matching the query in the request body,
+// as described by its interval and group_by.
+func (s *Server) aggregateEvents(w http.ResponseWriter, r *http.Request, _ httprouter.Params) (interface{}, error) {
+	var aq eventmaster.AggregateQuery
+	if err := json.NewDecoder(r.Body).Decode(&aq); err != nil {
+		return nil, jh.NewError(errors.Wrap(err, "json decode").Error(), http.StatusBadRequest)
+	}
+	q := aq.Query
+	if q == nil {
+		q = &eventmaster.Query{}
+	}
+	res, err := s.store.Aggregate(r.Context(), q, Aggregation{Interval: aq.Interval, GroupBy: aq.GroupBy})
+	if err != nil {
+		return nil, jh.Wrap(err, "aggregate events")
+	}
+	return res, nil
+}
+
+// postEventByID dispatches POST /v1/event/:id, where the only id is
+// "aggregate"; httprouter does not allow a static route alongside :id.
+func (s *Server) postEventByID(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if ps.ByName("id") != "aggregate" {
+		jh.Adapter(func(http.ResponseWriter, *http.Request, httprouter.Params) (interface{}, error) {
+			return nil, jh.NewError("not found", http.StatusNotFound)
+		})(w, r, ps)
+		return
+	}
+	latency("/v1/event/aggregate", jh.Adapter(s.aggregateEvents))(w, r, ps)
+}
+
 func (s *Server) getEventByID(w http.ResponseWriter, r *http.Request, ps httprouter.Params) (interface{}, error) {
 	eventID := ps.ByName("id")
 	if eventID == "" {
 		return nil, errors.New("did not provide event id")
 	}
 
-	ev, err := s.store.FindByID(eventID)
+	ev, err := s.store.FindByID(r.Context(), eventID)
 	if err != nil {
 		return ev, errors.Wrap(err, "find by id")
 	}
 
-	ret := map[string]EventResult{
-		"result": {
-			EventID:       ev.EventID,
-			ParentEventID: ev.ParentEventID,
-			EventTime:     ev.EventTime,
-			DC:            s.store.getDCName(ev.DCID),
-			TopicName:     s.store.getTopicName(ev.TopicID),
-			Tags:          ev.Tags,
-			Host:          ev.Host,
-			TargetHosts:   ev.TargetHosts,
-			User:          ev.User,
-			Data:          ev.Data,
-		},
+	ret := map[string]*EventResult{
+		"result": s.store.eventResult(ev),
 	}
 	return ret, nil
 }
+
+// eventByIDOrStream dispatches /v1/event/:id, where the id "stream" is the
+// live event stream; httprouter does not allow a static route alongside :id.
+func (s *Server) eventByIDOrStream(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if ps.ByName("id") == "stream" {
+		s.streamEvents(w, r, ps)
+		return
+	}
+	latency("/v1/event", jh.Adapter(s.getEventByID))(w, r, ps)
+}
+
+// streamEvents sends newly added events that match the query parameters to
+// the client as Server-Sent Events, until the client disconnects.
+//
+// Each event is sent as an EventResult in json with its event id as the SSE
+// id. If the client cannot keep up a final "error" event is sent and the
+// stream is closed.
+func (s *Server) streamEvents(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	metrics.HTTPStatus("/v1/event/stream", http.StatusOK)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSONError(w, jh.NewError("streaming unsupported", http.StatusInternalServerError))
+		return
+	}
+	q, err := getQueryFromRequest(r)
+	if err != nil {
+		writeJSONError(w, jh.NewError(errors.Wrap(err, "get query from request").Error(), http.StatusBadRequest))
+		return
+	}
+	sub, err := s.store.Subscribe(q)
+	if err != nil {
+		writeJSONError(w, jh.Wrap(err, "subscribe"))
+		return
+	}
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// comments keep idle connections from being closed by proxies
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			if _, err := io.WriteString(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case ev, ok := <-sub.Events():
+			if !ok {
+				if err := sub.Err(); err != nil {
+					b, _ := json.Marshal(map[string]string{"error": err.Error()})
+					fmt.Fprintf(w, "event: error\ndata: %s\n\n", b)
+					flusher.Flush()
+				}
+				return
+			}
+			b, err := json.Marshal(s.store.eventResult(ev))
+			if err != nil {
+				log.Errorf("json encode of event %v: %v", ev.EventID, err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "id: %s\ndata: %s\n\n", ev.EventID, b); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// writeJSONError writes err in the same form as jh.Adapter.
+func writeJSONError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if e, ok := err.(jh.Error); ok {
+		status = e.Status()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	r := map[string]string{"error": err.Error()}
+	if err := json.NewEncoder(w).Encode(&r); err != nil {
+		log.Printf("json encode: %v", err)
+	}
+}
+
+// eventResult converts ev, as returned by the DataStores, into the form sent
+// to clients, with topic and dc names in place of ids.
+func (es *EventStore) eventResult(ev *Event) *EventResult {
+	return &EventResult{
+		EventID:       ev.EventID,
+		ParentEventID: ev.ParentEventID,
+		EventTime:     ev.EventTime,
+		DC:            es.getDCName(ev.DCID),
+		TopicName:     es.getTopicName(ev.TopicID),
+		Tags:          ev.Tags,
+		Host:          ev.Host,
+		TargetHosts:   ev.TargetHosts,
+		User:          ev.User,
+		Data:          ev.Data,
+		ReceivedTime:  ev.ReceivedTime,
+	}
+}
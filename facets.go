@@ -0,0 +1,59 @@
+package eventmaster
+
+import (
+	"sort"
+)
+
+// facetDimensions are the dimensions that facets are counted for.
+var facetDimensions = []string{GroupByTopic, GroupByDC, GroupByHost, GroupByUser, GroupByTag}
+
+// maxFacetLimit caps the number of values returned for each facet.
+const maxFacetLimit = 100
+
+// FacetCount is the number of matching events with a value.
+type FacetCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// Facets holds the most common values of each facet dimension, most common
+// first.
+type Facets map[string][]FacetCount
+
+// countFacets returns the limit most common values of each facet dimension
+// across evts, after name has been applied to them. Events are counted once
+// for each of their tags, and empty values are left out.
+func countFacets(evts Events, limit int, name func(dim, value string) string) Facets {
+	counts := map[string]map[string]int{}
+	for _, dim := range facetDimensions {
+		counts[dim] = map[string]int{}
+	}
+	for _, evt := range evts {
+		for _, dim := range facetDimensions {
+			for _, v := range groupValues(evt, dim) {
+				if v = name(dim, v); v != "" {
+					counts[dim][v]++
+				}
+			}
+		}
+	}
+
+	f := Facets{}
+	for dim, values := range counts {
+		fc := make([]FacetCount, 0, len(values))
+		for v, n := range values {
+			fc = append(fc, FacetCount{Value: v, Count: n})
+		}
+		sort.Slice(fc, func(i, j int) bool {
+			if fc[i].Count != fc[j].Count {
+				return fc[i].Count > fc[j].Count
+			}
+			return fc[i].Value < fc[j].Value
+		})
+		if len(fc) > limit {
+			fc = fc[:limit]
+		}
+		f[dim] = fc
+	}
+	return f
+}
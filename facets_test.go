@@ -0,0 +1,87 @@
+package eventmaster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCountFacets(t *testing.T) {
+	evts := Events{
+		{TopicID: "t1", DCID: "d1", Host: "Web1", User: "alice", Tags: []string{"deploy", "api"}},
+		{TopicID: "t1", DCID: "d2", Host: "web1", Tags: []string{"api"}},
+		{TopicID: "t2", DCID: "d1", Host: "web2", User: "bob"},
+	}
+	names := map[string]string{"t1": "deploys", "t2": "alerts"}
+	f := countFacets(evts, 1, func(dim, value string) string {
+		if dim == GroupByTopic {
+			return names[value]
+		}
+		return value
+	})
+	want := Facets{
+		GroupByTopic: {{Value: "deploys", Count: 2}},
+		GroupByDC:    {{Value: "d1", Count: 2}},
+		GroupByHost:  {{Value: "web1", Count: 2}},
+		GroupByUser:  {{Value: "alice", Count: 1}},
+		GroupByTag:   {{Value: "api", Count: 2}},
+	}
+	assert.Equal(t, want, f)
+}
+
+func TestFacetsHTTP(t *testing.T) {
+	store := newTestEventStore(t, &mockDataStore{})
+	ts := httptest.NewServer(NewServer(store, "", ""))
+	defer ts.Close()
+
+	now := time.Now().Unix()
+	for i, host := range []string{"a", "b", "a"} {
+		evt := &UnaddedEvent{DC: "dc1", TopicName: "test1", Host: host, EventTime: now - int64(i)}
+		if _, err := store.AddEvent(context.Background(), evt); err != nil {
+			t.Fatalf("add event: %v", err)
+		}
+	}
+
+	get := func(params string) (*http.Response, SearchResult) {
+		resp, err := http.Get(fmt.Sprintf("%s/v1/event?start_event_time=%d&end_event_time=%d&%s", ts.URL, now-60, now+60, params))
+		if err != nil {
+			t.Fatalf("get events: %v", err)
+		}
+		defer resp.Body.Close()
+		var sr SearchResult
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&sr); err != nil {
+				t.Fatalf("json decode: %v", err)
+			}
+		}
+		return resp, sr
+	}
+
+	resp, sr := get("facets=5&limit=1")
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		t.Fatalf("status: got %v, want %v", got, want)
+	}
+	if got, want := len(sr.Results), 1; got != want {
+		t.Fatalf("results: got %v, want %v", got, want)
+	}
+	// facets cover every match, not just the page
+	want := []FacetCount{{Value: "a", Count: 2}, {Value: "b", Count: 1}}
+	assert.Equal(t, want, sr.Facets[GroupByHost])
+	assert.Equal(t, []FacetCount{{Value: "test1", Count: 3}}, sr.Facets[GroupByTopic])
+
+	_, next := get("facets=5&limit=1&cursor=" + sr.Cursor)
+	assert.Equal(t, want, next.Facets[GroupByHost])
+
+	if _, sr := get(""); sr.Facets != nil {
+		t.Fatalf("facets without asking: got %v", sr.Facets)
+	}
+	if resp, _ := get("facets=0"); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("facets=0 status: got %v, want %v", resp.StatusCode, http.StatusBadRequest)
+	}
+}
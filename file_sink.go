@@ -0,0 +1,137 @@
+package eventmaster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Defaults for the FileSinkConfig fields that are left empty.
+const (
+	DefaultFileSinkMaxBytes = 100 << 20
+	DefaultFileSinkMaxFiles = 5
+)
+
+// FileSinkConfig configures a sink that appends events to a file.
+type FileSinkConfig struct {
+	Path string `json:"path"`
+	// MaxBytes is the size above which the file is rotated.
+	MaxBytes int64 `json:"max_bytes"`
+	// MaxFiles is the number of rotated files kept, as Path.1 (the newest)
+	// to Path.MaxFiles.
+	MaxFiles int `json:"max_files"`
+}
+
+// FileSink appends events to a file as newline delimited json, one event per
+// line, rotating the file when it grows past MaxBytes.
+type FileSink struct {
+	conf FileSinkConfig
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+	// closed is set by Close; f is also nil after a failed rotation
+	closed bool
+}
+
+// NewFileSink opens the file in c for appending, creating it if needed.
+func NewFileSink(c FileSinkConfig) (*FileSink, error) {
+	if c.Path == "" {
+		return nil, errors.New("file sink needs a path")
+	}
+	if c.MaxBytes <= 0 {
+		c.MaxBytes = DefaultFileSinkMaxBytes
+	}
+	if c.MaxFiles <= 0 {
+		c.MaxFiles = DefaultFileSinkMaxFiles
+	}
+	s := &FileSink{conf: c}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileSink) open() error {
+	f, err := os.OpenFile(s.conf.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "open %v", s.conf.Path)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.Wrapf(err, "stat %v", s.conf.Path)
+	}
+	s.f, s.size = f, fi.Size()
+	return nil
+}
+
+// rotate shifts the rotated files up by one, dropping the oldest, moves the
+// current file to Path.1 and starts a new one. The file is reopened even if
+// rotating fails, so that later batches can still be written.
+func (s *FileSink) rotate() error {
+	s.f.Close()
+	s.f = nil
+	var err error
+	for i := s.conf.MaxFiles - 1; i >= 1 && err == nil; i-- {
+		from := fmt.Sprintf("%s.%d", s.conf.Path, i)
+		if err = os.Rename(from, fmt.Sprintf("%s.%d", s.conf.Path, i+1)); os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if err == nil {
+		err = os.Rename(s.conf.Path, s.conf.Path+".1")
+	}
+	if openErr := s.open(); openErr != nil {
+		return openErr
+	}
+	return errors.Wrapf(err, "rotate %v", s.conf.Path)
+}
+
+// Send implements Sink. A batch is never split across two files.
+func (s *FileSink) Send(ctx context.Context, evts []*EventResult) error {
+	var lines []byte
+	for _, evt := range evts {
+		b, err := json.Marshal(evt)
+		if err != nil {
+			return errors.Wrapf(err, "json encode event %v", evt.EventID)
+		}
+		lines = append(append(lines, b...), '\n')
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errors.New("file sink is closed")
+	}
+	if s.f == nil {
+		// a failed rotation could not reopen the file
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	if s.size > 0 && s.size+int64(len(lines)) > s.conf.MaxBytes {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.f.Write(lines)
+	s.size += int64(n)
+	return errors.Wrapf(err, "write %v", s.conf.Path)
+}
+
+// Close implements Sink.
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return errors.Wrapf(err, "close %v", s.conf.Path)
+}
@@ -0,0 +1,190 @@
+package eventmaster
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+
+	eventmaster "github.com/ContextLogic/eventmaster/proto"
+)
+
+// filterEvents returns the subset of evts that satisfy the tag, exclude tag,
+// target host and data constraints in q.
+//
+// These constraints are not backed by an index in BoltStore, and data is
+// not indexed by CassandraStore, so they are applied after candidate events
+// have been fetched. Filtering on data requires that evts were fetched with
+// their data.
+func filterEvents(q *eventmaster.Query, evts Events) (Events, error) {
+	dataFilter, err := parseDataFilter(q.Data)
+	if err != nil {
+		return nil, err
+	}
+	if len(q.TagSet) == 0 && len(q.ExcludeTagSet) == 0 && len(q.TargetHostSet) == 0 && len(dataFilter) == 0 {
+		return evts, nil
+	}
+	r := Events{}
+	for _, evt := range evts {
+		if matchesTargetHosts(q, evt) && matchesTags(q, evt) && matchesData(dataFilter, evt) {
+			r = append(r, evt)
+		}
+	}
+	return r, nil
+}
+
+// matchesTargetHosts reports whether evt has the target hosts requested in q.
+//
+// If q.TargetHostAndOperator is set all target hosts must be present,
+// otherwise any one of them is sufficient.
+func matchesTargetHosts(q *eventmaster.Query, evt *Event) bool {
+	if len(q.TargetHostSet) == 0 {
+		return true
+	}
+	return containsSet(evt.TargetHosts, q.TargetHostSet, q.TargetHostAndOperator)
+}
+
+// matchesTags reports whether evt has the tags requested in q, and none of
+// the excluded tags.
+func matchesTags(q *eventmaster.Query, evt *Event) bool {
+	if len(q.TagSet) > 0 && !containsSet(evt.Tags, q.TagSet, q.TagAndOperator) {
+		return false
+	}
+	if len(q.ExcludeTagSet) > 0 && containsSet(evt.Tags, q.ExcludeTagSet, false) {
+		return false
+	}
+	return true
+}
+
+// matchesData reports whether every path in filter exists in evt's data with
+// exactly the given value.
+func matchesData(filter []Pair, evt *Event) bool {
+	for _, p := range filter {
+		v, ok := lookupDataPath(evt.Data, p.a)
+		if !ok || !dataValuesEqual(v, p.b) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasEventTimeWindow reports whether q limits the event time of results.
+func hasEventTimeWindow(q *eventmaster.Query) bool {
+	return q.StartEventTime != 0 || q.EndEventTime != 0
+}
+
+// hasReceivedTimeWindow reports whether q limits the received time of
+// results.
+func hasReceivedTimeWindow(q *eventmaster.Query) bool {
+	return q.StartReceivedTime != 0 || q.EndReceivedTime != 0
+}
+
+// validateTimeWindows checks that q has an event time window, a received
+// time window or both, and that each window it has is complete.
+func validateTimeWindows(q *eventmaster.Query) error {
+	if !hasEventTimeWindow(q) && !hasReceivedTimeWindow(q) {
+		return errors.New("Must specify a start and end event time or received time")
+	}
+	if hasEventTimeWindow(q) && (q.StartEventTime == 0 || q.EndEventTime == 0 || q.EndEventTime < q.StartEventTime) {
+		return errors.New("Must specify valid start and end event time")
+	}
+	if hasReceivedTimeWindow(q) && (q.StartReceivedTime == 0 || q.EndReceivedTime == 0 || q.EndReceivedTime < q.StartReceivedTime) {
+		return errors.New("Must specify valid start and end received time")
+	}
+	return nil
+}
+
+// matchesTimeWindows reports whether evt is within the time windows of q.
+// Event times are in seconds and received times in milliseconds, both in q
+// and in evt as returned by a DataStore.
+func matchesTimeWindows(q *eventmaster.Query, evt *Event) bool {
+	if hasEventTimeWindow(q) && (evt.EventTime < q.StartEventTime || evt.EventTime > q.EndEventTime) {
+		return false
+	}
+	if hasReceivedTimeWindow(q) && (evt.ReceivedTime < q.StartReceivedTime || evt.ReceivedTime > q.EndReceivedTime) {
+		return false
+	}
+	return true
+}
+
+// containsSet reports whether have contains all (and == true) or any
+// (and == false) of the values in want.
+func containsSet(have []string, want []string, and bool) bool {
+	h := make(map[string]struct{}, len(have))
+	for _, v := range have {
+		h[v] = struct{}{}
+	}
+	for _, v := range want {
+		_, ok := h[v]
+		if and && !ok {
+			return false
+		}
+		if !and && ok {
+			return true
+		}
+	}
+	return and
+}
+
+// eventMatcher reports whether single events satisfy a query, for use where
+// events are not fetched from a DataStore (e.g. live subscriptions).
+//
+// Unlike DataStore.Find no time window is applied.
+type eventMatcher struct {
+	q          *eventmaster.Query
+	topicIDs   map[string]struct{}
+	dcIDs      map[string]struct{}
+	hosts      map[string]struct{}
+	users      map[string]struct{}
+	parentIDs  map[string]struct{}
+	dataFilter []Pair
+}
+
+// newEventMatcher builds an eventMatcher for q, where topicIDs and dcIDs are
+// the ids of the topics and dcs named in q.
+func newEventMatcher(q *eventmaster.Query, topicIDs []string, dcIDs []string) (*eventMatcher, error) {
+	dataFilter, err := parseDataFilter(q.Data)
+	if err != nil {
+		return nil, err
+	}
+	return &eventMatcher{
+		q:          q,
+		topicIDs:   stringSet(topicIDs),
+		dcIDs:      stringSet(dcIDs),
+		hosts:      stringSet(lowerAll(q.Host)),
+		users:      stringSet(lowerAll(q.User)),
+		parentIDs:  stringSet(q.ParentEventID),
+		dataFilter: dataFilter,
+	}, nil
+}
+
+func (m *eventMatcher) matches(evt *Event) bool {
+	return inSet(m.topicIDs, evt.TopicID) &&
+		inSet(m.dcIDs, evt.DCID) &&
+		inSet(m.hosts, strings.ToLower(evt.Host)) &&
+		inSet(m.users, strings.ToLower(evt.User)) &&
+		inSet(m.parentIDs, evt.ParentEventID) &&
+		matchesTargetHosts(m.q, evt) &&
+		matchesTags(m.q, evt) &&
+		matchesData(m.dataFilter, evt)
+}
+
+// stringSet returns the values in strs as a set, or nil if strs is empty.
+func stringSet(strs []string) map[string]struct{} {
+	if len(strs) == 0 {
+		return nil
+	}
+	s := make(map[string]struct{}, len(strs))
+	for _, v := range strs {
+		s[v] = struct{}{}
+	}
+	return s
+}
+
+// inSet reports whether v is in set; an empty set matches everything.
+func inSet(set map[string]struct{}, v string) bool {
+	if set == nil {
+		return true
+	}
+	_, ok := set[v]
+	return ok
+}
@@ -16,7 +16,7 @@ func (s *Server) gitHubEvent(w http.ResponseWriter, r *http.Request, _ httproute
 		return nil, jh.NewError(errors.Wrap(err, "json decode").Error(), http.StatusBadRequest)
 	}
 
-	id, err := s.store.AddEvent(&UnaddedEvent{
+	id, err := s.store.AddEvent(r.Context(), &UnaddedEvent{
 		DC:        "github",
 		Host:      "github",
 		TopicName: "github",
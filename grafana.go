@@ -133,7 +133,7 @@ func (h *Server) grafanaAnnotations(w http.ResponseWriter, r *http.Request, p ht
 			}
 		}
 
-		evs, err := h.store.Find(q)
+		evs, _, err := h.store.Find(r.Context(), q)
 		if err != nil {
 			e := errors.Wrapf(err, "grafana search with %v", q)
 			http.Error(w, e.Error(), http.StatusInternalServerError)
@@ -169,7 +169,7 @@ func (h *Server) grafanaSearch(w http.ResponseWriter, r *http.Request, p httprou
 	tags := []string{"all"}
 	switch req.Target {
 	case "dc":
-		dcs, err := h.store.GetDCs()
+		dcs, err := h.store.GetDCs(r.Context())
 		if err != nil {
 			http.Error(w, errors.Wrap(err, "get dcs").Error(), http.StatusInternalServerError)
 			return
@@ -178,7 +178,7 @@ func (h *Server) grafanaSearch(w http.ResponseWriter, r *http.Request, p httprou
 			tags = append(tags, dc.Name)
 		}
 	case "topic":
-		topics, err := h.store.GetTopics()
+		topics, err := h.store.GetTopics(r.Context())
 		if err != nil {
 			http.Error(w, errors.Wrap(err, "get topics").Error(), http.StatusInternalServerError)
 			return
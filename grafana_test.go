@@ -2,6 +2,7 @@ package eventmaster
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"io"
 	"net/http"
@@ -112,11 +113,11 @@ func TestGrafanaAnnotations(t *testing.T) {
 		t.Fatalf("populating test data: %v", err)
 	}
 
-	topics, err := mds.GetTopics()
+	topics, err := mds.GetTopics(context.Background())
 	if err != nil {
 		t.Fatalf("get topics: %v", err)
 	}
-	dcs, err := mds.GetDCs()
+	dcs, err := mds.GetDCs(context.Background())
 	if err != nil {
 		t.Fatalf("get dcs: %v", err)
 	}
@@ -133,7 +134,7 @@ func TestGrafanaAnnotations(t *testing.T) {
 				TopicName: topic.Name,
 				EventTime: et,
 			}
-			if _, err := store.AddEvent(e); err != nil {
+			if _, err := store.AddEvent(context.Background(), e); err != nil {
 				t.Fatalf("adding event: %v", err)
 			}
 			i++
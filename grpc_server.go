@@ -1,12 +1,19 @@
 package eventmaster
 
 import (
+	"context"
 	"encoding/json"
+	"io"
+	"net/http"
 	"time"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/pkg/errors"
-	context "golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 
+	"github.com/ContextLogic/eventmaster/jh"
 	"github.com/ContextLogic/eventmaster/metrics"
 	eventmaster "github.com/ContextLogic/eventmaster/proto"
 )
@@ -46,28 +53,87 @@ func (s *GRPCServer) performOperation(method string, op func() (string, error))
 // AddEvent adds an event to the datastore.
 func (s *GRPCServer) AddEvent(ctx context.Context, evt *eventmaster.Event) (*eventmaster.WriteResponse, error) {
 	return s.performOperation("AddEvent", func() (string, error) {
-		if evt.Data == nil {
-			evt.Data = []byte("{}")
-		}
-		var data map[string]interface{}
-		err := json.Unmarshal(evt.Data, &data)
+		e, err := fromProtoEvent(evt)
 		if err != nil {
-			return "", errors.Wrap(err, "json decode of data")
+			return "", err
 		}
-		return s.store.AddEvent(&UnaddedEvent{
-			ParentEventID: evt.ParentEventID,
-			EventTime:     evt.EventTime,
-			DC:            evt.DC,
-			TopicName:     evt.TopicName,
-			Tags:          evt.TagSet,
-			Host:          evt.Host,
-			TargetHosts:   evt.TargetHostSet,
-			User:          evt.User,
-			Data:          data,
-		})
+		return s.store.AddEvent(ctx, e)
 	})
 }
 
+// MaxGRPCMessageSize is the largest message the gRPC server accepts.
+const MaxGRPCMessageSize = maxBatchBytes
+
+// AddEvents adds all of the events sent on the stream once the client closes
+// it, and replies with a result per event in the order they were sent. A
+// stream is bounded like an HTTP batch, and fails with ResourceExhausted
+// once it sends more than maxBatchEvents events or maxBatchBytes bytes.
+func (s *GRPCServer) AddEvents(stream eventmaster.EventMaster_AddEventsServer) error {
+	name := "AddEvents"
+	start := time.Now()
+	defer func() {
+		metrics.GRPCLatency(name, start)
+	}()
+
+	var results []*eventmaster.AddEventResult
+	var evts []*UnaddedEvent
+	var idx []int
+	size := 0
+	for {
+		evt, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			metrics.GRPCFailure(name)
+			return errors.Wrap(err, "receiving events")
+		}
+		size += proto.Size(evt)
+		if len(results) == maxBatchEvents || size > maxBatchBytes {
+			metrics.GRPCFailure(name)
+			return status.Errorf(codes.ResourceExhausted, "batch has more than %d events or %d bytes", maxBatchEvents, maxBatchBytes)
+		}
+		results = append(results, &eventmaster.AddEventResult{})
+		e, err := fromProtoEvent(evt)
+		if err != nil {
+			results[len(results)-1].Error = err.Error()
+			continue
+		}
+		evts = append(evts, e)
+		idx = append(idx, len(results)-1)
+	}
+	for j, res := range s.store.AddEvents(stream.Context(), evts) {
+		results[idx[j]].EventID = res.EventID
+		results[idx[j]].Error = res.Error
+	}
+
+	metrics.GRPCSuccess(name)
+	return stream.SendAndClose(&eventmaster.AddEventsResponse{Results: results})
+}
+
+// fromProtoEvent converts evt into an UnaddedEvent, decoding its data.
+func fromProtoEvent(evt *eventmaster.Event) (*UnaddedEvent, error) {
+	if evt.Data == nil {
+		evt.Data = []byte("{}")
+	}
+	var data map[string]interface{}
+	if err := json.Unmarshal(evt.Data, &data); err != nil {
+		return nil, errors.Wrap(err, "json decode of data")
+	}
+	return &UnaddedEvent{
+		ParentEventID:  evt.ParentEventID,
+		EventTime:      evt.EventTime,
+		DC:             evt.DC,
+		TopicName:      evt.TopicName,
+		Tags:           evt.TagSet,
+		Host:           evt.Host,
+		TargetHosts:    evt.TargetHostSet,
+		User:           evt.User,
+		Data:           data,
+		IdempotencyKey: evt.IdempotencyKey,
+	}, nil
+}
+
 // GetEventByID returns an event by id.
 func (s *GRPCServer) GetEventByID(ctx context.Context, id *eventmaster.EventID) (*eventmaster.Event, error) {
 	name := "GetEventByID"
@@ -76,7 +142,7 @@ func (s *GRPCServer) GetEventByID(ctx context.Context, id *eventmaster.EventID)
 		metrics.GRPCLatency(name, start)
 	}()
 
-	ev, err := s.store.FindByID(id.EventID)
+	ev, err := s.store.FindByID(ctx, id.EventID)
 	if err != nil {
 		metrics.GRPCFailure(name)
 		return nil, errors.Wrapf(err, "could not find by id", id.EventID)
@@ -97,10 +163,15 @@ func (s *GRPCServer) GetEventByID(ctx context.Context, id *eventmaster.EventID)
 		TargetHostSet: ev.TargetHosts,
 		User:          ev.User,
 		Data:          d,
+		ReceivedTime:  ev.ReceivedTime,
 	}, nil
 }
 
-// GetEvents returns all Events.
+// CursorTrailer is the gRPC trailer key under which GetEvents returns the
+// cursor for the next page of results, if there is one.
+const CursorTrailer = "eventmaster-cursor"
+
+// GetEvents returns all Events matching q, a page at a time if q.Limit is set.
 func (s *GRPCServer) GetEvents(q *eventmaster.Query, stream eventmaster.EventMaster_GetEventsServer) error {
 	name := "GetEvents"
 	start := time.Now()
@@ -108,29 +179,21 @@ func (s *GRPCServer) GetEvents(q *eventmaster.Query, stream eventmaster.EventMas
 		metrics.GRPCLatency(name, start)
 	}()
 
-	events, err := s.store.Find(q)
+	events, cursor, err := s.store.Find(stream.Context(), q)
 	if err != nil {
 		metrics.GRPCFailure(name)
-		return errors.Wrapf(err, "unable to find %v", q)
+		return contextStatus(errors.Wrapf(err, "unable to find %v", q))
+	}
+	if cursor != "" {
+		stream.SetTrailer(metadata.Pairs(CursorTrailer, cursor))
 	}
 	for _, ev := range events {
-		d, err := json.Marshal(ev.Data)
+		e, err := s.toProtoEvent(ev)
 		if err != nil {
 			metrics.GRPCFailure(name)
-			return errors.Wrap(err, "json marshal of data")
+			return err
 		}
-		if err := stream.Send(&eventmaster.Event{
-			EventID:       ev.EventID,
-			ParentEventID: ev.ParentEventID,
-			EventTime:     ev.EventTime,
-			DC:            s.store.getDCName(ev.DCID),
-			TopicName:     s.store.getTopicName(ev.TopicID),
-			TagSet:        ev.Tags,
-			Host:          ev.Host,
-			TargetHostSet: ev.TargetHosts,
-			User:          ev.User,
-			Data:          d,
-		}); err != nil {
+		if err := stream.Send(e); err != nil {
 			metrics.GRPCFailure(name)
 			return errors.Wrap(err, "stream send")
 		}
@@ -139,6 +202,88 @@ func (s *GRPCServer) GetEvents(q *eventmaster.Query, stream eventmaster.EventMas
 	return nil
 }
 
+// AggregateEvents counts the events matching q.Query in buckets of event
+// time, split by q.GroupBy.
+func (s *GRPCServer) AggregateEvents(ctx context.Context, q *eventmaster.AggregateQuery) (*eventmaster.AggregateResult, error) {
+	name := "AggregateEvents"
+	start := time.Now()
+	defer func() {
+		metrics.GRPCLatency(name, start)
+	}()
+
+	query := q.Query
+	if query == nil {
+		query = &eventmaster.Query{}
+	}
+	res, err := s.store.Aggregate(ctx, query, Aggregation{Interval: q.Interval, GroupBy: q.GroupBy})
+	if err != nil {
+		metrics.GRPCFailure(name)
+		return nil, contextStatus(errors.Wrap(err, "unable to aggregate events"))
+	}
+	r := &eventmaster.AggregateResult{Interval: res.Interval, GroupBy: res.GroupBy}
+	for _, b := range res.Buckets {
+		r.Buckets = append(r.Buckets, &eventmaster.AggregateBucket{Time: b.Time, Group: b.Group, Count: b.Count})
+	}
+	metrics.GRPCSuccess(name)
+	return r, nil
+}
+
+// Subscribe streams newly added events matching q until the client goes away.
+//
+// The time fields of q are ignored. If the client does not keep up with the
+// rate of new events the stream is ended with an error.
+func (s *GRPCServer) Subscribe(q *eventmaster.Query, stream eventmaster.EventMaster_SubscribeServer) error {
+	name := "Subscribe"
+	sub, err := s.store.Subscribe(q)
+	if err != nil {
+		metrics.GRPCFailure(name)
+		return errors.Wrapf(err, "unable to subscribe to %v", q)
+	}
+	defer sub.Close()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			metrics.GRPCSuccess(name)
+			return nil
+		case ev, ok := <-sub.Events():
+			if !ok {
+				metrics.GRPCFailure(name)
+				return sub.Err()
+			}
+			e, err := s.toProtoEvent(ev)
+			if err != nil {
+				metrics.GRPCFailure(name)
+				return err
+			}
+			if err := stream.Send(e); err != nil {
+				metrics.GRPCFailure(name)
+				return errors.Wrap(err, "stream send")
+			}
+		}
+	}
+}
+
+func (s *GRPCServer) toProtoEvent(ev *Event) (*eventmaster.Event, error) {
+	d, err := json.Marshal(ev.Data)
+	if err != nil {
+		return nil, errors.Wrap(err, "json marshal of data")
+	}
+	return &eventmaster.Event{
+		EventID:       ev.EventID,
+		ParentEventID: ev.ParentEventID,
+		EventTime:     ev.EventTime,
+		DC:            s.store.getDCName(ev.DCID),
+		TopicName:     s.store.getTopicName(ev.TopicID),
+		TagSet:        ev.Tags,
+		Host:          ev.Host,
+		TargetHostSet: ev.TargetHosts,
+		User:          ev.User,
+		Data:          d,
+		ReceivedTime:  ev.ReceivedTime,
+	}, nil
+}
+
 // GetEventIDs returns all event ids.
 func (s *GRPCServer) GetEventIDs(q *eventmaster.TimeQuery, stream eventmaster.EventMaster_GetEventIDsServer) error {
 	name := "GetEventByIDs"
@@ -150,7 +295,68 @@ func (s *GRPCServer) GetEventIDs(q *eventmaster.TimeQuery, stream eventmaster.Ev
 	streamProxy := func(eventID string) error {
 		return stream.Send(&eventmaster.EventID{EventID: eventID})
 	}
-	return s.store.FindIDs(q, streamProxy)
+	return contextStatus(s.store.FindIDs(stream.Context(), q, streamProxy))
+}
+
+// contextStatus gives err the gRPC status code of a query that ran out of
+// time or whose client went away, so that clients can tell those apart from
+// failures.
+func contextStatus(err error) error {
+	cause := errors.Cause(err)
+	if e, ok := cause.(jh.Error); ok && e.Status() == http.StatusGatewayTimeout {
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	switch cause {
+	case context.DeadlineExceeded:
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case context.Canceled:
+		return status.Error(codes.Canceled, err.Error())
+	}
+	return err
+}
+
+// DeleteEvent deletes an event, recording who deleted it and why.
+func (s *GRPCServer) DeleteEvent(ctx context.Context, r *eventmaster.DeleteEventRequest) (*eventmaster.WriteResponse, error) {
+	return s.performOperation("DeleteEvent", func() (string, error) {
+		return r.EventID, s.store.DeleteEvent(ctx, r.EventID, AuditInfo{User: r.User, Reason: r.Reason})
+	})
+}
+
+// RedactEvent blanks data paths of an event, recording who redacted it and
+// why.
+func (s *GRPCServer) RedactEvent(ctx context.Context, r *eventmaster.RedactEventRequest) (*eventmaster.WriteResponse, error) {
+	return s.performOperation("RedactEvent", func() (string, error) {
+		return r.EventID, s.store.RedactEvent(ctx, r.EventID, r.Paths, AuditInfo{User: r.User, Reason: r.Reason})
+	})
+}
+
+// GetAuditTrail returns the deletions and redactions of an event.
+func (s *GRPCServer) GetAuditTrail(ctx context.Context, id *eventmaster.EventID) (*eventmaster.AuditTrail, error) {
+	name := "GetAuditTrail"
+	start := time.Now()
+	defer func() {
+		metrics.GRPCLatency(name, start)
+	}()
+
+	entries, err := s.store.AuditTrail(ctx, id.EventID)
+	if err != nil {
+		metrics.GRPCFailure(name)
+		return nil, errors.Wrap(err, "get audit trail")
+	}
+	trail := &eventmaster.AuditTrail{}
+	for _, e := range entries {
+		trail.Results = append(trail.Results, &eventmaster.AuditEntry{
+			ID:      e.ID,
+			EventID: e.EventID,
+			Action:  e.Action,
+			Paths:   e.Paths,
+			User:    e.User,
+			Reason:  e.Reason,
+			Time:    e.Time,
+		})
+	}
+	metrics.GRPCSuccess(name)
+	return trail, nil
 }
 
 // AddTopic is the gRPC verison of AddTopic.
@@ -164,9 +370,10 @@ func (s *GRPCServer) AddTopic(ctx context.Context, t *eventmaster.Topic) (*event
 		if err != nil {
 			return "", errors.Wrap(err, "json unmarshal of data schema")
 		}
-		return s.store.AddTopic(Topic{
-			Name:   t.TopicName,
-			Schema: schema,
+		return s.store.AddTopic(ctx, Topic{
+			Name:             t.TopicName,
+			Schema:           schema,
+			RetentionSeconds: t.RetentionSeconds,
 		})
 	})
 }
@@ -179,10 +386,14 @@ func (s *GRPCServer) UpdateTopic(ctx context.Context, t *eventmaster.UpdateTopic
 		if err != nil {
 			return "", errors.Wrap(err, "json unmarshal of data schema")
 		}
-		return s.store.UpdateTopic(t.OldName, Topic{
+		td := TopicUpdate{
 			Name:   t.NewName,
 			Schema: schema,
-		})
+		}
+		if t.RetentionSeconds != nil {
+			td.RetentionSeconds = &t.RetentionSeconds.Value
+		}
+		return s.store.UpdateTopic(ctx, t.OldName, td)
 	})
 }
 
@@ -194,7 +405,7 @@ func (s *GRPCServer) DeleteTopic(ctx context.Context, t *eventmaster.DeleteTopic
 		metrics.GRPCLatency(name, start)
 	}()
 
-	err := s.store.DeleteTopic(t)
+	err := s.store.DeleteTopic(ctx, t)
 	if err != nil {
 		metrics.GRPCFailure(name)
 		return nil, errors.Wrap(err, "delete topic")
@@ -211,7 +422,7 @@ func (s *GRPCServer) GetTopics(ctx context.Context, _ *eventmaster.EmptyRequest)
 		metrics.GRPCLatency(name, start)
 	}()
 
-	topics, err := s.store.GetTopics()
+	topics, err := s.store.GetTopics(ctx)
 	if err != nil {
 		metrics.GRPCFailure(name)
 		return nil, errors.Wrap(err, "get topics")
@@ -231,9 +442,10 @@ func (s *GRPCServer) GetTopics(ctx context.Context, _ *eventmaster.EmptyRequest)
 			}
 		}
 		topicResults = append(topicResults, &eventmaster.Topic{
-			ID:         topic.ID,
-			TopicName:  topic.Name,
-			DataSchema: schemaBytes,
+			ID:               topic.ID,
+			TopicName:        topic.Name,
+			DataSchema:       schemaBytes,
+			RetentionSeconds: topic.RetentionSeconds,
 		})
 	}
 	metrics.GRPCSuccess(name)
@@ -245,14 +457,14 @@ func (s *GRPCServer) GetTopics(ctx context.Context, _ *eventmaster.EmptyRequest)
 // AddDC is the gRPC version of adding a datacenter.
 func (s *GRPCServer) AddDC(ctx context.Context, d *eventmaster.DC) (*eventmaster.WriteResponse, error) {
 	return s.performOperation("AddDC", func() (string, error) {
-		return s.store.AddDC(d)
+		return s.store.AddDC(ctx, d)
 	})
 }
 
 // UpdateDC is the gRPC version of updating a datacenter.
 func (s *GRPCServer) UpdateDC(ctx context.Context, t *eventmaster.UpdateDCRequest) (*eventmaster.WriteResponse, error) {
 	return s.performOperation("UpdateDC", func() (string, error) {
-		return s.store.UpdateDC(t)
+		return s.store.UpdateDC(ctx, t)
 	})
 }
 
@@ -264,7 +476,7 @@ func (s *GRPCServer) GetDCs(ctx context.Context, _ *eventmaster.EmptyRequest) (*
 		metrics.GRPCLatency(name, start)
 	}()
 
-	dcs, err := s.store.GetDCs()
+	dcs, err := s.store.GetDCs(ctx)
 	if err != nil {
 		metrics.GRPCFailure(name)
 		return nil, errors.Wrap(err, "get dcs")
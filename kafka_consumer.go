@@ -0,0 +1,298 @@
+package eventmaster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+	kafka "github.com/segmentio/kafka-go"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ContextLogic/eventmaster/jh"
+	"github.com/ContextLogic/eventmaster/metrics"
+)
+
+// Headers added to the messages written to a dead-letter topic.
+const (
+	DeadLetterErrorHeader     = "eventmaster-error"
+	DeadLetterTopicHeader     = "eventmaster-source-topic"
+	DeadLetterPartitionHeader = "eventmaster-source-partition"
+	DeadLetterOffsetHeader    = "eventmaster-source-offset"
+)
+
+// kafkaConsumerBackoff is the wait after a message could not be stored for
+// a reason other than the message itself, before it is tried again. It
+// doubles with every failure up to kafkaConsumerMaxBackoff.
+var (
+	kafkaConsumerBackoff    = 500 * time.Millisecond
+	kafkaConsumerMaxBackoff = 30 * time.Second
+)
+
+// KafkaConsumerConfig configures a consumer that adds the messages of a
+// Kafka topic as events.
+type KafkaConsumerConfig struct {
+	// Name identifies the consumer in logs and metrics.
+	Name    string   `json:"name"`
+	Brokers []string `json:"brokers"`
+	Topic   string   `json:"topic"`
+	GroupID string   `json:"group_id"`
+	// Fields maps the json fields of an event, as accepted by
+	// POST /v1/event, to dotted paths in the json message. The path "."
+	// is the whole message.
+	Fields map[string]string `json:"fields"`
+	// Template, used instead of Fields, is a text/template that is executed
+	// with the decoded message and produces the json of the event. The
+	// function json encodes its argument as json.
+	Template string `json:"template"`
+	// Defaults are event json fields used when the mapping does not set
+	// them, e.g. a fixed topic_name.
+	Defaults map[string]interface{} `json:"defaults"`
+	// DeadLetterTopic receives the messages that cannot be stored as
+	// events, with the reason in the DeadLetterErrorHeader header. Without
+	// it they are logged and skipped.
+	DeadLetterTopic string `json:"dead_letter_topic"`
+}
+
+// kafkaReader is the part of a kafka.Reader that a KafkaConsumer uses.
+type kafkaReader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// kafkaWriter is the part of a kafka.Writer that a KafkaConsumer uses.
+type kafkaWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// KafkaConsumer reads messages from a Kafka topic and adds them to an
+// EventStore.
+//
+// The offset of a message is committed only once its event is stored or it
+// has been written to the dead-letter topic, so a message is never lost; it
+// may be stored twice if eventmaster stops between the two, which the
+// idempotency key derived from its offset prevents.
+type KafkaConsumer struct {
+	name       string
+	store      *EventStore
+	conf       KafkaConsumerConfig
+	tmpl       *template.Template
+	reader     kafkaReader
+	deadLetter kafkaWriter
+}
+
+// NewKafkaConsumer returns a consumer that adds the messages described by c
+// to store.
+func NewKafkaConsumer(store *EventStore, c KafkaConsumerConfig) (*KafkaConsumer, error) {
+	if len(c.Brokers) == 0 {
+		return nil, errors.New("kafka consumer needs at least one broker")
+	}
+	if c.GroupID == "" {
+		return nil, errors.New("kafka consumer needs a group id to commit offsets for")
+	}
+	var dl kafkaWriter
+	if c.DeadLetterTopic != "" {
+		dl = &kafka.Writer{
+			Addr:         kafka.TCP(c.Brokers...),
+			Topic:        c.DeadLetterTopic,
+			RequiredAcks: kafka.RequireAll,
+			BatchTimeout: 10 * time.Millisecond,
+		}
+	}
+	r := kafka.NewReader(kafka.ReaderConfig{
+		Brokers: c.Brokers,
+		Topic:   c.Topic,
+		GroupID: c.GroupID,
+	})
+	kc, err := newKafkaConsumer(store, c, r, dl)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return kc, nil
+}
+
+// newKafkaConsumer returns a consumer that reads from r and writes dead
+// letters to dl, which may be nil.
+func newKafkaConsumer(store *EventStore, c KafkaConsumerConfig, r kafkaReader, dl kafkaWriter) (*KafkaConsumer, error) {
+	if c.Topic == "" {
+		return nil, errors.New("kafka consumer needs a topic")
+	}
+	if (len(c.Fields) == 0) == (c.Template == "") {
+		return nil, errors.New("kafka consumer needs either fields or a template")
+	}
+	kc := &KafkaConsumer{name: c.Name, store: store, conf: c, reader: r, deadLetter: dl}
+	if kc.name == "" {
+		kc.name = c.Topic
+	}
+	if c.Template != "" {
+		tmpl, err := template.New(kc.name).Funcs(template.FuncMap{
+			"json": func(v interface{}) (string, error) {
+				b, err := json.Marshal(v)
+				return string(b), err
+			},
+		}).Option("missingkey=zero").Parse(c.Template)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse template")
+		}
+		kc.tmpl = tmpl
+	}
+	return kc, nil
+}
+
+// event maps the message m into an event.
+func (kc *KafkaConsumer) event(m kafka.Message) (*UnaddedEvent, error) {
+	var msg map[string]interface{}
+	if err := json.Unmarshal(m.Value, &msg); err != nil {
+		return nil, errors.Wrap(err, "json decode message")
+	}
+
+	fields := map[string]interface{}{}
+	if kc.tmpl != nil {
+		var b bytes.Buffer
+		if err := kc.tmpl.Execute(&b, msg); err != nil {
+			return nil, errors.Wrap(err, "execute template")
+		}
+		if err := json.Unmarshal(b.Bytes(), &fields); err != nil {
+			return nil, errors.Wrap(err, "json decode template output")
+		}
+	}
+	for field, path := range kc.conf.Fields {
+		if path == "." {
+			fields[field] = msg
+			continue
+		}
+		if v, ok := lookupDataPath(msg, path); ok {
+			fields[field] = v
+		}
+	}
+	for field, v := range kc.conf.Defaults {
+		if _, ok := fields[field]; !ok {
+			fields[field] = v
+		}
+	}
+
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return nil, errors.Wrap(err, "json encode event")
+	}
+	var evt UnaddedEvent
+	if err := json.Unmarshal(b, &evt); err != nil {
+		return nil, errors.Wrap(err, "json decode event")
+	}
+	if evt.EventTime == 0 && !m.Time.IsZero() {
+		evt.EventTime = m.Time.Unix()
+	}
+	if evt.IdempotencyKey == "" {
+		evt.IdempotencyKey = "kafka:" + m.Topic + ":" + strconv.Itoa(m.Partition) + ":" + strconv.FormatInt(m.Offset, 10)
+	}
+	return &evt, nil
+}
+
+// rejected reports whether err means the event itself is invalid, so that
+// adding it again would fail again.
+func rejected(err error) bool {
+	hs, ok := err.(jh.HasStatus)
+	return ok && hs.Status() >= 400 && hs.Status() < 500
+}
+
+// Run consumes messages until ctx is done.
+func (kc *KafkaConsumer) Run(ctx context.Context) {
+	wait := kafkaConsumerBackoff
+	for {
+		err := kc.consume(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			wait = kafkaConsumerBackoff
+			continue
+		}
+		metrics.KafkaMessage(kc.name, "error")
+		log.Errorf("kafka consumer %v: %v", kc.name, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		if wait *= 2; wait > kafkaConsumerMaxBackoff {
+			wait = kafkaConsumerMaxBackoff
+		}
+	}
+}
+
+// consume handles the next message, retrying it until it is either stored
+// or dead-lettered, and then commits its offset.
+func (kc *KafkaConsumer) consume(ctx context.Context) error {
+	m, err := kc.reader.FetchMessage(ctx)
+	if err != nil {
+		return errors.Wrap(err, "fetch message")
+	}
+	wait := kafkaConsumerBackoff
+	for {
+		result, err := kc.handle(ctx, m)
+		if err == nil {
+			metrics.KafkaMessage(kc.name, result)
+			break
+		}
+		metrics.KafkaMessage(kc.name, "error")
+		log.Errorf("kafka consumer %v: offset %d of partition %d: %v", kc.name, m.Offset, m.Partition, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		if wait *= 2; wait > kafkaConsumerMaxBackoff {
+			wait = kafkaConsumerMaxBackoff
+		}
+	}
+	return errors.Wrap(kc.reader.CommitMessages(ctx, m), "commit offset")
+}
+
+// handle stores m as an event, or sends it to the dead-letter topic if it
+// cannot be, returning which it did. An error means neither happened.
+func (kc *KafkaConsumer) handle(ctx context.Context, m kafka.Message) (string, error) {
+	evt, err := kc.event(m)
+	if err == nil {
+		if _, err = kc.store.AddEvent(ctx, evt); err == nil {
+			return "added", nil
+		}
+		if !rejected(err) {
+			return "", errors.Wrap(err, "add event")
+		}
+	}
+	if kc.deadLetter == nil {
+		log.Warnf("kafka consumer %v: skipping offset %d of partition %d: %v", kc.name, m.Offset, m.Partition, err)
+		return "skipped", nil
+	}
+	dl := kafka.Message{
+		Key:   m.Key,
+		Value: m.Value,
+		Headers: append(append([]kafka.Header{}, m.Headers...),
+			kafka.Header{Key: DeadLetterErrorHeader, Value: []byte(err.Error())},
+			kafka.Header{Key: DeadLetterTopicHeader, Value: []byte(m.Topic)},
+			kafka.Header{Key: DeadLetterPartitionHeader, Value: []byte(strconv.Itoa(m.Partition))},
+			kafka.Header{Key: DeadLetterOffsetHeader, Value: []byte(strconv.FormatInt(m.Offset, 10))},
+		),
+	}
+	if err := kc.deadLetter.WriteMessages(ctx, dl); err != nil {
+		return "", errors.Wrap(err, "write to dead-letter topic")
+	}
+	return "dead_letter", nil
+}
+
+// Close closes the consumer's connections.
+func (kc *KafkaConsumer) Close() error {
+	err := kc.reader.Close()
+	if kc.deadLetter != nil {
+		if dlErr := kc.deadLetter.Close(); err == nil {
+			err = dlErr
+		}
+	}
+	return err
+}
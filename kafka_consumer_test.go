@@ -0,0 +1,274 @@
+package eventmaster
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeBroker is an in-process stand-in for a Kafka cluster with a single
+// partition per topic and a single consumer group.
+type fakeBroker struct {
+	mu        sync.Mutex
+	topics    map[string][]kafka.Message
+	committed map[string]int64 // next offset to consume, by topic
+}
+
+func newFakeBroker() *fakeBroker {
+	return &fakeBroker{topics: map[string][]kafka.Message{}, committed: map[string]int64{}}
+}
+
+func (b *fakeBroker) produce(topic string, msgs ...kafka.Message) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, m := range msgs {
+		m.Topic = topic
+		m.Offset = int64(len(b.topics[topic]))
+		if m.Time.IsZero() {
+			m.Time = time.Now()
+		}
+		b.topics[topic] = append(b.topics[topic], m)
+	}
+}
+
+func (b *fakeBroker) messages(topic string) []kafka.Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]kafka.Message(nil), b.topics[topic]...)
+}
+
+func (b *fakeBroker) offset(topic string) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.committed[topic]
+}
+
+// reader returns a group reader for topic that starts at the committed
+// offset, as a restarted consumer would.
+func (b *fakeBroker) reader(topic string) *fakeReader {
+	return &fakeReader{b: b, topic: topic, next: b.offset(topic)}
+}
+
+type fakeReader struct {
+	b     *fakeBroker
+	topic string
+	next  int64
+}
+
+func (r *fakeReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	for {
+		r.b.mu.Lock()
+		msgs := r.b.topics[r.topic]
+		r.b.mu.Unlock()
+		if r.next < int64(len(msgs)) {
+			r.next++
+			return msgs[r.next-1], nil
+		}
+		select {
+		case <-ctx.Done():
+			return kafka.Message{}, ctx.Err()
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func (r *fakeReader) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	r.b.mu.Lock()
+	defer r.b.mu.Unlock()
+	for _, m := range msgs {
+		if m.Offset+1 > r.b.committed[m.Topic] {
+			r.b.committed[m.Topic] = m.Offset + 1
+		}
+	}
+	return nil
+}
+
+func (r *fakeReader) Close() error { return nil }
+
+type fakeWriter struct {
+	b     *fakeBroker
+	topic string
+}
+
+func (w *fakeWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	w.b.produce(w.topic, msgs...)
+	return nil
+}
+
+func (w *fakeWriter) Close() error { return nil }
+
+// failingDataStore fails the first fails writes.
+type failingDataStore struct {
+	*mockDataStore
+	mu    sync.Mutex
+	fails int
+}
+
+func (f *failingDataStore) AddEvent(ctx context.Context, e *Event) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fails > 0 {
+		f.fails--
+		return errors.New("unavailable")
+	}
+	return f.mockDataStore.AddEvent(ctx, e)
+}
+
+func TestKafkaConsumerMapping(t *testing.T) {
+	msg := kafka.Message{
+		Topic:     "deploys",
+		Partition: 2,
+		Offset:    7,
+		Time:      time.Unix(1500000000, 0),
+		Value:     []byte(`{"who":"alice","where":{"dc":"dc1","host":"web1"},"tags":["deploy"],"sha":"abc"}`),
+	}
+
+	fields, err := newKafkaConsumer(nil, KafkaConsumerConfig{
+		Topic: "deploys",
+		Fields: map[string]string{
+			"user":    "who",
+			"dc":      "where.dc",
+			"host":    "where.host",
+			"tag_set": "tags",
+			"data":    ".",
+		},
+		Defaults: map[string]interface{}{"topic_name": "test1", "user": "nobody"},
+	}, nil, nil)
+	if err != nil {
+		t.Fatalf("new consumer: %v", err)
+	}
+	evt, err := fields.event(msg)
+	if err != nil {
+		t.Fatalf("event: %v", err)
+	}
+	assert.Equal(t, "test1", evt.TopicName)
+	assert.Equal(t, "alice", evt.User)
+	assert.Equal(t, "dc1", evt.DC)
+	assert.Equal(t, "web1", evt.Host)
+	assert.Equal(t, []string{"deploy"}, evt.Tags)
+	assert.Equal(t, "abc", evt.Data["sha"])
+	assert.Equal(t, int64(1500000000), evt.EventTime)
+	assert.Equal(t, "kafka:deploys:2:7", evt.IdempotencyKey)
+
+	tmpl, err := newKafkaConsumer(nil, KafkaConsumerConfig{
+		Topic:    "deploys",
+		Template: `{"topic_name":"test2","dc":{{json .where.dc}},"host":{{json .where.host}},"data":{"sha":{{json .sha}}},"event_time":42}`,
+	}, nil, nil)
+	if err != nil {
+		t.Fatalf("new consumer: %v", err)
+	}
+	evt, err = tmpl.event(msg)
+	if err != nil {
+		t.Fatalf("event: %v", err)
+	}
+	assert.Equal(t, "test2", evt.TopicName)
+	assert.Equal(t, "web1", evt.Host)
+	assert.Equal(t, map[string]interface{}{"sha": "abc"}, evt.Data)
+	assert.Equal(t, int64(42), evt.EventTime)
+
+	if _, err := tmpl.event(kafka.Message{Value: []byte("not json")}); err == nil {
+		t.Fatalf("event from invalid json: got nil error")
+	}
+	if _, err := newKafkaConsumer(nil, KafkaConsumerConfig{Topic: "deploys"}, nil, nil); err == nil {
+		t.Fatalf("consumer without fields or template: got nil error")
+	}
+	if _, err := newKafkaConsumer(nil, KafkaConsumerConfig{Topic: "deploys", Template: "{{"}, nil, nil); err == nil {
+		t.Fatalf("consumer with invalid template: got nil error")
+	}
+}
+
+func TestKafkaConsumer(t *testing.T) {
+	defer func(d time.Duration) { kafkaConsumerBackoff = d }(kafkaConsumerBackoff)
+	kafkaConsumerBackoff = time.Millisecond
+
+	ds := &failingDataStore{mockDataStore: &mockDataStore{}}
+	store := newTestEventStore(t, ds)
+	broker := newFakeBroker()
+	conf := KafkaConsumerConfig{
+		Topic:           "in",
+		Fields:          map[string]string{"topic_name": "topic", "dc": "dc", "host": "host"},
+		DeadLetterTopic: "dead",
+	}
+	newConsumer := func() *KafkaConsumer {
+		kc, err := newKafkaConsumer(store, conf, broker.reader("in"), &fakeWriter{b: broker, topic: "dead"})
+		if err != nil {
+			t.Fatalf("new consumer: %v", err)
+		}
+		return kc
+	}
+
+	broker.produce("in",
+		kafka.Message{Value: []byte(`{"topic":"test1","dc":"dc1","host":"a"}`)},
+		kafka.Message{Value: []byte(`not json`), Key: []byte("k")},
+		kafka.Message{Value: []byte(`{"topic":"nope","dc":"dc1","host":"b"}`)},
+		kafka.Message{Value: []byte(`{"topic":"test2","dc":"dc2","host":"c"}`)},
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		newConsumer().Run(ctx)
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for broker.offset("in") < 4 {
+		if time.Now().After(deadline) {
+			t.Fatalf("committed offset: got %v, want 4", broker.offset("in"))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	var hosts []string
+	for _, e := range ds.events {
+		hosts = append(hosts, e.Host)
+	}
+	assert.Equal(t, []string{"a", "c"}, hosts)
+
+	dead := broker.messages("dead")
+	if len(dead) != 2 {
+		t.Fatalf("dead letters: got %v, want 2", len(dead))
+	}
+	assert.Equal(t, []byte("not json"), dead[0].Value)
+	assert.Equal(t, []byte("k"), dead[0].Key)
+	headers := map[string]string{}
+	for _, h := range dead[1].Headers {
+		headers[h.Key] = string(h.Value)
+	}
+	assert.Equal(t, "in", headers[DeadLetterTopicHeader])
+	assert.Equal(t, "2", headers[DeadLetterOffsetHeader])
+	assert.Contains(t, headers[DeadLetterErrorHeader], "nope")
+
+	// a failed write is retried, and its offset only committed once it succeeds
+	ds.fails = 2
+	broker.produce("in", kafka.Message{Value: []byte(`{"topic":"test1","dc":"dc1","host":"d"}`)})
+	if err := newConsumer().consume(context.Background()); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+	assert.Equal(t, int64(5), broker.offset("in"))
+	assert.Equal(t, "d", ds.events[len(ds.events)-1].Host)
+
+	// a write that never succeeds is never committed, and is read again by
+	// the next consumer
+	ds.fails = 1000
+	broker.produce("in", kafka.Message{Value: []byte(`{"topic":"test1","dc":"dc1","host":"e"}`)})
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := newConsumer().consume(ctx); err == nil {
+		t.Fatalf("consume with a failing store: got nil error")
+	}
+	assert.Equal(t, int64(5), broker.offset("in"))
+	ds.fails = 0
+	if err := newConsumer().consume(context.Background()); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+	assert.Equal(t, int64(6), broker.offset("in"))
+	assert.Equal(t, "e", ds.events[len(ds.events)-1].Host)
+	assert.Len(t, broker.messages("dead"), 2)
+}
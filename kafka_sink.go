@@ -0,0 +1,82 @@
+package eventmaster
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+	kafka "github.com/segmentio/kafka-go"
+)
+
+const defaultKafkaTimeout = 10 * time.Second
+
+// KafkaSinkConfig configures a sink that produces events to a Kafka topic.
+type KafkaSinkConfig struct {
+	Brokers []string `json:"brokers"`
+	Topic   string   `json:"topic"`
+	// Timeout limits each write, as a duration string.
+	Timeout string `json:"timeout"`
+}
+
+// KafkaSink produces each event as a json message keyed by its topic name,
+// so that the events of one topic stay in order on one partition.
+type KafkaSink struct {
+	w *kafka.Writer
+}
+
+// NewKafkaSink returns a sink for the topic in c.
+func NewKafkaSink(c KafkaSinkConfig) (*KafkaSink, error) {
+	if len(c.Brokers) == 0 {
+		return nil, errors.New("kafka sink needs at least one broker")
+	}
+	if c.Topic == "" {
+		return nil, errors.New("kafka sink needs a topic")
+	}
+	timeout, err := durationOrDefault(c.Timeout, defaultKafkaTimeout)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse timeout")
+	}
+	return &KafkaSink{w: &kafka.Writer{
+		Addr:         kafka.TCP(c.Brokers...),
+		Topic:        c.Topic,
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+		WriteTimeout: timeout,
+		// the sink queue already batches, so writes need not wait for more
+		BatchTimeout: 10 * time.Millisecond,
+		// and it retries with its own backoff
+		MaxAttempts: 1,
+	}}, nil
+}
+
+// kafkaMessages converts evts into the messages produced for them.
+func kafkaMessages(evts []*EventResult) ([]kafka.Message, error) {
+	msgs := make([]kafka.Message, 0, len(evts))
+	for _, evt := range evts {
+		b, err := json.Marshal(evt)
+		if err != nil {
+			return nil, errors.Wrapf(err, "json encode event %v", evt.EventID)
+		}
+		msgs = append(msgs, kafka.Message{
+			Key:   []byte(evt.TopicName),
+			Value: b,
+			Time:  time.Unix(evt.EventTime, 0),
+		})
+	}
+	return msgs, nil
+}
+
+// Send implements Sink.
+func (k *KafkaSink) Send(ctx context.Context, evts []*EventResult) error {
+	msgs, err := kafkaMessages(evts)
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(k.w.WriteMessages(ctx, msgs...), "write kafka messages")
+}
+
+// Close implements Sink.
+func (k *KafkaSink) Close() error {
+	return k.w.Close()
+}
@@ -15,6 +15,70 @@ func DBError(op string) {
 	eventStoreDbErrCounter.WithLabelValues(op).Inc()
 }
 
+// Subscribers records the current number of live event subscriptions.
+func Subscribers(n int) {
+	subscriberGauge.Set(float64(n))
+}
+
+// SlowSubscriber counts subscriptions dropped for not keeping up.
+func SlowSubscriber() {
+	slowSubscriberCounter.Inc()
+}
+
+// DuplicateEvent counts writes that repeated the idempotency key of an
+// earlier event and were not stored, by topic.
+func DuplicateEvent(topic string) {
+	duplicateEventCounter.WithLabelValues(topic).Inc()
+}
+
+// PurgedEvents counts events deleted for being past their topic's retention.
+func PurgedEvents(topic string, n int) {
+	purgedEventCounter.WithLabelValues(topic).Add(float64(n))
+}
+
+// SinkEvents counts events shipped by a sink, by sink name.
+func SinkEvents(sink string, n int) {
+	sinkEventCounter.WithLabelValues(sink).Add(float64(n))
+}
+
+// SinkDropped counts events a sink gave up on because they were rejected.
+func SinkDropped(sink string, n int) {
+	sinkDroppedCounter.WithLabelValues(sink).Add(float64(n))
+}
+
+// SinkQueueLength records the number of events waiting to be sent by a sink.
+func SinkQueueLength(sink string, n int) {
+	sinkQueueGauge.WithLabelValues(sink).Set(float64(n))
+}
+
+// SinkLag records how long after it was received the last event sent by a
+// sink was delivered.
+func SinkLag(sink string, d time.Duration) {
+	sinkLagGauge.WithLabelValues(sink).Set(d.Seconds())
+}
+
+// SinkError counts failed attempts by a sink to ship events.
+func SinkError(sink string) {
+	sinkErrCounter.WithLabelValues(sink).Inc()
+}
+
+// RuleFired counts notifications fired by an alert rule, by rule name.
+func RuleFired(rule string) {
+	ruleFiredCounter.WithLabelValues(rule).Inc()
+}
+
+// RuleNotifyError counts notifications of an alert rule that could not be
+// delivered, by rule name.
+func RuleNotifyError(rule string) {
+	ruleNotifyErrCounter.WithLabelValues(rule).Inc()
+}
+
+// KafkaMessage counts messages handled by a Kafka consumer, by consumer and
+// result: added, dead_letter, skipped or error.
+func KafkaMessage(consumer, result string) {
+	kafkaMessageCounter.WithLabelValues(consumer, result).Inc()
+}
+
 // GRPCLatency records grpc request latency for a named method.
 func GRPCLatency(method string, start time.Time) {
 	grpcReqLatencies.WithLabelValues(method).Observe(msSince(start))
@@ -60,6 +60,90 @@ var (
 		Name:      "db_error",
 		Help:      "The count of db errors by db name and type of operation",
 	}, []string{"operation"})
+
+	subscriberGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "eventmaster",
+		Subsystem: "event_store",
+		Name:      "subscribers",
+		Help:      "The number of live event subscriptions",
+	})
+
+	slowSubscriberCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "eventmaster",
+		Subsystem: "event_store",
+		Name:      "slow_subscriber_count",
+		Help:      "The count of subscriptions closed for falling behind",
+	})
+
+	duplicateEventCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "eventmaster",
+		Subsystem: "event_store",
+		Name:      "duplicate_event_count",
+		Help:      "The count of writes skipped for repeating an idempotency key, by topic",
+	}, []string{"topic"})
+
+	purgedEventCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "eventmaster",
+		Subsystem: "event_store",
+		Name:      "purged_event_count",
+		Help:      "The count of events deleted for being past their topic's retention, by topic",
+	}, []string{"topic"})
+
+	sinkEventCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "eventmaster",
+		Subsystem: "sink",
+		Name:      "event_count",
+		Help:      "The count of events shipped, by sink",
+	}, []string{"sink"})
+
+	sinkDroppedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "eventmaster",
+		Subsystem: "sink",
+		Name:      "dropped_event_count",
+		Help:      "The count of events rejected by the destination and not retried, by sink",
+	}, []string{"sink"})
+
+	sinkQueueGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "eventmaster",
+		Subsystem: "sink",
+		Name:      "queue_length",
+		Help:      "The number of events waiting to be sent, by sink",
+	}, []string{"sink"})
+
+	sinkLagGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "eventmaster",
+		Subsystem: "sink",
+		Name:      "lag_seconds",
+		Help:      "The time from receiving the last event sent to delivering it, by sink",
+	}, []string{"sink"})
+
+	sinkErrCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "eventmaster",
+		Subsystem: "sink",
+		Name:      "error_count",
+		Help:      "The count of failed attempts to ship events, by sink",
+	}, []string{"sink"})
+
+	ruleFiredCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "eventmaster",
+		Subsystem: "rule",
+		Name:      "fired_count",
+		Help:      "The count of times an alert rule fired, by rule",
+	}, []string{"rule"})
+
+	ruleNotifyErrCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "eventmaster",
+		Subsystem: "rule",
+		Name:      "notify_error_count",
+		Help:      "The count of alert rule notifications that could not be delivered, by rule",
+	}, []string{"rule"})
+
+	kafkaMessageCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "eventmaster",
+		Subsystem: "kafka_consumer",
+		Name:      "message_count",
+		Help:      "The count of messages consumed from Kafka, by consumer and result",
+	}, []string{"consumer", "result"})
 )
 
 // RegisterPromMetrics registers all the metrics that eventmanger uses.
@@ -92,6 +176,54 @@ func RegisterPromMetrics() error {
 		return errors.Wrap(err, "registering event store errors")
 	}
 
+	if err := prometheus.Register(subscriberGauge); err != nil {
+		return errors.Wrap(err, "registering subscriber gauge")
+	}
+
+	if err := prometheus.Register(slowSubscriberCounter); err != nil {
+		return errors.Wrap(err, "registering slow subscriber counter")
+	}
+
+	if err := prometheus.Register(duplicateEventCounter); err != nil {
+		return errors.Wrap(err, "registering duplicate event counter")
+	}
+
+	if err := prometheus.Register(purgedEventCounter); err != nil {
+		return errors.Wrap(err, "registering purged event counter")
+	}
+
+	if err := prometheus.Register(sinkEventCounter); err != nil {
+		return errors.Wrap(err, "registering sink event counter")
+	}
+
+	if err := prometheus.Register(sinkDroppedCounter); err != nil {
+		return errors.Wrap(err, "registering sink dropped event counter")
+	}
+
+	if err := prometheus.Register(sinkQueueGauge); err != nil {
+		return errors.Wrap(err, "registering sink queue gauge")
+	}
+
+	if err := prometheus.Register(sinkLagGauge); err != nil {
+		return errors.Wrap(err, "registering sink lag gauge")
+	}
+
+	if err := prometheus.Register(sinkErrCounter); err != nil {
+		return errors.Wrap(err, "registering sink error counter")
+	}
+
+	if err := prometheus.Register(ruleFiredCounter); err != nil {
+		return errors.Wrap(err, "registering rule fired counter")
+	}
+
+	if err := prometheus.Register(ruleNotifyErrCounter); err != nil {
+		return errors.Wrap(err, "registering rule notify error counter")
+	}
+
+	if err := prometheus.Register(kafkaMessageCounter); err != nil {
+		return errors.Wrap(err, "registering kafka consumer message counter")
+	}
+
 	return nil
 }
 
@@ -1,7 +1,10 @@
 package eventmaster
 
 import (
+	"context"
+	"encoding/json"
 	"net/http"
+	"sync"
 
 	"github.com/pkg/errors"
 
@@ -11,17 +14,52 @@ import (
 
 type mockDataStore struct {
 	events []*Event
+	audit  []AuditEntry
 
 	dcs    []DC
 	topics []Topic
+
+	ruleMu     sync.Mutex // rule states are saved in the background
+	rules      []Rule
+	ruleStates map[string]RuleState
+
+	keyMu sync.Mutex
+	keys  map[string]boltIdempotencyEntry
 }
 
-func (mds *mockDataStore) AddEvent(e *Event) error {
+func (mds *mockDataStore) AddEvent(ctx context.Context, e *Event) error {
 	mds.events = append(mds.events, e)
 	return nil
 }
 
-func (mds *mockDataStore) Find(q *proto.Query, topicIds []string, DCIDs []string) (Events, error) {
+func (mds *mockDataStore) ClaimIdempotencyKey(ctx context.Context, key, id string, receivedTime, since int64) (string, error) {
+	mds.keyMu.Lock()
+	defer mds.keyMu.Unlock()
+	if entry, ok := mds.keys[key]; ok && entry.ReceivedTime >= since {
+		return entry.EventID, nil
+	}
+	if mds.keys == nil {
+		mds.keys = map[string]boltIdempotencyEntry{}
+	}
+	mds.keys[key] = boltIdempotencyEntry{EventID: id, ReceivedTime: receivedTime}
+	return "", nil
+}
+
+func (mds *mockDataStore) ReleaseIdempotencyKey(ctx context.Context, key, id string) error {
+	mds.keyMu.Lock()
+	defer mds.keyMu.Unlock()
+	if mds.keys[key].EventID == id {
+		delete(mds.keys, key)
+	}
+	return nil
+}
+
+func (mds *mockDataStore) AddEvents(ctx context.Context, evts []*Event) error {
+	mds.events = append(mds.events, evts...)
+	return nil
+}
+
+func (mds *mockDataStore) Find(ctx context.Context, q *proto.Query, topicIds []string, DCIDs []string) (Events, error) {
 	// for some reason we convert to ms randomly throughout the code
 	q.StartEventTime *= 1000
 	q.EndEventTime *= 1000
@@ -37,7 +75,10 @@ func (mds *mockDataStore) Find(q *proto.Query, topicIds []string, DCIDs []string
 
 	r := Events{}
 	for _, ev := range mds.events {
-		if !(ev.EventTime > q.StartEventTime && ev.EventTime < q.EndEventTime) {
+		if hasEventTimeWindow(q) && !(ev.EventTime > q.StartEventTime && ev.EventTime < q.EndEventTime) {
+			continue
+		}
+		if hasReceivedTimeWindow(q) && (ev.ReceivedTime < q.StartReceivedTime || ev.ReceivedTime > q.EndReceivedTime) {
 			continue
 		}
 		if topicIds != nil {
@@ -52,31 +93,111 @@ func (mds *mockDataStore) Find(q *proto.Query, topicIds []string, DCIDs []string
 		}
 		r = append(r, ev)
 	}
-	return r, nil
+	return filterEvents(q, r)
+}
+
+func (mds *mockDataStore) Aggregate(ctx context.Context, q *proto.Query, topicIds []string, DCIDs []string, agg Aggregation) ([]AggregateCount, error) {
+	evts, err := mds.Find(ctx, q, topicIds, DCIDs)
+	if err != nil {
+		return nil, err
+	}
+	counter := newAggregateCounter(agg)
+	for _, ev := range evts {
+		// events are kept with their event time in ms
+		e := *ev
+		e.EventTime /= 1000
+		counter.add(&e)
+	}
+	return counter.result(), nil
+}
+
+func (mds *mockDataStore) FindByID(ctx context.Context, id string, data bool) (*Event, error) {
+	for _, e := range mds.events {
+		if e.EventID == id {
+			return e, nil
+		}
+	}
+	return nil, nil
+}
+
+func (mds *mockDataStore) DeleteEvent(ctx context.Context, id string) error {
+	var kept []*Event
+	for _, e := range mds.events {
+		if e.EventID != id {
+			kept = append(kept, e)
+		}
+	}
+	mds.events = kept
+	return nil
+}
+
+func (mds *mockDataStore) UpdateEventData(ctx context.Context, id string, data map[string]interface{}) error {
+	for _, e := range mds.events {
+		if e.EventID == id {
+			e.Data = data
+			return nil
+		}
+	}
+	return errors.New("event not found")
+}
+
+func (mds *mockDataStore) AddAuditEntry(ctx context.Context, e AuditEntry) error {
+	mds.audit = append(mds.audit, e)
+	return nil
 }
 
-func (mds *mockDataStore) FindByID(id string, data bool) (*Event, error) {
-	return nil, errors.New("NYI")
+func (mds *mockDataStore) GetAuditEntries(ctx context.Context, eventID string) ([]AuditEntry, error) {
+	var r []AuditEntry
+	for _, e := range mds.audit {
+		if e.EventID == eventID {
+			r = append(r, e)
+		}
+	}
+	return r, nil
 }
 
-func (mds *mockDataStore) FindIDs(*proto.TimeQuery, HandleEvent) error {
+func (mds *mockDataStore) FindIDs(context.Context, *proto.TimeQuery, HandleEvent) error {
 	return errors.New("NYI")
 }
 
-func (mds *mockDataStore) GetTopics() ([]Topic, error) {
+func (mds *mockDataStore) GetTopics(ctx context.Context) ([]Topic, error) {
 	return mds.topics, nil
 }
 
-func (mds *mockDataStore) AddTopic(rt RawTopic) error {
-	mds.topics = append(mds.topics, Topic{ID: rt.ID, Name: rt.Name})
+func (mds *mockDataStore) AddTopic(ctx context.Context, rt RawTopic) error {
+	mds.topics = append(mds.topics, Topic{ID: rt.ID, Name: rt.Name, RetentionSeconds: rt.RetentionSeconds})
 	return nil
 }
 
-func (mds *mockDataStore) UpdateTopic(rt RawTopic) error {
+// CountEvents expects event times in ms, as AddEvent stores them.
+func (mds *mockDataStore) CountEvents(ctx context.Context, topicID string, before int64) (int, error) {
+	n := 0
+	for _, e := range mds.events {
+		if e.TopicID == topicID && e.EventTime < before*1000 {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (mds *mockDataStore) PurgeEvents(ctx context.Context, topicID string, before int64) (int, error) {
+	var kept []*Event
+	for _, e := range mds.events {
+		if e.TopicID != topicID || e.EventTime >= before*1000 {
+			kept = append(kept, e)
+		}
+	}
+	n := len(mds.events) - len(kept)
+	mds.events = kept
+	return n, nil
+}
+
+func (mds *mockDataStore) UpdateTopic(ctx context.Context, rt RawTopic) error {
 	changed := false
 	for i := range mds.topics {
 		if mds.topics[i].ID == rt.ID {
 			mds.topics[i].Name = rt.Name
+			mds.topics[i].RetentionSeconds = rt.RetentionSeconds
 			changed = true
 		}
 	}
@@ -86,7 +207,7 @@ func (mds *mockDataStore) UpdateTopic(rt RawTopic) error {
 	return nil
 }
 
-func (mds *mockDataStore) DeleteTopic(id string) error {
+func (mds *mockDataStore) DeleteTopic(ctx context.Context, id string) error {
 	changed := false
 	ts := []Topic{}
 	for i := range mds.topics {
@@ -103,16 +224,16 @@ func (mds *mockDataStore) DeleteTopic(id string) error {
 	return nil
 }
 
-func (mds *mockDataStore) GetDCs() ([]DC, error) {
+func (mds *mockDataStore) GetDCs(ctx context.Context) ([]DC, error) {
 	return mds.dcs, nil
 }
 
-func (mds *mockDataStore) AddDC(dc DC) error {
+func (mds *mockDataStore) AddDC(ctx context.Context, dc DC) error {
 	mds.dcs = append(mds.dcs, dc)
 	return nil
 }
 
-func (mds *mockDataStore) UpdateDC(id, newName string) error {
+func (mds *mockDataStore) UpdateDC(ctx context.Context, id, newName string) error {
 	changed := false
 	for i := range mds.dcs {
 		if mds.dcs[i].ID == id {
@@ -126,4 +247,67 @@ func (mds *mockDataStore) UpdateDC(id, newName string) error {
 	return nil
 }
 
+func (mds *mockDataStore) GetRules(ctx context.Context) ([]Rule, error) {
+	mds.ruleMu.Lock()
+	defer mds.ruleMu.Unlock()
+	return append([]Rule(nil), mds.rules...), nil
+}
+
+func (mds *mockDataStore) PutRule(ctx context.Context, r Rule) error {
+	mds.ruleMu.Lock()
+	defer mds.ruleMu.Unlock()
+	for i := range mds.rules {
+		if mds.rules[i].ID == r.ID {
+			mds.rules[i] = r
+			return nil
+		}
+	}
+	mds.rules = append(mds.rules, r)
+	return nil
+}
+
+func (mds *mockDataStore) DeleteRule(ctx context.Context, id string) error {
+	mds.ruleMu.Lock()
+	defer mds.ruleMu.Unlock()
+	for i := range mds.rules {
+		if mds.rules[i].ID == id {
+			mds.rules = append(mds.rules[:i], mds.rules[i+1:]...)
+			break
+		}
+	}
+	delete(mds.ruleStates, id)
+	return nil
+}
+
+func (mds *mockDataStore) GetRuleState(ctx context.Context, id string) (RuleState, error) {
+	mds.ruleMu.Lock()
+	defer mds.ruleMu.Unlock()
+	// round trip through json like the real stores, so that the state is
+	// not shared with the caller
+	var state RuleState
+	b, err := json.Marshal(mds.ruleStates[id])
+	if err != nil {
+		return state, err
+	}
+	return state, json.Unmarshal(b, &state)
+}
+
+func (mds *mockDataStore) SaveRuleState(ctx context.Context, id string, state RuleState) error {
+	mds.ruleMu.Lock()
+	defer mds.ruleMu.Unlock()
+	if mds.ruleStates == nil {
+		mds.ruleStates = map[string]RuleState{}
+	}
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	var saved RuleState
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return err
+	}
+	mds.ruleStates[id] = saved
+	return nil
+}
+
 func (mds *mockDataStore) CloseSession() {}
@@ -1,6 +1,7 @@
 package eventmaster
 
 import (
+	"context"
 	"testing"
 )
 
@@ -15,7 +16,7 @@ func TestPopulateTestData(t *testing.T) {
 		t.Fatalf("populating test data: %v", err)
 	}
 
-	dcs, err := store.GetDCs()
+	dcs, err := store.GetDCs(context.Background())
 	if err != nil {
 		t.Fatalf("get dcs: %v", err)
 	}
@@ -24,7 +25,7 @@ func TestPopulateTestData(t *testing.T) {
 	}
 	t.Logf("%v", dcs)
 
-	topics, err := store.GetTopics()
+	topics, err := store.GetTopics(context.Background())
 	if err != nil {
 		t.Fatalf("get topics: %v", err)
 	}
@@ -0,0 +1,799 @@
+package eventmaster
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	eventmaster "github.com/ContextLogic/eventmaster/proto"
+)
+
+// PostgresConfig defines the PostgreSQL-specific section of the eventmaster
+// configuration file.
+type PostgresConfig struct {
+	// DSN is a lib/pq connection string, e.g.
+	// "postgres://eventmaster@localhost/eventmaster?sslmode=disable"
+	DSN          string `json:"dsn"`
+	MaxOpenConns int    `json:"max_open_conns"`
+	MaxIdleConns int    `json:"max_idle_conns"`
+}
+
+// PostgresStore is an implementation of DataStore that is backed by
+// PostgreSQL.
+//
+// Unlike CassandraStore all of the filters in a Query are pushed down into
+// a single SQL statement.
+type PostgresStore struct {
+	db *sql.DB
+}
+
+// NewPostgresStore connects to PostgreSQL, brings the schema up to date and
+// returns a working PostgresStore.
+func NewPostgresStore(c PostgresConfig) (*PostgresStore, error) {
+	db, err := sql.Open("postgres", c.DSN)
+	if err != nil {
+		return nil, errors.Wrap(err, "open postgres connection")
+	}
+	if c.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(c.MaxOpenConns)
+	}
+	if c.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(c.MaxIdleConns)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "ping postgres")
+	}
+
+	if err := migratePostgres(db); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "migrate postgres schema")
+	}
+
+	return &PostgresStore{
+		db: db,
+	}, nil
+}
+
+// postgresMigrationLock is the key of the advisory lock that serializes
+// migratePostgres between eventmasters starting against the same database.
+const postgresMigrationLock = 0x6576656e746d6173 // "eventmas"
+
+// beginMigration starts a transaction that holds the migration lock until it
+// ends.
+func beginMigration(db *sql.DB) (*sql.Tx, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, errors.Wrap(err, "begin migration")
+	}
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, int64(postgresMigrationLock)); err != nil {
+		tx.Rollback()
+		return nil, errors.Wrap(err, "lock schema_migrations")
+	}
+	return tx, nil
+}
+
+// migratePostgres applies every migration in postgresMigrations that has not
+// yet been recorded in the schema_migrations table. Each migration is applied
+// in its own transaction, under a lock, after checking again that no other
+// eventmaster has applied it first.
+func migratePostgres(db *sql.DB) error {
+	tx, err := beginMigration(db)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version integer PRIMARY KEY,
+		description text NOT NULL,
+		applied_at timestamptz NOT NULL DEFAULT now()
+	)`); err != nil {
+		tx.Rollback()
+		return errors.Wrap(err, "create schema_migrations")
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "commit schema_migrations")
+	}
+
+	for _, m := range postgresMigrations {
+		if err := applyPostgresMigration(db, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyPostgresMigration applies m unless it has already been applied.
+func applyPostgresMigration(db *sql.DB, m pgMigration) error {
+	tx, err := beginMigration(db)
+	if err != nil {
+		return err
+	}
+	var applied bool
+	if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)`,
+		m.Version).Scan(&applied); err != nil {
+		tx.Rollback()
+		return errors.Wrap(err, "select schema_migrations")
+	}
+	if applied {
+		return errors.Wrap(tx.Commit(), "commit")
+	}
+
+	log.Infof("applying postgres migration %d: %v", m.Version, m.Description)
+	for _, stmt := range m.Statements {
+		if _, err := tx.Exec(stmt); err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "migration %d", m.Version)
+		}
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_migrations (version, description) VALUES ($1, $2)`,
+		m.Version, m.Description); err != nil {
+		tx.Rollback()
+		return errors.Wrapf(err, "record migration %d", m.Version)
+	}
+	return errors.Wrapf(tx.Commit(), "commit migration %d", m.Version)
+}
+
+// AddEvent inserts evt into the event table.
+func (p *PostgresStore) AddEvent(ctx context.Context, evt *Event) error {
+	return insertPostgresEvent(ctx, p.db, evt)
+}
+
+// AddEvents stores all of evts in a single transaction.
+func (p *PostgresStore) AddEvents(ctx context.Context, evts []*Event) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "begin")
+	}
+	for _, evt := range evts {
+		if err := insertPostgresEvent(ctx, tx, evt); err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "event %v", evt.EventID)
+		}
+	}
+	return errors.Wrap(tx.Commit(), "commit")
+}
+
+// pgExecer is satisfied by both *sql.DB and *sql.Tx.
+type pgExecer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+func insertPostgresEvent(ctx context.Context, db pgExecer, evt *Event) error {
+	data := []byte("{}")
+	if evt.Data != nil {
+		var err error
+		data, err = json.Marshal(evt.Data)
+		if err != nil {
+			return errors.Wrap(err, "Error marshalling event data into json")
+		}
+	}
+	_, err := db.ExecContext(ctx, `INSERT INTO event
+		(event_id, parent_event_id, dc_id, topic_id, host, target_host_set, username, event_time, tag_set, received_time, data, idempotency_key)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, NULLIF($12, ''))`,
+		evt.EventID, evt.ParentEventID, evt.DCID, evt.TopicID, strings.ToLower(evt.Host),
+		pq.Array(nonNil(evt.TargetHosts)), strings.ToLower(evt.User), evt.EventTime,
+		pq.Array(nonNil(evt.Tags)), evt.ReceivedTime, string(data), evt.IdempotencyKey)
+	return err
+}
+
+// postgresClaimAttempts is how many times a claim of an idempotency key is
+// tried while other writes keep changing the key.
+const postgresClaimAttempts = 3
+
+// ClaimIdempotencyKey implements DataStore. The primary key of
+// event_idempotency_key makes concurrent claims of a key conflict, and only
+// the latest claim of each key is kept.
+func (p *PostgresStore) ClaimIdempotencyKey(ctx context.Context, key, id string, receivedTime, since int64) (string, error) {
+	for i := 0; i < postgresClaimAttempts; i++ {
+		var claimed string
+		err := p.db.QueryRowContext(ctx, `INSERT INTO event_idempotency_key AS k (idempotency_key, event_id, received_time)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (idempotency_key) DO UPDATE SET event_id = EXCLUDED.event_id, received_time = EXCLUDED.received_time
+			WHERE k.received_time < $4
+			RETURNING event_id`, key, id, receivedTime, since).Scan(&claimed)
+		if err == nil {
+			return "", nil
+		}
+		if err != sql.ErrNoRows {
+			return "", errors.Wrap(err, "insert idempotency key")
+		}
+
+		// another event holds the key within the window
+		var holder string
+		err = p.db.QueryRowContext(ctx, `SELECT event_id FROM event_idempotency_key WHERE idempotency_key = $1`, key).Scan(&holder)
+		if err == nil {
+			return holder, nil
+		}
+		if err != sql.ErrNoRows {
+			return "", errors.Wrap(err, "select idempotency key")
+		}
+	}
+	return "", errors.Errorf("idempotency key %q kept changing", key)
+}
+
+// ReleaseIdempotencyKey implements DataStore.
+func (p *PostgresStore) ReleaseIdempotencyKey(ctx context.Context, key, id string) error {
+	_, err := p.db.ExecContext(ctx, `DELETE FROM event_idempotency_key WHERE idempotency_key = $1 AND event_id = $2`, key, id)
+	return errors.Wrap(err, "delete idempotency key")
+}
+
+// pgQuery accumulates the conditions and bind values of a query.
+type pgQuery struct {
+	conds []string
+	args  []interface{}
+}
+
+// bind adds v to the list of arguments and returns its placeholder.
+func (w *pgQuery) bind(v interface{}) string {
+	w.args = append(w.args, v)
+	return fmt.Sprintf("$%d", len(w.args))
+}
+
+// where adds a condition; format must contain a single %s for the
+// placeholder of v.
+func (w *pgQuery) where(format string, v interface{}) {
+	w.conds = append(w.conds, fmt.Sprintf(format, w.bind(v)))
+}
+
+// nonEmpty returns vals with empty strings removed.
+func nonEmpty(vals []string) []string {
+	var r []string
+	for _, v := range vals {
+		if v != "" {
+			r = append(r, v)
+		}
+	}
+	return r
+}
+
+// nonNil returns vals, or an empty slice if vals is nil, so it can be stored
+// in a NOT NULL array column.
+func nonNil(vals []string) []string {
+	if vals == nil {
+		return []string{}
+	}
+	return vals
+}
+
+// errNoMatch is returned by buildFindQuery when the query can not possibly
+// match any rows, e.g. it filters on a topic that doesn't exist.
+var errNoMatch = errors.New("query matches no events")
+
+// buildFindQuery translates q into a SELECT against the event table.
+func buildFindQuery(q *eventmaster.Query, topicIDs []string, dcIDs []string) (string, []interface{}, error) {
+	w := &pgQuery{}
+	if err := w.whereQuery(q, topicIDs, dcIDs); err != nil {
+		return "", nil, err
+	}
+	query := fmt.Sprintf(`SELECT %s FROM event WHERE %s ORDER BY event_time DESC`,
+		pgEventColumns, strings.Join(w.conds, " AND "))
+	return query, w.args, nil
+}
+
+// buildPageQuery is buildFindQuery limited to the limit events that sort
+// after the cursor after (if non-nil).
+func buildPageQuery(q *eventmaster.Query, topicIDs []string, dcIDs []string, after *pageCursor, limit int) (string, []interface{}, error) {
+	w := &pgQuery{conds: []string{"true"}}
+	if err := w.whereQuery(q, topicIDs, dcIDs); err != nil {
+		return "", nil, err
+	}
+	if after != nil {
+		w.conds = append(w.conds, fmt.Sprintf("(event_time, event_id) < (%s, %s)",
+			w.bind(after.EventTime*1000), w.bind(after.EventID)))
+	}
+	query := fmt.Sprintf(`SELECT %s FROM event WHERE %s ORDER BY event_time DESC, event_id DESC LIMIT %s`,
+		pgEventColumns, strings.Join(w.conds, " AND "), w.bind(limit))
+	return query, w.args, nil
+}
+
+// whereQuery adds the conditions that select the events matching q.
+func (w *pgQuery) whereQuery(q *eventmaster.Query, topicIDs []string, dcIDs []string) error {
+	if hasEventTimeWindow(q) {
+		w.where("event_time >= %s", q.StartEventTime*1000)
+		w.where("event_time <= %s", q.EndEventTime*1000)
+	}
+	if hasReceivedTimeWindow(q) {
+		w.where("received_time >= %s", q.StartReceivedTime)
+		w.where("received_time <= %s", q.EndReceivedTime)
+	}
+
+	if len(q.User) > 0 {
+		w.where("username = ANY(%s)", pq.Array(lowerAll(q.User)))
+	}
+	if len(q.ParentEventID) > 0 {
+		w.where("parent_event_id = ANY(%s)", pq.Array(q.ParentEventID))
+	}
+	if len(q.Host) > 0 {
+		w.where("host = ANY(%s)", pq.Array(lowerAll(q.Host)))
+	}
+	if len(topicIDs) > 0 {
+		ids := nonEmpty(topicIDs)
+		if len(ids) == 0 {
+			return errNoMatch
+		}
+		w.where("topic_id = ANY(%s::uuid[])", pq.Array(ids))
+	}
+	if len(dcIDs) > 0 {
+		ids := nonEmpty(dcIDs)
+		if len(ids) == 0 {
+			return errNoMatch
+		}
+		w.where("dc_id = ANY(%s::uuid[])", pq.Array(ids))
+	}
+	if len(q.TagSet) > 0 {
+		if q.TagAndOperator {
+			w.where("tag_set @> %s", pq.Array(q.TagSet))
+		} else {
+			w.where("tag_set && %s", pq.Array(q.TagSet))
+		}
+	}
+	if len(q.ExcludeTagSet) > 0 {
+		w.where("NOT (tag_set && %s)", pq.Array(q.ExcludeTagSet))
+	}
+	if len(q.TargetHostSet) > 0 {
+		if q.TargetHostAndOperator {
+			w.where("target_host_set @> %s", pq.Array(q.TargetHostSet))
+		} else {
+			w.where("target_host_set && %s", pq.Array(q.TargetHostSet))
+		}
+	}
+
+	dataFilter, err := parseDataFilter(q.Data)
+	if err != nil {
+		return err
+	}
+	for _, f := range dataFilter {
+		v, err := json.Marshal(f.b)
+		if err != nil {
+			return errors.Wrapf(err, "marshal data filter value for %v", f.a)
+		}
+		path := w.bind(pq.Array(strings.Split(f.a, ".")))
+		w.conds = append(w.conds, fmt.Sprintf("data #> %s = %s::jsonb", path, w.bind(string(v))))
+	}
+	return nil
+}
+
+// buildAggregateQuery translates q and agg into a SELECT that counts events
+// by the start of their bucket (in ms) and then by each dimension of
+// agg.GroupBy. Tags are joined in so that an event is counted once for each
+// of its tags.
+func buildAggregateQuery(q *eventmaster.Query, topicIDs []string, dcIDs []string, agg Aggregation) (string, []interface{}, error) {
+	w := &pgQuery{}
+	interval := w.bind(agg.Interval * 1000)
+	cols := []string{fmt.Sprintf("event_time - mod(event_time, %s)", interval)}
+	from := "event"
+	for _, dim := range agg.GroupBy {
+		switch dim {
+		case GroupByTopic:
+			cols = append(cols, "topic_id::text")
+		case GroupByDC:
+			cols = append(cols, "dc_id::text")
+		case GroupByHost:
+			cols = append(cols, "host")
+		case GroupByUser:
+			cols = append(cols, "coalesce(username, '')")
+		case GroupByTag:
+			from += " LEFT JOIN LATERAL unnest(tag_set) AS tag ON true"
+			cols = append(cols, "coalesce(tag, '')")
+		default:
+			path := strings.Split(strings.TrimPrefix(dim, GroupByDataPrefix), ".")
+			cols = append(cols, fmt.Sprintf("coalesce(data #>> %s, '')", w.bind(pq.Array(path))))
+		}
+	}
+	if err := w.whereQuery(q, topicIDs, dcIDs); err != nil {
+		return "", nil, err
+	}
+	groups := make([]string, len(cols))
+	for i := range cols {
+		groups[i] = fmt.Sprint(i + 1)
+	}
+	query := fmt.Sprintf(`SELECT %s, count(*) FROM %s WHERE %s GROUP BY %s`,
+		strings.Join(cols, ", "), from, strings.Join(w.conds, " AND "), strings.Join(groups, ", "))
+	return query, w.args, nil
+}
+
+// pgEventColumns lists the columns scanned by scanEvent.
+const pgEventColumns = `event_id, parent_event_id, dc_id, topic_id, host, target_host_set, username, event_time, tag_set, received_time`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanEvent(row rowScanner, extra ...interface{}) (*Event, error) {
+	var evt Event
+	var parentEventID, user sql.NullString
+	dest := []interface{}{
+		&evt.EventID, &parentEventID, &evt.DCID, &evt.TopicID, &evt.Host,
+		pq.Array(&evt.TargetHosts), &user, &evt.EventTime, pq.Array(&evt.Tags), &evt.ReceivedTime,
+	}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+	evt.ParentEventID = parentEventID.String
+	evt.User = user.String
+	// match CassandraStore, which hands back event time in seconds
+	evt.EventTime /= 1000
+	return &evt, nil
+}
+
+// Find searches using the Query, and filters topicIDs and dcIDs.
+func (p *PostgresStore) Find(ctx context.Context, q *eventmaster.Query, topicIDs []string, dcIDs []string) (Events, error) {
+	query, args, err := buildFindQuery(q, topicIDs, dcIDs)
+	if err == errNoMatch {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "build query")
+	}
+	return p.queryEvents(ctx, query, args)
+}
+
+// FindPage returns at most limit events that match q and sort after the
+// cursor after (if non-nil), in Events order.
+func (p *PostgresStore) FindPage(ctx context.Context, q *eventmaster.Query, topicIDs []string, dcIDs []string, after *pageCursor, limit int) (Events, error) {
+	query, args, err := buildPageQuery(q, topicIDs, dcIDs, after, limit)
+	if err == errNoMatch {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "build query")
+	}
+	return p.queryEvents(ctx, query, args)
+}
+
+// queryEvents runs a query that selects pgEventColumns.
+func (p *PostgresStore) queryEvents(ctx context.Context, query string, args []interface{}) (Events, error) {
+	rows, err := p.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "select events")
+	}
+	defer rows.Close()
+
+	var evts Events
+	for rows.Next() {
+		evt, err := scanEvent(rows)
+		if err != nil {
+			return nil, errors.Wrap(err, "scan event")
+		}
+		evts = append(evts, evt)
+	}
+	return evts, errors.Wrap(rows.Err(), "iterate events")
+}
+
+// Aggregate implements DataStore. The counting is done by postgres.
+func (p *PostgresStore) Aggregate(ctx context.Context, q *eventmaster.Query, topicIDs []string, dcIDs []string, agg Aggregation) ([]AggregateCount, error) {
+	query, args, err := buildAggregateQuery(q, topicIDs, dcIDs, agg)
+	if err == errNoMatch {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "build query")
+	}
+
+	rows, err := p.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "select event counts")
+	}
+	defer rows.Close()
+
+	counter := newAggregateCounter(agg)
+	for rows.Next() {
+		var start, n int64
+		group := make([]string, len(agg.GroupBy))
+		dest := []interface{}{&start}
+		for i := range group {
+			dest = append(dest, &group[i])
+		}
+		if err := rows.Scan(append(dest, &n)...); err != nil {
+			return nil, errors.Wrap(err, "scan event count")
+		}
+		counter.addCount(start/1000, group, n)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "iterate event counts")
+	}
+	return counter.result(), nil
+}
+
+// FindByID returns the event with the given id, or nil if there is no such
+// event.
+func (p *PostgresStore) FindByID(ctx context.Context, id string, includeData bool) (*Event, error) {
+	var data []byte
+	var extra []interface{}
+	cols := pgEventColumns
+	if includeData {
+		cols += ", data"
+		extra = append(extra, &data)
+	}
+	row := p.db.QueryRowContext(ctx, fmt.Sprintf(`SELECT %s FROM event WHERE event_id = $1`, cols), id)
+	evt, err := scanEvent(row, extra...)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "select event")
+	}
+	if includeData && len(data) > 0 {
+		var d map[string]interface{}
+		if err := json.Unmarshal(data, &d); err != nil {
+			return nil, errors.Wrap(err, "Error unmarshalling JSON in event data")
+		}
+		evt.Data = d
+	}
+	return evt, nil
+}
+
+// FindByIDs returns the events with ids, and their data if includeData is
+// true, with one query. Ids that are not found are left out.
+func (p *PostgresStore) FindByIDs(ctx context.Context, ids []string, includeData bool) (Events, error) {
+	cols := pgEventColumns
+	if includeData {
+		cols += ", data"
+	}
+	rows, err := p.db.QueryContext(ctx, fmt.Sprintf(`SELECT %s FROM event WHERE event_id = ANY($1)`, cols), pq.Array(ids))
+	if err != nil {
+		return nil, errors.Wrap(err, "select events")
+	}
+	defer rows.Close()
+	var evts Events
+	for rows.Next() {
+		var data []byte
+		var extra []interface{}
+		if includeData {
+			extra = append(extra, &data)
+		}
+		evt, err := scanEvent(rows, extra...)
+		if err != nil {
+			return nil, errors.Wrap(err, "scan event")
+		}
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &evt.Data); err != nil {
+				return nil, errors.Wrap(err, "Error unmarshalling JSON in event data")
+			}
+		}
+		evts = append(evts, evt)
+	}
+	return evts, errors.Wrap(rows.Err(), "iterate events")
+}
+
+// FindIDs calls stream with the id of every event in the window defined by
+// q, in the requested order.
+func (p *PostgresStore) FindIDs(ctx context.Context, q *eventmaster.TimeQuery, stream HandleEvent) error {
+	order := "DESC"
+	if q.Ascending {
+		order = "ASC"
+	}
+	query := fmt.Sprintf(`SELECT event_id FROM event WHERE event_time >= $1 AND event_time <= $2 ORDER BY event_time %s`, order)
+	args := []interface{}{q.StartEventTime * 1000, q.EndEventTime * 1000}
+	if q.Limit > 0 {
+		query += " LIMIT $3"
+		args = append(args, q.Limit)
+	}
+
+	rows, err := p.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return errors.Wrap(err, "select event ids")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return errors.Wrap(err, "scan event id")
+		}
+		if err := stream(id); err != nil {
+			return errors.Wrap(err, "Error streaming event ID")
+		}
+	}
+	return errors.Wrap(rows.Err(), "iterate event ids")
+}
+
+// GetTopics returns all topics.
+func (p *PostgresStore) GetTopics(ctx context.Context) ([]Topic, error) {
+	rows, err := p.db.QueryContext(ctx, `SELECT topic_id, topic_name, data_schema, retention_seconds FROM event_topic`)
+	if err != nil {
+		return nil, errors.Wrap(err, "select topics")
+	}
+	defer rows.Close()
+
+	var topics []Topic
+	for rows.Next() {
+		var t Topic
+		var schema []byte
+		if err := rows.Scan(&t.ID, &t.Name, &schema, &t.RetentionSeconds); err != nil {
+			return nil, errors.Wrap(err, "scan topic")
+		}
+		if err := json.Unmarshal(schema, &t.Schema); err != nil {
+			return nil, errors.Wrap(err, "Error unmarshalling schema")
+		}
+		topics = append(topics, t)
+	}
+	return topics, errors.Wrap(rows.Err(), "iterate topics")
+}
+
+// AddTopic inserts t into event_topic.
+func (p *PostgresStore) AddTopic(ctx context.Context, t RawTopic) error {
+	_, err := p.db.ExecContext(ctx, `INSERT INTO event_topic (topic_id, topic_name, data_schema, retention_seconds) VALUES ($1, $2, $3, $4)`,
+		t.ID, t.Name, t.Schema, t.RetentionSeconds)
+	return err
+}
+
+// UpdateTopic replaces the name, schema and retention of the topic with t.ID.
+func (p *PostgresStore) UpdateTopic(ctx context.Context, t RawTopic) error {
+	_, err := p.db.ExecContext(ctx, `UPDATE event_topic SET topic_name = $1, data_schema = $2, retention_seconds = $3 WHERE topic_id = $4`,
+		t.Name, t.Schema, t.RetentionSeconds, t.ID)
+	return err
+}
+
+// DeleteEvent implements DataStore. The indexes are maintained by
+// PostgreSQL, so only the row and its idempotency key need to be removed.
+func (p *PostgresStore) DeleteEvent(ctx context.Context, id string) error {
+	_, err := p.db.ExecContext(ctx, `WITH deleted AS (DELETE FROM event WHERE event_id = $1 RETURNING event_id)
+		DELETE FROM event_idempotency_key WHERE event_id IN (SELECT event_id FROM deleted)`, id)
+	return errors.Wrap(err, "delete event")
+}
+
+// UpdateEventData implements DataStore.
+func (p *PostgresStore) UpdateEventData(ctx context.Context, id string, data map[string]interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return errors.Wrap(err, "Error marshalling event data into json")
+	}
+	_, err = p.db.ExecContext(ctx, `UPDATE event SET data = $1 WHERE event_id = $2`, string(b), id)
+	return errors.Wrap(err, "update event data")
+}
+
+// AddAuditEntry implements DataStore.
+func (p *PostgresStore) AddAuditEntry(ctx context.Context, e AuditEntry) error {
+	_, err := p.db.ExecContext(ctx, `INSERT INTO event_audit
+		(audit_id, event_id, action, paths, username, reason, audit_time)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		e.ID, e.EventID, e.Action, pq.Array(nonNil(e.Paths)), e.User, e.Reason, e.Time)
+	return errors.Wrap(err, "insert audit entry")
+}
+
+// GetAuditEntries implements DataStore.
+func (p *PostgresStore) GetAuditEntries(ctx context.Context, eventID string) ([]AuditEntry, error) {
+	rows, err := p.db.QueryContext(ctx, `SELECT audit_id, action, paths, username, reason, audit_time
+		FROM event_audit WHERE event_id = $1 ORDER BY audit_id`, eventID)
+	if err != nil {
+		return nil, errors.Wrap(err, "select audit entries")
+	}
+	defer rows.Close()
+
+	var entries []AuditEntry
+	for rows.Next() {
+		e := AuditEntry{EventID: eventID}
+		if err := rows.Scan(&e.ID, &e.Action, pq.Array(&e.Paths), &e.User, &e.Reason, &e.Time); err != nil {
+			return nil, errors.Wrap(err, "scan audit entry")
+		}
+		entries = append(entries, e)
+	}
+	return entries, errors.Wrap(rows.Err(), "iterate audit entries")
+}
+
+// CountEvents implements DataStore.
+func (p *PostgresStore) CountEvents(ctx context.Context, topicID string, before int64) (int, error) {
+	var n int
+	err := p.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM event WHERE topic_id = $1 AND event_time < $2`,
+		topicID, before*1000).Scan(&n)
+	return n, errors.Wrap(err, "count events")
+}
+
+// PurgeEvents implements DataStore.
+func (p *PostgresStore) PurgeEvents(ctx context.Context, topicID string, before int64) (int, error) {
+	var n int
+	err := p.db.QueryRowContext(ctx, `WITH purged AS (DELETE FROM event WHERE topic_id = $1 AND event_time < $2 RETURNING event_id),
+		keys AS (DELETE FROM event_idempotency_key WHERE event_id IN (SELECT event_id FROM purged))
+		SELECT count(*) FROM purged`, topicID, before*1000).Scan(&n)
+	return n, errors.Wrap(err, "delete events")
+}
+
+// DeleteTopic removes the topic with the given id.
+func (p *PostgresStore) DeleteTopic(ctx context.Context, id string) error {
+	_, err := p.db.ExecContext(ctx, `DELETE FROM event_topic WHERE topic_id = $1`, id)
+	return err
+}
+
+// GetDCs returns all entries from the event_dc table.
+func (p *PostgresStore) GetDCs(ctx context.Context) ([]DC, error) {
+	rows, err := p.db.QueryContext(ctx, `SELECT dc_id, dc FROM event_dc`)
+	if err != nil {
+		return nil, errors.Wrap(err, "select dcs")
+	}
+	defer rows.Close()
+
+	var dcs []DC
+	for rows.Next() {
+		var dc DC
+		if err := rows.Scan(&dc.ID, &dc.Name); err != nil {
+			return nil, errors.Wrap(err, "scan dc")
+		}
+		dcs = append(dcs, dc)
+	}
+	return dcs, errors.Wrap(rows.Err(), "iterate dcs")
+}
+
+// AddDC inserts dc into the event_dc table.
+func (p *PostgresStore) AddDC(ctx context.Context, dc DC) error {
+	_, err := p.db.ExecContext(ctx, `INSERT INTO event_dc (dc_id, dc) VALUES ($1, $2)`, dc.ID, dc.Name)
+	return err
+}
+
+// UpdateDC replaces the name for a given DC by id.
+func (p *PostgresStore) UpdateDC(ctx context.Context, id string, newName string) error {
+	_, err := p.db.ExecContext(ctx, `UPDATE event_dc SET dc = $1 WHERE dc_id = $2`, newName, id)
+	return err
+}
+
+// GetRules implements DataStore.
+func (p *PostgresStore) GetRules(ctx context.Context) ([]Rule, error) {
+	rows, err := p.db.QueryContext(ctx, `SELECT rule FROM event_rule`)
+	if err != nil {
+		return nil, errors.Wrap(err, "select rules")
+	}
+	defer rows.Close()
+
+	var rules []Rule
+	for rows.Next() {
+		var b []byte
+		if err := rows.Scan(&b); err != nil {
+			return nil, errors.Wrap(err, "scan rule")
+		}
+		var r Rule
+		if err := json.Unmarshal(b, &r); err != nil {
+			return nil, errors.Wrap(err, "json unmarshal rule")
+		}
+		rules = append(rules, r)
+	}
+	return rules, errors.Wrap(rows.Err(), "iterate rules")
+}
+
+// PutRule implements DataStore.
+func (p *PostgresStore) PutRule(ctx context.Context, r Rule) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return errors.Wrap(err, "json marshal rule")
+	}
+	_, err = p.db.ExecContext(ctx, `INSERT INTO event_rule (rule_id, rule) VALUES ($1, $2)
+		ON CONFLICT (rule_id) DO UPDATE SET rule = EXCLUDED.rule`, r.ID, string(b))
+	return errors.Wrap(err, "upsert rule")
+}
+
+// DeleteRule implements DataStore.
+func (p *PostgresStore) DeleteRule(ctx context.Context, id string) error {
+	_, err := p.db.ExecContext(ctx, `WITH s AS (DELETE FROM event_rule_state WHERE rule_id = $1)
+		DELETE FROM event_rule WHERE rule_id = $1`, id)
+	return errors.Wrap(err, "delete rule")
+}
+
+// GetRuleState implements DataStore.
+func (p *PostgresStore) GetRuleState(ctx context.Context, id string) (RuleState, error) {
+	var state RuleState
+	var b []byte
+	err := p.db.QueryRowContext(ctx, `SELECT state FROM event_rule_state WHERE rule_id = $1`, id).Scan(&b)
+	if err == sql.ErrNoRows {
+		return state, nil
+	}
+	if err != nil {
+		return state, errors.Wrap(err, "select rule state")
+	}
+	return state, errors.Wrap(json.Unmarshal(b, &state), "json unmarshal rule state")
+}
+
+// SaveRuleState implements DataStore.
+func (p *PostgresStore) SaveRuleState(ctx context.Context, id string, state RuleState) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return errors.Wrap(err, "json marshal rule state")
+	}
+	_, err = p.db.ExecContext(ctx, `INSERT INTO event_rule_state (rule_id, state) VALUES ($1, $2)
+		ON CONFLICT (rule_id) DO UPDATE SET state = EXCLUDED.state`, id, string(b))
+	return errors.Wrap(err, "upsert rule state")
+}
+
+// CloseSession closes the underlying connection pool.
+func (p *PostgresStore) CloseSession() {
+	p.db.Close()
+}
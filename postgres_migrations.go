@@ -0,0 +1,120 @@
+package eventmaster
+
+// pgMigration is a single, numbered change to the PostgreSQL schema.
+//
+// Migrations are applied in order by migratePostgres and recorded in the
+// schema_migrations table. Once released a migration must never be edited;
+// add a new one instead.
+type pgMigration struct {
+	Version     int
+	Description string
+	Statements  []string
+}
+
+var postgresMigrations = []pgMigration{
+	{
+		Version:     1,
+		Description: "create event, topic and dc tables",
+		Statements: []string{
+			`CREATE TABLE event_topic (
+				topic_id uuid PRIMARY KEY,
+				topic_name text NOT NULL,
+				data_schema jsonb NOT NULL DEFAULT '{}'
+			)`,
+			`CREATE TABLE event_dc (
+				dc_id uuid PRIMARY KEY,
+				dc text NOT NULL
+			)`,
+			`CREATE TABLE event (
+				event_id text PRIMARY KEY,
+				parent_event_id text,
+				dc_id uuid NOT NULL,
+				topic_id uuid NOT NULL,
+				host text NOT NULL,
+				target_host_set text[] NOT NULL DEFAULT '{}',
+				username text,
+				event_time bigint NOT NULL,
+				tag_set text[] NOT NULL DEFAULT '{}',
+				received_time bigint NOT NULL,
+				data jsonb NOT NULL DEFAULT '{}'
+			)`,
+			`CREATE INDEX event_by_date ON event (event_time DESC)`,
+			`CREATE INDEX event_by_topic ON event (topic_id, event_time DESC)`,
+			`CREATE INDEX event_by_dc ON event (dc_id, event_time DESC)`,
+			`CREATE INDEX event_by_host ON event (host, event_time DESC)`,
+			`CREATE INDEX event_by_user ON event (username, event_time DESC)`,
+			`CREATE INDEX event_by_parent_event_id ON event (parent_event_id, event_time DESC)`,
+			`CREATE INDEX event_by_tag ON event USING GIN (tag_set)`,
+			`CREATE INDEX event_by_target_host ON event USING GIN (target_host_set)`,
+		},
+	},
+	{
+		Version:     2,
+		Description: "add event idempotency keys",
+		Statements: []string{
+			`ALTER TABLE event ADD COLUMN idempotency_key text`,
+			`CREATE INDEX event_by_idempotency_key ON event (idempotency_key, received_time DESC) WHERE idempotency_key IS NOT NULL`,
+		},
+	},
+	{
+		Version:     3,
+		Description: "add topic retention",
+		Statements: []string{
+			`ALTER TABLE event_topic ADD COLUMN retention_seconds bigint NOT NULL DEFAULT 0`,
+		},
+	},
+	{
+		Version:     4,
+		Description: "create event audit table",
+		Statements: []string{
+			`CREATE TABLE event_audit (
+				audit_id text PRIMARY KEY,
+				event_id text NOT NULL,
+				action text NOT NULL,
+				paths text[] NOT NULL DEFAULT '{}',
+				username text NOT NULL,
+				reason text NOT NULL,
+				audit_time bigint NOT NULL
+			)`,
+			`CREATE INDEX event_audit_by_event ON event_audit (event_id, audit_id)`,
+		},
+	},
+	{
+		Version:     5,
+		Description: "index events by received time",
+		Statements: []string{
+			`CREATE INDEX event_by_received_time ON event (received_time DESC)`,
+		},
+	},
+	{
+		Version:     6,
+		Description: "create rule tables",
+		Statements: []string{
+			`CREATE TABLE event_rule (
+				rule_id text PRIMARY KEY,
+				rule jsonb NOT NULL
+			)`,
+			`CREATE TABLE event_rule_state (
+				rule_id text PRIMARY KEY,
+				state jsonb NOT NULL
+			)`,
+		},
+	},
+	{
+		Version:     7,
+		Description: "claim idempotency keys in a table of their own",
+		Statements: []string{
+			`CREATE TABLE event_idempotency_key (
+				idempotency_key text PRIMARY KEY,
+				event_id text NOT NULL,
+				received_time bigint NOT NULL
+			)`,
+			`INSERT INTO event_idempotency_key (idempotency_key, event_id, received_time)
+				SELECT DISTINCT ON (idempotency_key) idempotency_key, event_id, received_time
+				FROM event WHERE idempotency_key IS NOT NULL
+				ORDER BY idempotency_key, received_time DESC`,
+			`CREATE INDEX event_idempotency_key_by_event ON event_idempotency_key (event_id)`,
+			`DROP INDEX event_by_idempotency_key`,
+		},
+	},
+}
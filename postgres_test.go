@@ -0,0 +1,141 @@
+package eventmaster
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/lib/pq"
+
+	eventmaster "github.com/ContextLogic/eventmaster/proto"
+)
+
+func TestBuildFindQuery(t *testing.T) {
+	tests := []struct {
+		label    string
+		q        *eventmaster.Query
+		topicIDs []string
+		dcIDs    []string
+		where    string
+		args     []interface{}
+		err      error
+	}{
+		{
+			label: "time only",
+			q:     &eventmaster.Query{StartEventTime: 10, EndEventTime: 20},
+			where: "event_time >= $1 AND event_time <= $2",
+			args:  []interface{}{int64(10000), int64(20000)},
+		},
+		{
+			label: "received time only",
+			q:     &eventmaster.Query{StartReceivedTime: 30000, EndReceivedTime: 40000},
+			where: "received_time >= $1 AND received_time <= $2",
+			args:  []interface{}{int64(30000), int64(40000)},
+		},
+		{
+			label: "event and received time",
+			q:     &eventmaster.Query{StartEventTime: 10, EndEventTime: 20, StartReceivedTime: 30000, EndReceivedTime: 40000},
+			where: "event_time >= $1 AND event_time <= $2 AND received_time >= $3 AND received_time <= $4",
+			args:  []interface{}{int64(10000), int64(20000), int64(30000), int64(40000)},
+		},
+		{
+			label:    "indexed columns",
+			q:        &eventmaster.Query{StartEventTime: 10, EndEventTime: 20, User: []string{"Bob"}, Host: []string{"H1", "h2"}},
+			topicIDs: []string{"c8a81b3b-a581-4330-8443-7572d753cffe"},
+			where:    "event_time >= $1 AND event_time <= $2 AND username = ANY($3) AND host = ANY($4) AND topic_id = ANY($5::uuid[])",
+			args: []interface{}{int64(10000), int64(20000), pq.Array([]string{"bob"}), pq.Array([]string{"h1", "h2"}),
+				pq.Array([]string{"c8a81b3b-a581-4330-8443-7572d753cffe"})},
+		},
+		{
+			label: "tags and target hosts",
+			q: &eventmaster.Query{StartEventTime: 10, EndEventTime: 20, TagSet: []string{"a", "b"}, TagAndOperator: true,
+				ExcludeTagSet: []string{"c"}, TargetHostSet: []string{"th"}},
+			where: "event_time >= $1 AND event_time <= $2 AND tag_set @> $3 AND NOT (tag_set && $4) AND target_host_set && $5",
+			args: []interface{}{int64(10000), int64(20000), pq.Array([]string{"a", "b"}), pq.Array([]string{"c"}),
+				pq.Array([]string{"th"})},
+		},
+		{
+			label: "data",
+			q:     &eventmaster.Query{StartEventTime: 10, EndEventTime: 20, Data: `{"version": 2, "deploy": {"service": "api"}}`},
+			where: "event_time >= $1 AND event_time <= $2 AND data #> $3 = $4::jsonb AND data #> $5 = $6::jsonb",
+			args: []interface{}{int64(10000), int64(20000), pq.Array([]string{"deploy", "service"}), `"api"`,
+				pq.Array([]string{"version"}), "2"},
+		},
+		{
+			label: "unknown dc",
+			q:     &eventmaster.Query{StartEventTime: 10, EndEventTime: 20, DC: []string{"nope"}},
+			dcIDs: []string{""},
+			err:   errNoMatch,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.label, func(t *testing.T) {
+			query, args, err := buildFindQuery(test.q, test.topicIDs, test.dcIDs)
+			if err != test.err {
+				t.Fatalf("err: got %v, want %v", err, test.err)
+			}
+			if test.err != nil {
+				return
+			}
+			want := "SELECT " + pgEventColumns + " FROM event WHERE " + test.where + " ORDER BY event_time DESC"
+			if query != want {
+				t.Fatalf("query:\n got %v\nwant %v", query, want)
+			}
+			if !reflect.DeepEqual(args, test.args) {
+				t.Fatalf("args: got %#v, want %#v", args, test.args)
+			}
+		})
+	}
+}
+
+func TestBuildFindQueryBadData(t *testing.T) {
+	q := &eventmaster.Query{StartEventTime: 10, EndEventTime: 20, Data: `["not", "an", "object"]`}
+	if _, _, err := buildFindQuery(q, nil, nil); err == nil {
+		t.Fatalf("expected error for non-object data filter")
+	}
+}
+
+func TestBuildPageQuery(t *testing.T) {
+	query, args, err := buildPageQuery(&eventmaster.Query{Host: []string{"h"}}, nil, nil,
+		&pageCursor{EventTime: 1500000000, EventID: "abc"}, 11)
+	if err != nil {
+		t.Fatalf("build query: %v", err)
+	}
+	want := `SELECT ` + pgEventColumns + ` FROM event WHERE true AND host = ANY($1) AND (event_time, event_id) < ($2, $3) ORDER BY event_time DESC, event_id DESC LIMIT $4`
+	if query != want {
+		t.Fatalf("query:\n got %v\nwant %v", query, want)
+	}
+	if len(args) != 4 || args[1] != int64(1500000000000) || args[2] != "abc" || args[3] != 11 {
+		t.Fatalf("args: got %v", args)
+	}
+}
+
+func TestBuildAggregateQuery(t *testing.T) {
+	q := &eventmaster.Query{StartEventTime: 10, EndEventTime: 20, Host: []string{"H"}}
+	agg := Aggregation{Interval: 60, GroupBy: []string{GroupByTopic, GroupByTag, "data.deploy.service"}}
+	query, args, err := buildAggregateQuery(q, nil, nil, agg)
+	if err != nil {
+		t.Fatalf("build: %v", err)
+	}
+	want := "SELECT event_time - mod(event_time, $1), topic_id::text, coalesce(tag, ''), coalesce(data #>> $2, ''), count(*)" +
+		" FROM event LEFT JOIN LATERAL unnest(tag_set) AS tag ON true" +
+		" WHERE event_time >= $3 AND event_time <= $4 AND host = ANY($5) GROUP BY 1, 2, 3, 4"
+	if query != want {
+		t.Fatalf("query:\n got %v\nwant %v", query, want)
+	}
+	wantArgs := []interface{}{int64(60000), pq.Array([]string{"deploy", "service"}), int64(10000), int64(20000), pq.Array([]string{"h"})}
+	if !reflect.DeepEqual(args, wantArgs) {
+		t.Fatalf("args: got %#v, want %#v", args, wantArgs)
+	}
+}
+
+func TestPostgresMigrationsOrdered(t *testing.T) {
+	for i, m := range postgresMigrations {
+		if got, want := m.Version, i+1; got != want {
+			t.Fatalf("migration %d has version %d, want %d", i, got, want)
+		}
+		if len(m.Statements) == 0 {
+			t.Fatalf("migration %d has no statements", m.Version)
+		}
+	}
+}
@@ -59,6 +59,9 @@ func getQueryFromRequest(r *http.Request) (*eventmaster.Query, error) {
 			resultSize, _ := strconv.ParseInt(limit, 10, 32)
 			q.Limit = int32(resultSize)
 		}
+		q.Cursor = query.Get("cursor")
+		q.Text = query.Get("text")
+		q.Sort = query.Get("sort")
 		if tagAndOperator := query.Get("tag_and_operator"); tagAndOperator == "true" {
 			q.TagAndOperator = true
 		}
@@ -0,0 +1,130 @@
+package eventmaster
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ContextLogic/eventmaster/jh"
+	"github.com/ContextLogic/eventmaster/metrics"
+)
+
+// RetentionReport is how many events of a topic are past a retention.
+type RetentionReport struct {
+	TopicName        string `json:"topic_name"`
+	RetentionSeconds int64  `json:"retention_seconds"`
+	// Expiring is the number of events older than RetentionSeconds, which
+	// would be removed by the next purge. It is always 0 when there is no
+	// retention.
+	Expiring int `json:"expiring"`
+}
+
+// RetentionReport counts the events in each topic that are older than its
+// retention. If retention is not 0 it is used for every topic instead of
+// their own, to see what a new retention would expire. If topic is not ""
+// only that topic is reported on.
+func (es *EventStore) RetentionReport(ctx context.Context, topic string, retention int64) ([]RetentionReport, error) {
+	start := time.Now()
+	defer func() {
+		metrics.EventStoreLatency("RetentionReport", start)
+	}()
+
+	if retention < 0 {
+		return nil, jh.NewError("retention_seconds cannot be negative", http.StatusBadRequest)
+	}
+	topics, err := es.GetTopics(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var r []RetentionReport
+	found := false
+	now := time.Now().Unix()
+	for _, t := range topics {
+		if topic != "" && t.Name != topic {
+			continue
+		}
+		found = true
+		rr := RetentionReport{TopicName: t.Name, RetentionSeconds: t.RetentionSeconds}
+		if retention != 0 {
+			rr.RetentionSeconds = retention
+		}
+		if rr.RetentionSeconds > 0 {
+			rr.Expiring, err = es.ds.CountEvents(ctx, t.ID, now-rr.RetentionSeconds)
+			if err != nil {
+				metrics.DBError("read")
+				return nil, jh.Wrap(err, "count events in "+t.Name)
+			}
+		}
+		r = append(r, rr)
+	}
+	if topic != "" && !found {
+		return nil, jh.NewError(errors.Errorf("no topic named %v", topic).Error(), http.StatusNotFound)
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].TopicName < r[j].TopicName })
+	return r, nil
+}
+
+// PurgeExpired deletes the events in every topic that are past the topic's
+// retention, returning how many were deleted. A failure to purge one topic
+// does not stop the others from being purged; the first error is returned.
+func (es *EventStore) PurgeExpired(ctx context.Context) (int, error) {
+	start := time.Now()
+	defer func() {
+		metrics.EventStoreLatency("PurgeExpired", start)
+	}()
+
+	topics, err := es.GetTopics(ctx)
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	var firstErr error
+	now := time.Now().Unix()
+	for _, t := range topics {
+		if t.RetentionSeconds <= 0 {
+			continue
+		}
+		n, err := es.ds.PurgeEvents(ctx, t.ID, now-t.RetentionSeconds)
+		if err != nil {
+			metrics.DBError("write")
+			if firstErr == nil {
+				firstErr = errors.Wrapf(err, "purge %v", t.Name)
+			}
+			continue
+		}
+		if es.textIndex != nil {
+			if _, err := es.textIndex.Purge(t.ID, now-t.RetentionSeconds); err != nil {
+				log.Errorf("purge %v from text index: %v", t.Name, err)
+			}
+		}
+		if n > 0 {
+			log.Infof("purged %d events from topic %v", n, t.Name)
+			metrics.PurgedEvents(t.Name, n)
+		}
+		total += n
+	}
+	return total, firstErr
+}
+
+func (s *Server) getRetention(w http.ResponseWriter, r *http.Request, _ httprouter.Params) (interface{}, error) {
+	var retention int64
+	if v := r.URL.Query().Get("retention_seconds"); v != "" {
+		var err error
+		retention, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, jh.NewError(errors.Wrap(err, "parse retention_seconds").Error(), http.StatusBadRequest)
+		}
+	}
+	report, err := s.store.RetentionReport(r.Context(), r.URL.Query().Get("topic_name"), retention)
+	if err != nil {
+		return nil, jh.Wrap(err, "retention report")
+	}
+	return map[string][]RetentionReport{"results": report}, nil
+}
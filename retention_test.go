@@ -0,0 +1,148 @@
+package eventmaster
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ContextLogic/eventmaster/cassandra"
+	"github.com/ContextLogic/eventmaster/jh"
+)
+
+func TestPurgeExpired(t *testing.T) {
+	bs, cleanup := newTestBoltStore(t)
+	defer cleanup()
+
+	store, err := GetTestEventStore(bs)
+	if err != nil {
+		t.Fatalf("creating event store: %v", err)
+	}
+	if err := populateDCs(store); err != nil {
+		t.Fatalf("populate dcs: %v", err)
+	}
+	for _, topic := range []Topic{
+		{Name: "short", RetentionSeconds: 3600},
+		{Name: "forever"},
+	} {
+		if _, err := store.AddTopic(context.Background(), topic); err != nil {
+			t.Fatalf("add topic: %v", err)
+		}
+	}
+
+	now := time.Now().Unix()
+	evts := []*UnaddedEvent{
+		{EventTime: now - 7200, DC: "dc1", TopicName: "short", Host: "h", IdempotencyKey: "old"},
+		{EventTime: now - 60, DC: "dc1", TopicName: "short", Host: "h"},
+		{EventTime: now - 7200, DC: "dc1", TopicName: "forever", Host: "h"},
+	}
+	var ids []string
+	for _, res := range store.AddEvents(context.Background(), evts) {
+		if res.Error != "" {
+			t.Fatalf("add event: %v", res.Error)
+		}
+		ids = append(ids, res.EventID)
+	}
+
+	report, err := store.RetentionReport(context.Background(), "", 0)
+	if err != nil {
+		t.Fatalf("retention report: %v", err)
+	}
+	want := []RetentionReport{
+		{TopicName: "forever"},
+		{TopicName: "short", RetentionSeconds: 3600, Expiring: 1},
+	}
+	if len(report) != len(want) {
+		t.Fatalf("report: got %+v, want %+v", report, want)
+	}
+	for i := range want {
+		if report[i] != want[i] {
+			t.Fatalf("report: got %+v, want %+v", report, want)
+		}
+	}
+	report, err = store.RetentionReport(context.Background(), "forever", 3600)
+	if err != nil {
+		t.Fatalf("retention report: %v", err)
+	}
+	if got, want := report[0].Expiring, 1; got != want {
+		t.Fatalf("what-if report expiring: got %v, want %v", got, want)
+	}
+	if _, err := store.RetentionReport(context.Background(), "nope", 0); err == nil {
+		t.Fatalf("expected error for unknown topic")
+	}
+
+	n, err := store.PurgeExpired(context.Background())
+	if err != nil {
+		t.Fatalf("purge: %v", err)
+	}
+	if got, want := n, 1; got != want {
+		t.Fatalf("purged: got %v, want %v", got, want)
+	}
+	for i, wantFound := range []bool{false, true, true} {
+		evt, err := bs.FindByID(context.Background(), ids[i], false)
+		if err != nil {
+			t.Fatalf("find by id: %v", err)
+		}
+		if got := evt != nil; got != wantFound {
+			t.Fatalf("event %d found: got %v, want %v", i, got, wantFound)
+		}
+	}
+	if id, err := bs.ClaimIdempotencyKey(context.Background(), "old", "new", now*1000, 0); err != nil || id != "" {
+		t.Fatalf("idempotency key of purged event: got %q, %v, want none", id, err)
+	}
+	if n, err := bs.CountEvents(context.Background(), store.getTopicID("short"), now+1); err != nil || n != 1 {
+		t.Fatalf("remaining events: got %v, %v, want 1", n, err)
+	}
+}
+
+func TestCassandraRetentionTTL(t *testing.T) {
+	s, err := GetTestEventStore(NewNoOpDataStore())
+	if err != nil {
+		t.Fatalf("creating event store: %v", err)
+	}
+	if err := populateDCs(s); err != nil {
+		t.Fatalf("populate dcs: %v", err)
+	}
+	if _, err := s.AddTopic(context.Background(), Topic{Name: "short", RetentionSeconds: 3600}); err != nil {
+		t.Fatalf("add topic: %v", err)
+	}
+
+	// an event from 10 minutes ago has 50 minutes left
+	if _, err := s.AddEvent(context.Background(), &UnaddedEvent{
+		EventTime: time.Now().Unix() - 600,
+		DC:        "dc1",
+		TopicName: "short",
+		Host:      "h",
+		User:      "u",
+	}); err != nil {
+		t.Fatalf("add event: %v", err)
+	}
+	b := fakeSession(s).LastBatch()
+	if len(b.Statements) == 0 {
+		t.Fatalf("no statements written")
+	}
+	for _, stmt := range b.Statements {
+		ttl, ok := stmt.Values[len(stmt.Values)-1].(int64)
+		if !ok || !strings.HasSuffix(stmt.CQL, "USING TTL ?") || ttl < 2990 || ttl > 3000 {
+			t.Fatalf("got ttl %v for %v, want about 3000", stmt.Values[len(stmt.Values)-1], stmt.CQL)
+		}
+	}
+}
+
+func TestCassandraCountEvents(t *testing.T) {
+	fs := &cassandra.FakeSession{}
+	c := &CassandraStore{session: fs}
+
+	_, err := c.CountEvents(context.Background(), "9a0b4d3c-6c3e-4b1a-8f5e-2d0c4f1e7a61", time.Now().Unix())
+	je, ok := err.(jh.Error)
+	if !ok {
+		t.Fatalf("count events: got %v, want a jh.Error", err)
+	}
+	if got, want := je.Status(), http.StatusNotImplemented; got != want {
+		t.Fatalf("status: got %v, want %v", got, want)
+	}
+	if got := len(fs.Statements()); got != 0 {
+		t.Fatalf("statements: got %v, want none", got)
+	}
+}
@@ -1,6 +1,7 @@
 package eventmaster
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"net"
@@ -85,6 +86,7 @@ func (s *RsyslogServer) handleLogRequest(conn net.Conn) {
 	}
 	defer conn.Close()
 
+	var evts []*UnaddedEvent
 	logs := strings.Split(string(buf), "\n")
 	for _, lg := range logs {
 		parts := strings.Split(lg, "^0")
@@ -102,16 +104,20 @@ func (s *RsyslogServer) handleLogRequest(conn net.Conn) {
 		}
 		dc, host, topic, message := parts[1], parts[2], parts[3], parts[4]
 		if parser, ok := logParserMap[topic]; ok {
-			evt := parser(timestamp, dc, host, topic, message)
-			_, err = s.store.AddEvent(evt)
-			if err != nil {
-				// TODO: keep metric on this, add to queue of events to retry?
-				log.Errorf("Error adding log event: %v", err)
-			}
+			evts = append(evts, parser(timestamp, dc, host, topic, message))
 		} else {
 			log.Errorf("unrecognized log type, won't be added: %v", topic)
 		}
 	}
+	if len(evts) == 0 {
+		return
+	}
+	for _, res := range s.store.AddEvents(context.Background(), evts) {
+		if res.Error != "" {
+			// TODO: keep metric on this, add to queue of events to retry?
+			log.Errorf("Error adding log event: %v", res.Error)
+		}
+	}
 }
 
 // AcceptLogs kickss off a goroutine that listens for connections and
@@ -0,0 +1,750 @@
+package eventmaster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+	"github.com/segmentio/ksuid"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ContextLogic/eventmaster/jh"
+	"github.com/ContextLogic/eventmaster/metrics"
+	eventmaster "github.com/ContextLogic/eventmaster/proto"
+)
+
+// Rule fires a notification when enough events matching its query are added
+// within a window of time.
+type Rule struct {
+	ID   string `json:"rule_id"`
+	Name string `json:"name"`
+	// Query selects the events the rule counts, with the same filters as a
+	// search. Its time, paging and sort fields are ignored.
+	Query *eventmaster.Query `json:"query"`
+	// GroupBy counts events separately for each combination of the values
+	// of these fields: "topic_name", "dc", "host", "user",
+	// "parent_event_id" or "data." followed by a dotted data path.
+	GroupBy []string `json:"group_by,omitempty"`
+	// Threshold is the number of matching events within Window that fire
+	// the rule. It defaults to 1, firing on every matching event.
+	Threshold int `json:"threshold,omitempty"`
+	// Window is how long, as a duration string, matching events count
+	// towards Threshold. It is required when Threshold is above 1.
+	Window string `json:"window,omitempty"`
+	// Cooldown is how long, as a duration string, after firing for a group
+	// the rule does not fire for it again. It defaults to Window.
+	Cooldown string      `json:"cooldown,omitempty"`
+	Webhook  RuleWebhook `json:"webhook"`
+	// Disabled rules are kept but not evaluated.
+	Disabled bool `json:"disabled,omitempty"`
+}
+
+// RuleWebhook is where a rule posts its notifications.
+type RuleWebhook struct {
+	URL string `json:"url"`
+	// Template is a text/template executed with a RuleNotification to
+	// produce the request body, DefaultRuleTemplate if empty. The function
+	// json encodes its argument as json.
+	Template string `json:"template,omitempty"`
+	// Headers are added to every request.
+	Headers map[string]string `json:"headers,omitempty"`
+	// Secret, if set, signs requests the same way as webhook sinks; see
+	// WebhookSignatureHeader.
+	Secret string `json:"secret,omitempty"`
+}
+
+// DefaultRuleTemplate is a Slack-compatible message about the event that
+// fired a rule.
+const DefaultRuleTemplate = `{"text": {{json (printf "Rule %q fired: %d matching events, the last %v on %v in %v (%v)" .Rule.Name .Count .Event.TopicName .Event.Host .Event.DC .Event.EventID)}}}`
+
+// RuleNotification is what a rule's webhook template is executed with.
+type RuleNotification struct {
+	Rule Rule
+	// Group has the value of each GroupBy field for the events counted.
+	Group map[string]string
+	// Count is the number of matching events within the window.
+	Count int
+	// Event is the event that fired the rule.
+	Event *EventResult
+}
+
+// RuleState is what a rule remembers between events. It is saved every
+// ruleStateSaveInterval while it changes, so that windows and cooldowns
+// survive restarts.
+//
+// Each eventmaster counts only the events added through it, and saves its
+// own state of a rule over that of the others. Behind a load balancer a
+// threshold therefore applies to each instance's share of the events, and a
+// restarted instance resumes from the state last saved by any of them.
+type RuleState struct {
+	// Groups is keyed by the json array of the group's GroupBy values.
+	Groups map[string]*RuleGroupState `json:"groups"`
+}
+
+// RuleGroupState is the state of one group of a rule.
+type RuleGroupState struct {
+	// Times are the received times, in seconds, of the matching events in
+	// the window, oldest first.
+	Times []int64 `json:"times,omitempty"`
+	// FiredAt is when the rule last fired for the group, in seconds.
+	FiredAt int64 `json:"fired_at,omitempty"`
+}
+
+// ruleNotifyAttempts is how many times a notification is posted before it is
+// given up on.
+const ruleNotifyAttempts = 3
+
+// rulePruneInterval is how often groups that can no longer fire are dropped
+// from the state of a rule.
+const rulePruneInterval = time.Minute
+
+// ruleQueueSize is the number of notifications of a rule waiting to be sent
+// above which new ones are dropped.
+const ruleQueueSize = 100
+
+// ruleStateSaveInterval is how often the state of a rule is saved while it
+// changes.
+var ruleStateSaveInterval = time.Second
+
+// compiledRule is a Rule ready to be evaluated. It does not change once
+// compiled; what changes as events arrive is in its ruleRuntime, which is
+// handed on to the compiledRule that replaces it when the rule is reloaded
+// unchanged.
+type compiledRule struct {
+	rule     Rule
+	matcher  *eventMatcher
+	terms    []string
+	window   int64 // seconds
+	cooldown int64 // seconds
+	tmpl     *template.Template
+	rt       *ruleRuntime
+}
+
+// ruleNotification is a notification queued to be sent by the rule that
+// fired.
+type ruleNotification struct {
+	cr *compiledRule
+	n  RuleNotification
+}
+
+// ruleRuntime is the state of a rule and the goroutines that send its
+// notifications and save its state.
+type ruleRuntime struct {
+	id   string
+	name string
+
+	mu        sync.Mutex // guards everything below but saveMu
+	state     RuleState
+	lastPrune int64
+	dirty     bool // state changed since it was last saved
+	stopped   bool
+	sends     chan ruleNotification
+	quit      chan struct{}
+	pending   *sync.WaitGroup // notifications queued or being sent
+
+	saveMu sync.Mutex // held while the state is being saved
+}
+
+var ruleGroupFields = map[string]bool{
+	"topic_name":      true,
+	"dc":              true,
+	"host":            true,
+	"user":            true,
+	"parent_event_id": true,
+}
+
+// compileRule validates r and prepares it for evaluation. Errors have a 400
+// status.
+func (es *EventStore) compileRule(r Rule) (*compiledRule, error) {
+	bad := func(format string, args ...interface{}) error {
+		return jh.NewError(fmt.Sprintf(format, args...), http.StatusBadRequest)
+	}
+	if r.Name == "" {
+		return nil, bad("rule name cannot be empty")
+	}
+	q := r.Query
+	if q == nil {
+		q = &eventmaster.Query{}
+	}
+	m, err := es.newQueryMatcher(q)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range r.GroupBy {
+		if !ruleGroupFields[f] && !(strings.HasPrefix(f, "data.") && len(f) > len("data.")) {
+			return nil, bad("cannot group by %q", f)
+		}
+	}
+	if r.Threshold < 0 {
+		return nil, bad("threshold cannot be negative")
+	}
+	window, err := durationOrDefault(r.Window, 0)
+	if err != nil || window < 0 {
+		return nil, bad("invalid window %q", r.Window)
+	}
+	if r.Threshold > 1 && window < time.Second {
+		return nil, bad("a threshold above 1 needs a window of at least a second")
+	}
+	cooldown, err := durationOrDefault(r.Cooldown, window)
+	if err != nil || cooldown < 0 {
+		return nil, bad("invalid cooldown %q", r.Cooldown)
+	}
+	if r.Webhook.URL == "" {
+		return nil, bad("rule needs a webhook url")
+	}
+	text := r.Webhook.Template
+	if text == "" {
+		text = DefaultRuleTemplate
+	}
+	tmpl, err := template.New(r.Name).Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Parse(text)
+	if err != nil {
+		return nil, bad("parse webhook template: %v", err)
+	}
+	return &compiledRule{
+		rule:     r,
+		matcher:  m,
+		terms:    queryTerms(q.Text),
+		window:   int64(window / time.Second),
+		cooldown: int64(cooldown / time.Second),
+		tmpl:     tmpl,
+	}, nil
+}
+
+// startRule starts the goroutines of a ruleRuntime for r, starting from
+// state.
+func (es *EventStore) startRule(r Rule, state RuleState) *ruleRuntime {
+	if state.Groups == nil {
+		state.Groups = map[string]*RuleGroupState{}
+	}
+	rt := &ruleRuntime{
+		id:      r.ID,
+		name:    r.Name,
+		state:   state,
+		sends:   make(chan ruleNotification, ruleQueueSize),
+		quit:    make(chan struct{}),
+		pending: es.ruleSends,
+	}
+	go rt.sendLoop()
+	go es.saveLoop(rt)
+	return rt
+}
+
+// enqueue queues n without blocking, dropping it if the queue of the rule is
+// full or the rule has been stopped. The caller holds rt.mu.
+func (rt *ruleRuntime) enqueue(n ruleNotification) {
+	if rt.stopped {
+		return
+	}
+	rt.pending.Add(1)
+	select {
+	case rt.sends <- n:
+	default:
+		rt.pending.Done()
+		metrics.RuleNotifyError(rt.name)
+		log.Errorf("rule %v: dropping notification, %d are waiting to be sent", rt.name, len(rt.sends))
+	}
+}
+
+func (rt *ruleRuntime) sendLoop() {
+	for n := range rt.sends {
+		if err := n.cr.notify(n.n); err != nil {
+			metrics.RuleNotifyError(rt.name)
+			log.Errorf("notify for rule %v: %v", rt.name, err)
+		}
+		rt.pending.Done()
+	}
+}
+
+// saveLoop saves the state of rt every ruleStateSaveInterval, if it
+// changed, until rt is stopped.
+func (es *EventStore) saveLoop(rt *ruleRuntime) {
+	t := time.NewTicker(ruleStateSaveInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-rt.quit:
+			return
+		case <-t.C:
+			if err := es.saveRuleState(context.Background(), rt); err != nil {
+				log.Errorf("save state of rule %v: %v", rt.name, err)
+			}
+		}
+	}
+}
+
+// saveRuleState saves the state of rt if it changed since it was last saved
+// and rt has not been stopped.
+func (es *EventStore) saveRuleState(ctx context.Context, rt *ruleRuntime) error {
+	rt.saveMu.Lock()
+	defer rt.saveMu.Unlock()
+	rt.mu.Lock()
+	if rt.stopped || !rt.dirty {
+		rt.mu.Unlock()
+		return nil
+	}
+	state := rt.state.copy()
+	rt.dirty = false
+	rt.mu.Unlock()
+
+	if err := es.ds.SaveRuleState(ctx, rt.id, state); err != nil {
+		rt.mu.Lock()
+		rt.dirty = true
+		rt.mu.Unlock()
+		metrics.DBError("write")
+		return errors.Wrap(err, "save rule state")
+	}
+	return nil
+}
+
+// stop ends the goroutines of rt once its queued notifications are sent,
+// and waits for a save of its state that is under way. Its state is not
+// saved again, so that it cannot overwrite the state written for the rule
+// that replaces it.
+func (rt *ruleRuntime) stop() {
+	rt.mu.Lock()
+	if !rt.stopped {
+		rt.stopped = true
+		close(rt.sends)
+		close(rt.quit)
+	}
+	rt.mu.Unlock()
+	rt.saveMu.Lock()
+	rt.saveMu.Unlock()
+}
+
+// copy returns a copy of s that shares nothing with it.
+func (s RuleState) copy() RuleState {
+	c := RuleState{Groups: make(map[string]*RuleGroupState, len(s.Groups))}
+	for key, g := range s.Groups {
+		c.Groups[key] = &RuleGroupState{Times: append([]int64(nil), g.Times...), FiredAt: g.FiredAt}
+	}
+	return c
+}
+
+// threshold returns the number of events that fire the rule.
+func (cr *compiledRule) threshold() int {
+	if cr.rule.Threshold < 1 {
+		return 1
+	}
+	return cr.rule.Threshold
+}
+
+// group returns the GroupBy values of evt and the key of its group.
+func (cr *compiledRule) group(evt *EventResult) (map[string]string, string) {
+	if len(cr.rule.GroupBy) == 0 {
+		return nil, "[]"
+	}
+	group := make(map[string]string, len(cr.rule.GroupBy))
+	values := make([]string, len(cr.rule.GroupBy))
+	for i, f := range cr.rule.GroupBy {
+		var v string
+		switch f {
+		case "topic_name":
+			v = evt.TopicName
+		case "dc":
+			v = evt.DC
+		case "host":
+			v = evt.Host
+		case "user":
+			v = evt.User
+		case "parent_event_id":
+			v = evt.ParentEventID
+		default:
+			if dv, ok := lookupDataPath(evt.Data, strings.TrimPrefix(f, "data.")); ok && dv != nil {
+				v = fmt.Sprint(dv)
+			}
+		}
+		group[f] = v
+		values[i] = v
+	}
+	key, _ := json.Marshal(values)
+	return group, string(key)
+}
+
+// observe counts an event of the group with key received at now (in
+// seconds), reporting whether the rule fires and how many events were
+// counted. The caller holds cr.rt.mu.
+func (cr *compiledRule) observe(key string, now int64) (bool, int) {
+	cr.rt.dirty = true
+	g := cr.rt.state.Groups[key]
+	if g == nil {
+		g = &RuleGroupState{}
+		cr.rt.state.Groups[key] = g
+	}
+	times := g.Times[:0]
+	for _, t := range g.Times {
+		if t > now-cr.window {
+			times = append(times, t)
+		}
+	}
+	g.Times = append(times, now)
+	if n := cr.threshold(); len(g.Times) > n {
+		g.Times = g.Times[len(g.Times)-n:]
+	}
+	if len(g.Times) < cr.threshold() {
+		return false, len(g.Times)
+	}
+	if g.FiredAt != 0 && now < g.FiredAt+cr.cooldown {
+		return false, len(g.Times)
+	}
+	count := len(g.Times)
+	g.FiredAt = now
+	g.Times = nil
+	return true, count
+}
+
+// prune drops the groups of a rule that can no longer fire or be held back by
+// a cooldown, so that its state does not grow without bound. The caller
+// holds cr.rt.mu.
+func (cr *compiledRule) prune(now int64) {
+	if now < cr.rt.lastPrune+int64(rulePruneInterval/time.Second) {
+		return
+	}
+	cr.rt.lastPrune = now
+	for key, g := range cr.rt.state.Groups {
+		if len(g.Times) > 0 && g.Times[len(g.Times)-1] > now-cr.window {
+			continue
+		}
+		if g.FiredAt != 0 && now < g.FiredAt+cr.cooldown {
+			continue
+		}
+		delete(cr.rt.state.Groups, key)
+	}
+}
+
+// evaluateRules counts evt, in the form returned by the DataStores, towards
+// every rule it matches and queues the notifications of the rules that fire.
+// States are saved and notifications sent by the goroutines of each rule, so
+// nothing here waits on the DataStore or a webhook.
+func (es *EventStore) evaluateRules(evt *Event) {
+	es.ruleMutex.RLock()
+	rules := es.rules
+	es.ruleMutex.RUnlock()
+
+	var result *EventResult
+	now := evt.ReceivedTime / 1000
+	for _, cr := range rules {
+		if cr.rule.Disabled || !cr.matcher.matches(evt) || (len(cr.terms) > 0 && !matchesText(evt, cr.terms)) {
+			continue
+		}
+		if result == nil {
+			result = es.eventResult(evt)
+		}
+		group, key := cr.group(result)
+
+		cr.rt.mu.Lock()
+		fired, count := cr.observe(key, now)
+		cr.prune(now)
+		if fired {
+			metrics.RuleFired(cr.rule.Name)
+			cr.rt.enqueue(ruleNotification{cr, RuleNotification{Rule: cr.rule, Group: group, Count: count, Event: result}})
+		}
+		cr.rt.mu.Unlock()
+	}
+}
+
+// notify posts n to the rule's webhook, retrying failures with backoff.
+func (cr *compiledRule) notify(n RuleNotification) error {
+	var body bytes.Buffer
+	if err := cr.tmpl.Execute(&body, n); err != nil {
+		return errors.Wrap(err, "execute template")
+	}
+	client := &http.Client{Timeout: defaultWebhookTimeout}
+	wait := sinkBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = cr.post(client, body.Bytes()); err == nil || attempt == ruleNotifyAttempts {
+			return err
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+func (cr *compiledRule) post(client *http.Client, body []byte) error {
+	wh := cr.rule.Webhook
+	req, err := http.NewRequest("POST", wh.URL, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "new webhook request")
+	}
+	for k, v := range wh.Headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if wh.Secret != "" {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(WebhookTimestampHeader, ts)
+		req.Header.Set(WebhookSignatureHeader, SignWebhook(wh.Secret, ts, body))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "post %v", wh.URL)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return errors.Errorf("post %v: status %d: %s", wh.URL, resp.StatusCode, bytes.TrimSpace(b))
+	}
+	return nil
+}
+
+// sameRule reports whether a and b are the same definition.
+func sameRule(a, b Rule) bool {
+	ja, errA := json.Marshal(a)
+	jb, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(ja, jb)
+}
+
+// loadRules replaces the rules being evaluated with those in the DataStore.
+// Rules that have not changed keep their runtime, and so their state, but
+// are compiled again since topics and dcs may have been renamed or
+// recreated; the others start from their saved state. A stored rule that is
+// no longer valid, e.g. because one of its topics was deleted, is logged and
+// skipped.
+func (es *EventStore) loadRules(ctx context.Context) error {
+	es.ruleLoadMutex.Lock()
+	defer es.ruleLoadMutex.Unlock()
+	rules, err := es.ds.GetRules(ctx)
+	if err != nil {
+		metrics.DBError("read")
+		return errors.Wrap(err, "get rules")
+	}
+	es.ruleMutex.RLock()
+	old := es.rules
+	es.ruleMutex.RUnlock()
+
+	loaded := make(map[string]*compiledRule, len(rules))
+	for _, r := range rules {
+		cr, err := es.compileRule(r)
+		if err != nil {
+			log.Errorf("skipping rule %v: %v", r.Name, err)
+			continue
+		}
+		if prev, ok := old[r.ID]; ok && sameRule(prev.rule, r) {
+			cr.rt = prev.rt
+			loaded[r.ID] = cr
+			continue
+		}
+		state, err := es.ds.GetRuleState(ctx, r.ID)
+		if err != nil {
+			metrics.DBError("read")
+			for _, cr := range loaded {
+				if old[cr.rule.ID] == nil || old[cr.rule.ID].rt != cr.rt {
+					cr.rt.stop()
+				}
+			}
+			return errors.Wrapf(err, "get state of rule %v", r.Name)
+		}
+		cr.rt = es.startRule(r, state)
+		loaded[r.ID] = cr
+	}
+
+	es.ruleMutex.Lock()
+	es.rules = loaded
+	es.ruleMutex.Unlock()
+	for id, cr := range old {
+		if l, ok := loaded[id]; !ok || l.rt != cr.rt {
+			cr.rt.stop()
+		}
+	}
+	return nil
+}
+
+// dropRule stops evaluating the rule with id until rules are next loaded,
+// so that nothing it has yet to save can overwrite what is written for the
+// rule next.
+func (es *EventStore) dropRule(id string) {
+	es.ruleLoadMutex.Lock()
+	defer es.ruleLoadMutex.Unlock()
+	es.ruleMutex.Lock()
+	cr, ok := es.rules[id]
+	if ok {
+		rules := make(map[string]*compiledRule, len(es.rules))
+		for k, v := range es.rules {
+			if k != id {
+				rules[k] = v
+			}
+		}
+		es.rules = rules
+	}
+	es.ruleMutex.Unlock()
+	if ok {
+		cr.rt.stop()
+	}
+}
+
+// GetRules returns every rule.
+func (es *EventStore) GetRules(ctx context.Context) ([]Rule, error) {
+	rules, err := es.ds.GetRules(ctx)
+	if err != nil {
+		metrics.DBError("read")
+		return nil, errors.Wrap(err, "get rules")
+	}
+	return rules, nil
+}
+
+// GetRule returns the rule with id, or a 404 if there is none.
+func (es *EventStore) GetRule(ctx context.Context, id string) (*Rule, error) {
+	rules, err := es.GetRules(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range rules {
+		if rules[i].ID == id {
+			return &rules[i], nil
+		}
+	}
+	return nil, jh.NewError(errors.Errorf("no rule with id %v", id).Error(), http.StatusNotFound)
+}
+
+// AddRule validates and stores r, returning its id.
+func (es *EventStore) AddRule(ctx context.Context, r Rule) (string, error) {
+	r.ID = ksuid.New().String()
+	if _, err := es.compileRule(r); err != nil {
+		return "", err
+	}
+	if err := es.ds.PutRule(ctx, r); err != nil {
+		metrics.DBError("write")
+		return "", errors.Wrap(err, "put rule")
+	}
+	return r.ID, es.loadRules(ctx)
+}
+
+// UpdateRule replaces the rule with id by r. Its state is reset, since what
+// it counts may have changed, unless r is the same as the rule.
+func (es *EventStore) UpdateRule(ctx context.Context, id string, r Rule) error {
+	old, err := es.GetRule(ctx, id)
+	if err != nil {
+		return err
+	}
+	r.ID = id
+	if _, err := es.compileRule(r); err != nil {
+		return err
+	}
+	if sameRule(*old, r) {
+		return nil
+	}
+	es.dropRule(id)
+	if err := es.ds.PutRule(ctx, r); err != nil {
+		metrics.DBError("write")
+		return es.reloadRules(ctx, errors.Wrap(err, "put rule"))
+	}
+	if err := es.ds.SaveRuleState(ctx, id, RuleState{}); err != nil {
+		metrics.DBError("write")
+		return es.reloadRules(ctx, errors.Wrap(err, "reset rule state"))
+	}
+	return es.loadRules(ctx)
+}
+
+// DeleteRule removes the rule with id and its state.
+func (es *EventStore) DeleteRule(ctx context.Context, id string) error {
+	if _, err := es.GetRule(ctx, id); err != nil {
+		return err
+	}
+	es.dropRule(id)
+	if err := es.ds.DeleteRule(ctx, id); err != nil {
+		metrics.DBError("write")
+		return es.reloadRules(ctx, errors.Wrap(err, "delete rule"))
+	}
+	return es.loadRules(ctx)
+}
+
+// reloadRules loads the rules again after a change to them failed with err,
+// so that a rule dropped for the change is evaluated again, and returns err.
+func (es *EventStore) reloadRules(ctx context.Context, err error) error {
+	if lerr := es.loadRules(ctx); lerr != nil {
+		log.Errorf("reload rules: %v", lerr)
+	}
+	return err
+}
+
+// CloseRules waits for the notifications that are queued or being sent,
+// until ctx is done, and saves the state of every rule that changed since it
+// was last saved.
+func (es *EventStore) CloseRules(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		es.ruleSends.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Warnf("gave up waiting for rule notifications: %v", ctx.Err())
+	}
+
+	es.ruleMutex.RLock()
+	rules := es.rules
+	es.ruleMutex.RUnlock()
+	for _, cr := range rules {
+		if err := es.saveRuleState(ctx, cr.rt); err != nil {
+			log.Errorf("save state of rule %v: %v", cr.rule.Name, err)
+		}
+	}
+}
+
+func (s *Server) addRule(w http.ResponseWriter, r *http.Request, _ httprouter.Params) (interface{}, error) {
+	var rule Rule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		return nil, jh.NewError(errors.Wrap(err, "json decode").Error(), http.StatusBadRequest)
+	}
+	id, err := s.store.AddRule(r.Context(), rule)
+	if err != nil {
+		return nil, jh.Wrap(err, "add rule")
+	}
+	return jh.NewSuccess(map[string]string{"rule_id": id}, http.StatusCreated), nil
+}
+
+func (s *Server) getRules(w http.ResponseWriter, r *http.Request, _ httprouter.Params) (interface{}, error) {
+	rules, err := s.store.GetRules(r.Context())
+	if err != nil {
+		return nil, jh.Wrap(err, "get rules")
+	}
+	if rules == nil {
+		rules = []Rule{}
+	}
+	return map[string][]Rule{"results": rules}, nil
+}
+
+func (s *Server) getRule(w http.ResponseWriter, r *http.Request, ps httprouter.Params) (interface{}, error) {
+	rule, err := s.store.GetRule(r.Context(), ps.ByName("id"))
+	if err != nil {
+		return nil, jh.Wrap(err, "get rule")
+	}
+	return rule, nil
+}
+
+func (s *Server) updateRule(w http.ResponseWriter, r *http.Request, ps httprouter.Params) (interface{}, error) {
+	var rule Rule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		return nil, jh.NewError(errors.Wrap(err, "json decode").Error(), http.StatusBadRequest)
+	}
+	id := ps.ByName("id")
+	if err := s.store.UpdateRule(r.Context(), id, rule); err != nil {
+		return nil, jh.Wrap(err, "update rule")
+	}
+	return map[string]string{"rule_id": id}, nil
+}
+
+func (s *Server) deleteRule(w http.ResponseWriter, r *http.Request, ps httprouter.Params) (interface{}, error) {
+	id := ps.ByName("id")
+	if err := s.store.DeleteRule(r.Context(), id); err != nil {
+		return nil, jh.Wrap(err, "delete rule")
+	}
+	return map[string]string{"rule_id": id}, nil
+}
@@ -0,0 +1,384 @@
+package eventmaster
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	eventmaster "github.com/ContextLogic/eventmaster/proto"
+)
+
+// ruleReceiver records the bodies of the notifications posted to it.
+type ruleReceiver struct {
+	mu     sync.Mutex
+	bodies []string
+}
+
+func (rr *ruleReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b, _ := ioutil.ReadAll(r.Body)
+	rr.mu.Lock()
+	rr.bodies = append(rr.bodies, string(b))
+	rr.mu.Unlock()
+}
+
+// take returns the bodies received once store has sent its notifications,
+// and forgets them.
+func (rr *ruleReceiver) take(t *testing.T, store *EventStore) []string {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	store.CloseRules(ctx)
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	b := rr.bodies
+	rr.bodies = nil
+	return b
+}
+
+func TestRules(t *testing.T) {
+	ds := &mockDataStore{}
+	store := newTestEventStore(t, ds)
+	rr := &ruleReceiver{}
+	hook := httptest.NewServer(rr)
+	defer hook.Close()
+	ts := httptest.NewServer(NewServer(store, "", ""))
+	defer ts.Close()
+
+	post := func(method, path, body string) (int, map[string]string) {
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("new request: %v", err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%v %v: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		r := map[string]string{}
+		json.NewDecoder(resp.Body).Decode(&r)
+		return resp.StatusCode, r
+	}
+
+	status, r := post("POST", "/v1/rule", `{
+		"name": "rollback",
+		"query": {"topic_name": ["test1"], "dc": ["dc1"], "tag_set": ["rollback"]},
+		"webhook": {"url": "`+hook.URL+`"}
+	}`)
+	if status != http.StatusCreated {
+		t.Fatalf("add rule: got status %v, want %v", status, http.StatusCreated)
+	}
+	rollbackID := r["rule_id"]
+	status, r = post("POST", "/v1/rule", `{
+		"name": "failed logins",
+		"query": {"topic_name": ["test2"], "data": "{\"type\": \"USER_LOGIN\", \"res\": \"failed\"}"},
+		"group_by": ["user"],
+		"threshold": 3,
+		"window": "10m",
+		"webhook": {"url": "`+hook.URL+`", "template": "{{.Group.user}} {{.Count}}"}
+	}`)
+	if status != http.StatusCreated {
+		t.Fatalf("add rule: got status %v, want %v", status, http.StatusCreated)
+	}
+	loginsID := r["rule_id"]
+
+	for _, body := range []string{
+		`{"name": "x", "query": {"topic_name": ["nope"]}, "webhook": {"url": "http://x"}}`,
+		`{"name": "x", "threshold": 2, "webhook": {"url": "http://x"}}`,
+		`{"name": "x", "group_by": ["tag_set"], "webhook": {"url": "http://x"}}`,
+		`{"name": "x", "webhook": {"url": "http://x", "template": "{{"}}`,
+		`{"name": "x"}`,
+	} {
+		if status, _ := post("POST", "/v1/rule", body); status != http.StatusBadRequest {
+			t.Fatalf("add rule %v: got status %v, want %v", body, status, http.StatusBadRequest)
+		}
+	}
+
+	add := func(evts ...*UnaddedEvent) {
+		for _, evt := range evts {
+			if evt.EventTime == 0 {
+				evt.EventTime = time.Now().Unix()
+			}
+			if _, err := store.AddEvent(context.Background(), evt); err != nil {
+				t.Fatalf("add event: %v", err)
+			}
+		}
+	}
+	login := func(user string) *UnaddedEvent {
+		return &UnaddedEvent{TopicName: "test2", DC: "dc1", Host: "a", User: user,
+			Data: map[string]interface{}{"type": "USER_LOGIN", "res": "failed"}}
+	}
+
+	add(
+		&UnaddedEvent{TopicName: "test1", DC: "dc1", Host: "web1", Tags: []string{"deploy", "rollback"}},
+		&UnaddedEvent{TopicName: "test1", DC: "dc2", Host: "web2", Tags: []string{"rollback"}},
+		&UnaddedEvent{TopicName: "test1", DC: "dc1", Host: "web3", Tags: []string{"deploy"}},
+	)
+	bodies := rr.take(t, store)
+	if len(bodies) != 1 {
+		t.Fatalf("rollback notifications: got %v, want 1", bodies)
+	}
+	var slack map[string]string
+	if err := json.Unmarshal([]byte(bodies[0]), &slack); err != nil {
+		t.Fatalf("default template is not json: %v: %v", bodies[0], err)
+	}
+	if !strings.Contains(slack["text"], `"rollback"`) || !strings.Contains(slack["text"], "web1") {
+		t.Fatalf("notification text: got %q", slack["text"])
+	}
+
+	add(login("bob"), login("bob"), login("alice"))
+	ok := login("bob")
+	ok.Data["res"] = "success"
+	add(ok)
+	assert.Empty(t, rr.take(t, store))
+	add(login("bob"))
+	assert.Equal(t, []string{"bob 3"}, rr.take(t, store))
+	// the count starts again, and the rule cannot fire again for bob within
+	// the cooldown
+	add(login("bob"), login("bob"), login("bob"))
+	assert.Empty(t, rr.take(t, store))
+
+	// a restarted eventmaster picks up where the last one left off
+	restarted := newTestEventStore(t, &mockDataStore{rules: ds.rules, ruleStates: ds.ruleStates})
+	if err := restarted.loadRules(context.Background()); err != nil {
+		t.Fatalf("load rules: %v", err)
+	}
+	add2 := func(evt *UnaddedEvent) {
+		evt.EventTime = time.Now().Unix()
+		if _, err := restarted.AddEvent(context.Background(), evt); err != nil {
+			t.Fatalf("add event: %v", err)
+		}
+	}
+	add2(login("alice"))
+	assert.Empty(t, rr.take(t, restarted))
+	add2(login("alice"))
+	assert.Equal(t, []string{"alice 3"}, rr.take(t, restarted))
+	add2(login("bob"))
+	assert.Empty(t, rr.take(t, restarted))
+
+	// updating a rule resets its state
+	status, _ = post("PUT", "/v1/rule/"+loginsID, `{
+		"name": "failed logins",
+		"query": {"topic_name": ["test2"]},
+		"group_by": ["user"],
+		"threshold": 2,
+		"window": "10m",
+		"webhook": {"url": "`+hook.URL+`", "template": "{{.Group.user}} {{.Count}}"}
+	}`)
+	if status != http.StatusOK {
+		t.Fatalf("update rule: got status %v, want %v", status, http.StatusOK)
+	}
+	add(login("bob"))
+	assert.Empty(t, rr.take(t, store))
+	add(login("bob"))
+	assert.Equal(t, []string{"bob 2"}, rr.take(t, store))
+
+	resp, err := http.Get(ts.URL + "/v1/rule")
+	if err != nil {
+		t.Fatalf("get rules: %v", err)
+	}
+	var list struct {
+		Results []Rule `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatalf("json decode: %v", err)
+	}
+	resp.Body.Close()
+	if len(list.Results) != 2 {
+		t.Fatalf("rules: got %+v, want 2", list.Results)
+	}
+
+	if status, _ := post("DELETE", "/v1/rule/"+rollbackID, ""); status != http.StatusOK {
+		t.Fatalf("delete rule: got status %v, want %v", status, http.StatusOK)
+	}
+	if status, _ := post("GET", "/v1/rule/"+rollbackID, ""); status != http.StatusNotFound {
+		t.Fatalf("get deleted rule: got status %v, want %v", status, http.StatusNotFound)
+	}
+	if status, _ := post("PUT", "/v1/rule/"+rollbackID, `{"name": "x", "webhook": {"url": "http://x"}}`); status != http.StatusNotFound {
+		t.Fatalf("update deleted rule: got status %v, want %v", status, http.StatusNotFound)
+	}
+	add(&UnaddedEvent{TopicName: "test1", DC: "dc1", Host: "web1", Tags: []string{"rollback"}})
+	assert.Empty(t, rr.take(t, store))
+}
+
+// putRuleFailingStore fails to store rules once fail is set.
+type putRuleFailingStore struct {
+	*mockDataStore
+	fail bool
+}
+
+func (s *putRuleFailingStore) PutRule(ctx context.Context, r Rule) error {
+	if s.fail {
+		return errors.New("unavailable")
+	}
+	return s.mockDataStore.PutRule(ctx, r)
+}
+
+func (s *putRuleFailingStore) DeleteRule(ctx context.Context, id string) error {
+	if s.fail {
+		return errors.New("unavailable")
+	}
+	return s.mockDataStore.DeleteRule(ctx, id)
+}
+
+func TestUpdateRuleKeepsState(t *testing.T) {
+	ds := &putRuleFailingStore{mockDataStore: &mockDataStore{}}
+	store := newTestEventStore(t, ds)
+	rr := &ruleReceiver{}
+	hook := httptest.NewServer(rr)
+	defer hook.Close()
+
+	ctx := context.Background()
+	rule := Rule{
+		Name:      "deploys",
+		Query:     &eventmaster.Query{TopicName: []string{"test1"}},
+		Threshold: 2,
+		Window:    "10m",
+		Webhook:   RuleWebhook{URL: hook.URL, Template: "{{.Count}}"},
+	}
+	id, err := store.AddRule(ctx, rule)
+	if err != nil {
+		t.Fatalf("add rule: %v", err)
+	}
+	add := func() {
+		if _, err := store.AddEvent(ctx, &UnaddedEvent{TopicName: "test1", DC: "dc1", Host: "h"}); err != nil {
+			t.Fatalf("add event: %v", err)
+		}
+	}
+
+	// an update that changes nothing keeps counting, even before the state
+	// is saved
+	add()
+	if err := store.UpdateRule(ctx, id, rule); err != nil {
+		t.Fatalf("update rule: %v", err)
+	}
+	add()
+	assert.Equal(t, []string{"2"}, rr.take(t, store))
+
+	// a rule that fails to be updated or deleted is still evaluated
+	ds.fail = true
+	changed := rule
+	changed.Threshold = 1
+	if err := store.UpdateRule(ctx, id, changed); err == nil {
+		t.Fatalf("update rule: got no error")
+	}
+	if err := store.DeleteRule(ctx, id); err == nil {
+		t.Fatalf("delete rule: got no error")
+	}
+	store.ruleMutex.RLock()
+	_, ok := store.rules[id]
+	store.ruleMutex.RUnlock()
+	if !ok {
+		t.Fatalf("rule is no longer evaluated")
+	}
+}
+
+func TestRuleObserve(t *testing.T) {
+	cr := &compiledRule{
+		rule:     Rule{Threshold: 2},
+		window:   60,
+		cooldown: 300,
+		rt:       &ruleRuntime{state: RuleState{Groups: map[string]*RuleGroupState{}}},
+	}
+	for _, tc := range []struct {
+		key  string
+		now  int64
+		want bool
+	}{
+		{"a", 0, false},
+		{"a", 61, false}, // the first event has left the window
+		{"b", 62, false}, // groups are counted apart
+		{"a", 90, true},
+		{"a", 100, false},
+		{"a", 130, false}, // within the cooldown
+		{"a", 400, false}, // after it, but the window holds one event
+		{"a", 410, true},
+	} {
+		if got, _ := cr.observe(tc.key, tc.now); got != tc.want {
+			t.Fatalf("observe(%v, %v): got %v, want %v", tc.key, tc.now, got, tc.want)
+		}
+	}
+
+	if !cr.rt.dirty {
+		t.Fatalf("observe did not mark the state to be saved")
+	}
+
+	cr.rt.lastPrune = 0
+	cr.prune(600)
+	if _, ok := cr.rt.state.Groups["b"]; ok {
+		t.Fatalf("prune kept a group that can no longer fire")
+	}
+	if _, ok := cr.rt.state.Groups["a"]; !ok {
+		t.Fatalf("prune dropped a group within its cooldown")
+	}
+}
+
+func TestRuleQueueFull(t *testing.T) {
+	rt := &ruleRuntime{
+		name:    "busy",
+		sends:   make(chan ruleNotification, ruleQueueSize),
+		pending: &sync.WaitGroup{},
+	}
+	for i := 0; i < ruleQueueSize+10; i++ {
+		rt.enqueue(ruleNotification{})
+	}
+	if got, want := len(rt.sends), ruleQueueSize; got != want {
+		t.Fatalf("queued notifications: got %v, want %v", got, want)
+	}
+	for range make([]struct{}, ruleQueueSize) {
+		<-rt.sends
+		rt.pending.Done()
+	}
+	// every queued notification was counted once, and the dropped ones not
+	// at all
+	rt.pending.Wait()
+
+	rt.stopped = true
+	rt.enqueue(ruleNotification{})
+	if got := len(rt.sends); got != 0 {
+		t.Fatalf("queued notifications of a stopped rule: got %v, want 0", got)
+	}
+}
+
+func TestBoltRules(t *testing.T) {
+	bs, cleanup := newTestBoltStore(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	r := Rule{ID: "r1", Name: "deploys", Query: &eventmaster.Query{TopicName: []string{"deploy"}}, Threshold: 2, Window: "1m"}
+	if err := bs.PutRule(ctx, r); err != nil {
+		t.Fatalf("put rule: %v", err)
+	}
+	state := RuleState{Groups: map[string]*RuleGroupState{"[]": {Times: []int64{5}, FiredAt: 1}}}
+	if err := bs.SaveRuleState(ctx, r.ID, state); err != nil {
+		t.Fatalf("save rule state: %v", err)
+	}
+
+	rules, err := bs.GetRules(ctx)
+	if err != nil {
+		t.Fatalf("get rules: %v", err)
+	}
+	assert.Equal(t, []Rule{r}, rules)
+	got, err := bs.GetRuleState(ctx, r.ID)
+	if err != nil {
+		t.Fatalf("get rule state: %v", err)
+	}
+	assert.Equal(t, state, got)
+
+	if err := bs.DeleteRule(ctx, r.ID); err != nil {
+		t.Fatalf("delete rule: %v", err)
+	}
+	if rules, err := bs.GetRules(ctx); err != nil || len(rules) != 0 {
+		t.Fatalf("get rules after delete: got %v, %v, want none", rules, err)
+	}
+	if got, err := bs.GetRuleState(ctx, r.ID); err != nil || got.Groups != nil {
+		t.Fatalf("get rule state after delete: got %+v, %v, want empty", got, err)
+	}
+}
@@ -79,12 +79,23 @@ func registerRoutes(srv *Server) http.Handler {
 
 	// API endpoints
 	r.POST("/v1/event", latency("/v1/event", jh.Adapter(srv.addEvent)))
+	r.POST("/v1/events", latency("/v1/events", jh.Adapter(srv.addEvents)))
+	r.POST("/v1/event/:id", srv.postEventByID)
 	r.GET("/v1/event", latency("/v1/event", jh.Adapter(srv.getEvent)))
-	r.GET("/v1/event/:id", latency("/v1/event", jh.Adapter(srv.getEventByID)))
+	r.GET("/v1/event/:id", srv.eventByIDOrStream)
+	r.DELETE("/v1/event/:id", latency("/v1/event", jh.Adapter(srv.deleteEvent)))
+	r.POST("/v1/event/:id/redact", latency("/v1/event/redact", jh.Adapter(srv.redactEvent)))
+	r.GET("/v1/event/:id/audit", latency("/v1/event/audit", jh.Adapter(srv.getAuditTrail)))
 	r.POST("/v1/topic", latency("/v1/topic", jh.Adapter(srv.addTopic)))
 	r.PUT("/v1/topic/:name", latency("/v1/topic", jh.Adapter(srv.updateTopic)))
 	r.GET("/v1/topic", latency("/v1/topic", jh.Adapter(srv.getTopic)))
 	r.DELETE("/v1/topic/:name", latency("/v1/topic", jh.Adapter(srv.deleteTopic)))
+	r.GET("/v1/retention", latency("/v1/retention", jh.Adapter(srv.getRetention)))
+	r.POST("/v1/rule", latency("/v1/rule", jh.Adapter(srv.addRule)))
+	r.GET("/v1/rule", latency("/v1/rule", jh.Adapter(srv.getRules)))
+	r.GET("/v1/rule/:id", latency("/v1/rule", jh.Adapter(srv.getRule)))
+	r.PUT("/v1/rule/:id", latency("/v1/rule", jh.Adapter(srv.updateRule)))
+	r.DELETE("/v1/rule/:id", latency("/v1/rule", jh.Adapter(srv.deleteRule)))
 	r.POST("/v1/dc", latency("/v1/dc", jh.Adapter(srv.addDC)))
 	r.PUT("/v1/dc/:name", latency("/v1/dc", jh.Adapter(srv.updateDC)))
 	r.GET("/v1/dc", latency("/v1/dc", jh.Adapter(srv.getDC)))
@@ -0,0 +1,246 @@
+package eventmaster
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ContextLogic/eventmaster/metrics"
+)
+
+// Sink delivers stored events to another system.
+type Sink interface {
+	// Send delivers evts, oldest first. An error means none of them can be
+	// assumed delivered, and the batch is sent again.
+	Send(ctx context.Context, evts []*EventResult) error
+	// Close releases the resources of the sink once nothing more will be
+	// sent.
+	Close() error
+}
+
+// SinkConfig configures a Sink and the queue in front of it.
+type SinkConfig struct {
+	// Name identifies the sink in logs and metrics.
+	Name string `json:"name"`
+	// Type is "webhook", "kafka" or "file".
+	Type string `json:"type"`
+	// TopicNames and DCs, if given, limit the sink to events in those
+	// topics and dcs.
+	TopicNames []string `json:"topic_names"`
+	DCs        []string `json:"dcs"`
+	// QueueSize is the number of events waiting to be sent above which new
+	// events are dropped rather than slowing down writes.
+	QueueSize int `json:"queue_size"`
+	// BatchSize is the most events passed to Send at once.
+	BatchSize int `json:"batch_size"`
+	// MaxAttempts is how many times a batch is sent before it is dropped.
+	MaxAttempts int `json:"max_attempts"`
+
+	Webhook WebhookConfig   `json:"webhook"`
+	Kafka   KafkaSinkConfig `json:"kafka"`
+	File    FileSinkConfig  `json:"file"`
+}
+
+// Defaults for the SinkConfig fields that are left empty.
+const (
+	DefaultSinkQueueSize   = 10000
+	DefaultSinkBatchSize   = 100
+	DefaultSinkMaxAttempts = 5
+)
+
+// sinkBackoff is the wait before the second attempt to send a batch. It
+// doubles with every attempt after that, up to sinkMaxBackoff.
+var (
+	sinkBackoff    = 100 * time.Millisecond
+	sinkMaxBackoff = 30 * time.Second
+)
+
+// NewSink creates the Sink described by c.
+func NewSink(c SinkConfig) (Sink, error) {
+	switch c.Type {
+	case "webhook":
+		return NewWebhookSink(c.Webhook)
+	case "kafka":
+		return NewKafkaSink(c.Kafka)
+	case "file":
+		return NewFileSink(c.File)
+	}
+	return nil, errors.Errorf("unknown sink type %q", c.Type)
+}
+
+// sinkQueue feeds the events for one sink to it from a goroutine, so that a
+// slow or failing sink never holds up writes.
+type sinkQueue struct {
+	name        string
+	sink        Sink
+	topics      map[string]bool
+	dcs         map[string]bool
+	batchSize   int
+	maxAttempts int
+	events      chan *EventResult
+	done        chan struct{}
+	// stop is cancelled when the queue must give up on what it has left
+	ctx  context.Context
+	stop context.CancelFunc
+}
+
+func newSinkQueue(s Sink, c SinkConfig) *sinkQueue {
+	q := &sinkQueue{
+		name:        c.Name,
+		sink:        s,
+		batchSize:   c.BatchSize,
+		maxAttempts: c.MaxAttempts,
+		done:        make(chan struct{}),
+	}
+	if q.name == "" {
+		q.name = c.Type
+	}
+	if q.batchSize <= 0 {
+		q.batchSize = DefaultSinkBatchSize
+	}
+	if q.maxAttempts <= 0 {
+		q.maxAttempts = DefaultSinkMaxAttempts
+	}
+	size := c.QueueSize
+	if size <= 0 {
+		size = DefaultSinkQueueSize
+	}
+	q.events = make(chan *EventResult, size)
+	if len(c.TopicNames) > 0 {
+		q.topics = map[string]bool{}
+		for _, t := range c.TopicNames {
+			q.topics[t] = true
+		}
+	}
+	if len(c.DCs) > 0 {
+		q.dcs = map[string]bool{}
+		for _, dc := range c.DCs {
+			q.dcs[dc] = true
+		}
+	}
+	q.ctx, q.stop = context.WithCancel(context.Background())
+	go q.run()
+	return q
+}
+
+// wants reports whether evt passes the topic and dc filters of the sink.
+func (q *sinkQueue) wants(evt *EventResult) bool {
+	return (q.topics == nil || q.topics[evt.TopicName]) && (q.dcs == nil || q.dcs[evt.DC])
+}
+
+// enqueue queues evt without blocking, dropping it if the queue is full.
+func (q *sinkQueue) enqueue(evt *EventResult) {
+	select {
+	case q.events <- evt:
+	default:
+		metrics.SinkDropped(q.name, 1)
+	}
+}
+
+func (q *sinkQueue) run() {
+	defer close(q.done)
+	for evt := range q.events {
+		batch := []*EventResult{evt}
+	fill:
+		for len(batch) < q.batchSize {
+			select {
+			case evt, ok := <-q.events:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, evt)
+			default:
+				break fill
+			}
+		}
+		metrics.SinkQueueLength(q.name, len(q.events))
+		q.send(batch)
+	}
+}
+
+// send sends batch, retrying with exponential backoff, and drops it after
+// maxAttempts failures.
+func (q *sinkQueue) send(batch []*EventResult) {
+	wait := sinkBackoff
+	for attempt := 1; ; attempt++ {
+		err := q.sink.Send(q.ctx, batch)
+		if err == nil {
+			metrics.SinkEvents(q.name, len(batch))
+			last := batch[len(batch)-1]
+			metrics.SinkLag(q.name, time.Since(time.Unix(0, last.ReceivedTime*int64(time.Millisecond))))
+			return
+		}
+		metrics.SinkError(q.name)
+		if attempt >= q.maxAttempts || q.ctx.Err() != nil {
+			metrics.SinkDropped(q.name, len(batch))
+			log.Errorf("sink %v: dropping %d events after %d attempts: %v", q.name, len(batch), attempt, err)
+			return
+		}
+		log.Warnf("sink %v: attempt %d failed, retrying in %v: %v", q.name, attempt, wait, err)
+		select {
+		case <-q.ctx.Done():
+		case <-time.After(wait):
+		}
+		if wait *= 2; wait > sinkMaxBackoff {
+			wait = sinkMaxBackoff
+		}
+	}
+}
+
+// AddSink makes es send the events it stores, after they are written, to
+// s through a queue configured by c.
+func (es *EventStore) AddSink(s Sink, c SinkConfig) {
+	es.sinkMutex.Lock()
+	defer es.sinkMutex.Unlock()
+	es.sinks = append(es.sinks, newSinkQueue(s, c))
+}
+
+// publishToSinks queues evt, in the form returned by the DataStores, for
+// every sink that wants it.
+func (es *EventStore) publishToSinks(evt *Event) {
+	es.sinkMutex.RLock()
+	defer es.sinkMutex.RUnlock()
+	if len(es.sinks) == 0 {
+		return
+	}
+	res := es.eventResult(evt)
+	for _, q := range es.sinks {
+		if q.wants(res) {
+			q.enqueue(res)
+		}
+	}
+}
+
+// CloseSinks stops queueing events for the sinks and waits for the events
+// already queued to be sent, until ctx is done. It then closes the sinks.
+func (es *EventStore) CloseSinks(ctx context.Context) {
+	es.sinkMutex.Lock()
+	sinks := es.sinks
+	es.sinks = nil
+	es.sinkMutex.Unlock()
+
+	for _, q := range sinks {
+		close(q.events)
+	}
+	var wg sync.WaitGroup
+	for _, q := range sinks {
+		wg.Add(1)
+		go func(q *sinkQueue) {
+			defer wg.Done()
+			select {
+			case <-q.done:
+			case <-ctx.Done():
+				q.stop()
+				<-q.done
+			}
+			q.stop()
+			if err := q.sink.Close(); err != nil {
+				log.Errorf("close sink %v: %v", q.name, err)
+			}
+		}(q)
+	}
+	wg.Wait()
+}
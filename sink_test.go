@@ -0,0 +1,214 @@
+package eventmaster
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingSink records what it is sent, failing the first fails sends.
+type recordingSink struct {
+	mu     sync.Mutex
+	fails  int
+	sends  int
+	events []*EventResult
+	closed bool
+}
+
+func (r *recordingSink) Send(ctx context.Context, evts []*EventResult) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sends++
+	if r.fails > 0 {
+		r.fails--
+		return errors.New("unavailable")
+	}
+	r.events = append(r.events, evts...)
+	return nil
+}
+
+func (r *recordingSink) Close() error {
+	r.closed = true
+	return nil
+}
+
+func TestSinkQueue(t *testing.T) {
+	defer func(d time.Duration) { sinkBackoff = d }(sinkBackoff)
+	sinkBackoff = time.Millisecond
+
+	store := newTestEventStore(t, &mockDataStore{})
+	all := &recordingSink{fails: 2}
+	filtered := &recordingSink{}
+	failing := &recordingSink{fails: 100}
+	store.AddSink(all, SinkConfig{Name: "all"})
+	store.AddSink(filtered, SinkConfig{Name: "filtered", TopicNames: []string{"test1"}, DCs: []string{"dc2"}})
+	store.AddSink(failing, SinkConfig{Name: "failing", MaxAttempts: 3})
+
+	now := time.Now().Unix()
+	var want []string
+	for _, evt := range []*UnaddedEvent{
+		{TopicName: "test1", DC: "dc1", Host: "a", EventTime: now},
+		{TopicName: "test1", DC: "dc2", Host: "b", EventTime: now},
+		{TopicName: "test2", DC: "dc2", Host: "c", EventTime: now},
+	} {
+		id, err := store.AddEvent(context.Background(), evt)
+		if err != nil {
+			t.Fatalf("add event: %v", err)
+		}
+		want = append(want, id)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	store.CloseSinks(ctx)
+
+	ids := func(evts []*EventResult) []string {
+		var r []string
+		for _, evt := range evts {
+			r = append(r, evt.EventID)
+		}
+		return r
+	}
+	assert.Equal(t, want, ids(all.events))
+	assert.Equal(t, want[1:2], ids(filtered.events))
+	if got := filtered.events[0]; got.TopicName != "test1" || got.DC != "dc2" {
+		t.Fatalf("sent event: got %+v, want names in place of ids", got)
+	}
+	if len(failing.events) != 0 || failing.sends%3 != 0 {
+		t.Fatalf("failing sink: got %v events in %v sends, want batches dropped after 3 attempts", len(failing.events), failing.sends)
+	}
+	for _, s := range []*recordingSink{all, filtered, failing} {
+		if !s.closed {
+			t.Fatalf("sink was not closed")
+		}
+	}
+
+	// writes after the sinks are closed go nowhere
+	if _, err := store.AddEvent(context.Background(), &UnaddedEvent{TopicName: "test1", DC: "dc1", Host: "a", EventTime: now}); err != nil {
+		t.Fatalf("add event: %v", err)
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	var status = http.StatusOK
+	var got []*EventResult
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		sig := SignWebhook("s3cret", r.Header.Get(WebhookTimestampHeader), body)
+		if r.Header.Get(WebhookSignatureHeader) != sig || r.Header.Get("X-Team") != "ops" {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return
+		}
+		var req struct {
+			Events []*EventResult `json:"events"`
+		}
+		if err := json.Unmarshal(body, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		got = append(got, req.Events...)
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	if _, err := NewWebhookSink(WebhookConfig{URL: ts.URL}); err == nil {
+		t.Fatalf("webhook without secret: got nil error")
+	}
+	sink, err := NewWebhookSink(WebhookConfig{URL: ts.URL, Secret: "s3cret", Headers: map[string]string{"X-Team": "ops"}})
+	if err != nil {
+		t.Fatalf("new webhook sink: %v", err)
+	}
+	evts := []*EventResult{{EventID: "a", TopicName: "deploy"}, {EventID: "b", TopicName: "deploy"}}
+	if err := sink.Send(context.Background(), evts); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	assert.Equal(t, evts, got)
+
+	status = http.StatusServiceUnavailable
+	if err := sink.Send(context.Background(), evts); err == nil {
+		t.Fatalf("send to failing endpoint: got nil error")
+	}
+
+	wrong, err := NewWebhookSink(WebhookConfig{URL: ts.URL, Secret: "other", Headers: map[string]string{"X-Team": "ops"}})
+	if err != nil {
+		t.Fatalf("new webhook sink: %v", err)
+	}
+	if err := wrong.Send(context.Background(), evts); err == nil {
+		t.Fatalf("send with the wrong secret: got nil error")
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eventmaster")
+	if err != nil {
+		t.Fatalf("temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "events.ndjson")
+
+	sink, err := NewFileSink(FileSinkConfig{Path: path, MaxBytes: 200, MaxFiles: 2})
+	if err != nil {
+		t.Fatalf("new file sink: %v", err)
+	}
+	for i := 0; i < 4; i++ {
+		if err := sink.Send(context.Background(), []*EventResult{{EventID: fmt.Sprint(i)}}); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	read := func(p string) []string {
+		f, err := os.Open(p)
+		if err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		defer f.Close()
+		var ids []string
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			var evt EventResult
+			if err := json.Unmarshal(sc.Bytes(), &evt); err != nil {
+				t.Fatalf("json decode: %v", err)
+			}
+			ids = append(ids, evt.EventID)
+		}
+		return ids
+	}
+	// each event is over 100 bytes, so every file holds one
+	assert.Equal(t, []string{"3"}, read(path))
+	assert.Equal(t, []string{"2"}, read(path+".1"))
+	assert.Equal(t, []string{"1"}, read(path+".2"))
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("only MaxFiles rotated files are kept: got %v", err)
+	}
+}
+
+func TestKafkaMessages(t *testing.T) {
+	msgs, err := kafkaMessages([]*EventResult{{EventID: "a", TopicName: "deploy", EventTime: 100}})
+	if err != nil {
+		t.Fatalf("kafka messages: %v", err)
+	}
+	if got, want := string(msgs[0].Key), "deploy"; got != want {
+		t.Fatalf("key: got %v, want %v", got, want)
+	}
+	var evt EventResult
+	if err := json.Unmarshal(msgs[0].Value, &evt); err != nil {
+		t.Fatalf("json decode: %v", err)
+	}
+	if got, want := evt.EventID, "a"; got != want {
+		t.Fatalf("value: got %v, want %v", got, want)
+	}
+}
@@ -1,8 +1,10 @@
 var params = [];
 var querySuccess = true;
 var curPage = 0;
+var nextCursor = "";
 
 function updateResults() {
+    $('#load-more').hide();
     params = params.filter(function(v) {
         return !v.startsWith('limit=')
     });
@@ -10,6 +12,7 @@ function updateResults() {
         return v.startsWith('event_id=')
     })
     if (idQuery.length >0) {
+        $('#histogram').hide();
         $.ajax({
             type: "GET",
             url: "/v1/event/"+idQuery[0].substr(9),
@@ -49,48 +52,198 @@ function updateResults() {
         });
     } else {
         params.push('limit=100');
-        $.ajax({
-            type: "GET",
-            url: "/v1/event?"+params.join("&"),
-            dataType: "json",
-            success: function(data) {
-                querySuccess = true;
-                var elem = document.getElementById("event_table")
+        loadHistogram(params);
+        loadEvents(params, true);
+    }
+
+}
+
+// histogramIntervals are the bucket widths, in seconds, that the histogram
+// picks from so that it has at most histogramBuckets bars.
+var histogramIntervals = [1, 5, 15, 30, 60, 300, 900, 1800, 3600, 3*3600, 6*3600, 12*3600, 86400, 7*86400];
+var histogramBuckets = 60;
+
+// queryFromParams converts the params of a search into a Query for the
+// aggregate API.
+function queryFromParams(queryParams) {
+    var names = {"dc": "DC", "parent_event_id": "parent_eventID"};
+    var q = {};
+    for (var i = 0; i < queryParams.length; i++) {
+        var idx = queryParams[i].indexOf("=");
+        var key = queryParams[i].substr(0, idx);
+        var value = queryParams[i].substr(idx + 1);
+        switch (key) {
+            case "start_event_time":
+            case "end_event_time":
+                q[key] = parseInt(value, 10);
+                break;
+            case "tag_and_operator":
+            case "target_host_and_operator":
+                q[key] = value === "true";
+                break;
+            case "data":
+            case "text":
+                q[key] = decodeURIComponent(value);
+                break;
+            case "limit":
+            case "cursor":
+                break;
+            default:
+                var name = names[key] || key;
+                q[name] = (q[name] || []).concat([value]);
+        }
+    }
+    return q;
+}
+
+// loadHistogram shows the number of events matching params over the event
+// time window of the search.
+function loadHistogram(queryParams) {
+    var q = queryFromParams(queryParams);
+    var start = q["start_event_time"], end = q["end_event_time"];
+    if (!start || !end || end < start) {
+        $('#histogram').hide();
+        return;
+    }
+    var interval = histogramIntervals[histogramIntervals.length - 1];
+    for (var i = 0; i < histogramIntervals.length; i++) {
+        if ((end - start) / histogramIntervals[i] < histogramBuckets) {
+            interval = histogramIntervals[i];
+            break;
+        }
+    }
+    $.ajax({
+        type: "POST",
+        url: "/v1/event/aggregate",
+        contentType: "application/json",
+        data: JSON.stringify({"query": q, "interval": interval}),
+        dataType: "json",
+        success: function(data) {
+            renderHistogram(start, end, interval, data["buckets"] || []);
+        },
+        error: function(data) {
+            $('#histogram').hide();
+        }
+    });
+}
+
+function renderHistogram(start, end, interval, buckets) {
+    var counts = {};
+    var max = 0;
+    for (var i = 0; i < buckets.length; i++) {
+        counts[buckets[i]["time"]] = buckets[i]["count"];
+        max = Math.max(max, buckets[i]["count"]);
+    }
+    var elem = $('#histogram');
+    elem.empty();
+    for (var t = start - start % interval; t <= end; t += interval) {
+        var n = counts[t] || 0;
+        var bar = $('<div class="histogram-bar">').attr('title', new Date(t*1000).toString() + ": " + n);
+        bar.append($('<div>').css('height', (max > 0 ? 100 * n / max : 0) + '%'));
+        elem.append(bar);
+    }
+    elem.show();
+}
+
+// loadEvents fetches a page of events matching params, replacing the current
+// results or appending to them. The facets of the search are loaded with its
+// first page.
+function loadEvents(queryParams, replace) {
+    if (replace) {
+        queryParams = queryParams.concat(['facets=' + facetLimit]);
+    }
+    $.ajax({
+        type: "GET",
+        url: "/v1/event?"+queryParams.join("&"),
+        dataType: "json",
+        success: function(data) {
+            querySuccess = true;
+            var elem = document.getElementById("event_table")
+            if (replace) {
                 elem.innerHTML = "";
-                var results = data["results"];
-                if (results && results.length > 0) {
-                    for (var i = 0; i < results.length; i++) {
-                        var event = results[i];
-                        var item =
-                        `<tr onclick=hideData(this)>
-                            <td style="word-wrap:break-word;overflow:hidden;">`.concat(event['event_id'],`</td>
-                            <th style="word-wrap:break-word;overflow:hidden;" scope="row">`,event['topic_name'],`</th>
-                            <td style="word-wrap:break-word;overflow:hidden;">`,event['dc'],`</td>
-                            <td style="word-wrap:break-word;overflow:hidden;">`,(event['tag_set'] || []).join(", "),`</td>
-                            <td style="word-wrap:break-word;overflow:hidden;">`,new Date(event['event_time']*1000).toString(),`</td>
-                            <td style="word-wrap:break-word;overflow:hidden;">`,event['host'],`</td>
-                            <td style="word-wrap:break-word;overflow:hidden;">`,(event['target_host_set'] || []).join(", "),`</td>
-                            <td style="word-wrap:break-word;overflow:hidden;">`,event['user'],`</td>
-                            <td style="word-wrap:break-word;overflow:hidden;">`,event['parent_event_id'],`</td>
-                        </tr>
-                        <tr>
-                            <td colspan="9" style="word-wrap:break-word;overflow:hidden;"><pre></pre></td>
-                        </tr>`)
-                        elem.innerHTML += item;
-                        $("td[colspan=9]").find("pre").hide();
-                    }
+            }
+            var results = data["results"];
+            if (results && results.length > 0) {
+                for (var i = 0; i < results.length; i++) {
+                    var event = results[i];
+                    var item =
+                    `<tr onclick=hideData(this)>
+                        <td style="word-wrap:break-word;overflow:hidden;">`.concat(event['event_id'],`</td>
+                        <th style="word-wrap:break-word;overflow:hidden;" scope="row">`,event['topic_name'],`</th>
+                        <td style="word-wrap:break-word;overflow:hidden;">`,event['dc'],`</td>
+                        <td style="word-wrap:break-word;overflow:hidden;">`,(event['tag_set'] || []).join(", "),`</td>
+                        <td style="word-wrap:break-word;overflow:hidden;">`,new Date(event['event_time']*1000).toString(),`</td>
+                        <td style="word-wrap:break-word;overflow:hidden;">`,event['host'],`</td>
+                        <td style="word-wrap:break-word;overflow:hidden;">`,(event['target_host_set'] || []).join(", "),`</td>
+                        <td style="word-wrap:break-word;overflow:hidden;">`,event['user'],`</td>
+                        <td style="word-wrap:break-word;overflow:hidden;">`,event['parent_event_id'],`</td>
+                    </tr>
+                    <tr>
+                        <td colspan="9" style="word-wrap:break-word;overflow:hidden;"><pre></pre></td>
+                    </tr>`)
+                    elem.innerHTML += item;
+                    $("td[colspan=9]").find("pre").hide();
                 }
-            },
-            error: function(data) {
-                querySuccess = false;
-                alert("Error querying events: " + JSON.parse(data.responseText).error);
-            },
-            complete: function(data) {
-                $('#loading-indicator').hide();
             }
+            if (replace) {
+                renderFacets(data["facets"] || {});
+            }
+            nextCursor = data["cursor"] || "";
+            $('#load-more').toggle(nextCursor !== "");
+        },
+        error: function(data) {
+            querySuccess = false;
+            alert("Error querying events: " + JSON.parse(data.responseText).error);
+        },
+        complete: function(data) {
+            $('#loading-indicator').hide();
+        }
+    });
+}
+
+// facetLimit is how many values of each facet are shown.
+var facetLimit = 10;
+
+// facetFields maps each facet to the query form field that filters on it.
+var facetFields = {"topic": "topic-select-box", "dc": "dc", "host": "host", "user": "user", "tag": "tag_set"};
+
+function renderFacets(facets) {
+    var elem = $('#facets');
+    elem.empty();
+    ["topic", "dc", "host", "user", "tag"].forEach(function(name) {
+        var values = facets[name] || [];
+        if (values.length === 0) {
+            return;
+        }
+        var group = $('<div class="facet">').append($('<strong>').text(name + ":"));
+        values.forEach(function(f) {
+            $('<a href="#">').text(f["value"] + " (" + f["count"] + ")").click(function() {
+                drillDown(name, f["value"]);
+                return false;
+            }).appendTo(group);
         });
+        elem.append(group);
+    });
+    elem.toggle(elem.children().length > 0);
+}
+
+// drillDown narrows the search to the events with value for the facet name.
+function drillDown(name, value) {
+    if (name === "topic") {
+        $("#topic-select-box").multiselect('deselectAll', false);
+        $("#topic-select-box").multiselect('select', [value]);
+    } else {
+        document.getElementById(facetFields[name]).value = value;
     }
+    $('#query-form').submit();
+}
 
+function loadMore() {
+    if (!nextCursor) {
+        return;
+    }
+    $('#loading-indicator').show();
+    loadEvents(params.concat(['cursor=' + encodeURIComponent(nextCursor)]), false);
 }
 
 function backgroundUpdate() {
@@ -123,6 +276,7 @@ function clearQuery() {
     document.getElementById("tag_host_and_operator").checked = false;
     document.getElementById("target_host_set").value = "";
     document.getElementById("user").value = "";
+    document.getElementById("text").value = "";
     document.getElementById("data").value = "";
     document.getElementById("start-event-time").value = "";
     document.getElementById("end-event-time").value = "";
@@ -211,7 +365,8 @@ function submitQuery(form) {
                         topics.push(value);
                         break;
 				    case "data":
-					    formData[key] = value;
+				    case "text":
+					    formData[key] = encodeURIComponent(value);
 					    break;
 				    case "startEventTime":
 					    startEventTime = value;
@@ -237,7 +392,7 @@ function submitQuery(form) {
 	}
 	params = [];
 	for (var key in formData) {
-		if (key === "start_event_time" || key === "end_event_time" || key == "data"
+		if (key === "start_event_time" || key === "end_event_time" || key == "data" || key == "text"
 			|| key === "tag_and_operator" || key === "target_host_and_operator") {
 			if (formData[key] != "") {
 				params.push(key + "=" + formData[key])
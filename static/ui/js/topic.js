@@ -10,6 +10,8 @@ function getFormData(data) {
 		        } else {
 		            formData[key] = {}
 		        }
+	        } else if (key === "retention_seconds") {
+	            formData[key] = parseInt(value, 10);
 	        } else {
 		        formData[key] = value;
 			}
@@ -54,6 +56,11 @@ function updateTopic(form, oldTopicName) {
         alert(err);
         return false;
     }
+    // the retention is kept unless sent, and the form shows it, so an
+    // emptied field means keeping events forever
+    if (!("retention_seconds" in formData)) {
+        formData["retention_seconds"] = 0;
+    }
 
     $.ajax({
         async: false,
@@ -85,6 +92,35 @@ function deleteTopic(topicName) {
     });
 }
 
+// describeRetention returns how long the events of a topic are kept for.
+function describeRetention(seconds) {
+	if (seconds > 0) {
+		return "kept for " + moment.duration(seconds, 'seconds').humanize();
+	}
+	return "kept forever";
+}
+
+// countExpiring shows how many events of a topic are past its retention.
+// Counting can scan every event of the topic, so it is only done on request.
+function countExpiring(topicName) {
+	var elem = document.getElementById("retention-" + topicName);
+	$.ajax({
+		type: 'GET',
+		url: '/v1/retention?topic_name=' + encodeURIComponent(topicName),
+		dataType: "json",
+		success: function(data) {
+			var r = (data['results'] || [])[0];
+			if (r) {
+				elem.textContent = describeRetention(r['retention_seconds']) + ", " + r['expiring'] + " events past retention";
+			}
+		},
+		error: function(data) {
+			alert("Error counting events: " + JSON.parse(data.responseText).error);
+		}
+	});
+	return false;
+}
+
 $(document).ready(function() {
 	$.ajax({
 		type: 'GET',
@@ -98,10 +134,15 @@ $(document).ready(function() {
 				for (var i = 0; i < results.length; i++) {
 					topicName = results[i]['topic_name'];
 					schema = JSON.stringify(results[i]['data_schema'], null, 2);
+					retention = results[i]['retention_seconds'] || '';
+					var countButton = '';
+					if (retention) {
+						countButton = `<button class="btn btn-default" onclick="return countExpiring('`.concat(topicName, `')">Count events past retention</button>`);
+					}
 					var inner = `
 					<div class="panel panel-default">`.concat(
                         `<div class="panel-heading"><h4 class="panel-title"><a data-toggle="collapse" href="#updateForm`, i, `">`,
-                            topicName, '</a></h4></div>',
+                            topicName, '</a> <small id="retention-', topicName, '">', describeRetention(retention), '</small></h4></div>',
                         `<div id="updateForm`, i, `" class="collapse">
                             <label>ID: `, results[i]['topic_id'],`</label>
                             <form onsubmit="return updateTopic(this,'`, topicName, `')">
@@ -113,8 +154,13 @@ $(document).ready(function() {
                                     <label for="data_schema">Topic Schema</label>
                                     <textarea name="data_schema" class="form-control">`, schema, `</textarea>
                                 </div>
+                                <div class="form-group">
+                                    <label for="retention_seconds">Retention (seconds, empty to keep events forever)</label>
+                                    <input type="number" min="0" class="form-control" name="retention_seconds" value="`, retention, `">
+                                </div>
                                 <button class="btn btn-default" type="submit">Update</button>
                             </form>
+                                `, countButton, `
                                 <button class="btn btn-danger" data-toggle="modal" data-target="#confirm-delete" data-topic-name="`, topicName, `">Delete</button>
                         </div>
 				    </div>`);
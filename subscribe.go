@@ -0,0 +1,228 @@
+package eventmaster
+
+import (
+	"net/http"
+
+	"github.com/pkg/errors"
+
+	"github.com/ContextLogic/eventmaster/jh"
+	"github.com/ContextLogic/eventmaster/metrics"
+	eventmaster "github.com/ContextLogic/eventmaster/proto"
+)
+
+// subscriptionBuffer is the number of events that are queued for
+// a subscriber before it is considered too slow and disconnected.
+const subscriptionBuffer = 256
+
+// ErrSlowSubscriber is reported by Subscription.Err when a subscription was
+// closed because it did not keep up with the rate of new events.
+var ErrSlowSubscriber = errors.New("subscriber could not keep up with new events")
+
+// Subscription delivers events added to an EventStore that match a query.
+//
+// Events are queued without blocking ingestion; if a subscriber falls more
+// than subscriptionBuffer events behind the subscription is closed and Err
+// returns ErrSlowSubscriber.
+type Subscription struct {
+	es      *EventStore
+	matcher *eventMatcher
+	terms   []string // words of the text search, if any
+	events  chan *Event
+	err     error
+}
+
+// Events returns the channel on which matching events are delivered. It is
+// closed when the subscription ends.
+func (s *Subscription) Events() <-chan *Event {
+	return s.events
+}
+
+// Err returns the reason the subscription ended. It is only valid after the
+// Events channel has been closed, and is nil if the subscription was ended
+// with Close.
+func (s *Subscription) Err() error {
+	return s.err
+}
+
+// Close ends the subscription. It is safe to call more than once.
+func (s *Subscription) Close() {
+	s.es.unsubscribe(s, nil)
+}
+
+// Subscribe returns a Subscription to newly added events that match the
+// topic, dc, host, user, parent event id, tag, target host, data and text
+// filters of q. The event time fields of q are ignored.
+func (es *EventStore) Subscribe(q *eventmaster.Query) (*Subscription, error) {
+	m, err := es.newQueryMatcher(q)
+	if err != nil {
+		return nil, err
+	}
+	s := &Subscription{
+		es:      es,
+		matcher: m,
+		terms:   queryTerms(q.Text),
+		events:  make(chan *Event, subscriptionBuffer),
+	}
+	es.subMutex.Lock()
+	es.subscriptions[s] = struct{}{}
+	n := len(es.subscriptions)
+	es.subMutex.Unlock()
+	metrics.Subscribers(n)
+	return s, nil
+}
+
+// newQueryMatcher returns an eventMatcher for the filters of q, resolving
+// the topic and dc names in it. Errors have a 400 status.
+func (es *EventStore) newQueryMatcher(q *eventmaster.Query) (*eventMatcher, error) {
+	var topicIDs, dcIDs []string
+	for _, topic := range q.TopicName {
+		id := es.getTopicID(topic)
+		if id == "" {
+			return nil, jh.NewError(errors.Errorf("unknown topic %q", topic).Error(), http.StatusBadRequest)
+		}
+		topicIDs = append(topicIDs, id)
+	}
+	for _, dc := range q.DC {
+		id := es.getDCID(dc)
+		if id == "" {
+			return nil, jh.NewError(errors.Errorf("unknown dc %q", dc).Error(), http.StatusBadRequest)
+		}
+		dcIDs = append(dcIDs, id)
+	}
+	m, err := newEventMatcher(q, topicIDs, dcIDs)
+	if err != nil {
+		return nil, jh.NewError(errors.Wrap(err, "invalid data filter").Error(), http.StatusBadRequest)
+	}
+
+	if err := validateTextQuery(q); err != nil {
+		return nil, jh.NewError(err.Error(), http.StatusBadRequest)
+	}
+	return m, nil
+}
+
+// publish hands evt to every matching subscriber, and to every change feed
+// as an addition, without blocking.
+//
+// evt is in the form returned by the DataStores, i.e. with EventTime in
+// seconds.
+func (es *EventStore) publish(evt *Event) {
+	var slow []*Subscription
+	es.subMutex.RLock()
+	for s := range es.subscriptions {
+		if !s.matcher.matches(evt) || (len(s.terms) > 0 && !matchesText(evt, s.terms)) {
+			continue
+		}
+		select {
+		case s.events <- evt:
+		default:
+			slow = append(slow, s)
+		}
+	}
+	es.subMutex.RUnlock()
+
+	for _, s := range slow {
+		metrics.SlowSubscriber()
+		es.unsubscribe(s, ErrSlowSubscriber)
+	}
+	es.publishChange(eventChange{Kind: changeAdd, Evt: evt})
+}
+
+// changeKind is what happened to the event of an eventChange.
+type changeKind int
+
+const (
+	changeAdd changeKind = iota
+	changeRedact
+	changeDelete
+)
+
+// eventChange is an event that was added to, redacted in or deleted from an
+// EventStore. Evt is in the form returned by the DataStores: as it is now
+// for an addition or redaction, and as it was without its data for a
+// deletion.
+type eventChange struct {
+	Kind changeKind
+	Evt  *Event
+}
+
+// changeFeedBuffer is the number of changes that are queued for a change
+// feed before it is considered too slow and closed. It has room for a couple
+// of the largest batches of new events.
+var changeFeedBuffer = 2 * maxBatchEvents
+
+// changeFeed delivers every change made to the events of an EventStore
+// through it, in the order they were made. Like a Subscription, it is
+// closed with ErrSlowSubscriber if it falls changeFeedBuffer changes behind.
+type changeFeed struct {
+	es      *EventStore
+	changes chan eventChange
+	err     error
+}
+
+// Close ends the feed. It is safe to call more than once.
+func (f *changeFeed) Close() {
+	f.es.unwatch(f, nil)
+}
+
+// watchChanges returns a changeFeed of the changes made from now on.
+func (es *EventStore) watchChanges() *changeFeed {
+	f := &changeFeed{es: es, changes: make(chan eventChange, changeFeedBuffer)}
+	es.subMutex.Lock()
+	es.changeFeeds[f] = struct{}{}
+	es.subMutex.Unlock()
+	return f
+}
+
+// publishChange hands c to every change feed without blocking.
+func (es *EventStore) publishChange(c eventChange) {
+	var slow []*changeFeed
+	es.subMutex.RLock()
+	for f := range es.changeFeeds {
+		select {
+		case f.changes <- c:
+		default:
+			slow = append(slow, f)
+		}
+	}
+	es.subMutex.RUnlock()
+
+	for _, f := range slow {
+		metrics.SlowSubscriber()
+		es.unwatch(f, ErrSlowSubscriber)
+	}
+}
+
+// unwatch removes f and closes its channel, recording err as the reason.
+func (es *EventStore) unwatch(f *changeFeed, err error) {
+	es.subMutex.Lock()
+	defer es.subMutex.Unlock()
+	if _, ok := es.changeFeeds[f]; !ok {
+		return
+	}
+	delete(es.changeFeeds, f)
+	f.err = err
+	close(f.changes)
+}
+
+// unsubscribe removes s and closes its channel, recording err as the reason.
+func (es *EventStore) unsubscribe(s *Subscription, err error) {
+	es.subMutex.Lock()
+	if _, ok := es.subscriptions[s]; !ok {
+		es.subMutex.Unlock()
+		return
+	}
+	delete(es.subscriptions, s)
+	n := len(es.subscriptions)
+	s.err = err
+	close(s.events)
+	es.subMutex.Unlock()
+	metrics.Subscribers(n)
+}
+
+// publishedEvent converts an Event as built by augmentEvent into the form
+// returned by the DataStores.
+func publishedEvent(evt *Event) *Event {
+	e := *evt
+	e.EventTime = evt.EventTime / 1000
+	return &e
+}
@@ -0,0 +1,157 @@
+package eventmaster
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	eventmaster "github.com/ContextLogic/eventmaster/proto"
+)
+
+func TestSubscribe(t *testing.T) {
+	store := newTestEventStore(t, &mockDataStore{})
+
+	sub, err := store.Subscribe(&eventmaster.Query{
+		TopicName: []string{"test1"},
+		Host:      []string{"Host1"},
+		TagSet:    []string{"deploy"},
+	})
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	defer sub.Close()
+
+	now := time.Now().Unix()
+	evts := []*UnaddedEvent{
+		{EventTime: now, DC: "dc1", TopicName: "test2", Host: "host1", Tags: []string{"deploy"}},
+		{EventTime: now, DC: "dc1", TopicName: "test1", Host: "host2", Tags: []string{"deploy"}},
+		{EventTime: now, DC: "dc1", TopicName: "test1", Host: "host1"},
+		{EventTime: now, DC: "dc1", TopicName: "test1", Host: "HOST1", Tags: []string{"deploy"}},
+	}
+	var ids []string
+	for _, evt := range evts {
+		id, err := store.AddEvent(context.Background(), evt)
+		if err != nil {
+			t.Fatalf("add event: %v", err)
+		}
+		ids = append(ids, id)
+	}
+
+	select {
+	case evt := <-sub.Events():
+		if got, want := evt.EventID, ids[3]; got != want {
+			t.Fatalf("event id: got %v, want %v", got, want)
+		}
+		if got, want := evt.EventTime, now; got != want {
+			t.Fatalf("event time: got %v, want %v", got, want)
+		}
+	default:
+		t.Fatalf("no event delivered")
+	}
+	select {
+	case evt := <-sub.Events():
+		t.Fatalf("unexpected event: %+v", evt)
+	default:
+	}
+
+	sub.Close()
+	sub.Close()
+	if _, ok := <-sub.Events(); ok {
+		t.Fatalf("events channel not closed")
+	}
+	if err := sub.Err(); err != nil {
+		t.Fatalf("err after close: got %v, want nil", err)
+	}
+
+	if _, err := store.Subscribe(&eventmaster.Query{TopicName: []string{"nope"}}); err == nil {
+		t.Fatalf("expected error subscribing to unknown topic")
+	}
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	store := newTestEventStore(t, &mockDataStore{})
+
+	sub, err := store.Subscribe(&eventmaster.Query{})
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	for i := 0; i < subscriptionBuffer+1; i++ {
+		if _, err := store.AddEvent(context.Background(), &UnaddedEvent{DC: "dc1", TopicName: "test1", Host: "h"}); err != nil {
+			t.Fatalf("add event: %v", err)
+		}
+	}
+
+	n := 0
+	for range sub.Events() {
+		n++
+	}
+	if got, want := n, subscriptionBuffer; got != want {
+		t.Fatalf("delivered events: got %v, want %v", got, want)
+	}
+	if got, want := sub.Err(), ErrSlowSubscriber; got != want {
+		t.Fatalf("err: got %v, want %v", got, want)
+	}
+	if got, want := len(store.subscriptions), 0; got != want {
+		t.Fatalf("subscriptions: got %v, want %v", got, want)
+	}
+}
+
+func TestStreamEvents(t *testing.T) {
+	store := newTestEventStore(t, &mockDataStore{})
+	ts := httptest.NewServer(NewServer(store, "", ""))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/v1/event/stream?topic_name=test2")
+	if err != nil {
+		t.Fatalf("get stream: %v", err)
+	}
+	defer resp.Body.Close()
+	if got, want := resp.Header.Get("Content-Type"), "text/event-stream"; got != want {
+		t.Fatalf("content type: got %v, want %v", got, want)
+	}
+
+	// the subscription is registered before the headers are flushed
+	if _, err := store.AddEvent(context.Background(), &UnaddedEvent{DC: "dc1", TopicName: "test1", Host: "h"}); err != nil {
+		t.Fatalf("add event: %v", err)
+	}
+	id, err := store.AddEvent(context.Background(), &UnaddedEvent{DC: "dc2", TopicName: "test2", Host: "h"})
+	if err != nil {
+		t.Fatalf("add event: %v", err)
+	}
+
+	r := bufio.NewReader(resp.Body)
+	var data string
+	for data == "" {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read stream: %v", err)
+		}
+		if strings.HasPrefix(line, "data: ") {
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+	var er EventResult
+	if err := json.Unmarshal([]byte(data), &er); err != nil {
+		t.Fatalf("json decode %q: %v", data, err)
+	}
+	if got, want := er.EventID, id; got != want {
+		t.Fatalf("event id: got %v, want %v", got, want)
+	}
+	if got, want := er.DC, "dc2"; got != want {
+		t.Fatalf("dc: got %v, want %v", got, want)
+	}
+
+	resp, err = http.Get(ts.URL + "/v1/event/stream?dc=nope")
+	if err != nil {
+		t.Fatalf("get stream: %v", err)
+	}
+	resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusBadRequest; got != want {
+		t.Fatalf("status: got %v, want %v", got, want)
+	}
+}
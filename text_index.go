@@ -0,0 +1,519 @@
+package eventmaster
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ContextLogic/eventmaster/jh"
+	"github.com/ContextLogic/eventmaster/metrics"
+	eventmaster "github.com/ContextLogic/eventmaster/proto"
+)
+
+// Orders that search results can be sorted in.
+const (
+	SortTime      = "time"
+	SortRelevance = "relevance"
+)
+
+// maxTermLen is the longest word, in bytes, that is indexed. Longer words are
+// almost always ids or encoded blobs and would only bloat the index.
+const maxTermLen = 64
+
+// reindexBatchSize is the number of events fetched and indexed together when
+// rebuilding the text index.
+const reindexBatchSize = 500
+
+// TextIndexConfig is the configuration of the full-text search index. An
+// empty Path disables full-text search. The index only sees the events
+// written through the eventmaster that has it open, so it may only be used
+// with a shared Cassandra or Postgres store if SingleWriter says that
+// eventmaster is the only one writing to it.
+type TextIndexConfig struct {
+	Path         string `json:"path"`
+	Timeout      string `json:"timeout"`
+	SingleWriter bool   `json:"single_writer"`
+}
+
+const (
+	// textPostingsBucket maps term + "\x00" + event id to the number of
+	// times the term appears in the event.
+	textPostingsBucket = "text_postings"
+	// textDocsBucket maps event id to the textDoc it was indexed as, so that
+	// its postings can be found again when it changes.
+	textDocsBucket = "text_docs"
+	textMetaBucket = "text_meta"
+)
+
+var textBuckets = []string{textPostingsBucket, textDocsBucket, textMetaBucket}
+
+// textDocCountKey holds the number of indexed events in textMetaBucket.
+var textDocCountKey = []byte("docs")
+
+// textDoc is what is remembered about an indexed event.
+type textDoc struct {
+	TopicID string `json:"topic_id"`
+	// EventTime is in seconds.
+	EventTime int64          `json:"event_time"`
+	Terms     map[string]int `json:"terms"`
+}
+
+// TextIndex is an inverted index of the words in events, kept in an embedded
+// bolt database next to whichever DataStore holds the events. It only knows
+// which events contain which words; everything else about a search is
+// answered by the DataStore.
+type TextIndex struct {
+	db *bolt.DB
+}
+
+// NewTextIndex opens the text index at c.Path, creating it if needed.
+func NewTextIndex(c TextIndexConfig) (*TextIndex, error) {
+	if c.Path == "" {
+		return nil, errors.New("text index path cannot be empty")
+	}
+	opts := &bolt.Options{}
+	if c.Timeout != "" {
+		timeout, err := time.ParseDuration(c.Timeout)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse timeout")
+		}
+		opts.Timeout = timeout
+	}
+	db, err := bolt.Open(c.Path, 0600, opts)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open text index %v", c.Path)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		for _, b := range textBuckets {
+			if _, err := tx.CreateBucketIfNotExists([]byte(b)); err != nil {
+				return errors.Wrapf(err, "create bucket %v", b)
+			}
+		}
+		return nil
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &TextIndex{db: db}, nil
+}
+
+// Close closes the index.
+func (ti *TextIndex) Close() error {
+	return ti.db.Close()
+}
+
+// tokenize splits s into lower case words of letters and digits.
+func tokenize(s string) []string {
+	words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	r := words[:0]
+	for _, w := range words {
+		if len(w) <= maxTermLen {
+			r = append(r, w)
+		}
+	}
+	return r
+}
+
+// eventTerms counts the words in the host, user, tags and data values of
+// evt. Data keys are not indexed.
+func eventTerms(evt *Event) map[string]int {
+	terms := map[string]int{}
+	add := func(s string) {
+		for _, w := range tokenize(s) {
+			terms[w]++
+		}
+	}
+	add(evt.Host)
+	add(evt.User)
+	for _, tag := range evt.Tags {
+		add(tag)
+	}
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case string:
+			add(v)
+		case float64:
+			add(strconv.FormatFloat(v, 'f', -1, 64))
+		case json.Number:
+			add(v.String())
+		case bool:
+			add(strconv.FormatBool(v))
+		case map[string]interface{}:
+			for _, e := range v {
+				walk(e)
+			}
+		case []interface{}:
+			for _, e := range v {
+				walk(e)
+			}
+		}
+	}
+	walk(evt.Data)
+	return terms
+}
+
+// queryTerms returns the distinct words of a search.
+func queryTerms(text string) []string {
+	seen := map[string]bool{}
+	var terms []string
+	for _, w := range tokenize(text) {
+		if !seen[w] {
+			seen[w] = true
+			terms = append(terms, w)
+		}
+	}
+	return terms
+}
+
+// matchesText reports whether evt contains every one of terms.
+func matchesText(evt *Event, terms []string) bool {
+	et := eventTerms(evt)
+	for _, t := range terms {
+		if et[t] == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func textPostingKey(term, id string) []byte {
+	return []byte(term + "\x00" + id)
+}
+
+func addDocCount(tx *bolt.Tx, n int64) error {
+	b := tx.Bucket([]byte(textMetaBucket))
+	var count int64
+	if v := b.Get(textDocCountKey); v != nil {
+		count = int64(binary.BigEndian.Uint64(v))
+	}
+	count += n
+	if count < 0 {
+		count = 0
+	}
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(count))
+	return b.Put(textDocCountKey, v)
+}
+
+// removeDoc removes the event with id from the index, if it is there.
+func removeDoc(tx *bolt.Tx, id string) error {
+	docs := tx.Bucket([]byte(textDocsBucket))
+	v := docs.Get([]byte(id))
+	if v == nil {
+		return nil
+	}
+	var doc textDoc
+	if err := json.Unmarshal(v, &doc); err != nil {
+		return errors.Wrapf(err, "json decode indexed event %v", id)
+	}
+	postings := tx.Bucket([]byte(textPostingsBucket))
+	for term := range doc.Terms {
+		if err := postings.Delete(textPostingKey(term, id)); err != nil {
+			return errors.Wrap(err, "delete posting")
+		}
+	}
+	if err := docs.Delete([]byte(id)); err != nil {
+		return errors.Wrap(err, "delete indexed event")
+	}
+	return addDocCount(tx, -1)
+}
+
+// Add indexes evts, replacing what was indexed for them before. The event
+// times of evts are in seconds, as returned by the DataStores.
+func (ti *TextIndex) Add(evts ...*Event) error {
+	return ti.db.Update(func(tx *bolt.Tx) error {
+		docs := tx.Bucket([]byte(textDocsBucket))
+		postings := tx.Bucket([]byte(textPostingsBucket))
+		for _, evt := range evts {
+			if err := removeDoc(tx, evt.EventID); err != nil {
+				return err
+			}
+			doc := textDoc{TopicID: evt.TopicID, EventTime: evt.EventTime, Terms: eventTerms(evt)}
+			for term, n := range doc.Terms {
+				v := make([]byte, binary.MaxVarintLen64)
+				v = v[:binary.PutUvarint(v, uint64(n))]
+				if err := postings.Put(textPostingKey(term, evt.EventID), v); err != nil {
+					return errors.Wrap(err, "put posting")
+				}
+			}
+			v, err := json.Marshal(doc)
+			if err != nil {
+				return errors.Wrap(err, "json encode indexed event")
+			}
+			if err := docs.Put([]byte(evt.EventID), v); err != nil {
+				return errors.Wrap(err, "put indexed event")
+			}
+			if err := addDocCount(tx, 1); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Delete removes the events with ids from the index.
+func (ti *TextIndex) Delete(ids ...string) error {
+	return ti.db.Update(func(tx *bolt.Tx) error {
+		for _, id := range ids {
+			if err := removeDoc(tx, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Purge removes the events in the topic with an event time (in seconds)
+// before before, returning how many were removed. It mirrors
+// DataStore.PurgeEvents, and has to read every indexed event to do so.
+func (ti *TextIndex) Purge(topicID string, before int64) (int, error) {
+	var ids []string
+	if err := ti.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(textDocsBucket)).ForEach(func(k, v []byte) error {
+			var doc textDoc
+			if err := json.Unmarshal(v, &doc); err != nil {
+				return errors.Wrapf(err, "json decode indexed event %s", k)
+			}
+			if doc.TopicID == topicID && doc.EventTime < before {
+				ids = append(ids, string(k))
+			}
+			return nil
+		})
+	}); err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	return len(ids), ti.Delete(ids...)
+}
+
+// Reset removes every event from the index.
+func (ti *TextIndex) Reset() error {
+	return ti.db.Update(func(tx *bolt.Tx) error {
+		for _, b := range textBuckets {
+			if err := tx.DeleteBucket([]byte(b)); err != nil {
+				return errors.Wrapf(err, "delete bucket %v", b)
+			}
+			if _, err := tx.CreateBucket([]byte(b)); err != nil {
+				return errors.Wrapf(err, "create bucket %v", b)
+			}
+		}
+		return nil
+	})
+}
+
+// Search returns the ids of the events that contain every word of text,
+// mapped to how relevant they are to it. Relevance is the sum over the words
+// of a tf-idf weight, so rare words and words that appear often in an event
+// count for more.
+func (ti *TextIndex) Search(text string) (map[string]float64, error) {
+	terms := queryTerms(text)
+	if len(terms) == 0 {
+		return nil, errors.New("text has no words to search for")
+	}
+	scores := map[string]float64{}
+	err := ti.db.View(func(tx *bolt.Tx) error {
+		var docCount int64
+		if v := tx.Bucket([]byte(textMetaBucket)).Get(textDocCountKey); v != nil {
+			docCount = int64(binary.BigEndian.Uint64(v))
+		}
+		c := tx.Bucket([]byte(textPostingsBucket)).Cursor()
+		for i, term := range terms {
+			prefix := []byte(term + "\x00")
+			counts := map[string]uint64{}
+			for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+				n, _ := binary.Uvarint(v)
+				counts[string(k[len(prefix):])] = n
+			}
+			idf := math.Log(1 + float64(docCount)/float64(len(counts)+1))
+			next := map[string]float64{}
+			for id, n := range counts {
+				score, ok := scores[id]
+				if i > 0 && !ok {
+					continue
+				}
+				next[id] = score + (1+math.Log(float64(n)))*idf
+			}
+			if scores = next; len(scores) == 0 {
+				return nil
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "search text index")
+	}
+	return scores, nil
+}
+
+// validateTextQuery checks the text and sort fields of q.
+func validateTextQuery(q *eventmaster.Query) error {
+	switch q.Sort {
+	case "", SortTime:
+	case SortRelevance:
+		if q.Text == "" {
+			return errors.New("sorting by relevance needs text to search for")
+		}
+		if q.Cursor != "" {
+			return errors.New("results sorted by relevance are paged with start, not cursor")
+		}
+	default:
+		return errors.Errorf("cannot sort by %q", q.Sort)
+	}
+	if q.Text != "" && len(queryTerms(q.Text)) == 0 {
+		return errors.New("text has no words to search for")
+	}
+	return nil
+}
+
+// filterText keeps the events of evts that are in scores, which is the result
+// of a Search.
+func filterText(evts Events, scores map[string]float64) Events {
+	r := evts[:0]
+	for _, evt := range evts {
+		if _, ok := scores[evt.EventID]; ok {
+			r = append(r, evt)
+		}
+	}
+	return r
+}
+
+// sortByRelevance sorts evts most relevant first, and then newest first.
+func sortByRelevance(evts Events, scores map[string]float64) {
+	sort.SliceStable(evts, func(i, j int) bool {
+		si, sj := scores[evts[i].EventID], scores[evts[j].EventID]
+		if si != sj {
+			return si > sj
+		}
+		return evts.Less(i, j)
+	})
+}
+
+// SetTextIndex makes es keep ti up to date with the events it adds, changes
+// and deletes, and enables full-text search. Events added before it was set
+// are only searchable after RebuildTextIndex.
+func (es *EventStore) SetTextIndex(ti *TextIndex) {
+	es.textIndex = ti
+}
+
+// searchText returns the relevance of the events that match the text of q,
+// or nil if q has no text.
+func (es *EventStore) searchText(q *eventmaster.Query) (map[string]float64, error) {
+	if q.Text == "" {
+		return nil, nil
+	}
+	if es.textIndex == nil {
+		return nil, jh.NewError("full-text search is not enabled", http.StatusBadRequest)
+	}
+	scores, err := es.textIndex.Search(q.Text)
+	if err != nil {
+		metrics.DBError("read")
+		return nil, err
+	}
+	return scores, nil
+}
+
+// aggregateText counts the events that match q, including its text, as
+// described by agg.
+func (es *EventStore) aggregateText(ctx context.Context, q *eventmaster.Query, topicIDs []string, dcIDs []string, agg Aggregation) ([]AggregateCount, error) {
+	scores, err := es.searchText(q)
+	if err != nil {
+		return nil, err
+	}
+	evts, err := es.ds.Find(ctx, q, topicIDs, dcIDs)
+	if err != nil {
+		return nil, err
+	}
+	c := newAggregateCounter(agg)
+	for _, evt := range filterText(evts, scores) {
+		c.add(evt)
+	}
+	return c.result(), nil
+}
+
+// indexText adds evts, in the form returned by the DataStores, to the text
+// index. The events are already stored, so a failure is logged rather than
+// returned; RebuildTextIndex fills in anything that was missed.
+func (es *EventStore) indexText(evts ...*Event) {
+	if es.textIndex == nil || len(evts) == 0 {
+		return
+	}
+	if err := es.textIndex.Add(evts...); err != nil {
+		metrics.DBError("write")
+		log.Errorf("index events for text search: %v", err)
+	}
+}
+
+// unindexText removes the event with id from the text index, logging any
+// failure like indexText.
+func (es *EventStore) unindexText(id string) {
+	if es.textIndex == nil {
+		return
+	}
+	if err := es.textIndex.Delete(id); err != nil {
+		metrics.DBError("write")
+		log.Errorf("remove event %v from text index: %v", id, err)
+	}
+}
+
+// RebuildTextIndex indexes the events with an event time (in seconds) in
+// [start, end] again from the DataStore, calling progress after each batch
+// with the number indexed so far. It returns how many events were indexed.
+func (es *EventStore) RebuildTextIndex(ctx context.Context, start, end int64, progress func(int)) (int, error) {
+	if es.textIndex == nil {
+		return 0, errors.New("full-text search is not enabled")
+	}
+	var ids []string
+	if err := es.ds.FindIDs(ctx, &eventmaster.TimeQuery{
+		StartEventTime: start,
+		EndEventTime:   end,
+		Limit:          math.MaxInt32,
+		Ascending:      true,
+	}, func(id string) error {
+		ids = append(ids, id)
+		return nil
+	}); err != nil {
+		return 0, errors.Wrap(err, "find event ids")
+	}
+
+	n := 0
+	for len(ids) > 0 {
+		batch := ids
+		if len(batch) > reindexBatchSize {
+			batch = batch[:reindexBatchSize]
+		}
+		ids = ids[len(batch):]
+		evts := make([]*Event, 0, len(batch))
+		for _, id := range batch {
+			evt, err := es.ds.FindByID(ctx, id, true)
+			if err != nil {
+				return n, errors.Wrapf(err, "find event %v", id)
+			}
+			evts = append(evts, evt)
+		}
+		if err := es.textIndex.Add(evts...); err != nil {
+			return n, errors.Wrap(err, "index events")
+		}
+		n += len(evts)
+		if progress != nil {
+			progress(n)
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,248 @@
+package eventmaster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	eventmaster "github.com/ContextLogic/eventmaster/proto"
+)
+
+func newTestTextIndex(t *testing.T) (*TextIndex, func()) {
+	dir, err := ioutil.TempDir("", "eventmaster")
+	if err != nil {
+		t.Fatalf("temp dir: %v", err)
+	}
+	ti, err := NewTextIndex(TextIndexConfig{Path: filepath.Join(dir, "text.db")})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("new text index: %v", err)
+	}
+	return ti, func() {
+		ti.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestEventTerms(t *testing.T) {
+	evt := &Event{
+		Host: "Web-1",
+		User: "alice",
+		Tags: []string{"deploy"},
+		Data: map[string]interface{}{
+			"reason": "OOMKilled: container app",
+			"ticket": []interface{}{"OPS-1234", float64(7)},
+			"nested": map[string]interface{}{"ok": true},
+		},
+	}
+	want := map[string]int{
+		"web": 1, "1": 1, "alice": 1, "deploy": 1, "oomkilled": 1, "container": 1,
+		"app": 1, "ops": 1, "1234": 1, "7": 1, "true": 1,
+	}
+	assert.Equal(t, want, eventTerms(evt))
+	assert.Equal(t, []string{"ops", "1234"}, queryTerms("OPS-1234 ops"))
+}
+
+func TestTextIndex(t *testing.T) {
+	ti, cleanup := newTestTextIndex(t)
+	defer cleanup()
+
+	evts := []*Event{
+		{EventID: "a", TopicID: "t1", EventTime: 100, Data: map[string]interface{}{"msg": "disk full on db"}},
+		{EventID: "b", TopicID: "t1", EventTime: 200, Data: map[string]interface{}{"msg": "disk disk disk"}},
+		{EventID: "c", TopicID: "t2", EventTime: 300, Host: "db", Tags: []string{"disk"}},
+	}
+	if err := ti.Add(evts...); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	search := func(text string) map[string]float64 {
+		scores, err := ti.Search(text)
+		if err != nil {
+			t.Fatalf("search %q: %v", text, err)
+		}
+		return scores
+	}
+	scores := search("DISK")
+	if got, want := len(scores), 3; got != want {
+		t.Fatalf("disk matches: got %v, want %v", got, want)
+	}
+	if scores["b"] <= scores["a"] {
+		t.Fatalf("more mentions should score higher: got %v", scores)
+	}
+	scores = search("disk db")
+	if _, ok := scores["b"]; ok || len(scores) != 2 {
+		t.Fatalf("every word must match: got %v", scores)
+	}
+	if got := search("network"); len(got) != 0 {
+		t.Fatalf("unknown word: got %v", got)
+	}
+	if _, err := ti.Search("!!"); err == nil {
+		t.Fatalf("search without words: got nil error")
+	}
+
+	// reindexing replaces the old words
+	if err := ti.Add(&Event{EventID: "a", TopicID: "t1", EventTime: 100, Data: map[string]interface{}{"msg": nil}}); err != nil {
+		t.Fatalf("re-add: %v", err)
+	}
+	if _, ok := search("full")["a"]; ok {
+		t.Fatalf("redacted word still matches")
+	}
+
+	if err := ti.Delete("c"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	n, err := ti.Purge("t1", 150)
+	if err != nil {
+		t.Fatalf("purge: %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("purged: got %v, want %v", n, 1)
+	}
+	assert.Equal(t, []string{"b"}, keys(search("disk")))
+
+	if err := ti.Reset(); err != nil {
+		t.Fatalf("reset: %v", err)
+	}
+	if got := search("disk"); len(got) != 0 {
+		t.Fatalf("after reset: got %v", got)
+	}
+}
+
+func keys(m map[string]float64) []string {
+	var r []string
+	for k := range m {
+		r = append(r, k)
+	}
+	return r
+}
+
+func TestTextSearchHTTP(t *testing.T) {
+	store := newTestEventStore(t, &mockDataStore{})
+	ti, cleanup := newTestTextIndex(t)
+	defer cleanup()
+	store.SetTextIndex(ti)
+	ts := httptest.NewServer(NewServer(store, "", ""))
+	defer ts.Close()
+
+	now := time.Now().Unix()
+	for i, evt := range []*UnaddedEvent{
+		{DC: "dc1", Host: "a", Data: map[string]interface{}{"reason": "OOMKilled"}},
+		{DC: "dc2", Host: "b", Data: map[string]interface{}{"reason": "oomkilled oomkilled"}},
+		{DC: "dc1", Host: "a", Data: map[string]interface{}{"reason": "Completed"}},
+	} {
+		evt.TopicName, evt.EventTime = "test1", now-int64(i)
+		if _, err := store.AddEvent(context.Background(), evt); err != nil {
+			t.Fatalf("add event: %v", err)
+		}
+	}
+
+	get := func(params url.Values) (int, []string) {
+		params.Set("start_event_time", fmt.Sprint(now-60))
+		params.Set("end_event_time", fmt.Sprint(now+60))
+		resp, err := http.Get(ts.URL + "/v1/event?" + params.Encode())
+		if err != nil {
+			t.Fatalf("get events: %v", err)
+		}
+		defer resp.Body.Close()
+		var sr SearchResult
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&sr); err != nil {
+				t.Fatalf("json decode: %v", err)
+			}
+		}
+		var hosts []string
+		for _, r := range sr.Results {
+			hosts = append(hosts, r.Host)
+		}
+		return resp.StatusCode, hosts
+	}
+
+	tests := []struct {
+		label  string
+		params url.Values
+		status int
+		hosts  []string
+	}{
+		{"time order", url.Values{"text": {"oomkilled"}}, http.StatusOK, []string{"a", "b"}},
+		{"relevance", url.Values{"text": {"OOMKilled"}, "sort": {"relevance"}}, http.StatusOK, []string{"b", "a"}},
+		{"with filter", url.Values{"text": {"oomkilled"}, "dc": {"dc2"}}, http.StatusOK, []string{"b"}},
+		{"relevance without text", url.Values{"sort": {"relevance"}}, http.StatusBadRequest, nil},
+		{"unknown sort", url.Values{"text": {"oom"}, "sort": {"size"}}, http.StatusBadRequest, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.label, func(t *testing.T) {
+			status, hosts := get(test.params)
+			if status != test.status {
+				t.Fatalf("status: got %v, want %v", status, test.status)
+			}
+			assert.Equal(t, test.hosts, hosts)
+		})
+	}
+
+	store.SetTextIndex(nil)
+	if status, _ := get(url.Values{"text": {"oomkilled"}}); status != http.StatusBadRequest {
+		t.Fatalf("without an index: got %v, want %v", status, http.StatusBadRequest)
+	}
+}
+
+func TestRebuildTextIndex(t *testing.T) {
+	bs, cleanup := newTestBoltStore(t)
+	defer cleanup()
+	store := newTestEventStore(t, bs)
+
+	now := time.Now().Unix()
+	// added before the index existed
+	id, err := store.AddEvent(context.Background(), &UnaddedEvent{
+		DC: "dc1", TopicName: "test1", Host: "h", EventTime: now,
+		Data: map[string]interface{}{"ticket": "OPS-42"},
+	})
+	if err != nil {
+		t.Fatalf("add event: %v", err)
+	}
+
+	ti, cleanupIndex := newTestTextIndex(t)
+	defer cleanupIndex()
+	store.SetTextIndex(ti)
+	q := &eventmaster.Query{StartEventTime: now - 60, EndEventTime: now + 60, Text: "ops-42"}
+	evts, _, err := store.Find(context.Background(), q)
+	if err != nil {
+		t.Fatalf("find: %v", err)
+	}
+	if len(evts) != 0 {
+		t.Fatalf("before rebuild: got %v events, want 0", len(evts))
+	}
+
+	n, err := store.RebuildTextIndex(context.Background(), now-60, now+60, nil)
+	if err != nil {
+		t.Fatalf("rebuild: %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("rebuilt: got %v, want %v", n, 1)
+	}
+	evts, _, err = store.Find(context.Background(), q)
+	if err != nil {
+		t.Fatalf("find: %v", err)
+	}
+	if len(evts) != 1 || evts[0].EventID != id {
+		t.Fatalf("after rebuild: got %v, want event %v", evts, id)
+	}
+
+	res, err := store.Aggregate(context.Background(), q, Aggregation{Interval: 3600})
+	if err != nil {
+		t.Fatalf("aggregate: %v", err)
+	}
+	if len(res.Buckets) != 1 || res.Buckets[0].Count != 1 {
+		t.Fatalf("aggregate: got %v, want one event", res.Buckets)
+	}
+}
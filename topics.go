@@ -21,7 +21,7 @@ func (s *Server) addTopic(w http.ResponseWriter, r *http.Request, _ httprouter.P
 		return td, jh.NewError(errors.New("Must include topic_name in request").Error(), http.StatusBadRequest)
 	}
 
-	id, err := s.store.AddTopic(td)
+	id, err := s.store.AddTopic(r.Context(), td)
 	if err != nil {
 		return nil, jh.Wrap(err, "add topic")
 	}
@@ -29,7 +29,7 @@ func (s *Server) addTopic(w http.ResponseWriter, r *http.Request, _ httprouter.P
 }
 
 func (s *Server) getTopic(w http.ResponseWriter, r *http.Request, _ httprouter.Params) (interface{}, error) {
-	topics, err := s.store.GetTopics()
+	topics, err := s.store.GetTopics(r.Context())
 	if err != nil {
 		return nil, jh.Wrap(err, "get topics")
 	}
@@ -39,7 +39,7 @@ func (s *Server) getTopic(w http.ResponseWriter, r *http.Request, _ httprouter.P
 }
 
 func (s *Server) updateTopic(w http.ResponseWriter, r *http.Request, ps httprouter.Params) (interface{}, error) {
-	var td Topic
+	var td TopicUpdate
 	if err := json.NewDecoder(r.Body).Decode(&td); err != nil {
 		return td, jh.NewError(errors.Wrap(err, "json decode").Error(), http.StatusBadRequest)
 	}
@@ -49,7 +49,7 @@ func (s *Server) updateTopic(w http.ResponseWriter, r *http.Request, ps httprout
 		return nil, jh.NewError(errors.New("Must include topic name in request").Error(), http.StatusBadRequest)
 	}
 
-	id, err := s.store.UpdateTopic(topicName, td)
+	id, err := s.store.UpdateTopic(r.Context(), topicName, td)
 	if err != nil {
 		return nil, jh.Wrap(err, "update topic")
 	}
@@ -65,7 +65,7 @@ func (s *Server) deleteTopic(w http.ResponseWriter, r *http.Request, ps httprout
 	req := &eventmaster.DeleteTopicRequest{
 		TopicName: name,
 	}
-	if err := s.store.DeleteTopic(req); err != nil {
+	if err := s.store.DeleteTopic(r.Context(), req); err != nil {
 		return nil, jh.Wrap(err, "delete topic")
 	}
 
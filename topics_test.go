@@ -2,6 +2,7 @@ package eventmaster
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -25,7 +26,7 @@ func TestTopicRoundtrip(t *testing.T) {
 	name := "test"
 
 	{
-		topics, err := store.GetTopics()
+		topics, err := store.GetTopics(context.Background())
 		if err != nil {
 			t.Fatalf("get topics: %v", err)
 		}
@@ -42,7 +43,7 @@ func TestTopicRoundtrip(t *testing.T) {
 	t.Logf("created topic: %v", id)
 
 	{
-		topics, err := store.GetTopics()
+		topics, err := store.GetTopics(context.Background())
 		if err != nil {
 			t.Fatalf("get topics: %v", err)
 		}
@@ -100,7 +101,7 @@ func TestTopicRoundtrip(t *testing.T) {
 	}
 
 	{
-		topics, err := store.GetTopics()
+		topics, err := store.GetTopics(context.Background())
 		if err != nil {
 			t.Fatalf("get topics: %v", err)
 		}
@@ -61,7 +61,7 @@ func (s *Server) HandleGetEventPage(w http.ResponseWriter, r *http.Request, ps h
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	topics, err := s.store.GetTopics()
+	topics, err := s.store.GetTopics(r.Context())
 	if err != nil {
 		http.Error(w, errors.Wrap(err, "get topics").Error(), http.StatusInternalServerError)
 		return
@@ -1,9 +1,14 @@
 package eventmaster
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"sort"
 	"strings"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
 // Pair represents a single string key to empty interface value mapping.
@@ -12,30 +17,12 @@ type Pair struct {
 	b interface{}
 }
 
-// stringify* used for mapping to cassandra inputs
-func stringify(str string) string {
-	if str == "" {
-		return "null"
-	}
-	return fmt.Sprintf("'%s'", str)
-}
-
-func stringifyArr(arr []string) string {
-	if len(arr) == 0 {
-		return "null"
-	}
-	var newArr []string
-	for _, str := range arr {
-		newArr = append(newArr, stringify(str))
-	}
-	return fmt.Sprintf("{%s}", strings.Join(newArr, ","))
-}
-
-func stringifyUUID(str string) string {
-	if str == "" {
-		return "null"
+func lowerAll(strs []string) []string {
+	r := make([]string, 0, len(strs))
+	for _, str := range strs {
+		r = append(r, strings.ToLower(str))
 	}
-	return str
+	return r
 }
 
 func getDataQueries(data map[string]interface{}) []Pair {
@@ -54,6 +41,77 @@ func getDataQueries(data map[string]interface{}) []Pair {
 	return pairs
 }
 
+// parseDataFilter parses the json object in a Query's data field into the
+// dotted paths and values that an event's data must contain, sorted by path.
+//
+// Nested objects and dotted keys are equivalent: {"deploy": {"service": "api"}}
+// and {"deploy.service": "api"} both produce the pair ("deploy.service", "api").
+func parseDataFilter(data string) ([]Pair, error) {
+	if strings.TrimSpace(data) == "" {
+		return nil, nil
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(data), &m); err != nil {
+		return nil, errors.Wrap(err, "data filter must be a json object")
+	}
+	pairs := getDataQueries(m)
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i].a < pairs[j].a
+	})
+	return pairs, nil
+}
+
+// lookupDataPath returns the value found by following the dotted path
+// through data.
+func lookupDataPath(data map[string]interface{}, path string) (interface{}, bool) {
+	var cur interface{} = data
+	for _, key := range strings.Split(path, ".") {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if cur, ok = m[key]; !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// redactDataPath replaces the value at the dotted path in data with null,
+// reporting whether the path was present.
+func redactDataPath(data map[string]interface{}, path string) bool {
+	keys := strings.Split(path, ".")
+	m := data
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := m[key].(map[string]interface{})
+		if !ok {
+			return false
+		}
+		m = next
+	}
+	last := keys[len(keys)-1]
+	if _, ok := m[last]; !ok {
+		return false
+	}
+	m[last] = nil
+	return true
+}
+
+// dataValuesEqual compares two values by their json encoding so that, for
+// example, an int in a Go literal matches the float64 produced by decoding
+// json.
+func dataValuesEqual(a, b interface{}) bool {
+	aj, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	bj, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(aj, bj)
+}
+
 func insertDefaults(schema map[string]interface{}, m map[string]interface{}) {
 	for k, v := range schema {
 		s, ok := v.(map[string]interface{})
@@ -137,6 +195,13 @@ func checkBackwardsCompatible(oldSchema map[string]interface{}, newSchema map[st
 	return true
 }
 
+// CheckBackwardsCompatible reports whether a topic's schema can be changed
+// from oldSchema to newSchema, using the same rules as EventStore.UpdateTopic.
+// It lets clients check a schema change before applying it.
+func CheckBackwardsCompatible(oldSchema map[string]interface{}, newSchema map[string]interface{}) bool {
+	return checkBackwardsCompatible(oldSchema, newSchema)
+}
+
 func parseKeyValuePair(content string) map[string]interface{} {
 	data := make(map[string]interface{})
 	pairs := strings.Split(content, " ")
@@ -4,6 +4,8 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+
+	eventmaster "github.com/ContextLogic/eventmaster/proto"
 )
 
 var insertDefaultsTests = []struct {
@@ -151,3 +153,101 @@ func TestGetDate(t *testing.T) {
 		assert.Equal(t, test.Expected, getDate(test.Input))
 	}
 }
+
+func TestParseDataFilter(t *testing.T) {
+	pairs, err := parseDataFilter(`{"version": "1.2", "deploy": {"service": "api"}}`)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	assert.Equal(t, []Pair{{"deploy.service", "api"}, {"version", "1.2"}}, pairs)
+
+	if pairs, err := parseDataFilter(""); err != nil || pairs != nil {
+		t.Fatalf("empty filter: got %v, %v, want nil, nil", pairs, err)
+	}
+	if _, err := parseDataFilter(`"api"`); err == nil {
+		t.Fatalf("expected error for non-object filter")
+	}
+}
+
+func TestMatchesData(t *testing.T) {
+	evt := &Event{Data: map[string]interface{}{
+		"version": float64(2),
+		"deploy":  map[string]interface{}{"service": "api"},
+	}}
+	tests := []struct {
+		filter string
+		want   bool
+	}{
+		{`{"deploy.service": "api"}`, true},
+		{`{"deploy": {"service": "api"}, "version": 2}`, true},
+		{`{"deploy.service": "web"}`, false},
+		{`{"version": "2"}`, false},
+		{`{"deploy.region": "us"}`, false},
+		{`{"version.major": 2}`, false},
+	}
+	for _, test := range tests {
+		filter, err := parseDataFilter(test.filter)
+		if err != nil {
+			t.Fatalf("parse %v: %v", test.filter, err)
+		}
+		if got := matchesData(filter, evt); got != test.want {
+			t.Fatalf("%v: got %v, want %v", test.filter, got, test.want)
+		}
+	}
+}
+
+func TestTimeWindows(t *testing.T) {
+	evt := &Event{EventTime: 100, ReceivedTime: 200500}
+	tests := []struct {
+		label   string
+		q       *eventmaster.Query
+		valid   bool
+		matches bool
+	}{
+		{"none", &eventmaster.Query{}, false, false},
+		{"event", &eventmaster.Query{StartEventTime: 90, EndEventTime: 100}, true, true},
+		{"event after", &eventmaster.Query{StartEventTime: 101, EndEventTime: 110}, true, false},
+		{"event inverted", &eventmaster.Query{StartEventTime: 110, EndEventTime: 90}, false, false},
+		{"received", &eventmaster.Query{StartReceivedTime: 200000, EndReceivedTime: 201000}, true, true},
+		{"received before", &eventmaster.Query{StartReceivedTime: 150000, EndReceivedTime: 200499}, true, false},
+		{"received missing end", &eventmaster.Query{StartReceivedTime: 200000}, false, false},
+		{"both", &eventmaster.Query{StartEventTime: 90, EndEventTime: 100, StartReceivedTime: 150000, EndReceivedTime: 200000}, true, false},
+	}
+	for _, test := range tests {
+		if got := validateTimeWindows(test.q) == nil; got != test.valid {
+			t.Fatalf("%v: valid: got %v, want %v", test.label, got, test.valid)
+		}
+		if !test.valid {
+			continue
+		}
+		if got := matchesTimeWindows(test.q, evt); got != test.matches {
+			t.Fatalf("%v: matches: got %v, want %v", test.label, got, test.matches)
+		}
+	}
+}
+
+func TestRedactDataPath(t *testing.T) {
+	data := map[string]interface{}{
+		"token": "secret",
+		"req":   map[string]interface{}{"ip": "10.0.0.1"},
+	}
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"token", true},
+		{"req.ip", true},
+		{"req.port", false},
+		{"token.inner", false},
+		{"nope", false},
+	}
+	for _, test := range tests {
+		if got := redactDataPath(data, test.path); got != test.want {
+			t.Fatalf("%v: got %v, want %v", test.path, got, test.want)
+		}
+	}
+	assert.Equal(t, map[string]interface{}{
+		"token": nil,
+		"req":   map[string]interface{}{"ip": nil},
+	}, data)
+}
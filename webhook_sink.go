@@ -0,0 +1,107 @@
+package eventmaster
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Headers set on every webhook request.
+const (
+	// WebhookSignatureHeader holds "sha256=" followed by the hex HMAC-SHA256
+	// of the timestamp header, a ".", and the request body, keyed with the
+	// webhook secret.
+	WebhookSignatureHeader = "X-Eventmaster-Signature"
+	// WebhookTimestampHeader holds the unix time the request was signed
+	// at, so that receivers can reject replayed requests.
+	WebhookTimestampHeader = "X-Eventmaster-Timestamp"
+)
+
+const defaultWebhookTimeout = 10 * time.Second
+
+// WebhookConfig configures a sink that POSTs events to an HTTP endpoint.
+type WebhookConfig struct {
+	URL string `json:"url"`
+	// Secret signs every request; see WebhookSignatureHeader.
+	Secret string `json:"secret"`
+	// Headers are added to every request.
+	Headers map[string]string `json:"headers"`
+	// Timeout limits each request, as a duration string.
+	Timeout string `json:"timeout"`
+}
+
+// WebhookSink POSTs batches of events to a URL as a json object with an
+// "events" array. Any response other than a 2xx is a failure.
+type WebhookSink struct {
+	conf   WebhookConfig
+	client *http.Client
+}
+
+// NewWebhookSink returns a sink for the endpoint in c.
+func NewWebhookSink(c WebhookConfig) (*WebhookSink, error) {
+	if c.URL == "" {
+		return nil, errors.New("webhook sink needs a url")
+	}
+	if c.Secret == "" {
+		return nil, errors.New("webhook sink needs a secret to sign requests with")
+	}
+	timeout, err := durationOrDefault(c.Timeout, defaultWebhookTimeout)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse timeout")
+	}
+	return &WebhookSink{conf: c, client: &http.Client{Timeout: timeout}}, nil
+}
+
+// SignWebhook returns the value of WebhookSignatureHeader for a request
+// with body sent at timestamp, signed with secret.
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Send implements Sink.
+func (w *WebhookSink) Send(ctx context.Context, evts []*EventResult) error {
+	body, err := json.Marshal(map[string][]*EventResult{"events": evts})
+	if err != nil {
+		return errors.Wrap(err, "json encode events")
+	}
+	req, err := http.NewRequest("POST", w.conf.URL, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "new webhook request")
+	}
+	for k, v := range w.conf.Headers {
+		req.Header.Set(k, v)
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookTimestampHeader, ts)
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(w.conf.Secret, ts, body))
+
+	resp, err := w.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrapf(err, "post %v", w.conf.URL)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return errors.Errorf("post %v: status %d: %s", w.conf.URL, resp.StatusCode, bytes.TrimSpace(b))
+	}
+	return nil
+}
+
+// Close implements Sink.
+func (w *WebhookSink) Close() error {
+	return nil
+}